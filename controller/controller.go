@@ -0,0 +1,283 @@
+/*
+
+Copyright 2021-2022 This Project Authors.
+
+Author:  seanchann <seanchann@foxmail.com>
+
+See docs/ for more information about the  project.
+
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	utilruntime "github.com/commcos/utils/runtime"
+	"github.com/commcos/utils/wait"
+	"github.com/commcos/utils/workqueue"
+)
+
+// Result is the outcome of a successful reconcile.
+type Result struct {
+	// Requeue tells the Controller to requeue the key with rate limiting.
+	Requeue bool
+
+	// RequeueAfter, if greater than zero, tells the Controller to forget
+	// the key's failures and requeue it after the given delay. It takes
+	// precedence over Requeue.
+	RequeueAfter time.Duration
+}
+
+// Reconciler reconciles the state identified by a key.
+type Reconciler interface {
+	// Reconcile brings the state identified by key to its desired state.
+	// ctx is cancelled when the Controller stops waiting for in-flight
+	// reconciles to drain.
+	Reconcile(ctx context.Context, key string) (Result, error)
+}
+
+// ReconcilerFunc adapts a function to the Reconciler interface.
+type ReconcilerFunc func(ctx context.Context, key string) (Result, error)
+
+// Reconcile calls f(ctx, key).
+func (f ReconcilerFunc) Reconcile(ctx context.Context, key string) (Result, error) {
+	return f(ctx, key)
+}
+
+// Options configures a Controller.
+type Options struct {
+	// Name names the controller. It is used to register the metrics of the
+	// controller and of the queue it creates. Unnamed controllers are not
+	// instrumented.
+	Name string
+
+	// Workers is the number of keys reconciled concurrently. Defaults to 1.
+	Workers int
+
+	// RateLimiter is used to requeue keys after errors. Defaults to
+	// workqueue.DefaultControllerRateLimiter(). Ignored when Queue is set.
+	RateLimiter workqueue.RateLimiter
+
+	// Queue is the queue keys are taken from. Defaults to a new named rate
+	// limiting queue. The Controller shuts it down when it stops.
+	Queue workqueue.RateLimitingInterface
+
+	// DrainTimeout bounds how long Run waits for queued and in-flight keys
+	// once its context is cancelled. When it expires the context passed to
+	// Reconcile is cancelled and keys still queued are dropped. Zero waits
+	// for the queue to be fully drained.
+	DrainTimeout time.Duration
+}
+
+// ErrAlreadyStarted is returned by Run when the Controller is already running
+// or has run before.
+var ErrAlreadyStarted = errors.New("controller already started")
+
+// Controller reconciles the keys of a rate limited work queue from a pool of
+// workers (see the package comment).
+type Controller struct {
+	name         string
+	reconciler   Reconciler
+	queue        workqueue.RateLimitingInterface
+	workers      int
+	drainTimeout time.Duration
+	metrics      *controllerMetrics
+
+	lock    sync.Mutex
+	started bool
+	// inFlight holds the keys being reconciled.
+	inFlight map[string]empty
+	// rerun holds in-flight keys that were handed out again, and are to be
+	// requeued once their current reconcile finishes.
+	rerun map[string]empty
+}
+
+type empty struct{}
+
+// New returns a Controller that reconciles keys with reconciler. Keys are
+// not reconciled until Run is called.
+func New(reconciler Reconciler, options Options) *Controller {
+	queue := options.Queue
+	if queue == nil {
+		rateLimiter := options.RateLimiter
+		if rateLimiter == nil {
+			rateLimiter = workqueue.DefaultControllerRateLimiter()
+		}
+		queue = workqueue.NewNamedRateLimitingQueue(rateLimiter, options.Name)
+	}
+	workers := options.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	return &Controller{
+		name:         options.Name,
+		reconciler:   reconciler,
+		queue:        queue,
+		workers:      workers,
+		drainTimeout: options.DrainTimeout,
+		metrics:      globalMetricsFactory.newControllerMetrics(options.Name),
+		inFlight:     map[string]empty{},
+		rerun:        map[string]empty{},
+	}
+}
+
+// Enqueue adds key to the queue.
+func (c *Controller) Enqueue(key string) {
+	c.queue.Add(key)
+}
+
+// EnqueueAfter adds key to the queue after the given delay.
+func (c *Controller) EnqueueAfter(key string, duration time.Duration) {
+	c.queue.AddAfter(key, duration)
+}
+
+// EnqueueRateLimited adds key to the queue after the rate limiter says it's ok.
+func (c *Controller) EnqueueRateLimited(key string) {
+	c.queue.AddRateLimited(key)
+}
+
+// Run starts the workers and blocks until ctx is cancelled. It then shuts the
+// queue down and returns once the workers have drained it, or once
+// DrainTimeout has passed and the in-flight reconciles have returned. A
+// Controller can only be run once.
+func (c *Controller) Run(ctx context.Context) error {
+	c.lock.Lock()
+	if c.started {
+		c.lock.Unlock()
+		return ErrAlreadyStarted
+	}
+	c.started = true
+	c.lock.Unlock()
+
+	// Reconciles outlive ctx while the queue drains, so they get their own
+	// context.
+	reconcileCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(c.workers)
+	for i := 0; i < c.workers; i++ {
+		go func() {
+			defer wg.Done()
+			// A worker only returns once the queue is shut down and empty,
+			// Until restarts it if it exits early by panicking.
+			stopCh := make(chan struct{})
+			wait.Until(func() {
+				c.worker(reconcileCtx)
+				close(stopCh)
+			}, time.Second, stopCh)
+		}()
+	}
+
+	<-ctx.Done()
+	c.queue.ShutDown()
+
+	if c.drainTimeout > 0 {
+		timer := time.AfterFunc(c.drainTimeout, cancel)
+		defer timer.Stop()
+	}
+	wg.Wait()
+	return nil
+}
+
+func (c *Controller) worker(ctx context.Context) {
+	for c.processNextWorkItem(ctx) {
+	}
+}
+
+// processNextWorkItem reconciles the next key of the queue. It returns false
+// once the queue is shut down and empty.
+func (c *Controller) processNextWorkItem(ctx context.Context) bool {
+	item, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(item)
+
+	key, ok := item.(string)
+	if !ok {
+		c.queue.Forget(item)
+		utilruntime.HandleError(fmt.Errorf("controller %q: dropping item of unexpected type %T: %v", c.name, item, item))
+		return true
+	}
+	if ctx.Err() != nil {
+		// The drain timeout passed, drop what is left in the queue.
+		return true
+	}
+
+	if !c.acquire(key) {
+		return true
+	}
+	result, err := c.reconcile(ctx, key)
+	if c.release(key) {
+		c.queue.Add(key)
+	}
+
+	switch {
+	case err != nil:
+		c.metrics.reconcileErrors.Inc()
+		c.queue.AddRateLimited(key)
+		utilruntime.HandleError(fmt.Errorf("controller %q: error reconciling %q, requeuing: %v", c.name, key, err))
+	case result.RequeueAfter > 0:
+		c.queue.Forget(key)
+		c.queue.AddAfter(key, result.RequeueAfter)
+	case result.Requeue:
+		c.queue.AddRateLimited(key)
+	default:
+		c.queue.Forget(key)
+	}
+	return true
+}
+
+// acquire marks key as in flight. If it already is, the key is remembered to
+// be requeued by release and acquire returns false. Queues do not hand out a
+// key again before it is Done, but Options.Queue may be any implementation.
+func (c *Controller) acquire(key string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, busy := c.inFlight[key]; busy {
+		c.rerun[key] = empty{}
+		return false
+	}
+	c.inFlight[key] = empty{}
+	return true
+}
+
+// release marks key as no longer in flight, and returns whether it has to be
+// requeued because it was handed out while it was.
+func (c *Controller) release(key string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.inFlight, key)
+	_, rerun := c.rerun[key]
+	delete(c.rerun, key)
+	return rerun
+}
+
+// reconcile calls the Reconciler, reporting its duration and turning a panic
+// into an error.
+func (c *Controller) reconcile(ctx context.Context, key string) (result Result, err error) {
+	c.metrics.activeWorkers.Inc()
+	start := time.Now()
+	defer func() {
+		c.metrics.activeWorkers.Dec()
+		c.metrics.reconcileTotal.Inc()
+		c.metrics.reconcileTime.Observe(time.Since(start).Seconds())
+	}()
+
+	defer func() {
+		// HandleCrash re-panics when runtime.ReallyCrash is set, once the
+		// panic has been reported. The key is requeued instead.
+		recover()
+	}()
+	defer utilruntime.HandleCrash(func(r interface{}) {
+		err = fmt.Errorf("observed a panic: %v", r)
+	})
+
+	return c.reconciler.Reconcile(ctx, key)
+}
@@ -0,0 +1,304 @@
+/*
+
+Copyright 2021-2022 This Project Authors.
+
+Author:  seanchann <seanchann@foxmail.com>
+
+See docs/ for more information about the  project.
+
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/commcos/utils/wait"
+	"github.com/commcos/utils/workqueue"
+)
+
+func runController(t *testing.T, c *Controller) (context.CancelFunc, <-chan error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Run(ctx)
+	}()
+	return cancel, done
+}
+
+func stopController(t *testing.T, cancel context.CancelFunc, done <-chan error) {
+	t.Helper()
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("unexpected error from Run: %v", err)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatalf("timed out waiting for Run to return")
+	}
+}
+
+func TestControllerReconcileResults(t *testing.T) {
+	var lock sync.Mutex
+	calls := map[string]int{}
+	reconciled := make(chan string, 100)
+	c := New(ReconcilerFunc(func(ctx context.Context, key string) (Result, error) {
+		lock.Lock()
+		calls[key]++
+		n := calls[key]
+		lock.Unlock()
+		defer func() { reconciled <- key }()
+
+		switch key {
+		case "error":
+			if n < 3 {
+				return Result{}, errors.New("failed")
+			}
+		case "requeue":
+			if n < 2 {
+				return Result{Requeue: true}, nil
+			}
+		case "requeue-after":
+			if n < 2 {
+				return Result{RequeueAfter: 10 * time.Millisecond}, nil
+			}
+		case "panic":
+			if n < 2 {
+				panic("reconcile panicked")
+			}
+		}
+		return Result{}, nil
+	}), Options{
+		Workers:     2,
+		RateLimiter: workqueue.NewItemExponentialFailureRateLimiter(time.Millisecond, 10*time.Millisecond),
+	})
+	cancel, done := runController(t, c)
+
+	expected := map[string]int{"ok": 1, "error": 3, "requeue": 2, "requeue-after": 2, "panic": 2}
+	for key := range expected {
+		c.Enqueue(key)
+	}
+	total := 0
+	for _, n := range expected {
+		total += n
+	}
+	for i := 0; i < total; i++ {
+		select {
+		case <-reconciled:
+		case <-time.After(wait.ForeverTestTimeout):
+			t.Fatalf("timed out waiting for reconciles, got %v", calls)
+		}
+	}
+	stopController(t, cancel, done)
+
+	for key, n := range expected {
+		if calls[key] != n {
+			t.Errorf("expected %q to be reconciled %d times, got %d", key, n, calls[key])
+		}
+		if a := c.queue.NumRequeues(key); a != 0 {
+			t.Errorf("expected %q to be forgotten, got %d requeues", key, a)
+		}
+	}
+}
+
+func TestControllerKeyExclusivity(t *testing.T) {
+	var lock sync.Mutex
+	running := map[string]bool{}
+	var count int32
+	c := New(ReconcilerFunc(func(ctx context.Context, key string) (Result, error) {
+		lock.Lock()
+		if running[key] {
+			t.Errorf("%q reconciled concurrently", key)
+		}
+		running[key] = true
+		lock.Unlock()
+
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&count, 1)
+
+		lock.Lock()
+		running[key] = false
+		lock.Unlock()
+		return Result{}, nil
+	}), Options{Workers: 4})
+	cancel, done := runController(t, c)
+
+	for i := 0; i < 50; i++ {
+		c.Enqueue("a")
+		c.Enqueue("b")
+		time.Sleep(100 * time.Microsecond)
+	}
+	stopController(t, cancel, done)
+	if atomic.LoadInt32(&count) == 0 {
+		t.Errorf("expected keys to be reconciled")
+	}
+
+	// A key handed out while in flight is requeued once it is released.
+	if !c.acquire("a") {
+		t.Fatalf("expected to acquire a")
+	}
+	if c.acquire("a") {
+		t.Errorf("expected a to be in flight")
+	}
+	if !c.release("a") {
+		t.Errorf("expected a to be requeued")
+	}
+	if c.acquire("a"); c.release("a") {
+		t.Errorf("expected a not to be requeued")
+	}
+}
+
+func TestControllerDrain(t *testing.T) {
+	release := make(chan struct{})
+	var count int32
+	c := New(ReconcilerFunc(func(ctx context.Context, key string) (Result, error) {
+		<-release
+		atomic.AddInt32(&count, 1)
+		// requeues are dropped once the controller is stopping
+		return Result{Requeue: true}, nil
+	}), Options{})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Run(ctx)
+	}()
+
+	for _, key := range []string{"a", "b", "c"} {
+		c.Enqueue(key)
+	}
+	cancel()
+	select {
+	case <-done:
+		t.Fatalf("Run returned before the queue was drained")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(release)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("unexpected error from Run: %v", err)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatalf("timed out waiting for Run to return")
+	}
+	if e, a := int32(3), atomic.LoadInt32(&count); e != a {
+		t.Errorf("expected %d reconciles, got %d", e, a)
+	}
+
+	if err := c.Run(context.Background()); err != ErrAlreadyStarted {
+		t.Errorf("expected %v, got %v", ErrAlreadyStarted, err)
+	}
+}
+
+func TestControllerDrainTimeout(t *testing.T) {
+	var count int32
+	c := New(ReconcilerFunc(func(ctx context.Context, key string) (Result, error) {
+		atomic.AddInt32(&count, 1)
+		<-ctx.Done()
+		return Result{}, ctx.Err()
+	}), Options{DrainTimeout: 10 * time.Millisecond})
+	cancel, done := runController(t, c)
+
+	for _, key := range []string{"a", "b", "c"} {
+		c.Enqueue(key)
+	}
+	if err := wait.Poll(time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return atomic.LoadInt32(&count) == 1, nil
+	}); err != nil {
+		t.Fatalf("timed out waiting for the first reconcile")
+	}
+	stopController(t, cancel, done)
+
+	if e, a := int32(1), atomic.LoadInt32(&count); e != a {
+		t.Errorf("expected the queued keys to be dropped, got %d reconciles", a)
+	}
+}
+
+type testMetric struct {
+	lock  sync.Mutex
+	value float64
+	count int
+}
+
+func (m *testMetric) Inc() { m.add(1) }
+func (m *testMetric) Dec() { m.add(-1) }
+func (m *testMetric) Observe(v float64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.count++
+}
+
+func (m *testMetric) add(v float64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.value += v
+}
+
+func (m *testMetric) get() (float64, int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.value, m.count
+}
+
+type testMetricsProvider struct {
+	total, errors, time, active testMetric
+}
+
+func (p *testMetricsProvider) NewReconcileTotalMetric(name string) workqueue.CounterMetric {
+	return &p.total
+}
+
+func (p *testMetricsProvider) NewReconcileErrorsMetric(name string) workqueue.CounterMetric {
+	return &p.errors
+}
+
+func (p *testMetricsProvider) NewReconcileTimeMetric(name string) workqueue.HistogramMetric {
+	return &p.time
+}
+
+func (p *testMetricsProvider) NewActiveWorkersMetric(name string) workqueue.GaugeMetric {
+	return &p.active
+}
+
+func TestControllerMetrics(t *testing.T) {
+	mp := &testMetricsProvider{}
+	f := controllerMetricsFactory{metricsProvider: mp}
+
+	c := New(ReconcilerFunc(func(ctx context.Context, key string) (Result, error) {
+		if key == "fail" {
+			return Result{}, errors.New("failed")
+		}
+		return Result{}, nil
+	}), Options{Name: "test"})
+	c.metrics = f.newControllerMetrics("test")
+	c.queue.Add("ok")
+	c.queue.Add("fail")
+	for i := 0; i < 2; i++ {
+		c.processNextWorkItem(context.Background())
+	}
+	c.queue.ShutDown()
+
+	if v, _ := mp.total.get(); v != 2 {
+		t.Errorf("expected 2 reconciles, got %v", v)
+	}
+	if v, _ := mp.errors.get(); v != 1 {
+		t.Errorf("expected 1 error, got %v", v)
+	}
+	if _, n := mp.time.get(); n != 2 {
+		t.Errorf("expected 2 observations, got %v", n)
+	}
+	if v, _ := mp.active.get(); v != 0 {
+		t.Errorf("expected no active workers, got %v", v)
+	}
+
+	if m := f.newControllerMetrics(""); m.reconcileTotal != (noopMetric{}) {
+		t.Errorf("expected unnamed controllers not to be instrumented")
+	}
+}
@@ -0,0 +1,26 @@
+/*
+
+Copyright 2021-2022 This Project Authors.
+
+Author:  seanchann <seanchann@foxmail.com>
+
+See docs/ for more information about the  project.
+
+*/
+
+// Package controller runs keyed reconcile functions from a rate limited work
+// queue.
+//
+// A Controller hands every key added to its queue to a Reconciler, from a
+// fixed number of workers. The outcome of Reconcile decides what happens to
+// the key next:
+//   - an error requeues it with rate limiting,
+//   - Result.RequeueAfter requeues it after the given delay,
+//   - Result.Requeue requeues it with rate limiting,
+//   - otherwise the rate limiter forgets it.
+//
+// A key is never reconciled by two workers at the same time, panics in
+// Reconcile are reported through runtime.HandleCrash and turned into errors,
+// and cancelling the context passed to Run drains the queue before Run
+// returns.
+package controller // import "github.com/commcos/utils/controller"
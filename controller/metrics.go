@@ -0,0 +1,96 @@
+/*
+
+Copyright 2021-2022 This Project Authors.
+
+Author:  seanchann <seanchann@foxmail.com>
+
+See docs/ for more information about the  project.
+
+*/
+
+package controller
+
+import (
+	"sync"
+
+	"github.com/commcos/utils/workqueue"
+)
+
+// MetricsProvider generates the metrics of a controller. Metrics of the queue
+// a controller creates come from the workqueue MetricsProvider.
+type MetricsProvider interface {
+	// NewReconcileTotalMetric counts the reconciles performed.
+	NewReconcileTotalMetric(name string) workqueue.CounterMetric
+	// NewReconcileErrorsMetric counts the reconciles that failed.
+	NewReconcileErrorsMetric(name string) workqueue.CounterMetric
+	// NewReconcileTimeMetric observes how long reconciles take, in seconds.
+	NewReconcileTimeMetric(name string) workqueue.HistogramMetric
+	// NewActiveWorkersMetric tracks the number of reconciles in flight.
+	NewActiveWorkersMetric(name string) workqueue.GaugeMetric
+}
+
+type noopMetric struct{}
+
+func (noopMetric) Inc()            {}
+func (noopMetric) Dec()            {}
+func (noopMetric) Observe(float64) {}
+
+type noopMetricsProvider struct{}
+
+func (noopMetricsProvider) NewReconcileTotalMetric(name string) workqueue.CounterMetric {
+	return noopMetric{}
+}
+
+func (noopMetricsProvider) NewReconcileErrorsMetric(name string) workqueue.CounterMetric {
+	return noopMetric{}
+}
+
+func (noopMetricsProvider) NewReconcileTimeMetric(name string) workqueue.HistogramMetric {
+	return noopMetric{}
+}
+
+func (noopMetricsProvider) NewActiveWorkersMetric(name string) workqueue.GaugeMetric {
+	return noopMetric{}
+}
+
+type controllerMetrics struct {
+	reconcileTotal  workqueue.CounterMetric
+	reconcileErrors workqueue.CounterMetric
+	reconcileTime   workqueue.HistogramMetric
+	activeWorkers   workqueue.GaugeMetric
+}
+
+var globalMetricsFactory = controllerMetricsFactory{
+	metricsProvider: noopMetricsProvider{},
+}
+
+type controllerMetricsFactory struct {
+	metricsProvider MetricsProvider
+
+	onlyOnce sync.Once
+}
+
+func (f *controllerMetricsFactory) setProvider(mp MetricsProvider) {
+	f.onlyOnce.Do(func() {
+		f.metricsProvider = mp
+	})
+}
+
+func (f *controllerMetricsFactory) newControllerMetrics(name string) *controllerMetrics {
+	mp := f.metricsProvider
+	if len(name) == 0 {
+		mp = noopMetricsProvider{}
+	}
+	return &controllerMetrics{
+		reconcileTotal:  mp.NewReconcileTotalMetric(name),
+		reconcileErrors: mp.NewReconcileErrorsMetric(name),
+		reconcileTime:   mp.NewReconcileTimeMetric(name),
+		activeWorkers:   mp.NewActiveWorkersMetric(name),
+	}
+}
+
+// SetProvider sets the metrics provider for all subsequently created
+// controllers. Only the first call has an effect.
+func SetProvider(metricsProvider MetricsProvider) {
+	globalMetricsFactory.setProvider(metricsProvider)
+}
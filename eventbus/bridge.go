@@ -0,0 +1,705 @@
+/*
+
+Copyright 2021-2022 This Project Authors.
+
+Author:  seanchann <seanchann@foxmail.com>
+
+See docs/ for more information about the  project.
+
+*/
+
+package eventbus
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/commcos/utils/logger"
+	"github.com/commcos/utils/wait"
+)
+
+// DefaultBridgeMaxPending is the default number of events a Bridge keeps
+// for a peer until it acknowledges them.
+const DefaultBridgeMaxPending = 1024
+
+// DefaultBridgePeerExpiry is the default time a Bridge keeps the state of a
+// disconnected peer.
+const DefaultBridgePeerExpiry = 10 * time.Minute
+
+// maxFrameSize bounds the size of the messages read from a peer.
+const maxFrameSize = 16 << 20
+
+// ErrBridgeClosed is returned by the bridges closed with Close.
+var ErrBridgeClosed = errors.New("eventbus: bridge closed")
+
+// The kinds of the messages exchanged by bridges. Each message is a JSON
+// object, preceded by its length as a 32-bit big-endian integer. The first
+// message on a connection is a hello from either end, naming it, followed by
+// the topics it subscribes to, replacing those of its previous connection.
+const (
+	messageHello       = "hello"
+	messageTopics      = "topics"
+	messageSubscribe   = "subscribe"
+	messageUnsubscribe = "unsubscribe"
+	messageEvent       = "event"
+	messageAck         = "ack"
+)
+
+type bridgeMessage struct {
+	Kind  string     `json:"kind"`
+	Name  string     `json:"name,omitempty"`
+	ID    uint64     `json:"id,omitempty"`
+	Topic EventTopic `json:"topic,omitempty"`
+	// Topics are the topics of a topics message.
+	Topics []EventTopic `json:"topics,omitempty"`
+	// Args are the arguments of an event, encoded by the Codec.
+	Args []byte `json:"args,omitempty"`
+}
+
+// BridgeConfig configures a Bridge.
+type BridgeConfig struct {
+	// Name identifies the bridge to its peers, which keep the events it did
+	// not acknowledge until it reconnects under the same name. It defaults to
+	// the host name and the process id.
+	Name string
+	// Topics are the topics, or patterns, forwarded from the peers to the
+	// local bus. More can be added with Subscribe.
+	Topics []EventTopic
+	// Codec encodes the arguments of the events. It defaults to a JSONCodec
+	// without registered types.
+	Codec Codec
+	// Backoff is the time to wait between the connection attempts of Dial.
+	// If its Duration is zero, Dial retries every second.
+	Backoff wait.Backoff
+	// MaxPending is the number of events kept for a peer until it
+	// acknowledges them; the oldest ones are dropped beyond it. It defaults to
+	// DefaultBridgeMaxPending.
+	MaxPending int
+	// PeerExpiry is the time a peer may stay disconnected before its
+	// subscriptions and pending events are dropped. It defaults to
+	// DefaultBridgePeerExpiry.
+	PeerExpiry time.Duration
+}
+
+// bridgeBus is implemented by the buses which can be bridged.
+type bridgeBus interface {
+	doSubscribe(topic EventTopic, fn interface{}, handler *eventHandler) (*Subscription, error)
+	publishFrom(ctx context.Context, origin interface{}, topic EventTopic, args ...interface{}) error
+}
+
+// Bridge forwards events between a bus and the buses of other processes, its
+// peers, over stream sockets such as Unix or TCP ones. A process serves the
+// bridge with Serve and the others connect to it with Dial, reconnecting
+// when the connection is lost. Each end then subscribes to the topics of its
+// configuration at the other, which forwards the events of these topics to
+// it; they are published to the local bus as if they were published locally.
+//
+// Delivery is at least once: an event is sent again on reconnection until the
+// peer acknowledges it, so it may be received twice. A peer disconnected for
+// longer than PeerExpiry is forgotten, with its subscriptions and the events
+// it did not acknowledge. The events received from a peer are not forwarded
+// back to it, but bridges must not form cycles.
+type Bridge struct {
+	bus    bridgeBus
+	config BridgeConfig
+
+	lock sync.Mutex
+	// topicsLock serializes the changes of topics with the messages sending
+	// them to the peers, which must receive them in order.
+	topicsLock sync.Mutex
+	topics     map[EventTopic]bool
+	peers      map[string]*bridgePeer
+	closed     bool
+}
+
+// NewBridge returns a bridge of bus, which must be returned by New.
+func NewBridge(bus Interface, config BridgeConfig) (*Bridge, error) {
+	b, ok := bus.(bridgeBus)
+	if !ok {
+		return nil, fmt.Errorf("%T can not be bridged", bus)
+	}
+	if config.Name == "" {
+		hostname, _ := os.Hostname()
+		config.Name = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+	if config.Codec == nil {
+		config.Codec = NewJSONCodec()
+	}
+	if config.Backoff.Duration <= 0 {
+		config.Backoff.Duration = time.Second
+	}
+	if config.MaxPending <= 0 {
+		config.MaxPending = DefaultBridgeMaxPending
+	}
+	if config.PeerExpiry <= 0 {
+		config.PeerExpiry = DefaultBridgePeerExpiry
+	}
+	bridge := &Bridge{
+		bus:    b,
+		config: config,
+		topics: map[EventTopic]bool{},
+		peers:  map[string]*bridgePeer{},
+	}
+	for _, topic := range config.Topics {
+		if _, err := splitPattern(topic); err != nil {
+			return nil, err
+		}
+		bridge.topics[topic] = true
+	}
+	return bridge, nil
+}
+
+// Subscribe forwards the events of a topic, which may be a pattern, from the
+// peers to the local bus.
+func (b *Bridge) Subscribe(topic EventTopic) error {
+	if _, err := splitPattern(topic); err != nil {
+		return err
+	}
+	b.topicsLock.Lock()
+	defer b.topicsLock.Unlock()
+	b.lock.Lock()
+	b.topics[topic] = true
+	b.lock.Unlock()
+	b.broadcast(&bridgeMessage{Kind: messageSubscribe, Topic: topic})
+	return nil
+}
+
+// Unsubscribe stops forwarding the events of a topic from the peers.
+func (b *Bridge) Unsubscribe(topic EventTopic) {
+	b.topicsLock.Lock()
+	defer b.topicsLock.Unlock()
+	b.lock.Lock()
+	delete(b.topics, topic)
+	b.lock.Unlock()
+	b.broadcast(&bridgeMessage{Kind: messageUnsubscribe, Topic: topic})
+}
+
+// broadcast sends a message to the connected peers.
+func (b *Bridge) broadcast(msg *bridgeMessage) {
+	b.lock.Lock()
+	var conns []*bridgeConn
+	for _, peer := range b.peers {
+		if conn := peer.connection(); conn != nil {
+			conns = append(conns, conn)
+		}
+	}
+	b.lock.Unlock()
+	for _, conn := range conns {
+		if err := conn.write(msg); err != nil {
+			conn.close()
+		}
+	}
+}
+
+// Serve accepts the connections of the peers on listener until stopCh is
+// closed. It returns the error of Accept, or nil once stopped.
+func (b *Bridge) Serve(listener net.Listener, stopCh <-chan struct{}) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stopCh:
+		case <-done:
+		}
+		listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-stopCh:
+				return nil
+			default:
+				return err
+			}
+		}
+		go func() {
+			if err := b.run(conn, stopCh); err != nil && !isStopped(stopCh) {
+				logger.Logf(logger.WarnLevel, "eventbus bridge: connection from %s: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// Dial connects to the bridge served at the given address, see net.Dial,
+// until stopCh is closed or the bridge is closed. It reconnects after the
+// connection is lost, waiting as configured by the Backoff of the bridge.
+func (b *Bridge) Dial(network, address string, stopCh <-chan struct{}) {
+	backoff := b.config.Backoff
+	for {
+		conn, err := net.Dial(network, address)
+		if err == nil {
+			backoff = b.config.Backoff
+			err = b.run(conn, stopCh)
+		}
+		if errors.Is(err, ErrBridgeClosed) || isStopped(stopCh) {
+			return
+		}
+		logger.Logf(logger.WarnLevel, "eventbus bridge: connection to %s: %v", address, err)
+
+		timer := time.NewTimer(backoff.Step())
+		select {
+		case <-stopCh:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// Close stops forwarding events to the peers and closes their connections.
+// The events not acknowledged by the peers are dropped.
+func (b *Bridge) Close() {
+	b.lock.Lock()
+	peers := b.peers
+	b.peers = map[string]*bridgePeer{}
+	b.closed = true
+	b.lock.Unlock()
+	for _, peer := range peers {
+		peer.close()
+	}
+}
+
+func isStopped(stopCh <-chan struct{}) bool {
+	select {
+	case <-stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// run exchanges messages with a peer over conn until the connection is lost
+// or stopCh is closed.
+func (b *Bridge) run(netConn net.Conn, stopCh <-chan struct{}) error {
+	conn := newBridgeConn(netConn)
+	defer conn.close()
+	go func() {
+		select {
+		case <-stopCh:
+			conn.close()
+		case <-conn.closed:
+		}
+	}()
+
+	if err := conn.write(&bridgeMessage{Kind: messageHello, Name: b.config.Name}); err != nil {
+		return err
+	}
+	hello, err := conn.read()
+	if err != nil {
+		return err
+	}
+	if hello.Kind != messageHello || hello.Name == "" {
+		return fmt.Errorf("unexpected %q message in place of hello", hello.Kind)
+	}
+	var peer *bridgePeer
+	for attached := false; !attached; {
+		// A peer expiring meanwhile is replaced by a new one.
+		if peer, err = b.peer(hello.Name); err != nil {
+			return err
+		}
+		attached = peer.attach(conn)
+	}
+	defer peer.detach(conn)
+	go peer.writeEvents(conn)
+
+	if err := b.writeTopics(conn); err != nil {
+		return err
+	}
+	for {
+		msg, err := conn.read()
+		if err != nil {
+			return err
+		}
+		switch msg.Kind {
+		case messageTopics:
+			peer.setTopics(msg.Topics)
+		case messageSubscribe:
+			if err := peer.subscribe(msg.Topic); err != nil {
+				logger.Logf(logger.WarnLevel, "eventbus bridge: peer %s: %v", peer.name, err)
+			}
+		case messageUnsubscribe:
+			peer.unsubscribe(msg.Topic)
+		case messageEvent:
+			if args, err := b.config.Codec.Unmarshal(msg.Args); err != nil {
+				// The event can't be decoded any better on another attempt.
+				logger.Logf(logger.ErrorLevel, "eventbus bridge: peer %s: dropping an event of topic %s: %v", peer.name, msg.Topic, err)
+			} else {
+				b.bus.publishFrom(context.Background(), peer, msg.Topic, args...)
+			}
+			if err := conn.write(&bridgeMessage{Kind: messageAck, ID: msg.ID}); err != nil {
+				return err
+			}
+		case messageAck:
+			peer.ack(msg.ID)
+		default:
+			logger.Logf(logger.WarnLevel, "eventbus bridge: peer %s: ignoring a message of kind %q", peer.name, msg.Kind)
+		}
+	}
+}
+
+func (b *Bridge) peer(name string) (*bridgePeer, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return nil, ErrBridgeClosed
+	}
+	peer, ok := b.peers[name]
+	if !ok {
+		peer = &bridgePeer{
+			bridge:        b,
+			name:          name,
+			subscriptions: map[EventTopic]*Subscription{},
+		}
+		b.peers[name] = peer
+	}
+	return peer, nil
+}
+
+// writeTopics sends the topics subscribed to on conn.
+func (b *Bridge) writeTopics(conn *bridgeConn) error {
+	b.topicsLock.Lock()
+	defer b.topicsLock.Unlock()
+	b.lock.Lock()
+	topics := make([]EventTopic, 0, len(b.topics))
+	for topic := range b.topics {
+		topics = append(topics, topic)
+	}
+	b.lock.Unlock()
+	return conn.write(&bridgeMessage{Kind: messageTopics, Topics: topics})
+}
+
+// expire drops a peer which stayed disconnected since its disconnection
+// numbered disconnects.
+func (b *Bridge) expire(peer *bridgePeer, disconnects uint64) {
+	b.lock.Lock()
+	peer.lock.Lock()
+	expired := peer.conn == nil && peer.disconnects == disconnects && !peer.closed
+	pending := len(peer.pending)
+	if expired {
+		// attach fails from now on.
+		peer.closed = true
+		if b.peers[peer.name] == peer {
+			delete(b.peers, peer.name)
+		}
+	}
+	peer.lock.Unlock()
+	b.lock.Unlock()
+	if expired {
+		logger.Logf(logger.WarnLevel, "eventbus bridge: peer %s expired, dropping %d unacknowledged events", peer.name, pending)
+		peer.close()
+	}
+}
+
+// bridgePeer is the state of a peer, kept across its connections.
+type bridgePeer struct {
+	bridge *Bridge
+	name   string
+
+	// lock is taken while the bus is locked, and must not be held when
+	// calling the bus.
+	lock sync.Mutex
+	conn *bridgeConn
+	// subscriptions are the handlers forwarding the events of the topics the
+	// peer subscribed to.
+	subscriptions map[EventTopic]*Subscription
+	// pending are the events not acknowledged yet, in order.
+	pending []*pendingEvent
+	lastID  uint64
+	// disconnects counts the disconnections, the last of which started
+	// expiry.
+	disconnects uint64
+	expiry      *time.Timer
+	closed      bool
+}
+
+type pendingEvent struct {
+	msg *bridgeMessage
+	// conn is the connection the event was last sent on.
+	conn *bridgeConn
+}
+
+func (p *bridgePeer) connection() *bridgeConn {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.conn
+}
+
+// attach makes conn the connection of the peer, on which the pending events
+// are sent again. It returns false if the peer is closed.
+func (p *bridgePeer) attach(conn *bridgeConn) bool {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return false
+	}
+	previous := p.conn
+	p.conn = conn
+	if p.expiry != nil {
+		p.expiry.Stop()
+		p.expiry = nil
+	}
+	p.lock.Unlock()
+	if previous != nil {
+		previous.close()
+	}
+	conn.notify()
+	return true
+}
+
+// detach forgets conn, expiring the peer unless it reconnects in time.
+func (p *bridgePeer) detach(conn *bridgeConn) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.conn != conn || p.closed {
+		return
+	}
+	p.conn = nil
+	p.disconnects++
+	disconnects := p.disconnects
+	p.expiry = time.AfterFunc(p.bridge.config.PeerExpiry, func() {
+		p.bridge.expire(p, disconnects)
+	})
+}
+
+// setTopics makes the topics the peer subscribes to exactly topics.
+func (p *bridgePeer) setTopics(topics []EventTopic) {
+	keep := make(map[EventTopic]bool, len(topics))
+	for _, topic := range topics {
+		keep[topic] = true
+		if err := p.subscribe(topic); err != nil {
+			logger.Logf(logger.WarnLevel, "eventbus bridge: peer %s: %v", p.name, err)
+		}
+	}
+	p.lock.Lock()
+	var stale []EventTopic
+	for topic := range p.subscriptions {
+		if !keep[topic] {
+			stale = append(stale, topic)
+		}
+	}
+	p.lock.Unlock()
+	for _, topic := range stale {
+		p.unsubscribe(topic)
+	}
+}
+
+// subscribe forwards the events of a topic to the peer.
+func (p *bridgePeer) subscribe(topic EventTopic) error {
+	p.lock.Lock()
+	_, exists := p.subscriptions[topic]
+	p.lock.Unlock()
+	if exists {
+		return nil
+	}
+
+	handler := &eventHandler{owner: p}
+	handler.typed = func(topic EventTopic, args []interface{}) error {
+		return p.send(handler, topic, args)
+	}
+	handler.callBack = reflect.ValueOf(handler.typed)
+	sub, err := p.bridge.bus.doSubscribe(topic, handler.typed, handler)
+	if err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	_, exists = p.subscriptions[topic]
+	keep := !exists && !p.closed
+	if keep {
+		p.subscriptions[topic] = sub
+	}
+	p.lock.Unlock()
+	if !keep {
+		sub.Unsubscribe()
+	}
+	return nil
+}
+
+func (p *bridgePeer) unsubscribe(topic EventTopic) {
+	p.lock.Lock()
+	sub := p.subscriptions[topic]
+	delete(p.subscriptions, topic)
+	p.lock.Unlock()
+	if sub != nil {
+		sub.Unsubscribe()
+	}
+}
+
+// send queues an event for the peer. It is called by the handler of a
+// subscription of the peer, while the bus is locked.
+func (p *bridgePeer) send(handler *eventHandler, topic EventTopic, args []interface{}) error {
+	data, err := p.bridge.config.Codec.Marshal(args)
+	if err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	// An event matching several subscriptions is only sent for the first one.
+	for pattern, sub := range p.subscriptions {
+		if sub.handler.seq < handler.seq && matchTopic(pattern, topic) {
+			p.lock.Unlock()
+			return nil
+		}
+	}
+	p.lastID++
+	p.pending = append(p.pending, &pendingEvent{
+		msg: &bridgeMessage{Kind: messageEvent, ID: p.lastID, Topic: topic, Args: data},
+	})
+	if len(p.pending) > p.bridge.config.MaxPending {
+		dropped := p.pending[0]
+		p.pending[0] = nil
+		p.pending = p.pending[1:]
+		logger.Logf(logger.ErrorLevel, "eventbus bridge: peer %s: dropping an unacknowledged event of topic %s", p.name, dropped.msg.Topic)
+	}
+	conn := p.conn
+	p.lock.Unlock()
+	if conn != nil {
+		conn.notify()
+	}
+	return nil
+}
+
+func (p *bridgePeer) ack(id uint64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for i, event := range p.pending {
+		if event.msg.ID == id {
+			copy(p.pending[i:], p.pending[i+1:])
+			p.pending[len(p.pending)-1] = nil
+			p.pending = p.pending[:len(p.pending)-1]
+			return
+		}
+	}
+}
+
+// unsent returns the pending events not sent on conn yet.
+func (p *bridgePeer) unsent(conn *bridgeConn) []*bridgeMessage {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var msgs []*bridgeMessage
+	for _, event := range p.pending {
+		if event.conn != conn {
+			event.conn = conn
+			msgs = append(msgs, event.msg)
+		}
+	}
+	return msgs
+}
+
+// writeEvents sends the pending events on conn until it is closed.
+func (p *bridgePeer) writeEvents(conn *bridgeConn) {
+	for {
+		select {
+		case <-conn.notifyCh:
+		case <-conn.closed:
+			return
+		}
+		for _, msg := range p.unsent(conn) {
+			if err := conn.write(msg); err != nil {
+				conn.close()
+				return
+			}
+		}
+	}
+}
+
+func (p *bridgePeer) close() {
+	p.lock.Lock()
+	subscriptions := p.subscriptions
+	p.subscriptions = map[EventTopic]*Subscription{}
+	conn := p.conn
+	p.conn = nil
+	p.pending = nil
+	p.closed = true
+	if p.expiry != nil {
+		p.expiry.Stop()
+		p.expiry = nil
+	}
+	p.lock.Unlock()
+	for _, sub := range subscriptions {
+		sub.Unsubscribe()
+	}
+	if conn != nil {
+		conn.close()
+	}
+}
+
+// bridgeConn reads and writes the messages of a connection.
+type bridgeConn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	writeLock sync.Mutex
+	notifyCh  chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newBridgeConn(conn net.Conn) *bridgeConn {
+	return &bridgeConn{
+		conn:     conn,
+		reader:   bufio.NewReader(conn),
+		notifyCh: make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+	}
+}
+
+// notify wakes up the writer of the pending events.
+func (c *bridgeConn) notify() {
+	select {
+	case c.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+func (c *bridgeConn) write(msg *bridgeMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	_, err = c.conn.Write(frame)
+	return err
+}
+
+func (c *bridgeConn) read() (*bridgeMessage, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxFrameSize {
+		return nil, fmt.Errorf("message of %d bytes exceeds the limit of %d", size, maxFrameSize)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c.reader, data); err != nil {
+		return nil, err
+	}
+	msg := &bridgeMessage{}
+	if err := json.Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (c *bridgeConn) close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+	})
+}
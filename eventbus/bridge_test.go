@@ -0,0 +1,322 @@
+/*
+
+Copyright 2021-2022 This Project Authors.
+
+Author:  seanchann <seanchann@foxmail.com>
+
+See docs/ for more information about the  project.
+
+*/
+
+package eventbus
+
+import (
+	"encoding/gob"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/commcos/utils/wait"
+)
+
+func TestCodecs(t *testing.T) {
+	jsonCodec := NewJSONCodec()
+	jsonCodec.Register("order", orderEvent{})
+	gob.Register(orderEvent{})
+
+	args := []interface{}{orderEvent{ID: 1, Region: "eu"}, "text", nil}
+	for name, codec := range map[string]Codec{"json": jsonCodec, "gob": GobCodec{}} {
+		data, err := codec.Marshal(args)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		decoded, err := codec.Unmarshal(data)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		if !reflect.DeepEqual(args, decoded) {
+			t.Errorf("%s: expected %#v, got %#v", name, args, decoded)
+		}
+	}
+
+	// Unregistered types are decoded as generic JSON values.
+	data, _ := NewJSONCodec().Marshal([]interface{}{orderEvent{ID: 3}})
+	decoded, err := jsonCodec.Unmarshal(data)
+	if exp := []interface{}{map[string]interface{}{"ID": 3.0, "Region": ""}}; err != nil || !reflect.DeepEqual(exp, decoded) {
+		t.Errorf("expected %#v, got %#v (%v)", exp, decoded, err)
+	}
+}
+
+func TestBridge(t *testing.T) {
+	codec := NewJSONCodec()
+	codec.Register("order", orderEvent{})
+	daemon, sidecar := New(2), New(2)
+	daemonBridge, err := NewBridge(daemon, BridgeConfig{
+		Name:   "daemon",
+		Topics: []EventTopic{"sidecar.>", "shared.*"},
+		Codec:  codec,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer daemonBridge.Close()
+	sidecarBridge, err := NewBridge(sidecar, BridgeConfig{
+		Name:    "sidecar",
+		Topics:  []EventTopic{"orders.>", "shared.*"},
+		Codec:   codec,
+		Backoff: wait.Backoff{Duration: 10 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer sidecarBridge.Close()
+
+	address := filepath.Join(t.TempDir(), "bus.sock")
+	serve := func() chan struct{} {
+		listener, err := net.Listen("unix", address)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		stopCh := make(chan struct{})
+		go daemonBridge.Serve(listener, stopCh)
+		return stopCh
+	}
+	stopServe := serve()
+	stopDial := make(chan struct{})
+	defer close(stopDial)
+	go sidecarBridge.Dial("unix", address, stopDial)
+
+	orders := make(chan orderEvent, 10)
+	SubscribeTyped(sidecar, "orders.*", func(e orderEvent) { orders <- e })
+	daemonEvents := make(chan string, 10)
+	sidecarEvents := make(chan string, 10)
+	daemon.Subscribe("sidecar.>", func(topic string) { daemonEvents <- topic })
+	daemon.Subscribe("shared.*", func(topic string) { daemonEvents <- topic })
+	sidecar.Subscribe("shared.*", func(topic string) { sidecarEvents <- topic })
+
+	// The subscriptions are propagated once connected.
+	if err := wait.PollImmediate(5*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return daemon.HasCallback("orders.created") && sidecar.HasCallback("sidecar.ready"), nil
+	}); err != nil {
+		t.Fatalf("subscriptions not propagated: %v", err)
+	}
+
+	receive := func(events <-chan string) string {
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for an event")
+			return ""
+		}
+	}
+	receiveOrder := func() orderEvent {
+		select {
+		case e := <-orders:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for an order")
+			return orderEvent{}
+		}
+	}
+
+	PublishTyped(daemon, "orders.created", orderEvent{ID: 1, Region: "eu"})
+	if exp, got := (orderEvent{ID: 1, Region: "eu"}), receiveOrder(); exp != got {
+		t.Errorf("expected %v, got %v", exp, got)
+	}
+	sidecar.Publish("sidecar.ready", "sidecar.ready")
+	if exp, got := "sidecar.ready", receive(daemonEvents); exp != got {
+		t.Errorf("expected %s, got %s", exp, got)
+	}
+
+	// Events received from a peer are not sent back to it: the sidecar sees
+	// shared.a once, and the daemon sees shared.b right after its own shared.a.
+	daemon.Publish("shared.a", "shared.a")
+	if exp, got := "shared.a", receive(daemonEvents); exp != got {
+		t.Errorf("expected %s, got %s", exp, got)
+	}
+	if exp, got := "shared.a", receive(sidecarEvents); exp != got {
+		t.Errorf("expected %s, got %s", exp, got)
+	}
+	sidecar.Publish("shared.b", "shared.b")
+	if exp, got := "shared.b", receive(sidecarEvents); exp != got {
+		t.Errorf("expected %s, got %s", exp, got)
+	}
+	if exp, got := "shared.b", receive(daemonEvents); exp != got {
+		t.Errorf("expected %s, got %s", exp, got)
+	}
+
+	// The events published while disconnected are delivered on reconnection.
+	close(stopServe)
+	if err := wait.PollImmediate(5*time.Millisecond, 5*time.Second, func() (bool, error) {
+		daemonBridge.lock.Lock()
+		peer := daemonBridge.peers["sidecar"]
+		daemonBridge.lock.Unlock()
+		return peer.connection() == nil, nil
+	}); err != nil {
+		t.Fatalf("connection not closed: %v", err)
+	}
+	PublishTyped(daemon, "orders.deleted", orderEvent{ID: 2})
+	stopServe = serve()
+	defer close(stopServe)
+	if exp, got := (orderEvent{ID: 2}), receiveOrder(); exp != got {
+		t.Errorf("expected %v, got %v", exp, got)
+	}
+
+	select {
+	case e := <-orders:
+		t.Errorf("unexpected order %v", e)
+	case topic := <-sidecarEvents:
+		t.Errorf("unexpected event %s", topic)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestBridgeArgumentTypes(t *testing.T) {
+	daemon, sidecar := New(2), New(2)
+	daemonBridge, err := NewBridge(daemon, BridgeConfig{Name: "daemon"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer daemonBridge.Close()
+	sidecarBridge, err := NewBridge(sidecar, BridgeConfig{
+		Name:    "sidecar",
+		Topics:  []EventTopic{"counts.*"},
+		Backoff: wait.Backoff{Duration: 10 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer sidecarBridge.Close()
+
+	address := filepath.Join(t.TempDir(), "bus.sock")
+	listener, err := net.Listen("unix", address)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go daemonBridge.Serve(listener, stopCh)
+	go sidecarBridge.Dial("unix", address, stopCh)
+
+	// The JSON numbers are decoded as float64, converted to the parameter
+	// types of the callbacks; a string parameter can not receive them.
+	counts := make(chan int, 10)
+	letters := make(chan *DeadLetter, 10)
+	sidecar.SetDeadLetter(DeadLetterConfig{Topic: "dead"})
+	sidecar.Subscribe("dead", func(letter *DeadLetter) { letters <- letter })
+	sidecar.Subscribe("counts.*", func(n int) { counts <- n })
+	sidecar.Subscribe("counts.*", func(s string) { t.Errorf("unexpected call with %q", s) })
+	if err := wait.PollImmediate(5*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return daemon.HasCallback("counts.a"), nil
+	}); err != nil {
+		t.Fatalf("subscriptions not propagated: %v", err)
+	}
+
+	// 1.5 is not an int either, and is dead-lettered by both callbacks.
+	daemon.Publish("counts.c", 1.5)
+	for i := 0; i < 2; i++ {
+		select {
+		case letter := <-letters:
+			if _, ok := letter.Err.(*HandlerPanicError); !ok || letter.Topic != "counts.c" {
+				t.Errorf("expected a handler panic on counts.c, got %v on %s", letter.Err, letter.Topic)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the dead letters of 1.5")
+		}
+	}
+	daemon.Publish("counts.a", 42)
+	daemon.Publish("counts.b", 43)
+	for _, exp := range []int{42, 43} {
+		select {
+		case n := <-counts:
+			if n != exp {
+				t.Errorf("expected %d, got %d", exp, n)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %d", exp)
+		}
+		select {
+		case letter := <-letters:
+			if _, ok := letter.Err.(*HandlerPanicError); !ok {
+				t.Errorf("expected a handler panic, got %v", letter.Err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the dead letter of %d", exp)
+		}
+	}
+}
+
+func TestBridgeReconnect(t *testing.T) {
+	daemon, sidecar := New(2), New(2)
+	daemonBridge, err := NewBridge(daemon, BridgeConfig{Name: "daemon", PeerExpiry: time.Second})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer daemonBridge.Close()
+	sidecarBridge, err := NewBridge(sidecar, BridgeConfig{
+		Name:    "sidecar",
+		Topics:  []EventTopic{"kept.*"},
+		Backoff: wait.Backoff{Duration: 10 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer sidecarBridge.Close()
+	if err := sidecarBridge.Subscribe("stale.*"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	address := filepath.Join(t.TempDir(), "bus.sock")
+	listener, err := net.Listen("unix", address)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stopServe := make(chan struct{})
+	defer close(stopServe)
+	go daemonBridge.Serve(listener, stopServe)
+
+	expect := func(kept, stale bool) {
+		t.Helper()
+		if err := wait.PollImmediate(5*time.Millisecond, 5*time.Second, func() (bool, error) {
+			return daemon.HasCallback("kept.a") == kept && daemon.HasCallback("stale.a") == stale, nil
+		}); err != nil {
+			t.Fatalf("expected kept=%v and stale=%v subscriptions: %v", kept, stale, err)
+		}
+	}
+	disconnect := func(stopDial chan struct{}) {
+		t.Helper()
+		close(stopDial)
+		if err := wait.PollImmediate(5*time.Millisecond, 5*time.Second, func() (bool, error) {
+			daemonBridge.lock.Lock()
+			defer daemonBridge.lock.Unlock()
+			peer := daemonBridge.peers["sidecar"]
+			return peer == nil || peer.connection() == nil, nil
+		}); err != nil {
+			t.Fatalf("connection not closed: %v", err)
+		}
+	}
+
+	stopDial := make(chan struct{})
+	go sidecarBridge.Dial("unix", address, stopDial)
+	expect(true, true)
+
+	// The topic unsubscribed while disconnected is dropped on reconnection.
+	disconnect(stopDial)
+	sidecarBridge.Unsubscribe("stale.*")
+	stopDial = make(chan struct{})
+	go sidecarBridge.Dial("unix", address, stopDial)
+	expect(true, false)
+
+	// The peer expires once disconnected for long enough.
+	disconnect(stopDial)
+	PublishTyped(daemon, "kept.a", "lost")
+	expect(false, false)
+	daemonBridge.lock.Lock()
+	defer daemonBridge.lock.Unlock()
+	if peers := len(daemonBridge.peers); peers != 0 {
+		t.Errorf("expected no peers, got %d", peers)
+	}
+}
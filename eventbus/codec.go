@@ -0,0 +1,125 @@
+/*
+
+Copyright 2021-2022 This Project Authors.
+
+Author:  seanchann <seanchann@foxmail.com>
+
+See docs/ for more information about the  project.
+
+*/
+
+package eventbus
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Codec encodes the arguments of the events forwarded by a Bridge. Both ends
+// of a bridge must use the same codec.
+type Codec interface {
+	Marshal(args []interface{}) ([]byte, error)
+	Unmarshal(data []byte) ([]interface{}, error)
+}
+
+// GobCodec encodes events with encoding/gob. The concrete types of the
+// arguments must be registered with gob.Register on both ends.
+type GobCodec struct{}
+
+// Marshal implements Codec.
+func (GobCodec) Marshal(args []interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(args); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal implements Codec.
+func (GobCodec) Unmarshal(data []byte) ([]interface{}, error) {
+	var args []interface{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&args); err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+// JSONCodec encodes events with encoding/json. The arguments of a type
+// registered with Register are decoded to that type, the others to the
+// generic JSON types (map[string]interface{}, float64, ...).
+type JSONCodec struct {
+	lock  sync.RWMutex
+	types map[string]reflect.Type
+	names map[reflect.Type]string
+}
+
+type jsonArg struct {
+	Type  string          `json:"type,omitempty"`
+	Value json.RawMessage `json:"value"`
+}
+
+// NewJSONCodec returns a JSONCodec without registered types.
+func NewJSONCodec() *JSONCodec {
+	return &JSONCodec{
+		types: map[string]reflect.Type{},
+		names: map[reflect.Type]string{},
+	}
+}
+
+// Register records the type of value under name, which identifies it on the
+// wire: both ends must register it under the same name.
+func (c *JSONCodec) Register(name string, value interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	t := reflect.TypeOf(value)
+	c.types[name] = t
+	c.names[t] = name
+}
+
+// Marshal implements Codec.
+func (c *JSONCodec) Marshal(args []interface{}) ([]byte, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	encoded := make([]jsonArg, len(args))
+	for i, arg := range args {
+		value, err := json.Marshal(arg)
+		if err != nil {
+			return nil, err
+		}
+		encoded[i] = jsonArg{Type: c.names[reflect.TypeOf(arg)], Value: value}
+	}
+	return json.Marshal(encoded)
+}
+
+// Unmarshal implements Codec.
+func (c *JSONCodec) Unmarshal(data []byte) ([]interface{}, error) {
+	var encoded []jsonArg
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return nil, err
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	args := make([]interface{}, len(encoded))
+	for i, arg := range encoded {
+		if arg.Type == "" {
+			if err := json.Unmarshal(arg.Value, &args[i]); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		t, ok := c.types[arg.Type]
+		if !ok {
+			return nil, fmt.Errorf("type %s is not registered", arg.Type)
+		}
+		value := reflect.New(t)
+		if err := json.Unmarshal(arg.Value, value.Interface()); err != nil {
+			return nil, err
+		}
+		args[i] = value.Elem().Interface()
+	}
+	return args, nil
+}
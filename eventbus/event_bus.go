@@ -11,26 +11,56 @@ See docs/ for more information about the  project.
 package eventbus
 
 import (
+	"context"
 	"fmt"
 	"reflect"
+	"runtime/debug"
 	"sync"
+	"time"
 
+	"github.com/commcos/utils/clock"
 	"github.com/commcos/utils/grpool"
 	"github.com/commcos/utils/logger"
+	"github.com/commcos/utils/wait"
 )
 
 // EventBus - box for handlers and callbacks.
 type EventBus struct {
-	handlers     map[EventTopic][]*eventHandler
-	lock         sync.Mutex // a lock for the map
+	handlers     *topicNode // the trie of subscriptions
+	handlerSeq   uint64     // the sequence number of the last subscription
+	lock         sync.Mutex // a lock for the trie
 	wg           sync.WaitGroup
 	evtAsyncPool *grpool.Pool
+	// stopCh is closed by Close, stopping the retries of the asynchronous
+	// callbacks.
+	stopCh    chan struct{}
+	closeOnce sync.Once
+
+	deadLetter     DeadLetterConfig
+	deadLetterLock sync.RWMutex
+
+	// retention and retained are protected by lock.
+	retention  []retentionRule
+	retained   map[EventTopic][]*retainedEvent
+	publishSeq uint64 // the sequence number of the last retained event
+	clock      clock.PassiveClock
 }
 
 type evtAsyncPayload struct {
 	args    []interface{}
 	handler *eventHandler
 	topic   EventTopic
+	// remote is set for the events received by a Bridge.
+	remote bool
+
+	// attempts is the number of times the callback was run, and retries and
+	// backoff the configuration of its retries, read on the first attempt.
+	attempts int
+	retries  int
+	backoff  wait.Backoff
+	// done, if set, is closed once the callback succeeded or the event was
+	// dead-lettered.
+	done chan struct{}
 }
 
 type eventHandler struct {
@@ -38,15 +68,39 @@ type eventHandler struct {
 	flagOnce      bool
 	async         bool
 	transactional bool
-	sync.Mutex    // lock for an event handler - useful for running async callbacks serially
+
+	pattern EventTopic // the subscribed topic
+	node    *topicNode // the node of the subscribed pattern
+	seq     uint64     // orders the handlers matching a topic
+
+	// returnsError is true if the last result of callBack is an error.
+	returnsError bool
+	// owner, if set, is the origin of the events not delivered to the handler,
+	// such as the bridge peer which the handler forwards events to.
+	owner interface{}
+	// typed, if set, is called in place of callBack, without reflection.
+	typed func(topic EventTopic, args []interface{}) error
+	// noReplay is true if the handler does not receive the retained events.
+	noReplay bool
+	// replaying is true while the handler receives the retained events, and
+	// backlog holds the events published meanwhile, delivered after them.
+	// Both are protected by the lock of the bus.
+	replaying bool
+	backlog   []*evtAsyncPayload
+	// mailbox queues the events of an asynchronous handler.
+	mailbox       *mailbox
+	mailboxConfig MailboxConfig
 }
 
 // New returns new EventBus with empty handlers.
 func New(asyncPoolSize int) Interface {
 	b := &EventBus{
-		handlers: make(map[EventTopic][]*eventHandler),
+		handlers: newTopicNode(nil, ""),
 		lock:     sync.Mutex{},
 		wg:       sync.WaitGroup{},
+		retained: map[EventTopic][]*retainedEvent{},
+		clock:    clock.RealClock{},
+		stopCh:   make(chan struct{}),
 	}
 
 	b.evtAsyncPool = newEvtBusPool(asyncPoolSize, b.doEvtAsyncPoolExecFunc)
@@ -61,155 +115,332 @@ func (bus *EventBus) doEvtAsyncPoolExecFunc(payload interface{}) interface{} {
 		return fmt.Errorf("解析payload类型失败")
 	}
 
-	bus.doPublishAsync(param.handler, param.topic, param.args...)
+	bus.doPublishAsync(param)
 
 	return nil
 }
 
 // doSubscribe handles the subscription logic and is utilized by the public Subscribe functions
-func (bus *EventBus) doSubscribe(topic EventTopic, fn interface{}, handler *eventHandler) error {
+func (bus *EventBus) doSubscribe(topic EventTopic, fn interface{}, handler *eventHandler) (*Subscription, error) {
+	sub, events, err := bus.subscribe(topic, fn, handler)
+	if err != nil {
+		return nil, err
+	}
+	bus.replay(handler, events)
+	return sub, nil
+}
+
+// subscribe adds a handler, and returns the retained events to replay to it.
+func (bus *EventBus) subscribe(topic EventTopic, fn interface{}, handler *eventHandler) (*Subscription, []*retainedEvent, error) {
 	bus.lock.Lock()
 	defer bus.lock.Unlock()
-	if !(reflect.TypeOf(fn).Kind() == reflect.Func) {
-		return fmt.Errorf("%s is not of type reflect.Func", reflect.TypeOf(fn).Kind())
+	fnType := reflect.TypeOf(fn)
+	if fnType == nil || fnType.Kind() != reflect.Func {
+		return nil, nil, fmt.Errorf("%v is not of type reflect.Func", fnType)
 	}
-	bus.handlers[topic] = append(bus.handlers[topic], handler)
-	return nil
+	segments, err := splitPattern(topic)
+	if err != nil {
+		return nil, nil, err
+	}
+	if handler.typed == nil {
+		handler.returnsError = fnType.NumOut() > 0 && fnType.Out(fnType.NumOut()-1) == errorType
+	}
+	handler.pattern = topic
+	bus.handlerSeq++
+	handler.seq = bus.handlerSeq
+	if handler.async {
+		handler.mailbox = newMailbox(bus, handler)
+	}
+	sub := &Subscription{bus: bus, handler: handler}
+
+	var events []*retainedEvent
+	if !handler.noReplay {
+		events = bus.retainedFor(handler)
+	}
+	if handler.flagOnce && len(events) > 0 {
+		// The handler is done with the oldest retained event.
+		return sub, events[:1], nil
+	}
+	// The events published from now on wait for the replay.
+	handler.replaying = len(events) > 0
+	bus.handlers.insert(segments, handler)
+	return sub, events, nil
 }
 
-// Subscribe subscribes to a topic.
+// Subscribe subscribes to a topic, which may be a pattern (see TopicSeparator).
+// If the last result of `fn` is an error, a non-nil error is a failure of the
+// callback (see SetDeadLetter). The callback first receives the events
+// retained for the topic, unless WithoutReplay is given (see SetRetention).
 // Returns error if `fn` is not a function.
-func (bus *EventBus) Subscribe(topic EventTopic, fn interface{}) error {
-	return bus.doSubscribe(topic, fn, &eventHandler{
-		reflect.ValueOf(fn), false, false, false, sync.Mutex{},
-	})
+func (bus *EventBus) Subscribe(topic EventTopic, fn interface{}, opts ...SubscribeOption) (*Subscription, error) {
+	return bus.doSubscribe(topic, fn, newEventHandler(&eventHandler{
+		callBack: reflect.ValueOf(fn),
+	}, opts))
 }
 
 // SubscribeAsync subscribes to a topic with an asynchronous callback
 // Transactional determines whether subsequent callbacks for a topic are
-// run serially (true) or concurrently (false)
+// run serially (true) or concurrently (false). A transactional callback
+// receives the events in the order they were queued in its mailbox; the
+// events of a concurrent one are handed to the pool in that order, but may
+// run, and complete, in any order.
 // Returns error if `fn` is not a function.
-func (bus *EventBus) SubscribeAsyncPool(topic EventTopic, fn interface{}, transactional bool) error {
-	return bus.doSubscribe(topic, fn, &eventHandler{
-		reflect.ValueOf(fn), false, true, transactional, sync.Mutex{},
-	})
+func (bus *EventBus) SubscribeAsyncPool(topic EventTopic, fn interface{}, transactional bool, opts ...SubscribeOption) (*Subscription, error) {
+	return bus.doSubscribe(topic, fn, newEventHandler(&eventHandler{
+		callBack:      reflect.ValueOf(fn),
+		async:         true,
+		transactional: transactional,
+	}, opts))
 }
 
 // SubscribeOnce subscribes to a topic once. Handler will be removed after executing.
 // Returns error if `fn` is not a function.
-func (bus *EventBus) SubscribeOnce(topic EventTopic, fn interface{}) error {
-	return bus.doSubscribe(topic, fn, &eventHandler{
-		reflect.ValueOf(fn), true, false, false, sync.Mutex{},
-	})
+func (bus *EventBus) SubscribeOnce(topic EventTopic, fn interface{}, opts ...SubscribeOption) (*Subscription, error) {
+	return bus.doSubscribe(topic, fn, newEventHandler(&eventHandler{
+		callBack: reflect.ValueOf(fn),
+		flagOnce: true,
+	}, opts))
 }
 
 // SubscribeOnceAsync subscribes to a topic once with an asynchronous callback
 // Handler will be removed after executing.
 // Returns error if `fn` is not a function.
-func (bus *EventBus) SubscribeOnceAsync(topic EventTopic, fn interface{}) error {
-	return bus.doSubscribe(topic, fn, &eventHandler{
-		reflect.ValueOf(fn), true, true, false, sync.Mutex{},
-	})
+func (bus *EventBus) SubscribeOnceAsync(topic EventTopic, fn interface{}, opts ...SubscribeOption) (*Subscription, error) {
+	return bus.doSubscribe(topic, fn, newEventHandler(&eventHandler{
+		callBack: reflect.ValueOf(fn),
+		flagOnce: true,
+		async:    true,
+	}, opts))
 }
 
-// HasCallback returns true if exists any callback subscribed to the topic.
+// HasCallback returns true if exists any callback subscribed to the topic,
+// directly or through a pattern matching it.
 func (bus *EventBus) HasCallback(topic EventTopic) bool {
 	bus.lock.Lock()
 	defer bus.lock.Unlock()
-	_, ok := bus.handlers[topic]
-	if ok {
-		return len(bus.handlers[topic]) > 0
-	}
-	return false
+	return len(bus.handlers.match(splitTopic(topic))) > 0
 }
 
-// Unsubscribe removes callback defined for a topic.
+// Unsubscribe removes callback defined for a topic, which is matched as a
+// pattern: unsubscribing from "orders.*" only removes callbacks subscribed to
+// "orders.*". Callbacks are compared by code, which closures of the same
+// function share; use Subscription.Unsubscribe to remove a given one.
 // Returns error if there are no callbacks subscribed to the topic.
 func (bus *EventBus) Unsubscribe(topic EventTopic, handler interface{}) error {
 	bus.lock.Lock()
 	defer bus.lock.Unlock()
-	if _, ok := bus.handlers[topic]; ok && len(bus.handlers[topic]) > 0 {
-		bus.removeHandler(topic, bus.findHandlerIdx(topic, reflect.ValueOf(handler)))
+	segments, err := splitPattern(topic)
+	if err != nil {
+		return err
+	}
+	if node := bus.handlers.find(segments); node != nil && len(node.handlers) > 0 {
+		bus.removeHandler(bus.findHandler(node, reflect.ValueOf(handler)))
 		return nil
 	}
 	return fmt.Errorf("topic %s doesn't exist", topic)
 }
 
-// Publish executes callback defined for a topic. Any additional argument will be transferred to the callback.
+// Publish executes callback defined for a topic, and for the patterns matching
+// it. Any additional argument will be transferred to the callback.
+// The events for asynchronous callbacks are queued in their mailboxes, which
+// may block the publisher (see WithMailbox).
 func (bus *EventBus) Publish(topic EventTopic, args ...interface{}) {
-	bus.lock.Lock() // will unlock if handler is not found or always after setUpPublish
+	bus.publishFrom(context.Background(), nil, topic, args...)
+}
+
+// PublishCtx is Publish, waiting for room in the mailboxes of the asynchronous
+// callbacks until ctx is done at most. Returns ctx.Err() if the event could
+// not be queued for some of them.
+func (bus *EventBus) PublishCtx(ctx context.Context, topic EventTopic, args ...interface{}) error {
+	return bus.publishFrom(ctx, nil, topic, args...)
+}
+
+// publishFrom publishes an event from origin, which is not delivered to the
+// handlers it owns.
+func (bus *EventBus) publishFrom(ctx context.Context, origin interface{}, topic EventTopic, args ...interface{}) error {
+	letters, async := bus.publish(origin, topic, args...)
+	var err error
+	for _, handler := range async {
+		if putErr := bus.deliverAsync(ctx, handler, origin != nil, topic, args, &letters); putErr != nil {
+			err = putErr
+		}
+	}
+	for _, letter := range letters {
+		bus.sendDeadLetter(letter)
+	}
+	return err
+}
+
+// publish implements publishFrom: it runs the synchronous callbacks, and
+// returns the dead letters of the ones that failed and the asynchronous
+// callbacks, to be handled once the lock is released.
+func (bus *EventBus) publish(origin interface{}, topic EventTopic, args ...interface{}) ([]*DeadLetter, []*eventHandler) {
+	bus.lock.Lock()
 	defer bus.lock.Unlock()
-	if handlers, ok := bus.handlers[topic]; ok && 0 < len(handlers) {
-		// Handlers slice may be changed by removeHandler and Unsubscribe during iteration,
-		// so make a copy and iterate the copied slice.
-		copyHandlers := make([]*eventHandler, len(handlers))
-		copy(copyHandlers, handlers)
-		for i, handler := range copyHandlers {
-			if handler.flagOnce {
-				bus.removeHandler(topic, i)
+	// The matched handlers are a copy, which removeHandler and Unsubscribe
+	// may not change during iteration.
+	bus.retain(origin, topic, args)
+	handlers := bus.handlers.match(splitTopic(topic))
+	var letters []*DeadLetter
+	var async []*eventHandler
+	for _, handler := range handlers {
+		if origin != nil && handler.owner == origin {
+			continue
+		}
+		if handler.replaying {
+			handler.backlog = append(handler.backlog, &evtAsyncPayload{
+				handler: handler,
+				topic:   topic,
+				args:    args,
+				remote:  origin != nil,
+			})
+			continue
+		}
+		if handler.flagOnce {
+			bus.removeHandler(handler)
+		}
+		if !handler.async {
+			publish := bus.doPublish
+			if origin != nil {
+				// A panic on an event of a peer must not kill the bridge.
+				publish = bus.doPublishRecover
 			}
-			if !handler.async {
-				bus.doPublish(handler, topic, args...)
-			} else {
-				bus.wg.Add(1)
-				if handler.transactional {
-					bus.lock.Unlock()
-					handler.Lock()
-					bus.lock.Lock()
-				}
-				payload := &evtAsyncPayload{
-					handler: handler,
-					topic:   topic,
-					args:    args,
-				}
-				bus.evtAsyncPool.AsyncProcess(payload)
+			if err := publish(handler, origin != nil, topic, args...); err != nil {
+				letters = append(letters, bus.newDeadLetter(handler, topic, args, err, 1))
 			}
+		} else {
+			async = append(async, handler)
 		}
 	}
+	return letters, async
 }
 
-func (bus *EventBus) doPublish(handler *eventHandler, topic EventTopic, args ...interface{}) {
-	passedArguments := bus.setUpPublish(handler, args...)
+// deliverAsync queues an event in the mailbox of an asynchronous callback,
+// adding the dead letter of the event dropped if it is full to letters.
+func (bus *EventBus) deliverAsync(ctx context.Context, handler *eventHandler, remote bool, topic EventTopic, args []interface{}, letters *[]*DeadLetter) error {
+	dropped, err := handler.mailbox.put(ctx, &evtAsyncPayload{
+		handler: handler,
+		topic:   topic,
+		args:    args,
+		remote:  remote,
+	})
+	if dropped != nil {
+		*letters = append(*letters, bus.newDeadLetter(handler, dropped.topic, dropped.args, ErrMailboxFull, 0))
+	}
+	return err
+}
+
+// doPublish runs a callback. The arguments of remote events, received by a
+// Bridge, are converted to the parameter types of the callback when exact.
+func (bus *EventBus) doPublish(handler *eventHandler, remote bool, topic EventTopic, args ...interface{}) error {
+	if handler.typed != nil {
+		return handler.typed(topic, args)
+	}
+	passedArguments := bus.setUpPublish(handler, remote, args...)
 	logger.Log(logger.DebugLevel, "call user function with args-len(%v)", len(passedArguments))
-	handler.callBack.Call(passedArguments)
+	results := handler.callBack.Call(passedArguments)
+	if handler.returnsError {
+		if err, _ := results[len(results)-1].Interface().(error); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// doPublishAsync runs an asynchronous callback. On failure, it is retried as
+// configured by SetDeadLetter once its backoff elapsed, which the worker of
+// the pool does not wait for.
+func (bus *EventBus) doPublishAsync(payload *evtAsyncPayload) {
+	if payload.attempts == 0 {
+		config := bus.deadLetterConfig()
+		payload.retries, payload.backoff = config.Retries, config.Backoff
+	}
+	payload.attempts++
+	err := bus.doPublishRecover(payload.handler, payload.remote, payload.topic, payload.args...)
+	if err != nil && payload.attempts <= payload.retries && !bus.closed() {
+		go bus.retryAsync(payload, err)
+		return
+	}
+	bus.finishAsync(payload, err)
+}
+
+// retryAsync runs a failed asynchronous callback again after its backoff, or
+// dead-letters its event with err if the bus is closed first.
+func (bus *EventBus) retryAsync(payload *evtAsyncPayload, err error) {
+	timer := time.NewTimer(payload.backoff.Step())
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		bus.evtAsyncPool.AsyncProcess(payload)
+	case <-bus.stopCh:
+		bus.finishAsync(payload, err)
+	}
 }
 
-func (bus *EventBus) doPublishAsync(handler *eventHandler, topic EventTopic, args ...interface{}) {
+// finishAsync is done with the event of an asynchronous callback, which
+// failed with err if not nil.
+func (bus *EventBus) finishAsync(payload *evtAsyncPayload, err error) {
 	defer bus.wg.Done()
-	if handler.transactional {
-		defer handler.Unlock()
+	if payload.done != nil {
+		close(payload.done)
+	}
+	if err != nil {
+		bus.wg.Add(1)
+		go func() {
+			defer bus.wg.Done()
+			bus.sendDeadLetter(bus.newDeadLetter(payload.handler, payload.topic, payload.args, err, payload.attempts))
+		}()
 	}
-	bus.doPublish(handler, topic, args...)
 }
 
-func (bus *EventBus) removeHandler(topic EventTopic, idx int) {
-	if _, ok := bus.handlers[topic]; !ok {
-		return
+// Close stops retrying the asynchronous callbacks which failed: the events
+// waiting for a retry, and the ones failing from now on, are dead-lettered
+// right away, so that WaitAsync only waits for the callbacks running. The bus
+// remains usable otherwise.
+func (bus *EventBus) Close() {
+	bus.closeOnce.Do(func() {
+		close(bus.stopCh)
+	})
+}
+
+func (bus *EventBus) closed() bool {
+	select {
+	case <-bus.stopCh:
+		return true
+	default:
+		return false
 	}
-	l := len(bus.handlers[topic])
+}
+
+// doPublishRecover runs a callback, turning a panic into an error.
+func (bus *EventBus) doPublishRecover(handler *eventHandler, remote bool, topic EventTopic, args ...interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &HandlerPanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return bus.doPublish(handler, remote, topic, args...)
+}
 
-	if !(0 <= idx && idx < l) {
+func (bus *EventBus) removeHandler(handler *eventHandler) {
+	if handler == nil || handler.node == nil {
 		return
 	}
-
-	copy(bus.handlers[topic][idx:], bus.handlers[topic][idx+1:])
-	bus.handlers[topic][l-1] = nil // or the zero value of T
-	bus.handlers[topic] = bus.handlers[topic][:l-1]
+	handler.node.remove(handler)
+	handler.node = nil
 }
 
-func (bus *EventBus) findHandlerIdx(topic EventTopic, callback reflect.Value) int {
-	if _, ok := bus.handlers[topic]; ok {
-		for idx, handler := range bus.handlers[topic] {
-			if handler.callBack.Type() == callback.Type() &&
-				handler.callBack.Pointer() == callback.Pointer() {
-				return idx
-			}
+func (bus *EventBus) findHandler(node *topicNode, callback reflect.Value) *eventHandler {
+	for _, handler := range node.handlers {
+		if handler.callBack.Type() == callback.Type() &&
+			handler.callBack.Pointer() == callback.Pointer() {
+			return handler
 		}
 	}
-	return -1
+	return nil
 }
 
-func (bus *EventBus) setUpPublish(callback *eventHandler, args ...interface{}) []reflect.Value {
+func (bus *EventBus) setUpPublish(callback *eventHandler, remote bool, args ...interface{}) []reflect.Value {
 	funcType := callback.callBack.Type()
 	passedArguments := make([]reflect.Value, len(args))
 	passedArgumentsIndex := 0
@@ -239,7 +470,11 @@ func (bus *EventBus) setUpPublish(callback *eventHandler, args ...interface{}) [
 					logger.Log(logger.WarnLevel, "setup parameter input a slice but not a reflect value. ignore?")
 				}
 			default:
-				passedArguments[passedArgumentsIndex] = reflect.ValueOf(v)
+				value := reflect.ValueOf(v)
+				if remote && i < funcType.NumIn() {
+					value = convertNumber(value, funcType.In(i))
+				}
+				passedArguments[passedArgumentsIndex] = value
 			}
 		}
 		passedArgumentsIndex++
@@ -248,6 +483,30 @@ func (bus *EventBus) setUpPublish(callback *eventHandler, args ...interface{}) [
 	return passedArguments
 }
 
+// convertNumber converts a number decoded from a peer, e.g. the float64 of a
+// JSON number, to the numeric type of a parameter if it does not change its
+// value. Any other value is returned as is.
+func convertNumber(value reflect.Value, in reflect.Type) reflect.Value {
+	if value.Type().AssignableTo(in) || !isNumber(value.Kind()) || !isNumber(in.Kind()) {
+		return value
+	}
+	converted := value.Convert(in)
+	if converted.Convert(value.Type()).Interface() != value.Interface() {
+		return value
+	}
+	return converted
+}
+
+func isNumber(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
 // WaitAsync waits for all async callbacks to complete
 func (bus *EventBus) WaitAsync() {
 	bus.wg.Wait()
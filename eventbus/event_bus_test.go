@@ -0,0 +1,442 @@
+/*
+
+Copyright 2021-2022 This Project Authors.
+
+Author:  seanchann <seanchann@foxmail.com>
+
+See docs/ for more information about the  project.
+
+*/
+
+package eventbus
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/commcos/utils/wait"
+)
+
+// recorder records the topics its callbacks are called for.
+type recorder struct {
+	lock   sync.Mutex
+	events []string
+}
+
+func (r *recorder) callback(name string) func(topic string) {
+	return func(topic string) {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		r.events = append(r.events, name+":"+topic)
+	}
+}
+
+func (r *recorder) take() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	events := r.events
+	r.events = nil
+	return events
+}
+
+func TestWildcardTopics(t *testing.T) {
+	bus := New(2)
+	r := &recorder{}
+	for name, topic := range map[string]EventTopic{
+		"exact":    "orders.created.eu",
+		"segment":  "orders.*",
+		"middle":   "orders.*.eu",
+		"rest":     "orders.>",
+		"all":      "#",
+		"unrelate": "users.*",
+	} {
+		if _, err := bus.Subscribe(topic, r.callback(name)); err != nil {
+			t.Fatalf("unexpected error subscribing to %s: %v", topic, err)
+		}
+	}
+
+	tests := []struct {
+		topic    EventTopic
+		expected []string
+	}{
+		{"orders.created.eu", []string{"exact", "middle", "rest", "all"}},
+		{"orders.created", []string{"segment", "rest", "all"}},
+		{"orders", []string{"all"}},
+		{"orders.created.eu.paris", []string{"rest", "all"}},
+		{"users.created.eu", []string{"all"}},
+	}
+	for _, test := range tests {
+		bus.Publish(test.topic, string(test.topic))
+		events := r.take()
+		got := map[string]bool{}
+		for _, event := range events {
+			got[event] = true
+		}
+		want := map[string]bool{}
+		for _, name := range test.expected {
+			want[name+":"+string(test.topic)] = true
+		}
+		if len(events) != len(test.expected) || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected %v, got %v", test.topic, test.expected, events)
+		}
+		if !bus.HasCallback(test.topic) {
+			t.Errorf("%s: expected callbacks", test.topic)
+		}
+	}
+}
+
+func TestWildcardOrderAndUnsubscribe(t *testing.T) {
+	bus := New(2)
+	r := &recorder{}
+	// Unsubscribe tells callbacks apart by their code, so they must not be
+	// closures of the same function.
+	first := func(topic string) { r.callback("first")(topic) }
+	second := func(topic string) { r.callback("second")(topic) }
+	third := func(topic string) { r.callback("third")(topic) }
+	bus.Subscribe("a.>", first)
+	bus.Subscribe("a.b", second)
+	bus.Subscribe("a.*", third)
+
+	bus.Publish("a.b", "a.b")
+	if exp, act := []string{"first:a.b", "second:a.b", "third:a.b"}, r.take(); !reflect.DeepEqual(exp, act) {
+		t.Errorf("expected %v, got %v", exp, act)
+	}
+
+	// Unsubscribing matches patterns literally.
+	if err := bus.Unsubscribe("a.b", first); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	bus.Publish("a.b", "a.b")
+	if exp, act := 3, len(r.take()); exp != act {
+		t.Errorf("expected %d callbacks, got %d", exp, act)
+	}
+	if err := bus.Unsubscribe("a.#", first); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := bus.Unsubscribe("a.*", third); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := bus.Unsubscribe("a.*", third); err == nil {
+		t.Errorf("expected an error unsubscribing from a pattern without callbacks")
+	}
+	bus.Publish("a.b", "a.b")
+	if exp, act := []string{"second:a.b"}, r.take(); !reflect.DeepEqual(exp, act) {
+		t.Errorf("expected %v, got %v", exp, act)
+	}
+	if bus.HasCallback("a.c") {
+		t.Errorf("expected no callbacks for a.c")
+	}
+
+	if _, err := bus.Subscribe("a.>.b", first); err == nil {
+		t.Errorf("expected an error for a remainder wildcard before the last segment")
+	}
+}
+
+func TestWildcardOnce(t *testing.T) {
+	bus := New(2)
+	r := &recorder{}
+	bus.SubscribeOnce("jobs.*", r.callback("once"))
+	bus.SubscribeOnceAsync("jobs.>", r.callback("async"))
+
+	bus.Publish("jobs.done", "jobs.done")
+	bus.WaitAsync()
+	bus.Publish("jobs.done", "jobs.done")
+	bus.WaitAsync()
+	if exp, act := 2, len(r.take()); exp != act {
+		t.Errorf("expected %d callbacks, got %d", exp, act)
+	}
+	if bus.HasCallback("jobs.done") {
+		t.Errorf("expected no callbacks left")
+	}
+}
+
+type orderEvent struct {
+	ID     int
+	Region string
+}
+
+func TestTypedSubscriptions(t *testing.T) {
+	bus := New(2)
+
+	var lock sync.Mutex
+	var typed, reflective []orderEvent
+	var async int
+	onOrder := func(e orderEvent) {
+		lock.Lock()
+		defer lock.Unlock()
+		typed = append(typed, e)
+	}
+	if _, err := SubscribeTyped(bus, "orders.*", onOrder); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := SubscribeTypedAsync(bus, "orders.>", func(e orderEvent) {
+		lock.Lock()
+		defer lock.Unlock()
+		async++
+	}, true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	bus.Subscribe("orders.created", func(e orderEvent) {
+		lock.Lock()
+		defer lock.Unlock()
+		reflective = append(reflective, e)
+	})
+
+	PublishTyped(bus, "orders.created", orderEvent{ID: 1, Region: "eu"})
+	// Events of other types or arities are ignored by typed handlers.
+	bus.Publish("orders.updated", "not an order")
+	bus.Publish("orders.updated", orderEvent{ID: 2}, "extra")
+	bus.Publish("orders.updated", orderEvent{ID: 3})
+	bus.WaitAsync()
+
+	lock.Lock()
+	if exp := []orderEvent{{ID: 1, Region: "eu"}, {ID: 3}}; !reflect.DeepEqual(exp, typed) {
+		t.Errorf("expected %v, got %v", exp, typed)
+	}
+	if exp := []orderEvent{{ID: 1, Region: "eu"}}; !reflect.DeepEqual(exp, reflective) {
+		t.Errorf("expected %v, got %v", exp, reflective)
+	}
+	if exp := 2; exp != async {
+		t.Errorf("expected %d async events, got %d", exp, async)
+	}
+	lock.Unlock()
+
+	if err := bus.Unsubscribe("orders.*", onOrder); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := SubscribeTypedOnce(bus, "orders.*", onOrder); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	PublishTyped(bus, "orders.deleted", orderEvent{ID: 4})
+	PublishTyped(bus, "orders.deleted", orderEvent{ID: 5})
+	bus.WaitAsync()
+	lock.Lock()
+	if exp := []orderEvent{{ID: 1, Region: "eu"}, {ID: 3}, {ID: 4}}; !reflect.DeepEqual(exp, typed) {
+		t.Errorf("expected %v, got %v", exp, typed)
+	}
+	lock.Unlock()
+}
+
+func TestSubscriptionUnsubscribe(t *testing.T) {
+	bus := New(1)
+	r := &recorder{}
+	// Closures of the same function can't be told apart by Unsubscribe.
+	first, err := bus.Subscribe("jobs.*", r.callback("first"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := bus.Subscribe("jobs.*", r.callback("second")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exp := EventTopic("jobs.*"); first.Topic() != exp {
+		t.Errorf("expected topic %s, got %s", exp, first.Topic())
+	}
+
+	first.Unsubscribe()
+	first.Unsubscribe()
+	bus.Publish("jobs.run", "jobs.run")
+	if exp, got := []string{"second:jobs.run"}, r.take(); !reflect.DeepEqual(exp, got) {
+		t.Errorf("expected %v, got %v", exp, got)
+	}
+
+	once, _ := bus.SubscribeOnce("jobs.*", r.callback("once"))
+	bus.Publish("jobs.run", "jobs.run")
+	once.Unsubscribe()
+	if !bus.HasCallback("jobs.run") {
+		t.Errorf("expected the remaining subscription to be kept")
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	bus := New(2)
+	var lock sync.Mutex
+	var letters []*DeadLetter
+	bus.Subscribe("dead", func(letter *DeadLetter) {
+		lock.Lock()
+		defer lock.Unlock()
+		letters = append(letters, letter)
+	})
+	bus.SetDeadLetter(DeadLetterConfig{
+		Topic:   "dead",
+		Retries: 2,
+		Backoff: wait.Backoff{Duration: time.Millisecond, Factor: 2, Steps: 2},
+	})
+
+	errFailed := errors.New("failed")
+	bus.Subscribe("sync.*", func(n int) error {
+		if n > 0 {
+			return errFailed
+		}
+		return nil
+	})
+	var calls int
+	bus.SubscribeAsyncPool("async.flaky", func(n int) error {
+		lock.Lock()
+		defer lock.Unlock()
+		calls++
+		if calls < 3 {
+			return errFailed
+		}
+		return nil
+	}, true)
+	bus.SubscribeAsyncPool("async.panic", func(n int) {
+		panic("boom")
+	}, false)
+	SubscribeTypedErr(bus, "typed", func(n int) error {
+		return errFailed
+	})
+	// Failures on the dead-letter topic are only logged.
+	bus.Subscribe("dead", func(letter *DeadLetter) error {
+		return errFailed
+	})
+
+	bus.Publish("sync.ok", 0)
+	bus.Publish("sync.fail", 1)
+	bus.Publish("async.flaky", 1)
+	bus.Publish("async.panic", 1)
+	PublishTyped(bus, "typed", 1)
+	bus.WaitAsync()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if calls != 3 {
+		t.Errorf("expected 3 calls of the flaky handler, got %d", calls)
+	}
+	byTopic := map[EventTopic]*DeadLetter{}
+	for _, letter := range letters {
+		byTopic[letter.Topic] = letter
+	}
+	if len(letters) != 3 || len(byTopic) != 3 {
+		t.Fatalf("expected 3 dead letters, got %v", letters)
+	}
+	if letter := byTopic["sync.fail"]; letter == nil || letter.Err != errFailed || letter.Attempts != 1 ||
+		letter.Subscription != "sync.*" || !reflect.DeepEqual(letter.Args, []interface{}{1}) {
+		t.Errorf("unexpected dead letter %+v", letter)
+	}
+	if letter := byTopic["async.panic"]; letter == nil || letter.Attempts != 3 {
+		t.Errorf("unexpected dead letter %+v", letter)
+	} else if err, ok := letter.Err.(*HandlerPanicError); !ok || err.Value != "boom" || len(err.Stack) == 0 {
+		t.Errorf("expected a panic error, got %v", letter.Err)
+	}
+	if letter := byTopic["typed"]; letter == nil || letter.Err != errFailed {
+		t.Errorf("unexpected dead letter %+v", letter)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	bus := New(1)
+	letters := make(chan *DeadLetter, 10)
+	bus.Subscribe("dead", func(letter *DeadLetter) { letters <- letter })
+	bus.SetDeadLetter(DeadLetterConfig{
+		Topic:   "dead",
+		Retries: 3,
+		Backoff: wait.Backoff{Duration: time.Hour},
+	})
+
+	errFailed := errors.New("failed")
+	bus.SubscribeAsyncPool("fail", func(n int) error { return errFailed }, false)
+	ok := make(chan int, 1)
+	bus.SubscribeAsyncPool("ok", func(n int) { ok <- n }, false)
+
+	// The only worker of the pool is not held by the retry waiting an hour.
+	bus.Publish("fail", 1)
+	bus.Publish("ok", 2)
+	select {
+	case <-ok:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for an event during the backoff")
+	}
+
+	// Closing the bus dead-letters the event waiting for a retry.
+	waited := make(chan struct{})
+	go func() {
+		bus.WaitAsync()
+		close(waited)
+	}()
+	bus.Close()
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the async callbacks")
+	}
+	select {
+	case letter := <-letters:
+		if letter.Topic != "fail" || letter.Err != errFailed || letter.Attempts != 1 {
+			t.Errorf("unexpected dead letter %+v", letter)
+		}
+	default:
+		t.Errorf("expected a dead letter")
+	}
+
+	// A transactional callback receives the next event once done with the
+	// retries of the previous one.
+	bus = New(2)
+	bus.SetDeadLetter(DeadLetterConfig{
+		Retries: 1,
+		Backoff: wait.Backoff{Duration: 10 * time.Millisecond},
+	})
+	var lock sync.Mutex
+	var received []int
+	bus.SubscribeAsyncPool("flaky", func(n int) error {
+		lock.Lock()
+		defer lock.Unlock()
+		received = append(received, n)
+		if len(received) == 1 {
+			return errFailed
+		}
+		return nil
+	}, true)
+	bus.Publish("flaky", 1)
+	bus.Publish("flaky", 2)
+	bus.WaitAsync()
+	lock.Lock()
+	defer lock.Unlock()
+	if exp := []int{1, 1, 2}; !reflect.DeepEqual(exp, received) {
+		t.Errorf("expected %v, got %v", exp, received)
+	}
+}
+
+func TestPublishArgumentTypes(t *testing.T) {
+	// Unlike the events received by a bridge, local events are passed as is:
+	// a callback of another type panics as it always did.
+	tests := map[string]struct {
+		fn  interface{}
+		arg interface{}
+	}{
+		"int to string":  {fn: func(s string) { t.Errorf("unexpected call with %q", s) }, arg: 65},
+		"float64 to int": {fn: func(n int) { t.Errorf("unexpected call with %d", n) }, arg: 1.0},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			bus := New(1)
+			bus.Subscribe("topic", test.fn)
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("expected a panic")
+				}
+			}()
+			bus.Publish("topic", test.arg)
+		})
+	}
+}
+
+func BenchmarkPublishTyped(b *testing.B) {
+	bus := New(1)
+	SubscribeTyped(bus, "bench", func(e orderEvent) {})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		PublishTyped(bus, "bench", orderEvent{ID: i})
+	}
+}
+
+func BenchmarkPublishReflective(b *testing.B) {
+	bus := New(1)
+	bus.Subscribe("bench", func(e orderEvent) {})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bus.Publish("bench", orderEvent{ID: i})
+	}
+}
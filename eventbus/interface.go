@@ -10,21 +10,24 @@ See docs/ for more information about the  project.
 
 package eventbus
 
+import "context"
+
 type EventTopic string
 
 //EventBusSubscriber defines subscription-related bus behavior
 type EventBusSubscriber interface {
-	Subscribe(topic EventTopic, fn interface{}) error
+	Subscribe(topic EventTopic, fn interface{}, opts ...SubscribeOption) (*Subscription, error)
 	//transactional 为true，代表顺序化执行callback
-	SubscribeAsyncPool(topic EventTopic, fn interface{}, transactional bool) error
-	SubscribeOnce(topic EventTopic, fn interface{}) error
-	SubscribeOnceAsync(topic EventTopic, fn interface{}) error
+	SubscribeAsyncPool(topic EventTopic, fn interface{}, transactional bool, opts ...SubscribeOption) (*Subscription, error)
+	SubscribeOnce(topic EventTopic, fn interface{}, opts ...SubscribeOption) (*Subscription, error)
+	SubscribeOnceAsync(topic EventTopic, fn interface{}, opts ...SubscribeOption) (*Subscription, error)
 	Unsubscribe(topic EventTopic, handler interface{}) error
 }
 
 //BusPublisher defines publishing-related bus behavior
 type EventBusPublisher interface {
 	Publish(topic EventTopic, args ...interface{})
+	PublishCtx(ctx context.Context, topic EventTopic, args ...interface{}) error
 }
 
 //EventBus englobes global (subscribe, publish, control) bus behavior
@@ -33,5 +36,8 @@ type Interface interface {
 	EventBusPublisher
 
 	HasCallback(topic EventTopic) bool
+	SetDeadLetter(config DeadLetterConfig)
+	SetRetention(topic EventTopic, policy RetentionPolicy) error
 	WaitAsync()
+	Close()
 }
@@ -0,0 +1,190 @@
+/*
+
+Copyright 2021-2022 This Project Authors.
+
+Author:  seanchann <seanchann@foxmail.com>
+
+See docs/ for more information about the  project.
+
+*/
+
+package eventbus
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// DefaultMailboxSize is the default number of events waiting in the mailbox
+// of an asynchronous callback.
+const DefaultMailboxSize = 1024
+
+// ErrMailboxFull is the error of the dead letters of the events dropped by a
+// full mailbox.
+var ErrMailboxFull = errors.New("eventbus: mailbox full")
+
+// MailboxPolicy decides what happens to an event published to a full
+// mailbox.
+type MailboxPolicy int
+
+const (
+	// MailboxBlock makes the publisher wait for room in the mailbox, at most
+	// for the BlockTimeout of the mailbox, or until the context of PublishCtx
+	// is done.
+	MailboxBlock MailboxPolicy = iota
+	// MailboxDropNewest drops the event published.
+	MailboxDropNewest
+	// MailboxDropOldest drops the oldest event of the mailbox to make room.
+	MailboxDropOldest
+)
+
+// MailboxConfig configures the mailbox of an asynchronous callback, which
+// holds the events published until the callback receives them. The events are
+// dead-lettered with ErrMailboxFull when dropped (see SetDeadLetter).
+type MailboxConfig struct {
+	// Size is the number of events the mailbox holds. It defaults to
+	// DefaultMailboxSize.
+	Size int
+	// Policy applies when the mailbox is full.
+	Policy MailboxPolicy
+	// BlockTimeout bounds the wait of the publishers with MailboxBlock; the
+	// event is dropped after it. If zero, they wait until room is made.
+	BlockTimeout time.Duration
+}
+
+// WithMailbox configures the mailbox of an asynchronous callback.
+func WithMailbox(config MailboxConfig) SubscribeOption {
+	return func(handler *eventHandler) {
+		handler.mailboxConfig = config
+	}
+}
+
+// mailbox queues the events of an asynchronous callback, and hands them over
+// to the pool of the bus in order: a transactional callback receives the next
+// event once done with the previous one, retries included, while the events
+// of the others run concurrently, in no particular order.
+type mailbox struct {
+	bus     *EventBus
+	handler *eventHandler
+	config  MailboxConfig
+
+	lock  sync.Mutex
+	queue []*evtAsyncPayload
+	// space, if set, is closed once an event leaves the mailbox.
+	space    chan struct{}
+	draining bool
+
+	depth   GaugeMetric
+	dropped CounterMetric
+}
+
+func newMailbox(bus *EventBus, handler *eventHandler) *mailbox {
+	config := handler.mailboxConfig
+	if config.Size <= 0 {
+		config.Size = DefaultMailboxSize
+	}
+	mp := globalMetricsFactory.metricsProvider
+	return &mailbox{
+		bus:     bus,
+		handler: handler,
+		config:  config,
+		depth:   mp.NewMailboxDepthMetric(string(handler.pattern)),
+		dropped: mp.NewMailboxDroppedMetric(string(handler.pattern)),
+	}
+}
+
+// put queues an event, and returns the event dropped if the mailbox is full.
+// Returns ctx.Err() if ctx is done while waiting for room.
+func (m *mailbox) put(ctx context.Context, payload *evtAsyncPayload) (*evtAsyncPayload, error) {
+	var timeout <-chan time.Time
+	if m.config.Policy == MailboxBlock && m.config.BlockTimeout > 0 {
+		timer := time.NewTimer(m.config.BlockTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		m.lock.Lock()
+		if len(m.queue) < m.config.Size {
+			m.push(payload)
+			m.lock.Unlock()
+			return nil, nil
+		}
+		switch m.config.Policy {
+		case MailboxDropNewest:
+			m.lock.Unlock()
+			m.dropped.Inc()
+			return payload, nil
+		case MailboxDropOldest:
+			dropped := m.pop()
+			m.push(payload)
+			m.lock.Unlock()
+			m.dropped.Inc()
+			m.bus.wg.Done()
+			return dropped, nil
+		}
+		if m.space == nil {
+			m.space = make(chan struct{})
+		}
+		space := m.space
+		m.lock.Unlock()
+
+		select {
+		case <-space:
+		case <-timeout:
+			m.dropped.Inc()
+			return payload, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// push queues an event, and starts draining the mailbox. It is called with
+// the lock held.
+func (m *mailbox) push(payload *evtAsyncPayload) {
+	m.queue = append(m.queue, payload)
+	m.depth.Inc()
+	m.bus.wg.Add(1)
+	if !m.draining {
+		m.draining = true
+		go m.drain()
+	}
+}
+
+// pop removes the oldest event. It is called with the lock held.
+func (m *mailbox) pop() *evtAsyncPayload {
+	payload := m.queue[0]
+	m.queue[0] = nil
+	m.queue = m.queue[1:]
+	m.depth.Dec()
+	if m.space != nil {
+		close(m.space)
+		m.space = nil
+	}
+	return payload
+}
+
+// drain hands the events over to the pool until the mailbox is empty. The
+// publishers are not blocked by a busy pool, only by a full mailbox.
+func (m *mailbox) drain() {
+	for {
+		m.lock.Lock()
+		if len(m.queue) == 0 {
+			m.draining = false
+			m.lock.Unlock()
+			return
+		}
+		payload := m.pop()
+		m.lock.Unlock()
+
+		if m.handler.transactional {
+			payload.done = make(chan struct{})
+			m.bus.evtAsyncPool.AsyncProcess(payload)
+			<-payload.done
+		} else {
+			m.bus.evtAsyncPool.AsyncProcess(payload)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+/*
+
+Copyright 2021-2022 This Project Authors.
+
+Author:  seanchann <seanchann@foxmail.com>
+
+See docs/ for more information about the  project.
+
+*/
+
+package eventbus
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMailboxOrder(t *testing.T) {
+	bus := New(4)
+	var lock sync.Mutex
+	var received []int
+	bus.SubscribeAsyncPool("numbers", func(n int) {
+		lock.Lock()
+		defer lock.Unlock()
+		received = append(received, n)
+	}, true)
+
+	var expected []int
+	for n := 0; n < 100; n++ {
+		bus.Publish("numbers", n)
+		expected = append(expected, n)
+	}
+	bus.WaitAsync()
+	lock.Lock()
+	defer lock.Unlock()
+	if !reflect.DeepEqual(expected, received) {
+		t.Errorf("expected %v, got %v", expected, received)
+	}
+}
+
+func TestMailboxConcurrent(t *testing.T) {
+	bus := New(4)
+	second := make(chan struct{})
+	var once sync.Once
+	var lock sync.Mutex
+	received := map[int]int{}
+	bus.SubscribeAsyncPool("numbers", func(n int) {
+		// The first event waits for another one, which must not wait for it.
+		if n == 0 {
+			select {
+			case <-second:
+			case <-time.After(5 * time.Second):
+				t.Errorf("events not run concurrently")
+			}
+		} else {
+			once.Do(func() { close(second) })
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		received[n]++
+	}, false)
+
+	for n := 0; n < 100; n++ {
+		bus.Publish("numbers", n)
+	}
+	bus.WaitAsync()
+	lock.Lock()
+	defer lock.Unlock()
+	for n := 0; n < 100; n++ {
+		if received[n] != 1 {
+			t.Errorf("expected event %d once, got it %d times", n, received[n])
+		}
+	}
+}
+
+// gatedSubscriber subscribes a transactional callback which holds the first
+// event until released, so that the next ones wait in its mailbox.
+type gatedSubscriber struct {
+	started  chan struct{}
+	release  chan struct{}
+	lock     sync.Mutex
+	received []int
+}
+
+func subscribeGated(t *testing.T, bus Interface, topic EventTopic, config MailboxConfig) *gatedSubscriber {
+	s := &gatedSubscriber{
+		started: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	_, err := bus.SubscribeAsyncPool(topic, func(n int) {
+		select {
+		case s.started <- struct{}{}:
+			<-s.release
+		default:
+		}
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.received = append(s.received, n)
+	}, true, WithMailbox(config))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return s
+}
+
+func TestMailboxOverflow(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   MailboxConfig
+		received []int
+		dropped  []int
+	}{
+		{
+			name:     "drop newest",
+			config:   MailboxConfig{Size: 2, Policy: MailboxDropNewest},
+			received: []int{0, 1, 2},
+			dropped:  []int{3, 4},
+		},
+		{
+			name:     "drop oldest",
+			config:   MailboxConfig{Size: 2, Policy: MailboxDropOldest},
+			received: []int{0, 3, 4},
+			dropped:  []int{1, 2},
+		},
+		{
+			name:     "block with timeout",
+			config:   MailboxConfig{Size: 2, Policy: MailboxBlock, BlockTimeout: 10 * time.Millisecond},
+			received: []int{0, 1, 2},
+			dropped:  []int{3, 4},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bus := New(2)
+			var dropped []int
+			bus.Subscribe("dead", func(letter *DeadLetter) {
+				if letter.Err != ErrMailboxFull {
+					t.Errorf("unexpected error %v", letter.Err)
+				}
+				dropped = append(dropped, letter.Args[0].(int))
+			})
+			bus.SetDeadLetter(DeadLetterConfig{Topic: "dead"})
+			s := subscribeGated(t, bus, "numbers", test.config)
+
+			bus.Publish("numbers", 0)
+			<-s.started
+			for n := 1; n < 5; n++ {
+				bus.Publish("numbers", n)
+			}
+			close(s.release)
+			bus.WaitAsync()
+
+			if !reflect.DeepEqual(test.dropped, dropped) {
+				t.Errorf("expected %v dropped, got %v", test.dropped, dropped)
+			}
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			if !reflect.DeepEqual(test.received, s.received) {
+				t.Errorf("expected %v, got %v", test.received, s.received)
+			}
+		})
+	}
+}
+
+func TestPublishCtx(t *testing.T) {
+	bus := New(2)
+	s := subscribeGated(t, bus, "numbers", MailboxConfig{Size: 1})
+	if err := bus.PublishCtx(context.Background(), "numbers", 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	<-s.started
+	if err := bus.PublishCtx(context.Background(), "numbers", 1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := bus.PublishCtx(ctx, "numbers", 2); err != context.DeadlineExceeded {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	// A blocked publisher proceeds once room is made.
+	published := make(chan error)
+	go func() {
+		published <- bus.PublishCtx(context.Background(), "numbers", 3)
+	}()
+	select {
+	case err := <-published:
+		t.Fatalf("expected the publisher to block, got %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(s.release)
+	if err := <-published; err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	bus.WaitAsync()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if exp := []int{0, 1, 3}; !reflect.DeepEqual(exp, s.received) {
+		t.Errorf("expected %v, got %v", exp, s.received)
+	}
+}
+
+type depthMetric struct {
+	lock  sync.Mutex
+	depth int
+}
+
+func (m *depthMetric) Inc() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.depth++
+}
+
+func (m *depthMetric) Dec() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.depth--
+}
+
+func (m *depthMetric) value() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.depth
+}
+
+type testMetricsProvider struct {
+	depths map[string]*depthMetric
+}
+
+func (p *testMetricsProvider) NewMailboxDepthMetric(topic string) GaugeMetric {
+	if depth, ok := p.depths[topic]; ok {
+		return depth
+	}
+	return noopMetric{}
+}
+
+func (p *testMetricsProvider) NewMailboxDroppedMetric(topic string) CounterMetric {
+	return noopMetric{}
+}
+
+// The metrics provider can be set once per process.
+var testDepth = &depthMetric{}
+
+func TestMailboxDepthMetric(t *testing.T) {
+	depth := testDepth
+	SetProvider(&testMetricsProvider{depths: map[string]*depthMetric{"depth.*": depth}})
+	if _, ok := globalMetricsFactory.metricsProvider.(*testMetricsProvider); !ok {
+		t.Skip("another metrics provider is installed")
+	}
+
+	bus := New(1)
+	s := subscribeGated(t, bus, "depth.*", MailboxConfig{})
+	bus.Publish("depth.a", 0)
+	<-s.started
+	bus.Publish("depth.a", 1)
+	bus.Publish("depth.b", 2)
+	if exp, got := 2, depth.value(); exp != got {
+		t.Errorf("expected a depth of %d, got %d", exp, got)
+	}
+	close(s.release)
+	bus.WaitAsync()
+	if exp, got := 0, depth.value(); exp != got {
+		t.Errorf("expected a depth of %d, got %d", exp, got)
+	}
+}
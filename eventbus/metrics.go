@@ -0,0 +1,71 @@
+/*
+
+Copyright 2021-2022 This Project Authors.
+
+Author:  seanchann <seanchann@foxmail.com>
+
+See docs/ for more information about the  project.
+
+*/
+
+package eventbus
+
+import "sync"
+
+// GaugeMetric represents a single numerical value that can arbitrarily go up
+// and down.
+type GaugeMetric interface {
+	Inc()
+	Dec()
+}
+
+// CounterMetric represents a single numerical value that only ever goes up.
+type CounterMetric interface {
+	Inc()
+}
+
+// MetricsProvider generates the metrics of the mailboxes of the asynchronous
+// callbacks, labeled by the topic they subscribed to.
+type MetricsProvider interface {
+	// NewMailboxDepthMetric tracks the number of events waiting in mailboxes.
+	NewMailboxDepthMetric(topic string) GaugeMetric
+	// NewMailboxDroppedMetric counts the events dropped by full mailboxes.
+	NewMailboxDroppedMetric(topic string) CounterMetric
+}
+
+type noopMetric struct{}
+
+func (noopMetric) Inc() {}
+func (noopMetric) Dec() {}
+
+type noopMetricsProvider struct{}
+
+func (noopMetricsProvider) NewMailboxDepthMetric(topic string) GaugeMetric {
+	return noopMetric{}
+}
+
+func (noopMetricsProvider) NewMailboxDroppedMetric(topic string) CounterMetric {
+	return noopMetric{}
+}
+
+var globalMetricsFactory = metricsFactory{
+	metricsProvider: noopMetricsProvider{},
+}
+
+type metricsFactory struct {
+	metricsProvider MetricsProvider
+
+	onlyOnce sync.Once
+}
+
+func (f *metricsFactory) setProvider(mp MetricsProvider) {
+	f.onlyOnce.Do(func() {
+		f.metricsProvider = mp
+	})
+}
+
+// SetProvider sets the metrics provider for all subsequently subscribed
+// callbacks. Only the first call has an effect.
+func SetProvider(metricsProvider MetricsProvider) {
+	globalMetricsFactory.setProvider(metricsProvider)
+}
@@ -0,0 +1,214 @@
+/*
+
+Copyright 2021-2022 This Project Authors.
+
+Author:  seanchann <seanchann@foxmail.com>
+
+See docs/ for more information about the  project.
+
+*/
+
+package eventbus
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// RetentionPolicy is the policy of the events a bus retains for the callbacks
+// subscribing later, see SetRetention.
+type RetentionPolicy struct {
+	// Last is the number of events retained per topic, or zero for no limit.
+	Last int
+	// Window is how long the events are retained, or zero for no limit.
+	Window time.Duration
+}
+
+// StickyRetention retains the last event of each topic.
+var StickyRetention = RetentionPolicy{Last: 1}
+
+func (p RetentionPolicy) isZero() bool {
+	return p.Last == 0 && p.Window == 0
+}
+
+// trim returns the events retained by the policy at the given time.
+func (p RetentionPolicy) trim(events []*retainedEvent, now time.Time) []*retainedEvent {
+	first := 0
+	if p.Window > 0 {
+		for first < len(events) && now.Sub(events[first].time) > p.Window {
+			first++
+		}
+	}
+	if p.Last > 0 && len(events)-first > p.Last {
+		first = len(events) - p.Last
+	}
+	if first == 0 {
+		return events
+	}
+	return append([]*retainedEvent(nil), events[first:]...)
+}
+
+type retentionRule struct {
+	pattern EventTopic
+	policy  RetentionPolicy
+}
+
+type retainedEvent struct {
+	seq    uint64
+	time   time.Time
+	origin interface{}
+	topic  EventTopic
+	args   []interface{}
+}
+
+// SubscribeOption configures a subscription.
+type SubscribeOption func(handler *eventHandler)
+
+// WithoutReplay subscribes a callback which does not receive the retained
+// events, only the ones published after it subscribed.
+func WithoutReplay() SubscribeOption {
+	return func(handler *eventHandler) {
+		handler.noReplay = true
+	}
+}
+
+func newEventHandler(handler *eventHandler, opts []SubscribeOption) *eventHandler {
+	for _, opt := range opts {
+		opt(handler)
+	}
+	return handler
+}
+
+// SetRetention sets the policy of the events retained for the topics matching
+// topic, which may be a pattern; the policy of a topic is the one set last
+// for a pattern matching it, and a zero policy removes the one of the pattern.
+// The callbacks subscribing to a topic first receive the events retained for
+// it, oldest first, then the events published after they subscribed.
+// Returns error if the topic or the policy is not valid.
+func (bus *EventBus) SetRetention(topic EventTopic, policy RetentionPolicy) error {
+	if _, err := splitPattern(topic); err != nil {
+		return err
+	}
+	if policy.Last < 0 || policy.Window < 0 {
+		return fmt.Errorf("invalid retention policy %+v", policy)
+	}
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	var rules []retentionRule
+	for _, rule := range bus.retention {
+		if rule.pattern != topic {
+			rules = append(rules, rule)
+		}
+	}
+	if !policy.isZero() {
+		rules = append(rules, retentionRule{pattern: topic, policy: policy})
+	}
+	bus.retention = rules
+
+	// Apply the new policies to the events retained so far.
+	now := bus.clock.Now()
+	for retainedTopic, events := range bus.retained {
+		if policy, ok := bus.retentionPolicy(retainedTopic); ok {
+			bus.retained[retainedTopic] = policy.trim(events, now)
+		} else {
+			delete(bus.retained, retainedTopic)
+		}
+	}
+	return nil
+}
+
+// retentionPolicy returns the policy of a published topic.
+func (bus *EventBus) retentionPolicy(topic EventTopic) (RetentionPolicy, bool) {
+	for i := len(bus.retention) - 1; i >= 0; i-- {
+		if matchTopic(bus.retention[i].pattern, topic) {
+			return bus.retention[i].policy, true
+		}
+	}
+	return RetentionPolicy{}, false
+}
+
+// retain records a published event if its topic has a retention policy.
+func (bus *EventBus) retain(origin interface{}, topic EventTopic, args []interface{}) {
+	policy, ok := bus.retentionPolicy(topic)
+	if !ok {
+		return
+	}
+	bus.publishSeq++
+	now := bus.clock.Now()
+	events := append(bus.retained[topic], &retainedEvent{
+		seq:    bus.publishSeq,
+		time:   now,
+		origin: origin,
+		topic:  topic,
+		args:   append([]interface{}(nil), args...),
+	})
+	bus.retained[topic] = policy.trim(events, now)
+}
+
+// retainedFor returns the retained events to replay to a new handler, oldest
+// first.
+func (bus *EventBus) retainedFor(handler *eventHandler) []*retainedEvent {
+	now := bus.clock.Now()
+	var matched []*retainedEvent
+	for topic, events := range bus.retained {
+		if !matchTopic(handler.pattern, topic) {
+			continue
+		}
+		policy, _ := bus.retentionPolicy(topic)
+		events = policy.trim(events, now)
+		if len(events) == 0 {
+			delete(bus.retained, topic)
+			continue
+		}
+		bus.retained[topic] = events
+		for _, event := range events {
+			if event.origin == nil || event.origin != handler.owner {
+				matched = append(matched, event)
+			}
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].seq < matched[j].seq })
+	return matched
+}
+
+// replay delivers the retained events to a new handler, as Publish does, then
+// the events of its backlog, published during the replay, until it is empty
+// and the handler no longer replaying.
+func (bus *EventBus) replay(handler *eventHandler, events []*retainedEvent) {
+	payloads := make([]*evtAsyncPayload, len(events))
+	for i, event := range events {
+		payloads[i] = &evtAsyncPayload{
+			handler: handler,
+			topic:   event.topic,
+			args:    event.args,
+			remote:  event.origin != nil,
+		}
+	}
+	for len(payloads) > 0 {
+		var letters []*DeadLetter
+		for _, payload := range payloads {
+			if handler.async {
+				bus.deliverAsync(context.Background(), handler, payload.remote, payload.topic, payload.args, &letters)
+			} else if err := bus.doPublish(handler, payload.remote, payload.topic, payload.args...); err != nil {
+				letters = append(letters, bus.newDeadLetter(handler, payload.topic, payload.args, err, 1))
+			}
+		}
+		for _, letter := range letters {
+			bus.sendDeadLetter(letter)
+		}
+
+		bus.lock.Lock()
+		payloads = handler.backlog
+		handler.backlog = nil
+		if handler.node == nil {
+			// Unsubscribed meanwhile.
+			payloads = nil
+		}
+		if len(payloads) == 0 {
+			handler.replaying = false
+		}
+		bus.lock.Unlock()
+	}
+}
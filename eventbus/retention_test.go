@@ -0,0 +1,141 @@
+/*
+
+Copyright 2021-2022 This Project Authors.
+
+Author:  seanchann <seanchann@foxmail.com>
+
+See docs/ for more information about the  project.
+
+*/
+
+package eventbus
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/commcos/utils/clock"
+)
+
+func TestRetention(t *testing.T) {
+	bus := New(2).(*EventBus)
+	fakeClock := clock.NewFakePassiveClock(time.Now())
+	bus.clock = fakeClock
+
+	for topic, policy := range map[EventTopic]RetentionPolicy{
+		"config.*": StickyRetention,
+		"audit.>":  {Last: 2},
+		"metrics":  {Window: time.Minute},
+	} {
+		if err := bus.SetRetention(topic, policy); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := bus.SetRetention("a.>.b", StickyRetention); err == nil {
+		t.Errorf("expected an error for an invalid topic")
+	}
+	if err := bus.SetRetention("a", RetentionPolicy{Last: -1}); err == nil {
+		t.Errorf("expected an error for an invalid policy")
+	}
+
+	bus.Publish("config.a", "a1")
+	bus.Publish("config.b", "b1")
+	bus.Publish("config.a", "a2")
+	bus.Publish("other", "o1")
+	for _, event := range []string{"x1", "x2", "x3"} {
+		bus.Publish("audit.x", event)
+	}
+	bus.Publish("metrics", "m1")
+	fakeClock.SetTime(fakeClock.Now().Add(30 * time.Second))
+	bus.Publish("metrics", "m2")
+	fakeClock.SetTime(fakeClock.Now().Add(40 * time.Second))
+
+	var lock sync.Mutex
+	received := map[string][]string{}
+	callback := func(name string) func(event string) {
+		return func(event string) {
+			lock.Lock()
+			defer lock.Unlock()
+			received[name] = append(received[name], event)
+		}
+	}
+	bus.Subscribe("config.*", callback("config"))
+	bus.Subscribe("audit.>", callback("audit"))
+	bus.Subscribe("metrics", callback("metrics"))
+	bus.Subscribe("other", callback("other"))
+	bus.Subscribe("config.*", callback("live"), WithoutReplay())
+	bus.SubscribeAsyncPool("#", callback("async"), true)
+	bus.SubscribeOnce("config.*", callback("once"))
+	bus.WaitAsync()
+
+	expected := map[string][]string{
+		"config":  {"b1", "a2"},
+		"audit":   {"x2", "x3"},
+		"metrics": {"m2"},
+		"async":   {"b1", "a2", "x2", "x3", "m2"},
+		"once":    {"b1"},
+	}
+	lock.Lock()
+	if !reflect.DeepEqual(expected, received) {
+		t.Errorf("expected %v, got %v", expected, received)
+	}
+	received = map[string][]string{}
+	lock.Unlock()
+
+	// The once callback was done with the retained event.
+	bus.Publish("config.c", "c1")
+	bus.WaitAsync()
+	lock.Lock()
+	if exp := (map[string][]string{"config": {"c1"}, "live": {"c1"}, "async": {"c1"}}); !reflect.DeepEqual(exp, received) {
+		t.Errorf("expected %v, got %v", exp, received)
+	}
+	received = map[string][]string{}
+	lock.Unlock()
+
+	// Removing the policy drops the retained events.
+	bus.SetRetention("config.*", RetentionPolicy{})
+	bus.Subscribe("config.*", callback("late"))
+	SubscribeTyped(bus, "audit.*", callback("typed"))
+	lock.Lock()
+	if exp := (map[string][]string{"typed": {"x2", "x3"}}); !reflect.DeepEqual(exp, received) {
+		t.Errorf("expected %v, got %v", exp, received)
+	}
+	lock.Unlock()
+}
+
+func TestRetentionReplayOrder(t *testing.T) {
+	bus := New(2)
+	bus.SetRetention("state", RetentionPolicy{Last: 3})
+	for _, event := range []string{"r1", "r2", "r3"} {
+		bus.Publish("state", event)
+	}
+
+	// The event published during the replay is received after it.
+	var lock sync.Mutex
+	var received []string
+	bus.Subscribe("state", func(event string) {
+		if event == "r1" {
+			published := make(chan struct{})
+			go func() {
+				bus.Publish("state", "live")
+				close(published)
+			}()
+			select {
+			case <-published:
+			case <-time.After(5 * time.Second):
+				t.Errorf("timed out publishing during the replay")
+			}
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		received = append(received, event)
+	})
+
+	lock.Lock()
+	defer lock.Unlock()
+	if expected := []string{"r1", "r2", "r3", "live"}; !reflect.DeepEqual(expected, received) {
+		t.Errorf("expected %v, got %v", expected, received)
+	}
+}
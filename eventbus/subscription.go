@@ -0,0 +1,125 @@
+/*
+
+Copyright 2021-2022 This Project Authors.
+
+Author:  seanchann <seanchann@foxmail.com>
+
+See docs/ for more information about the  project.
+
+*/
+
+package eventbus
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/commcos/utils/logger"
+	"github.com/commcos/utils/wait"
+)
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// Subscription is a subscription of a callback to a topic, returned by the
+// Subscribe functions.
+type Subscription struct {
+	bus     *EventBus
+	handler *eventHandler
+	once    sync.Once
+}
+
+// Topic returns the topic, or pattern, of the subscription.
+func (s *Subscription) Topic() EventTopic {
+	return s.handler.pattern
+}
+
+// Unsubscribe removes the callback of the subscription, and only it, even if
+// the same callback is subscribed several times. Unsubscribe may be called
+// more than once, and after a SubscribeOnce callback has run.
+func (s *Subscription) Unsubscribe() {
+	s.once.Do(func() {
+		s.bus.lock.Lock()
+		defer s.bus.lock.Unlock()
+		s.bus.removeHandler(s.handler)
+	})
+}
+
+// HandlerPanicError is the error of an asynchronous callback which panicked.
+type HandlerPanicError struct {
+	// Value is the value passed to panic.
+	Value interface{}
+	// Stack is the stack trace of the goroutine which panicked.
+	Stack []byte
+}
+
+func (e *HandlerPanicError) Error() string {
+	return fmt.Sprintf("event handler panic: %v", e.Value)
+}
+
+// DeadLetter is published to the dead-letter topic when a callback fails.
+type DeadLetter struct {
+	// Topic is the topic of the event.
+	Topic EventTopic
+	// Subscription is the topic, or pattern, the callback subscribed to.
+	Subscription EventTopic
+	// Args are the arguments of the event.
+	Args []interface{}
+	// Err is the last error of the callback.
+	Err error
+	// Attempts is the number of times the callback was run.
+	Attempts int
+}
+
+// DeadLetterConfig configures the handling of callback failures. A callback
+// fails when it returns a non-nil error as its last result, or, for an
+// asynchronous callback, when it panics; synchronous callbacks panic in
+// Publish as before, except on the events received by a Bridge.
+type DeadLetterConfig struct {
+	// Topic receives a *DeadLetter for every failed event. If empty, the
+	// failures are logged.
+	Topic EventTopic
+	// Retries is the number of times an asynchronous callback is run again
+	// before its event is dead-lettered. Synchronous callbacks are not retried.
+	Retries int
+	// Backoff is the time to wait between retries; the zero value retries
+	// immediately.
+	Backoff wait.Backoff
+}
+
+// SetDeadLetter configures the handling of callback failures for the events
+// published from now on.
+func (bus *EventBus) SetDeadLetter(config DeadLetterConfig) {
+	bus.deadLetterLock.Lock()
+	defer bus.deadLetterLock.Unlock()
+	bus.deadLetter = config
+}
+
+func (bus *EventBus) deadLetterConfig() DeadLetterConfig {
+	bus.deadLetterLock.RLock()
+	defer bus.deadLetterLock.RUnlock()
+	return bus.deadLetter
+}
+
+func (bus *EventBus) newDeadLetter(handler *eventHandler, topic EventTopic, args []interface{}, err error, attempts int) *DeadLetter {
+	return &DeadLetter{
+		Topic:        topic,
+		Subscription: handler.pattern,
+		Args:         args,
+		Err:          err,
+		Attempts:     attempts,
+	}
+}
+
+// sendDeadLetter publishes a dead letter to the dead-letter topic. The
+// failures of the callbacks subscribed to it are logged instead, so that they
+// are not dead-lettered in a loop.
+func (bus *EventBus) sendDeadLetter(letter *DeadLetter) {
+	deadLetterTopic := bus.deadLetterConfig().Topic
+	if deadLetterTopic == "" || letter.Topic == deadLetterTopic {
+		logger.Logf(logger.ErrorLevel, "topic %s: handler of %s failed after %d attempt(s): %v",
+			letter.Topic, letter.Subscription, letter.Attempts, letter.Err)
+		return
+	}
+	bus.Publish(deadLetterTopic, letter)
+}
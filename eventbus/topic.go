@@ -0,0 +1,179 @@
+/*
+
+Copyright 2021-2022 This Project Authors.
+
+Author:  seanchann <seanchann@foxmail.com>
+
+See docs/ for more information about the  project.
+
+*/
+
+package eventbus
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Topics are hierarchical: their segments are separated by TopicSeparator,
+// as in "orders.created.eu". A subscription topic can be a pattern where a
+// segment is a wildcard: WildcardSegment matches exactly one segment, and
+// WildcardRemainder (or its alias "#"), which must be the last segment,
+// matches one or more segments. "orders.*" matches "orders.created" but
+// not "orders.created.eu", which "orders.>" and "#" both match.
+const (
+	TopicSeparator    = "."
+	WildcardSegment   = "*"
+	WildcardRemainder = ">"
+
+	wildcardRemainderAlias = "#"
+)
+
+// IsPattern returns true if topic holds a wildcard segment.
+func (topic EventTopic) IsPattern() bool {
+	for _, segment := range strings.Split(string(topic), TopicSeparator) {
+		if segment == WildcardSegment || segment == WildcardRemainder || segment == wildcardRemainderAlias {
+			return true
+		}
+	}
+	return false
+}
+
+// splitPattern returns the segments of a subscription topic, with the
+// remainder wildcards normalized.
+func splitPattern(topic EventTopic) ([]string, error) {
+	segments := strings.Split(string(topic), TopicSeparator)
+	for i, segment := range segments {
+		if segment == wildcardRemainderAlias {
+			segment = WildcardRemainder
+			segments[i] = segment
+		}
+		if segment == WildcardRemainder && i != len(segments)-1 {
+			return nil, fmt.Errorf("topic %s: %q must be the last segment", topic, segment)
+		}
+	}
+	return segments, nil
+}
+
+// splitTopic returns the segments of a published topic.
+func splitTopic(topic EventTopic) []string {
+	return strings.Split(string(topic), TopicSeparator)
+}
+
+// topicNode is a node of the trie of subscriptions, indexed by segment.
+type topicNode struct {
+	parent   *topicNode
+	segment  string
+	children map[string]*topicNode
+	// handlers are the subscriptions to the pattern ending at this node.
+	handlers []*eventHandler
+}
+
+func newTopicNode(parent *topicNode, segment string) *topicNode {
+	return &topicNode{
+		parent:   parent,
+		segment:  segment,
+		children: map[string]*topicNode{},
+	}
+}
+
+// insert adds a handler for the pattern of the given segments.
+func (n *topicNode) insert(segments []string, handler *eventHandler) {
+	for _, segment := range segments {
+		child, ok := n.children[segment]
+		if !ok {
+			child = newTopicNode(n, segment)
+			n.children[segment] = child
+		}
+		n = child
+	}
+	handler.node = n
+	n.handlers = append(n.handlers, handler)
+}
+
+// find returns the node of the pattern of the given segments, or nil.
+func (n *topicNode) find(segments []string) *topicNode {
+	for _, segment := range segments {
+		n = n.children[segment]
+		if n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+// match returns the handlers of the patterns matching the given segments of
+// a topic, in the order they subscribed.
+func (n *topicNode) match(segments []string) []*eventHandler {
+	var matched []*eventHandler
+	n.collect(segments, &matched)
+	if len(matched) > 1 {
+		sort.Slice(matched, func(i, j int) bool { return matched[i].seq < matched[j].seq })
+		// A topic holding wildcards matches the patterns literally too.
+		unique := matched[:1]
+		for _, handler := range matched[1:] {
+			if handler != unique[len(unique)-1] {
+				unique = append(unique, handler)
+			}
+		}
+		matched = unique
+	}
+	return matched
+}
+
+func (n *topicNode) collect(segments []string, matched *[]*eventHandler) {
+	if len(segments) == 0 {
+		*matched = append(*matched, n.handlers...)
+		return
+	}
+	if child, ok := n.children[segments[0]]; ok {
+		child.collect(segments[1:], matched)
+	}
+	if child, ok := n.children[WildcardSegment]; ok {
+		child.collect(segments[1:], matched)
+	}
+	if child, ok := n.children[WildcardRemainder]; ok {
+		*matched = append(*matched, child.handlers...)
+	}
+}
+
+// remove removes a handler from its node, and prunes the nodes left empty.
+func (n *topicNode) remove(handler *eventHandler) bool {
+	for i, h := range n.handlers {
+		if h == handler {
+			copy(n.handlers[i:], n.handlers[i+1:])
+			n.handlers[len(n.handlers)-1] = nil
+			n.handlers = n.handlers[:len(n.handlers)-1]
+			n.prune()
+			return true
+		}
+	}
+	return false
+}
+
+func (n *topicNode) prune() {
+	for n.parent != nil && len(n.handlers) == 0 && len(n.children) == 0 {
+		delete(n.parent.children, n.segment)
+		n = n.parent
+	}
+}
+
+// matchTopic returns true if pattern matches the published topic, as the
+// trie of subscriptions does.
+func matchTopic(pattern, topic EventTopic) bool {
+	patternSegments, err := splitPattern(pattern)
+	if err != nil {
+		return false
+	}
+	segments := splitTopic(topic)
+	for i, segment := range patternSegments {
+		if segment == WildcardRemainder {
+			return len(segments) > i
+		}
+		if i >= len(segments) || (segment != WildcardSegment && segment != segments[i]) {
+			return false
+		}
+	}
+	return len(segments) == len(patternSegments)
+}
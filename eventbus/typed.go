@@ -0,0 +1,104 @@
+/*
+
+Copyright 2021-2022 This Project Authors.
+
+Author:  seanchann <seanchann@foxmail.com>
+
+See docs/ for more information about the  project.
+
+*/
+
+package eventbus
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/commcos/utils/logger"
+)
+
+// typedSubscriber is implemented by the buses supporting typed handlers.
+type typedSubscriber interface {
+	doSubscribe(topic EventTopic, fn interface{}, handler *eventHandler) (*Subscription, error)
+}
+
+// SubscribeTyped subscribes fn to a topic, which may be a pattern. Unlike
+// Subscribe, the signature of fn is checked at compile time, and events are
+// delivered without reflection. fn is called for events published with a
+// single argument of type T, such as with PublishTyped; other events are
+// ignored.
+func SubscribeTyped[T any](bus EventBusSubscriber, topic EventTopic, fn func(T), opts ...SubscribeOption) (*Subscription, error) {
+	return subscribeTyped(bus, topic, fn, ignoreError(fn), newEventHandler(&eventHandler{}, opts))
+}
+
+// SubscribeTypedAsync is the asynchronous form of SubscribeTyped, see
+// SubscribeAsyncPool.
+func SubscribeTypedAsync[T any](bus EventBusSubscriber, topic EventTopic, fn func(T), transactional bool, opts ...SubscribeOption) (*Subscription, error) {
+	return subscribeTyped(bus, topic, fn, ignoreError(fn), newEventHandler(&eventHandler{
+		async:         true,
+		transactional: transactional,
+	}, opts))
+}
+
+// SubscribeTypedOnce is the form of SubscribeTyped removed after executing,
+// see SubscribeOnce.
+func SubscribeTypedOnce[T any](bus EventBusSubscriber, topic EventTopic, fn func(T), opts ...SubscribeOption) (*Subscription, error) {
+	return subscribeTyped(bus, topic, fn, ignoreError(fn), newEventHandler(&eventHandler{
+		flagOnce: true,
+	}, opts))
+}
+
+// SubscribeTypedErr is the form of SubscribeTyped for callbacks which may
+// fail, see SetDeadLetter.
+func SubscribeTypedErr[T any](bus EventBusSubscriber, topic EventTopic, fn func(T) error, opts ...SubscribeOption) (*Subscription, error) {
+	return subscribeTyped(bus, topic, fn, fn, newEventHandler(&eventHandler{}, opts))
+}
+
+// SubscribeTypedErrAsync is the asynchronous form of SubscribeTypedErr, see
+// SubscribeAsyncPool.
+func SubscribeTypedErrAsync[T any](bus EventBusSubscriber, topic EventTopic, fn func(T) error, transactional bool, opts ...SubscribeOption) (*Subscription, error) {
+	return subscribeTyped(bus, topic, fn, fn, newEventHandler(&eventHandler{
+		async:         true,
+		transactional: transactional,
+	}, opts))
+}
+
+func ignoreError[T any](fn func(T)) func(T) error {
+	return func(event T) error {
+		fn(event)
+		return nil
+	}
+}
+
+// subscribeTyped subscribes call in place of fn, which identifies the
+// callback for Unsubscribe.
+func subscribeTyped[T any](bus EventBusSubscriber, topic EventTopic, fn interface{}, call func(T) error, handler *eventHandler) (*Subscription, error) {
+	b, ok := bus.(typedSubscriber)
+	if !ok {
+		return nil, fmt.Errorf("%T does not support typed subscriptions", bus)
+	}
+	handler.callBack = reflect.ValueOf(fn)
+	handler.typed = func(topic EventTopic, args []interface{}) error {
+		if len(args) != 1 {
+			logger.Logf(logger.WarnLevel, "topic %s: typed handler ignores an event of %d arguments", topic, len(args))
+			return nil
+		}
+		if args[0] == nil {
+			var zero T
+			return call(zero)
+		}
+		event, ok := args[0].(T)
+		if !ok {
+			logger.Logf(logger.WarnLevel, "topic %s: typed handler of %v ignores an event of %T", topic, reflect.TypeOf((*T)(nil)).Elem(), args[0])
+			return nil
+		}
+		return call(event)
+	}
+	return b.doSubscribe(topic, fn, handler)
+}
+
+// PublishTyped publishes an event of type T to a topic. Typed handlers of T
+// and handlers taking a single argument of type T receive it.
+func PublishTyped[T any](bus EventBusPublisher, topic EventTopic, event T) {
+	bus.Publish(topic, event)
+}
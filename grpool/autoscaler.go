@@ -0,0 +1,192 @@
+/*
+
+Copyright 2021-2022 This Project Authors.
+
+Author:  seanchann <seanchann@foxmail.com>
+
+See docs/ for more information about the  project.
+
+*/
+
+package grpool
+
+import (
+	"sync"
+	"time"
+
+	"github.com/commcos/utils/clock"
+	"github.com/commcos/utils/logapi"
+	"github.com/commcos/utils/logger"
+)
+
+//------------------------------------------------------------------------------
+
+// Defaults of AutoscalerConfig.
+const (
+	DefaultAutoscaleInterval = time.Second
+	DefaultAutoscaleCooldown = time.Minute
+)
+
+// AutoscalerConfig configures an Autoscaler.
+type AutoscalerConfig struct {
+	// MinWorkers and MaxWorkers bound the size of the pool. MaxWorkers below
+	// MinWorkers is treated as MinWorkers.
+	MinWorkers int
+	MaxWorkers int
+
+	// QueueLengthThreshold is the number of jobs waiting for a worker at
+	// which the pool is scaled up. Defaults to 1.
+	QueueLengthThreshold int64
+	// WaitTimeThreshold is the mean time jobs waited for a worker since the
+	// last check at which the pool is scaled up. Zero disables it.
+	WaitTimeThreshold time.Duration
+
+	// ScaleUpStep and ScaleDownStep are the number of workers added or
+	// removed at once. Both default to 1.
+	ScaleUpStep   int
+	ScaleDownStep int
+
+	// Interval is the period of the checks. Defaults to
+	// DefaultAutoscaleInterval.
+	Interval time.Duration
+	// Cooldown is how long the pool must have been under the thresholds,
+	// and not scaled, before it is scaled down. Defaults to
+	// DefaultAutoscaleCooldown.
+	Cooldown time.Duration
+
+	// Logger logs the scaling decisions. Defaults to the logger package.
+	Logger logapi.Interface
+	// Clock measures the cooldowns, and the time jobs wait for a worker
+	// compared to WaitTimeThreshold. Defaults to the real clock.
+	Clock clock.Clock
+}
+
+// Autoscaler drives the size of a Pool from the number of jobs waiting for a
+// worker and the time they wait.
+type Autoscaler struct {
+	pool   *Pool
+	config AutoscalerConfig
+
+	lock sync.Mutex
+	// lastBusy is the last time the pool was over a threshold.
+	lastBusy time.Time
+	// lastScale is the last time the pool was resized.
+	lastScale time.Time
+}
+
+// NewAutoscaler returns an Autoscaler for pool. The pool is resized to fit
+// within the bounds of config right away.
+func NewAutoscaler(pool *Pool, config AutoscalerConfig) *Autoscaler {
+	if config.MinWorkers < 0 {
+		config.MinWorkers = 0
+	}
+	if config.MaxWorkers < config.MinWorkers {
+		config.MaxWorkers = config.MinWorkers
+	}
+	if config.QueueLengthThreshold <= 0 {
+		config.QueueLengthThreshold = 1
+	}
+	if config.ScaleUpStep <= 0 {
+		config.ScaleUpStep = 1
+	}
+	if config.ScaleDownStep <= 0 {
+		config.ScaleDownStep = 1
+	}
+	if config.Interval <= 0 {
+		config.Interval = DefaultAutoscaleInterval
+	}
+	if config.Cooldown <= 0 {
+		config.Cooldown = DefaultAutoscaleCooldown
+	}
+	if config.Clock == nil {
+		config.Clock = clock.RealClock{}
+	}
+
+	pool.setClock(config.Clock)
+
+	a := &Autoscaler{
+		pool:   pool,
+		config: config,
+	}
+	now := config.Clock.Now()
+	a.lastBusy, a.lastScale = now, now
+
+	size := pool.GetSize()
+	if size < config.MinWorkers {
+		a.resize(size, config.MinWorkers, "below the minimum")
+	} else if size > config.MaxWorkers {
+		a.resize(size, config.MaxWorkers, "above the maximum")
+	}
+	return a
+}
+
+// Run checks the pool every interval until stopCh is closed.
+func (a *Autoscaler) Run(stopCh <-chan struct{}) {
+	ticker := a.config.Clock.NewTicker(a.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C():
+			a.check()
+		}
+	}
+}
+
+// check scales the pool up if it is over a threshold, or down if it has been
+// under the thresholds for the cooldown.
+func (a *Autoscaler) check() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	now := a.config.Clock.Now()
+	size := a.pool.GetSize()
+	waiting := a.pool.WaitingJobs()
+	waitTime, waited := a.pool.takeWaitTime()
+
+	var reason string
+	switch {
+	case waiting >= a.config.QueueLengthThreshold:
+		reason = "jobs waiting"
+	case a.config.WaitTimeThreshold > 0 && waited && waitTime >= a.config.WaitTimeThreshold:
+		reason = "wait time"
+	}
+
+	if reason != "" {
+		a.lastBusy = now
+		if size < a.config.MaxWorkers {
+			target := size + a.config.ScaleUpStep
+			if target > a.config.MaxWorkers {
+				target = a.config.MaxWorkers
+			}
+			a.resize(size, target, "%s: %d waiting, %v mean wait", reason, waiting, waitTime)
+			a.lastScale = now
+		}
+		return
+	}
+
+	if size > a.config.MinWorkers && now.Sub(a.lastBusy) >= a.config.Cooldown && now.Sub(a.lastScale) >= a.config.Cooldown {
+		target := size - a.config.ScaleDownStep
+		if target < a.config.MinWorkers {
+			target = a.config.MinWorkers
+		}
+		a.resize(size, target, "idle for %v", now.Sub(a.lastBusy))
+		a.lastScale = now
+	}
+}
+
+func (a *Autoscaler) resize(from, to int, format string, args ...interface{}) {
+	a.logf(logapi.InfoLevel, "Scaling pool from %d to %d workers: "+format, append([]interface{}{from, to}, args...)...)
+	a.pool.SetSize(to)
+}
+
+func (a *Autoscaler) logf(level logapi.Level, format string, args ...interface{}) {
+	if a.config.Logger != nil {
+		a.config.Logger.Logf(level, format, args...)
+		return
+	}
+	logger.Logf(level, format, args...)
+}
+
+//------------------------------------------------------------------------------
@@ -0,0 +1,134 @@
+/*
+
+Copyright 2021-2022 This Project Authors.
+
+Author:  seanchann <seanchann@foxmail.com>
+
+See docs/ for more information about the  project.
+
+*/
+
+package grpool
+
+import (
+	"context"
+	"errors"
+	"reflect"
+)
+
+//------------------------------------------------------------------------------
+
+// Errors returned by Future and its combinators.
+var (
+	ErrFutureNotDone = errors.New("the future is not done")
+	ErrNoFutures     = errors.New("no future to wait for")
+)
+
+// Future is the handle of a job submitted with Submit. It is done once the
+// job was processed, or could not be.
+type Future struct {
+	done   chan struct{}
+	result interface{}
+	err    error
+}
+
+func newFuture() *Future {
+	return &Future{done: make(chan struct{})}
+}
+
+// resolve records the outcome of the job. It must be called exactly once.
+func (f *Future) resolve(result interface{}, err error) {
+	f.result, f.err = result, err
+	close(f.done)
+}
+
+// Done returns a channel that is closed once the future is done.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait blocks until the future is done and returns its result.
+func (f *Future) Wait() (interface{}, error) {
+	<-f.done
+	return f.result, f.err
+}
+
+// WaitCtx blocks until the future is done and returns its result, or returns
+// ctx.Err() if ctx is done first. The job is not affected by ctx.
+func (f *Future) WaitCtx(ctx context.Context) (interface{}, error) {
+	select {
+	case <-f.done:
+		return f.result, f.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Result returns the result of the future without blocking, or
+// ErrFutureNotDone if it is not done yet.
+func (f *Future) Result() (interface{}, error) {
+	select {
+	case <-f.done:
+		return f.result, f.err
+	default:
+		return nil, ErrFutureNotDone
+	}
+}
+
+// Submit hands a payload to a worker of the Pool, blocking until one takes
+// it, and returns a Future for the result of the job. The Future fails with a
+// *JobPanicError if the job panics, with ctx.Err() if ctx is done before the
+// job finished, in which case the worker is interrupted, and with
+// ErrPoolNotRunning if the Pool is closed. A job which finished keeps its
+// result even if ctx is done right after.
+func (p *Pool) Submit(ctx context.Context, payload interface{}) *Future {
+	f := newFuture()
+	err := p.asyncProcessCtx(ctx, payload, f.resolve)
+	if err != nil {
+		f.resolve(nil, err)
+	}
+	return f
+}
+
+// WaitAll blocks until all the futures are done and returns their results,
+// in order. The error is the one of the first future in order that failed,
+// or ctx.Err() if ctx is done first.
+func WaitAll(ctx context.Context, futures ...*Future) ([]interface{}, error) {
+	results := make([]interface{}, len(futures))
+	var firstErr error
+	for i, f := range futures {
+		result, err := f.WaitCtx(ctx)
+		if err != nil && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		results[i] = result
+	}
+	return results, firstErr
+}
+
+// WaitAny blocks until one of the futures is done and returns its index and
+// result. It returns ctx.Err() if ctx is done first, and ErrNoFutures if no
+// future is given.
+func WaitAny(ctx context.Context, futures ...*Future) (int, interface{}, error) {
+	if len(futures) == 0 {
+		return -1, nil, ErrNoFutures
+	}
+
+	cases := make([]reflect.SelectCase, 0, len(futures)+1)
+	for _, f := range futures {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(f.done)})
+	}
+	cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())})
+
+	chosen, _, _ := reflect.Select(cases)
+	if chosen == len(futures) {
+		return -1, nil, ctx.Err()
+	}
+	result, err := futures[chosen].Wait()
+	return chosen, result, err
+}
+
+//------------------------------------------------------------------------------
@@ -11,11 +11,15 @@ See docs/ for more information about the  project.
 package grpool
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/commcos/utils/clock"
+	utilruntime "github.com/commcos/utils/runtime"
 	"github.com/commcos/utils/uuid"
 )
 
@@ -27,9 +31,26 @@ var (
 	ErrJobNotFunc     = errors.New("generic worker not given a func()")
 	ErrWorkerClosed   = errors.New("worker was closed")
 	ErrJobTimedOut    = errors.New("job request timed out")
+	ErrQueueFull      = errors.New("the job queue is full")
+	ErrJobDropped     = errors.New("job dropped from a full queue")
 	defaultIdleTime   = 10 * time.Minute
 )
 
+// JobPanicError is the error of a job whose processing panicked. The worker
+// that panicked is terminated and replaced by a new one.
+type JobPanicError struct {
+	// Payload is the payload of the job.
+	Payload interface{}
+	// Value is the value passed to panic.
+	Value interface{}
+	// Stack is the stack trace of the panicking goroutine.
+	Stack []byte
+}
+
+func (e *JobPanicError) Error() string {
+	return fmt.Sprintf("job panicked: %v", e.Value)
+}
+
 // Worker is an interface representing a Tunny working agent. It will be used to
 // block a calling goroutine until ready to process a job, process that job
 // synchronously, interrupt its own process call when jobs are abandoned, and
@@ -96,7 +117,11 @@ func (w *callbackWorker) Terminate()       {}
 // goroutine. The Pool can initialize, expand, compress and close the workers,
 // as well as processing jobs with the workers synchronously.
 type Pool struct {
-	queuedJobs int64
+	queuedJobs  int64
+	waitingJobs int64
+	pendingJobs int64
+	waitNanos   int64
+	waits       int64
 
 	ctor         func() Worker
 	workers      map[string]*workerWrapper
@@ -105,6 +130,17 @@ type Pool struct {
 	idleTime     time.Duration
 	idleWorkChan chan string
 	workerMut    sync.Mutex
+
+	panicHandler func(err *JobPanicError)
+	panicMut     sync.RWMutex
+
+	// clock holds the poolClock measuring how long jobs wait for a worker,
+	// set by NewAutoscaler.
+	clock atomic.Value
+
+	// queue holds the jobs submitted with a priority, created on first use.
+	queue     *priorityQueue
+	queueOnce sync.Once
 }
 
 // New creates a new Pool of workers that starts with n workers. You must
@@ -181,14 +217,44 @@ func (p *Pool) removeWorkerByUUID(uuid string) {
 	}
 }
 
+// OnPanic sets a function called with the error of every job that panics. By
+// default, the error is handled by runtime.HandleError, as are the panics of
+// the function itself. OnPanic can be called safely by any goroutines.
+func (p *Pool) OnPanic(handler func(err *JobPanicError)) {
+	p.panicMut.Lock()
+	defer p.panicMut.Unlock()
+	p.panicHandler = handler
+}
+
+// handlePanic reports the error of a job that panicked.
+func (p *Pool) handlePanic(err *JobPanicError) {
+	p.panicMut.RLock()
+	handler := p.panicHandler
+	p.panicMut.RUnlock()
+
+	if handler == nil {
+		utilruntime.HandleError(fmt.Errorf("%v\n%s", err, err.Stack))
+		return
+	}
+	// The handler runs on the worker, which a panic would kill.
+	defer func() {
+		if r := recover(); r != nil {
+			utilruntime.HandleError(fmt.Errorf("panic handler panicked on %v: %v", err, r))
+		}
+	}()
+	handler(err)
+}
+
 // Process will use the Pool to process a payload and synchronously return the
-// result. Process can be called safely by any goroutines, but will panic if the
-// Pool has been stopped.
+// result. If the job panics, the result is a *JobPanicError. Process can be
+// called safely by any goroutines, but will panic if the Pool has been stopped.
 func (p *Pool) Process(payload interface{}) interface{} {
 	atomic.AddInt64(&p.queuedJobs, 1)
 	defer atomic.AddInt64(&p.queuedJobs, -1)
 
+	start := p.startWait()
 	request, open := <-p.reqChan
+	p.endWait(start)
 	if !open {
 		panic(ErrPoolNotRunning)
 	}
@@ -212,7 +278,9 @@ func (p *Pool) AsyncProcess(
 ) error {
 	atomic.AddInt64(&p.queuedJobs, 1)
 
+	start := p.startWait()
 	request, open := <-p.reqChan
+	p.endWait(start)
 	if !open {
 		panic(ErrPoolNotRunning)
 	}
@@ -220,7 +288,7 @@ func (p *Pool) AsyncProcess(
 	request.jobChan <- jobData{
 		payload:      payload,
 		asyncProcess: true,
-		asyncJobComplete: func(result interface{}) {
+		asyncJobComplete: func(result interface{}, err error) {
 			defer atomic.AddInt64(&p.queuedJobs, -1)
 		},
 	}
@@ -228,10 +296,107 @@ func (p *Pool) AsyncProcess(
 	return nil
 }
 
+// ProcessCtx will use the Pool to process a payload and synchronously return
+// the result. If the job panics, a *JobPanicError is returned. If ctx is done
+// before the job has finished, the worker is interrupted if it already holds
+// the job, and ctx.Err() is returned. Unlike Process, ProcessCtx returns
+// ErrPoolNotRunning once the Pool is closed. ProcessCtx can be called safely
+// by any goroutines.
+func (p *Pool) ProcessCtx(ctx context.Context, payload interface{}) (interface{}, error) {
+	atomic.AddInt64(&p.queuedJobs, 1)
+	defer atomic.AddInt64(&p.queuedJobs, -1)
+
+	request, err := p.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case request.jobChan <- jobData{
+		payload:      payload,
+		asyncProcess: false,
+	}:
+	case <-ctx.Done():
+		request.interruptFunc()
+		return nil, ctx.Err()
+	}
+
+	select {
+	case result, open := <-request.retChan:
+		if !open {
+			return nil, ErrWorkerClosed
+		}
+		if err, ok := result.(*JobPanicError); ok {
+			return nil, err
+		}
+		return result, nil
+	case <-ctx.Done():
+		request.interruptFunc()
+		return nil, ctx.Err()
+	}
+}
+
+// AsyncProcessCtx hands a payload to a worker of the Pool without waiting for
+// the result. It returns ctx.Err() if ctx is done before a worker took the
+// job, and ErrPoolNotRunning once the Pool is closed. If ctx is done while
+// the job is processed, the worker is interrupted.
+func (p *Pool) AsyncProcessCtx(ctx context.Context, payload interface{}) error {
+	return p.asyncProcessCtx(ctx, payload, nil)
+}
+
+// asyncProcessCtx implements AsyncProcessCtx, calling complete, if not nil,
+// with the result of the job once processed.
+func (p *Pool) asyncProcessCtx(ctx context.Context, payload interface{}, complete func(result interface{}, err error)) error {
+	atomic.AddInt64(&p.queuedJobs, 1)
+
+	request, err := p.acquire(ctx)
+	if err != nil {
+		atomic.AddInt64(&p.queuedJobs, -1)
+		return err
+	}
+
+	select {
+	case request.jobChan <- jobData{
+		ctx:          ctx,
+		payload:      payload,
+		asyncProcess: true,
+		asyncJobComplete: func(result interface{}, err error) {
+			atomic.AddInt64(&p.queuedJobs, -1)
+			if complete != nil {
+				complete(result, err)
+			}
+		},
+	}:
+	case <-ctx.Done():
+		request.interruptFunc()
+		atomic.AddInt64(&p.queuedJobs, -1)
+		return ctx.Err()
+	}
+
+	return nil
+}
+
+// acquire waits for a worker ready to process a job, until ctx is done.
+func (p *Pool) acquire(ctx context.Context) (workRequest, error) {
+	start := p.startWait()
+	defer p.endWait(start)
+
+	select {
+	case request, open := <-p.reqChan:
+		if !open {
+			return workRequest{}, ErrPoolNotRunning
+		}
+		return request, nil
+	case <-ctx.Done():
+		return workRequest{}, ctx.Err()
+	}
+}
+
 // ProcessTimed will use the Pool to process a payload and synchronously return
 // the result. If the timeout occurs before the job has finished the worker will
-// be interrupted and ErrJobTimedOut will be returned. ProcessTimed can be
-// called safely by any goroutines.
+// be interrupted and ErrJobTimedOut will be returned. If the job panics, a
+// *JobPanicError will be returned. ProcessTimed can be called safely by any
+// goroutines.
 func (p *Pool) ProcessTimed(
 	payload interface{},
 	timeout time.Duration,
@@ -244,12 +409,15 @@ func (p *Pool) ProcessTimed(
 	var request workRequest
 	var open bool
 
+	start := p.startWait()
 	select {
 	case request, open = <-p.reqChan:
+		p.endWait(start)
 		if !open {
 			return nil, ErrPoolNotRunning
 		}
 	case <-tout.C:
+		p.endWait(start)
 		return nil, ErrJobTimedOut
 	}
 
@@ -274,6 +442,9 @@ func (p *Pool) ProcessTimed(
 	}
 
 	tout.Stop()
+	if err, ok := payload.(*JobPanicError); ok {
+		return nil, err
+	}
 	return payload, nil
 }
 
@@ -282,6 +453,66 @@ func (p *Pool) QueueLength() int64 {
 	return atomic.LoadInt64(&p.queuedJobs)
 }
 
+// WaitingJobs returns the current count of jobs waiting for a worker,
+// including the ones pending in the priority queue.
+func (p *Pool) WaitingJobs() int64 {
+	return atomic.LoadInt64(&p.waitingJobs) + atomic.LoadInt64(&p.pendingJobs)
+}
+
+type poolClock struct {
+	clock.PassiveClock
+}
+
+// jobWait is the start of the wait of a job for a worker.
+type jobWait struct {
+	clock clock.PassiveClock
+	start time.Time
+}
+
+// setClock sets the clock measuring how long jobs wait for a worker.
+func (p *Pool) setClock(c clock.PassiveClock) {
+	p.clock.Store(poolClock{c})
+}
+
+// beginWait returns the start of a wait for a worker, measured with the
+// clock of the pool.
+func (p *Pool) beginWait() jobWait {
+	var c clock.PassiveClock = clock.RealClock{}
+	if pc, ok := p.clock.Load().(poolClock); ok {
+		c = pc.PassiveClock
+	}
+	return jobWait{clock: c, start: c.Now()}
+}
+
+// recordWait adds a finished wait to the mean returned by takeWaitTime.
+func (p *Pool) recordWait(wait jobWait) {
+	atomic.AddInt64(&p.waitNanos, int64(wait.clock.Since(wait.start)))
+	atomic.AddInt64(&p.waits, 1)
+}
+
+// startWait records that a job starts waiting for a worker.
+func (p *Pool) startWait() jobWait {
+	atomic.AddInt64(&p.waitingJobs, 1)
+	return p.beginWait()
+}
+
+// endWait records that a job stopped waiting for a worker.
+func (p *Pool) endWait(wait jobWait) {
+	atomic.AddInt64(&p.waitingJobs, -1)
+	p.recordWait(wait)
+}
+
+// takeWaitTime returns the mean time jobs waited for a worker since the last
+// call, and whether any job did.
+func (p *Pool) takeWaitTime() (time.Duration, bool) {
+	waits := atomic.SwapInt64(&p.waits, 0)
+	waitNanos := atomic.SwapInt64(&p.waitNanos, 0)
+	if waits == 0 {
+		return 0, false
+	}
+	return time.Duration(waitNanos / waits), true
+}
+
 // SetSize changes the total number of workers in the Pool. This can be called
 // by any goroutine at any time unless the Pool has been stopped, in which case
 // a panic will occur.
@@ -300,7 +531,7 @@ func (p *Pool) SetSize(n int) {
 	// Add extra workers if N > len(workers)
 	for i := lWorkers; i < n; i++ {
 		uuidStr := string(uuid.NewUUID())
-		p.workers[uuidStr] = newWorkerWrapper(p.reqChan, p.ctor(), p.idleTime, uuidStr, p.idleWorkChan)
+		p.workers[uuidStr] = newWorkerWrapper(p.reqChan, p.ctor, p.handlePanic, p.idleTime, uuidStr, p.idleWorkChan)
 	}
 
 	if n < lWorkers {
@@ -310,7 +541,7 @@ func (p *Pool) SetSize(n int) {
 			deleteWorkers = append(deleteWorkers, worker)
 			defer delete(p.workers, uuid)
 			deleteWorkerCount--
-			if deleteWorkerCount < 0 {
+			if deleteWorkerCount == 0 {
 				break
 			}
 		}
@@ -336,6 +567,7 @@ func (p *Pool) GetSize() int {
 func (p *Pool) Close() {
 	p.SetSize(0)
 	close(p.reqChan)
+	p.priorityQueue().close()
 }
 
 //------------------------------------------------------------------------------
@@ -11,10 +11,16 @@ See docs/ for more information about the  project.
 package grpool
 
 import (
+	"context"
+	"fmt"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/commcos/utils/clock"
+	"github.com/commcos/utils/logapi"
+	"github.com/commcos/utils/wait"
 )
 
 //------------------------------------------------------------------------------
@@ -269,6 +275,734 @@ func TestCustomWorker(t *testing.T) {
 
 //------------------------------------------------------------------------------
 
+// interruptibleWorker processes jobs until interrupted or released.
+type interruptibleWorker struct {
+	started     chan struct{}
+	release     chan struct{}
+	interrupted chan struct{}
+}
+
+func newInterruptibleWorker() *interruptibleWorker {
+	return &interruptibleWorker{
+		started:     make(chan struct{}, 10),
+		release:     make(chan struct{}),
+		interrupted: make(chan struct{}, 10),
+	}
+}
+
+func (w *interruptibleWorker) Process(in interface{}) interface{} {
+	w.started <- struct{}{}
+	select {
+	case <-w.release:
+		return in
+	case <-w.interrupted:
+		return nil
+	}
+}
+
+func (w *interruptibleWorker) BlockUntilReady() {}
+func (w *interruptibleWorker) Interrupt()       { w.interrupted <- struct{}{} }
+func (w *interruptibleWorker) Terminate()       {}
+
+func TestProcessCtx(t *testing.T) {
+	pool := NewFunc(2, func(in interface{}) interface{} {
+		return in.(int) * 2
+	})
+
+	ret, err := pool.ProcessCtx(context.Background(), 10)
+	if err != nil {
+		t.Fatalf("Failed to process: %v", err)
+	}
+	if exp, act := 20, ret.(int); exp != act {
+		t.Errorf("Wrong result: %v != %v", act, exp)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := pool.ProcessCtx(ctx, 10); err != context.Canceled {
+		t.Errorf("Wrong error: %v != %v", err, context.Canceled)
+	}
+
+	pool.Close()
+	if _, err := pool.ProcessCtx(context.Background(), 10); err != ErrPoolNotRunning {
+		t.Errorf("Wrong error: %v != %v", err, ErrPoolNotRunning)
+	}
+	if err := pool.AsyncProcessCtx(context.Background(), 10); err != ErrPoolNotRunning {
+		t.Errorf("Wrong error: %v != %v", err, ErrPoolNotRunning)
+	}
+}
+
+func TestProcessCtxInterrupt(t *testing.T) {
+	worker := newInterruptibleWorker()
+	pool := New(1, func() Worker { return worker })
+	defer pool.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errChan := make(chan error)
+	go func() {
+		_, err := pool.ProcessCtx(ctx, 10)
+		errChan <- err
+	}()
+	<-worker.started
+
+	// The only worker is busy, so waiting for one honors the deadline.
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer waitCancel()
+	if _, err := pool.ProcessCtx(waitCtx, 10); err != context.DeadlineExceeded {
+		t.Errorf("Wrong error: %v != %v", err, context.DeadlineExceeded)
+	}
+
+	cancel()
+	if err := <-errChan; err != context.Canceled {
+		t.Errorf("Wrong error: %v != %v", err, context.Canceled)
+	}
+
+	close(worker.release)
+	if exp, act := 5, pool.Process(5).(int); exp != act {
+		t.Errorf("Wrong result: %v != %v", act, exp)
+	}
+}
+
+func TestAsyncProcessCtxInterrupt(t *testing.T) {
+	worker := newInterruptibleWorker()
+	pool := New(1, func() Worker { return worker })
+	defer pool.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := pool.AsyncProcessCtx(ctx, 10); err != nil {
+		t.Fatalf("Failed to process: %v", err)
+	}
+	<-worker.started
+	if exp, act := int64(1), pool.QueueLength(); exp != act {
+		t.Errorf("Wrong queue length: %v != %v", act, exp)
+	}
+
+	cancel()
+	err := wait.Poll(time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return pool.QueueLength() == 0, nil
+	})
+	if err != nil {
+		t.Fatalf("The async job was not interrupted: %v", err)
+	}
+
+	close(worker.release)
+	if exp, act := 5, pool.Process(5).(int); exp != act {
+		t.Errorf("Wrong result: %v != %v", act, exp)
+	}
+}
+
+func TestSubmit(t *testing.T) {
+	pool := NewFunc(4, func(in interface{}) interface{} {
+		if in.(int) < 0 {
+			return nil
+		}
+		return in.(int) * 2
+	})
+
+	var futures []*Future
+	for i := 0; i < 10; i++ {
+		futures = append(futures, pool.Submit(context.Background(), i))
+	}
+	results, err := WaitAll(context.Background(), futures...)
+	if err != nil {
+		t.Fatalf("Failed to process: %v", err)
+	}
+	for i, result := range results {
+		if exp, act := i*2, result.(int); exp != act {
+			t.Errorf("Wrong result: %v != %v", act, exp)
+		}
+	}
+
+	future := pool.Submit(context.Background(), -1)
+	if result, err := future.Wait(); result != nil || err != nil {
+		t.Errorf("Wrong result: %v, %v != nil, nil", result, err)
+	}
+
+	pool.Close()
+	future = pool.Submit(context.Background(), 1)
+	if _, err := future.Result(); err != ErrPoolNotRunning {
+		t.Errorf("Wrong error: %v != %v", err, ErrPoolNotRunning)
+	}
+	if _, err := WaitAll(context.Background(), futures[0], future); err != ErrPoolNotRunning {
+		t.Errorf("Wrong error: %v != %v", err, ErrPoolNotRunning)
+	}
+}
+
+// lateContext reports being canceled, but never signals it, as a context
+// canceled right after the job finished appears to the pool.
+type lateContext struct {
+	context.Context
+}
+
+func (lateContext) Err() error { return context.Canceled }
+
+func TestSubmitKeepsResult(t *testing.T) {
+	pool := NewFunc(1, func(in interface{}) interface{} { return in })
+	defer pool.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if result, err := pool.Submit(lateContext{ctx}, 1).Wait(); result != 1 || err != nil {
+		t.Errorf("Wrong result: %v, %v != 1, nil", result, err)
+	}
+}
+
+func TestFutureWait(t *testing.T) {
+	worker := newInterruptibleWorker()
+	pool := New(1, func() Worker { return worker })
+	defer pool.Close()
+	fastPool := NewFunc(1, func(in interface{}) interface{} { return in })
+	defer fastPool.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	slow := pool.Submit(ctx, 1)
+	<-worker.started
+	if _, err := slow.Result(); err != ErrFutureNotDone {
+		t.Errorf("Wrong error: %v != %v", err, ErrFutureNotDone)
+	}
+
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer waitCancel()
+	if _, err := slow.WaitCtx(waitCtx); err != context.DeadlineExceeded {
+		t.Errorf("Wrong error: %v != %v", err, context.DeadlineExceeded)
+	}
+	if i, _, err := WaitAny(waitCtx, slow); i != -1 || err != context.DeadlineExceeded {
+		t.Errorf("Wrong WaitAny result: %v, %v != -1, %v", i, err, context.DeadlineExceeded)
+	}
+	if _, _, err := WaitAny(context.Background()); err != ErrNoFutures {
+		t.Errorf("Wrong error: %v != %v", err, ErrNoFutures)
+	}
+
+	fast := fastPool.Submit(context.Background(), 2)
+	i, result, err := WaitAny(context.Background(), slow, fast)
+	if i != 1 || err != nil {
+		t.Fatalf("Wrong WaitAny result: %v, %v != 1, nil", i, err)
+	}
+	if exp, act := 2, result.(int); exp != act {
+		t.Errorf("Wrong result: %v != %v", act, exp)
+	}
+
+	cancel()
+	select {
+	case <-slow.Done():
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatalf("The cancelled future is not done")
+	}
+	if _, err := slow.Wait(); err != context.Canceled {
+		t.Errorf("Wrong error: %v != %v", err, context.Canceled)
+	}
+}
+
+type panickyWorker struct {
+	terminated *int32
+}
+
+func (w *panickyWorker) Process(in interface{}) interface{} {
+	if in == "panic" {
+		panic("boom")
+	}
+	return in
+}
+
+func (w *panickyWorker) BlockUntilReady() {}
+func (w *panickyWorker) Interrupt()       {}
+func (w *panickyWorker) Terminate()       { atomic.AddInt32(w.terminated, 1) }
+
+func TestPoolShrink(t *testing.T) {
+	var terminated int32
+	pool := New(5, func() Worker {
+		return &panickyWorker{terminated: &terminated}
+	})
+	defer pool.Close()
+
+	// Shrinking stops exactly the workers in excess.
+	pool.SetSize(2)
+	if exp, act := 2, pool.GetSize(); exp != act {
+		t.Errorf("Wrong size of pool: %v != %v", act, exp)
+	}
+	if exp, act := int32(3), atomic.LoadInt32(&terminated); exp != act {
+		t.Errorf("Wrong number of workers terminated: %v != %v", act, exp)
+	}
+	pool.SetSize(1)
+	if exp, act := 1, pool.GetSize(); exp != act {
+		t.Errorf("Wrong size of pool: %v != %v", act, exp)
+	}
+	if exp, act := "ok", pool.Process("ok"); exp != act {
+		t.Errorf("Wrong result: %v != %v", act, exp)
+	}
+}
+
+func TestJobPanic(t *testing.T) {
+	var created, terminated int32
+	pool := New(1, func() Worker {
+		atomic.AddInt32(&created, 1)
+		return &panickyWorker{terminated: &terminated}
+	})
+	defer pool.Close()
+
+	panics := make(chan *JobPanicError, 10)
+	pool.OnPanic(func(err *JobPanicError) {
+		panics <- err
+	})
+
+	checkPanic := func(err error) {
+		t.Helper()
+		panicErr, ok := err.(*JobPanicError)
+		if !ok {
+			t.Fatalf("Wrong error: %v is not a *JobPanicError", err)
+		}
+		if panicErr.Payload != "panic" || panicErr.Value != "boom" || len(panicErr.Stack) == 0 {
+			t.Errorf("Wrong panic error: %#v", panicErr)
+		}
+		select {
+		case hooked := <-panics:
+			if hooked != panicErr {
+				t.Errorf("Wrong error passed to OnPanic: %v != %v", hooked, panicErr)
+			}
+		case <-time.After(wait.ForeverTestTimeout):
+			t.Fatalf("OnPanic was not called")
+		}
+	}
+
+	checkPanic(pool.Process("panic").(error))
+	_, err := pool.ProcessTimed("panic", wait.ForeverTestTimeout)
+	checkPanic(err)
+	_, err = pool.ProcessCtx(context.Background(), "panic")
+	checkPanic(err)
+	_, err = pool.Submit(context.Background(), "panic").Wait()
+	checkPanic(err)
+
+	if exp, act := "ok", pool.Process("ok"); exp != act {
+		t.Errorf("Wrong result: %v != %v", act, exp)
+	}
+	if exp, act := int32(5), atomic.LoadInt32(&created); exp != act {
+		t.Errorf("Wrong number of workers created: %v != %v", act, exp)
+	}
+	if exp, act := int32(4), atomic.LoadInt32(&terminated); exp != act {
+		t.Errorf("Wrong number of workers terminated: %v != %v", act, exp)
+	}
+}
+
+func TestPanickingPanicHandler(t *testing.T) {
+	pool := New(1, func() Worker {
+		return &panickyWorker{terminated: new(int32)}
+	})
+	defer pool.Close()
+	pool.OnPanic(func(err *JobPanicError) {
+		panic("handler boom")
+	})
+
+	if _, ok := pool.Process("panic").(*JobPanicError); !ok {
+		t.Fatalf("Expected a *JobPanicError")
+	}
+	// The worker survived the panic of the handler.
+	if exp, act := "ok", pool.Process("ok"); exp != act {
+		t.Errorf("Wrong result: %v != %v", act, exp)
+	}
+}
+
+type recordingLogger struct {
+	lock     sync.Mutex
+	messages []string
+}
+
+func (l *recordingLogger) Logf(level logapi.Level, format string, args ...interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Log(level logapi.Level, args ...interface{})           {}
+func (l *recordingLogger) Level() logapi.Level                                   { return logapi.InfoLevel }
+func (l *recordingLogger) SetLevel(logapi.Level)                                 {}
+func (l *recordingLogger) SetLoggerOutputFileConfig(logapi.LoggerOutputFileConf) {}
+func (l *recordingLogger) SetLoggerOutputType(logapi.LoggerOutputType)           {}
+
+func (l *recordingLogger) count() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return len(l.messages)
+}
+
+func TestAutoscaler(t *testing.T) {
+	worker := newInterruptibleWorker()
+	pool := New(0, func() Worker { return worker })
+	defer pool.Close()
+	fakeClock := clock.NewFakeClock(time.Now())
+
+	log := &recordingLogger{}
+	a := NewAutoscaler(pool, AutoscalerConfig{
+		MinWorkers:        1,
+		MaxWorkers:        2,
+		WaitTimeThreshold: time.Second,
+		Cooldown:          time.Minute,
+		Logger:            log,
+		Clock:             fakeClock,
+	})
+	checkSize := func(exp int) {
+		t.Helper()
+		if act := pool.GetSize(); exp != act {
+			t.Fatalf("Wrong size of pool: %v != %v", act, exp)
+		}
+	}
+	checkSize(1)
+
+	// A job waiting for a worker scales the pool up.
+	first := pool.Submit(context.Background(), 1)
+	<-worker.started
+	waiting := make(chan *Future)
+	go func() {
+		waiting <- pool.Submit(context.Background(), 2)
+	}()
+	if err := wait.Poll(time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return pool.WaitingJobs() == 1, nil
+	}); err != nil {
+		t.Fatalf("The job is not waiting: %v", err)
+	}
+	checkSize(1)
+	a.check()
+	checkSize(2)
+	second := <-waiting
+	<-worker.started
+
+	// The maximum is never exceeded.
+	go func() {
+		waiting <- pool.Submit(context.Background(), 3)
+	}()
+	if err := wait.Poll(time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return pool.WaitingJobs() == 1, nil
+	}); err != nil {
+		t.Fatalf("The job is not waiting: %v", err)
+	}
+	a.check()
+	checkSize(2)
+
+	// The time jobs waited is measured with the autoscaler's clock.
+	fakeClock.Step(5 * time.Second)
+	close(worker.release)
+	third := <-waiting
+	if _, err := WaitAll(context.Background(), first, second, third); err != nil {
+		t.Fatalf("Failed to process: %v", err)
+	}
+	if waitTime, waited := pool.takeWaitTime(); !waited || waitTime < time.Second {
+		t.Errorf("Wrong wait time: %v, %v", waitTime, waited)
+	}
+
+	// Once idle for the cooldown, the pool is scaled down to the minimum.
+	fakeClock.Step(30 * time.Second)
+	a.check()
+	checkSize(2)
+	fakeClock.Step(30 * time.Second)
+	a.check()
+	checkSize(1)
+	fakeClock.Step(time.Hour)
+	a.check()
+	checkSize(1)
+
+	if exp, act := 3, log.count(); exp != act {
+		t.Errorf("Wrong number of scaling decisions logged: %v != %v: %v", act, exp, log.messages)
+	}
+}
+
+func TestAutoscalerRun(t *testing.T) {
+	pool := NewFunc(4, func(in interface{}) interface{} { return in })
+	defer pool.Close()
+	fakeClock := clock.NewFakeClock(time.Now())
+
+	a := NewAutoscaler(pool, AutoscalerConfig{
+		MinWorkers: 1,
+		MaxWorkers: 3,
+		Interval:   time.Second,
+		Cooldown:   time.Minute,
+		Logger:     &recordingLogger{},
+		Clock:      fakeClock,
+	})
+	if exp, act := 3, pool.GetSize(); exp != act {
+		t.Fatalf("Wrong size of pool: %v != %v", act, exp)
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go a.Run(stopCh)
+
+	err := wait.Poll(time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		fakeClock.Step(10 * time.Second)
+		return pool.GetSize() == 1, nil
+	})
+	if err != nil {
+		t.Errorf("The pool was not scaled down: size %v", pool.GetSize())
+	}
+}
+
+// gatedPool returns a pool with a single worker that records the payloads it
+// processes, and a job keeping that worker busy until the returned function
+// is called.
+func gatedPool(t *testing.T) (*Pool, *[]interface{}, func()) {
+	var lock sync.Mutex
+	var processed []interface{}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	pool := NewFunc(1, func(in interface{}) interface{} {
+		if in == "gate" {
+			close(started)
+			<-release
+			return in
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		processed = append(processed, in)
+		return in
+	})
+	pool.Submit(context.Background(), "gate")
+	<-started
+	return pool, &processed, func() { close(release) }
+}
+
+func TestPriorityDispatch(t *testing.T) {
+	pool, processed, release := gatedPool(t)
+	defer pool.Close()
+	pool.SetQueueConfig(QueueConfig{Weights: map[Priority]int{PriorityLow: 1, PriorityHigh: 2}})
+
+	var futures []*Future
+	for i := 0; i < 3; i++ {
+		futures = append(futures, pool.SubmitPriority(context.Background(), PriorityLow, "L"))
+	}
+	for i := 0; i < 6; i++ {
+		futures = append(futures, pool.SubmitPriority(context.Background(), PriorityHigh, "H"))
+	}
+	if exp, act := int64(3), pool.PriorityQueueLength(PriorityLow); exp != act {
+		t.Errorf("Wrong queue length: %v != %v", act, exp)
+	}
+	if exp, act := int64(6), pool.PriorityQueueLength(PriorityHigh); exp != act {
+		t.Errorf("Wrong queue length: %v != %v", act, exp)
+	}
+	if exp, act := int64(9), pool.WaitingJobs(); exp != act {
+		t.Errorf("Wrong number of waiting jobs: %v != %v", act, exp)
+	}
+
+	release()
+	if _, err := WaitAll(context.Background(), futures...); err != nil {
+		t.Fatalf("Failed to process: %v", err)
+	}
+	order := ""
+	for _, in := range *processed {
+		order += in.(string)
+	}
+	if exp := "HLHHLHHLH"; order != exp {
+		t.Errorf("Wrong dispatch order: %v != %v", order, exp)
+	}
+	if exp, act := int64(0), pool.PriorityQueueLength(PriorityHigh); exp != act {
+		t.Errorf("Wrong queue length: %v != %v", act, exp)
+	}
+}
+
+func TestPriorityQueueFull(t *testing.T) {
+	pool, _, release := gatedPool(t)
+	defer pool.Close()
+	defer release()
+
+	pool.SetQueueConfig(QueueConfig{MaxPending: 2, FullPolicy: QueueFullFail})
+	pool.SubmitPriority(context.Background(), PriorityLow, 1)
+	pool.SubmitPriority(context.Background(), PriorityLow, 2)
+	if _, err := pool.SubmitPriority(context.Background(), PriorityHigh, 3).Result(); err != ErrQueueFull {
+		t.Errorf("Wrong error: %v != %v", err, ErrQueueFull)
+	}
+
+	// Jobs canceled while pending free their slot.
+	ctx, cancel := context.WithCancel(context.Background())
+	pool.SetQueueConfig(QueueConfig{MaxPending: 3, FullPolicy: QueueFullDropOldest})
+	canceled := pool.SubmitPriority(ctx, PriorityLow, 4)
+	cancel()
+	kept := pool.SubmitPriority(context.Background(), PriorityHigh, 5)
+	if _, err := canceled.Result(); err != context.Canceled {
+		t.Errorf("Wrong error: %v != %v", err, context.Canceled)
+	}
+
+	// The oldest job is dropped.
+	pool.SubmitPriority(context.Background(), PriorityHigh, 6)
+	if exp, act := int64(3), pool.WaitingJobs(); exp != act {
+		t.Errorf("Wrong number of waiting jobs: %v != %v", act, exp)
+	}
+	if _, err := kept.Result(); err != ErrFutureNotDone {
+		t.Errorf("Wrong error: %v != %v", err, ErrFutureNotDone)
+	}
+	if exp, act := int64(1), pool.PriorityQueueLength(PriorityLow); exp != act {
+		t.Errorf("Wrong queue length: %v != %v", act, exp)
+	}
+
+	// Blocking honors the context.
+	pool.SetQueueConfig(QueueConfig{MaxPending: 3, FullPolicy: QueueFullBlock})
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer waitCancel()
+	if _, err := pool.SubmitPriority(waitCtx, PriorityHigh, 7).Result(); err != context.DeadlineExceeded {
+		t.Errorf("Wrong error: %v != %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestPriorityQueueDropOldest(t *testing.T) {
+	pool, _, release := gatedPool(t)
+	defer pool.Close()
+
+	// The oldest job of the lowest priority is dropped, not the urgent one.
+	pool.SetQueueConfig(QueueConfig{MaxPending: 2, FullPolicy: QueueFullDropOldest})
+	urgent := pool.SubmitPriority(context.Background(), PriorityHigh, 1)
+	oldest := pool.SubmitPriority(context.Background(), PriorityLow, 2)
+	newest := pool.SubmitPriority(context.Background(), PriorityLow, 3)
+	if _, err := oldest.Result(); err != ErrJobDropped {
+		t.Errorf("Wrong error: %v != %v", err, ErrJobDropped)
+	}
+
+	release()
+	results, err := WaitAll(context.Background(), urgent, newest)
+	if err != nil {
+		t.Fatalf("Failed to process: %v", err)
+	}
+	if results[0] != 1 || results[1] != 3 {
+		t.Errorf("Wrong results: %v", results)
+	}
+}
+
+func TestPriorityQueueCancel(t *testing.T) {
+	pool, _, release := gatedPool(t)
+	defer pool.Close()
+	defer release()
+
+	// A pending job fails once canceled, though no worker is free.
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := pool.SubmitPriority(ctx, PriorityNormal, 1)
+	kept := pool.SubmitPriority(context.Background(), PriorityNormal, 2)
+	cancel()
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), wait.ForeverTestTimeout)
+	defer waitCancel()
+	if _, err := canceled.WaitCtx(waitCtx); err != context.Canceled {
+		t.Errorf("Wrong error: %v != %v", err, context.Canceled)
+	}
+	if exp, act := int64(1), pool.PriorityQueueLength(PriorityNormal); exp != act {
+		t.Errorf("Wrong queue length: %v != %v", act, exp)
+	}
+	if _, err := kept.Result(); err != ErrFutureNotDone {
+		t.Errorf("Wrong error: %v != %v", err, ErrFutureNotDone)
+	}
+}
+
+func TestPriorityQueueBlock(t *testing.T) {
+	pool, _, release := gatedPool(t)
+
+	pool.SetQueueConfig(QueueConfig{MaxPending: 1})
+	first := pool.SubmitPriority(context.Background(), PriorityNormal, 1)
+	blocked := make(chan *Future)
+	go func() {
+		blocked <- pool.SubmitPriority(context.Background(), PriorityNormal, 2)
+	}()
+	select {
+	case <-blocked:
+		t.Fatalf("SubmitPriority did not block on a full queue")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	release()
+	second := <-blocked
+	results, err := WaitAll(context.Background(), first, second)
+	if err != nil {
+		t.Fatalf("Failed to process: %v", err)
+	}
+	if results[0] != 1 || results[1] != 2 {
+		t.Errorf("Wrong results: %v", results)
+	}
+
+	pool.Close()
+	if _, err := pool.SubmitPriority(context.Background(), PriorityHigh, 3).Result(); err != ErrPoolNotRunning {
+		t.Errorf("Wrong error: %v != %v", err, ErrPoolNotRunning)
+	}
+}
+
+type typedTestWorker struct {
+	terminated *int32
+}
+
+func (w *typedTestWorker) Process(in string) (int, error) {
+	switch in {
+	case "":
+		return 0, ErrJobNotFunc
+	case "panic":
+		panic("boom")
+	}
+	return len(in), nil
+}
+
+func (w *typedTestWorker) BlockUntilReady() {}
+func (w *typedTestWorker) Interrupt()       {}
+func (w *typedTestWorker) Terminate()       { atomic.AddInt32(w.terminated, 1) }
+
+func TestTypedPool(t *testing.T) {
+	var terminated int32
+	pool := NewTyped(2, func() TypedWorker[string, int] {
+		return &typedTestWorker{terminated: &terminated}
+	})
+	pool.OnPanic(func(*JobPanicError) {})
+
+	if out, err := pool.Process("foo"); out != 3 || err != nil {
+		t.Errorf("Wrong result: %v, %v != 3, nil", out, err)
+	}
+	if _, err := pool.Process(""); err != ErrJobNotFunc {
+		t.Errorf("Wrong error: %v != %v", err, ErrJobNotFunc)
+	}
+	if _, err := pool.ProcessTimed("panic", wait.ForeverTestTimeout); err == nil {
+		t.Errorf("Expected a panic error")
+	} else if _, ok := err.(*JobPanicError); !ok {
+		t.Errorf("Wrong error: %v is not a *JobPanicError", err)
+	}
+	if out, err := pool.ProcessCtx(context.Background(), "foobar"); out != 6 || err != nil {
+		t.Errorf("Wrong result: %v, %v != 6, nil", out, err)
+	}
+
+	futures := []*TypedFuture[int]{
+		pool.Submit(context.Background(), "a"),
+		pool.SubmitPriority(context.Background(), PriorityHigh, "ab"),
+		pool.Submit(context.Background(), ""),
+	}
+	for i, exp := range []int{1, 2, 0} {
+		out, err := futures[i].Wait()
+		if out != exp {
+			t.Errorf("%d: Wrong result: %v != %v", i, out, exp)
+		}
+		if (err != nil) != (i == 2) {
+			t.Errorf("%d: Unexpected error: %v", i, err)
+		}
+	}
+	if _, _, err := WaitAny(context.Background(), futures[0].Future()); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	pool.Close()
+	if _, err := pool.Process("foo"); err != ErrPoolNotRunning {
+		t.Errorf("Wrong error: %v != %v", err, ErrPoolNotRunning)
+	}
+	if exp, act := int32(3), atomic.LoadInt32(&terminated); exp != act {
+		t.Errorf("Wrong number of workers terminated: %v != %v", act, exp)
+	}
+}
+
+func TestTypedFuncPool(t *testing.T) {
+	pool := NewTypedFunc(4, func(in []int) (int, error) {
+		sum := 0
+		for _, i := range in {
+			sum += i
+		}
+		return sum, nil
+	})
+	defer pool.Close()
+
+	if out, err := pool.Process([]int{1, 2, 3}); out != 6 || err != nil {
+		t.Errorf("Wrong result: %v, %v != 6, nil", out, err)
+	}
+	if out, err := pool.Process(nil); out != 0 || err != nil {
+		t.Errorf("Wrong result: %v, %v != 0, nil", out, err)
+	}
+}
+
+//------------------------------------------------------------------------------
+
 func BenchmarkFuncJob(b *testing.B) {
 	pool := NewFunc(10, func(in interface{}) interface{} {
 		intVal := in.(int)
@@ -0,0 +1,410 @@
+/*
+
+Copyright 2021-2022 This Project Authors.
+
+Author:  seanchann <seanchann@foxmail.com>
+
+See docs/ for more information about the  project.
+
+*/
+
+package grpool
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+//------------------------------------------------------------------------------
+
+// Priority is the priority class of a job submitted with SubmitPriority.
+type Priority int
+
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+
+	numPriorities = int(PriorityHigh) + 1
+)
+
+// QueueFullPolicy is what SubmitPriority does when the queue is full.
+type QueueFullPolicy int
+
+const (
+	// QueueFullBlock blocks until there is room in the queue.
+	QueueFullBlock QueueFullPolicy = iota
+	// QueueFullFail fails the job with ErrQueueFull.
+	QueueFullFail
+	// QueueFullDropOldest fails the oldest pending job of the lowest priority
+	// holding jobs with ErrJobDropped to make room, so that bulk work does not
+	// evict urgent jobs.
+	QueueFullDropOldest
+)
+
+// DefaultPriorityWeights are the dispatch weights used for the priorities
+// missing from QueueConfig.Weights.
+var DefaultPriorityWeights = map[Priority]int{
+	PriorityLow:    1,
+	PriorityNormal: 4,
+	PriorityHigh:   16,
+}
+
+// QueueConfig configures the queue of the jobs submitted with SubmitPriority.
+type QueueConfig struct {
+	// MaxPending bounds the number of jobs waiting for a worker. Zero means
+	// no bound.
+	MaxPending int
+	// FullPolicy is applied when MaxPending jobs are waiting.
+	FullPolicy QueueFullPolicy
+	// Weights are the shares of the workers the priorities get when jobs
+	// of several priorities are waiting.
+	Weights map[Priority]int
+}
+
+// SetQueueConfig configures the queue of the jobs submitted with
+// SubmitPriority. It applies to the jobs submitted afterwards.
+func (p *Pool) SetQueueConfig(config QueueConfig) {
+	p.priorityQueue().setConfig(config)
+}
+
+// SubmitPriority queues a payload with a priority, and returns a Future for
+// the result of the job. Jobs are handed to the workers by a dispatcher that
+// shares them between priorities according to their weights, and in order
+// within a priority. Jobs submitted without a priority compete with the
+// dispatcher for workers.
+//
+// If the queue is full, the job is handled according to the FullPolicy of
+// the queue. The Future fails with ctx.Err() if ctx is done before the job
+// finished, and with ErrPoolNotRunning if the Pool is closed.
+func (p *Pool) SubmitPriority(ctx context.Context, priority Priority, payload interface{}) *Future {
+	if priority < PriorityLow {
+		priority = PriorityLow
+	} else if priority > PriorityHigh {
+		priority = PriorityHigh
+	}
+
+	f := newFuture()
+	job := &priorityJob{ctx: ctx, priority: priority, payload: payload, future: f}
+	if err := p.priorityQueue().add(job); err != nil {
+		f.resolve(nil, err)
+	}
+	return f
+}
+
+// PriorityQueueLength returns the current count of jobs of a priority that
+// were submitted with SubmitPriority and are not finished yet.
+func (p *Pool) PriorityQueueLength(priority Priority) int64 {
+	if priority < PriorityLow || priority > PriorityHigh {
+		return 0
+	}
+	return atomic.LoadInt64(&p.priorityQueue().lengths[priority])
+}
+
+func (p *Pool) priorityQueue() *priorityQueue {
+	p.queueOnce.Do(func() {
+		p.queue = &priorityQueue{
+			pool:    p,
+			changed: make(chan struct{}),
+		}
+		p.queue.setConfig(QueueConfig{})
+	})
+	return p.queue
+}
+
+//------------------------------------------------------------------------------
+
+type priorityJob struct {
+	ctx      context.Context
+	priority Priority
+	payload  interface{}
+	future   *Future
+	seq      uint64
+	queued   jobWait
+	// dequeued, if set, is closed once the job leaves the queue.
+	dequeued chan struct{}
+}
+
+// priorityQueue holds the jobs submitted with a priority and dispatches them
+// to the workers of its pool.
+type priorityQueue struct {
+	// lengths count the unfinished jobs per priority, accessed atomically.
+	lengths [numPriorities]int64
+
+	pool *Pool
+
+	lock       sync.Mutex
+	maxPending int
+	fullPolicy QueueFullPolicy
+	weights    [numPriorities]int
+	lanes      [numPriorities][]*priorityJob
+	pending    int
+	seq        uint64
+	// current is the state of the smooth weighted round robin between lanes.
+	current [numPriorities]int
+	// changed is closed and replaced whenever jobs are added or removed.
+	changed chan struct{}
+	started bool
+	closed  bool
+}
+
+func (q *priorityQueue) setConfig(config QueueConfig) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.maxPending = config.MaxPending
+	q.fullPolicy = config.FullPolicy
+	for i := range q.weights {
+		weight, ok := config.Weights[Priority(i)]
+		if !ok {
+			weight = DefaultPriorityWeights[Priority(i)]
+		}
+		if weight < 1 {
+			weight = 1
+		}
+		q.weights[i] = weight
+	}
+	q.notify()
+}
+
+// notify wakes up the goroutines waiting for the queue to change. It must be
+// called with the lock held.
+func (q *priorityQueue) notify() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// add queues a job, applying the full policy if needed.
+func (q *priorityQueue) add(job *priorityJob) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for {
+		if q.closed {
+			return ErrPoolNotRunning
+		}
+		if q.maxPending <= 0 || q.pending < q.maxPending {
+			break
+		}
+		q.purge()
+		if q.pending < q.maxPending {
+			break
+		}
+
+		switch q.fullPolicy {
+		case QueueFullFail:
+			return ErrQueueFull
+		case QueueFullDropOldest:
+			q.fail(q.pop(q.lowest()), ErrJobDropped)
+			continue
+		}
+
+		changed := q.changed
+		q.lock.Unlock()
+		select {
+		case <-changed:
+			q.lock.Lock()
+		case <-job.ctx.Done():
+			q.lock.Lock()
+			return job.ctx.Err()
+		}
+	}
+
+	q.seq++
+	job.seq = q.seq
+	job.queued = q.pool.beginWait()
+	if job.ctx.Done() != nil {
+		job.dequeued = make(chan struct{})
+		go q.watch(job)
+	}
+	q.lanes[job.priority] = append(q.lanes[job.priority], job)
+	q.pending++
+	atomic.AddInt64(&q.pool.pendingJobs, 1)
+	atomic.AddInt64(&q.pool.queuedJobs, 1)
+	atomic.AddInt64(&q.lengths[job.priority], 1)
+	q.notify()
+
+	if !q.started {
+		q.started = true
+		go q.run()
+	}
+	return nil
+}
+
+// watch fails a pending job as soon as its context is done, rather than when
+// the dispatcher gets to it.
+func (q *priorityQueue) watch(job *priorityJob) {
+	select {
+	case <-job.ctx.Done():
+		q.lock.Lock()
+		defer q.lock.Unlock()
+		q.purge()
+	case <-job.dequeued:
+	}
+}
+
+// close fails the pending jobs and stops the dispatcher.
+func (q *priorityQueue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.closed = true
+	for i := range q.lanes {
+		for len(q.lanes[i]) > 0 {
+			q.fail(q.pop(Priority(i)), ErrPoolNotRunning)
+		}
+	}
+	q.notify()
+}
+
+// run dispatches the pending jobs to the workers until the queue is closed.
+func (q *priorityQueue) run() {
+	for {
+		q.lock.Lock()
+		for q.pending == 0 && !q.closed {
+			changed := q.changed
+			q.lock.Unlock()
+			<-changed
+			q.lock.Lock()
+		}
+		closed := q.closed
+		q.lock.Unlock()
+		if closed {
+			return
+		}
+
+		request, open := <-q.pool.reqChan
+		if !open {
+			q.close()
+			return
+		}
+
+		job := q.next()
+		if job == nil {
+			// Every pending job was canceled while waiting for a worker.
+			request.interruptFunc()
+			continue
+		}
+		q.pool.recordWait(job.queued)
+
+		request.jobChan <- jobData{
+			ctx:          job.ctx,
+			payload:      job.payload,
+			asyncProcess: true,
+			asyncJobComplete: func(result interface{}, err error) {
+				q.finish(job)
+				job.future.resolve(result, err)
+			},
+		}
+	}
+}
+
+// next removes the next job to dispatch from the queue, failing the canceled
+// ones it meets.
+func (q *priorityQueue) next() *priorityJob {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for q.pending > 0 {
+		job := q.pop(q.pick())
+		if err := job.ctx.Err(); err != nil {
+			q.fail(job, err)
+			continue
+		}
+		return job
+	}
+	return nil
+}
+
+// pick chooses the lane to dispatch from with a smooth weighted round robin
+// between the lanes holding jobs. It must be called with the lock held and
+// jobs pending.
+func (q *priorityQueue) pick() Priority {
+	total, best := 0, -1
+	for i := range q.lanes {
+		if len(q.lanes[i]) == 0 {
+			q.current[i] = 0
+			continue
+		}
+		q.current[i] += q.weights[i]
+		total += q.weights[i]
+		if best < 0 || q.current[i] >= q.current[best] {
+			best = i
+		}
+	}
+	q.current[best] -= total
+	return Priority(best)
+}
+
+// lowest returns the lowest priority holding pending jobs. It must be called
+// with the lock held and jobs pending.
+func (q *priorityQueue) lowest() Priority {
+	for i := range q.lanes {
+		if len(q.lanes[i]) > 0 {
+			return Priority(i)
+		}
+	}
+	panic("grpool: no pending job")
+}
+
+// purge fails the pending jobs whose context is done. It must be called with
+// the lock held.
+func (q *priorityQueue) purge() {
+	purged := 0
+	for i := range q.lanes {
+		kept := q.lanes[i][:0]
+		for _, job := range q.lanes[i] {
+			if err := job.ctx.Err(); err != nil {
+				job.dequeue()
+				q.fail(job, err)
+				purged++
+				continue
+			}
+			kept = append(kept, job)
+		}
+		for j := len(kept); j < len(q.lanes[i]); j++ {
+			q.lanes[i][j] = nil
+		}
+		q.lanes[i] = kept
+	}
+	if purged > 0 {
+		q.pending -= purged
+		atomic.AddInt64(&q.pool.pendingJobs, -int64(purged))
+		q.notify()
+	}
+}
+
+// pop removes the first job of a lane. It must be called with the lock held.
+func (q *priorityQueue) pop(priority Priority) *priorityJob {
+	lane := q.lanes[priority]
+	job := lane[0]
+	lane[0] = nil
+	q.lanes[priority] = lane[1:]
+	job.dequeue()
+	q.pending--
+	atomic.AddInt64(&q.pool.pendingJobs, -1)
+	q.notify()
+	return job
+}
+
+// dequeue stops watching the context of a job removed from the queue.
+func (job *priorityJob) dequeue() {
+	if job.dequeued != nil {
+		close(job.dequeued)
+	}
+}
+
+// fail resolves a job removed from the queue with err.
+func (q *priorityQueue) fail(job *priorityJob, err error) {
+	q.finish(job)
+	job.future.resolve(nil, err)
+}
+
+// finish accounts for a job that is over.
+func (q *priorityQueue) finish(job *priorityJob) {
+	atomic.AddInt64(&q.pool.queuedJobs, -1)
+	atomic.AddInt64(&q.lengths[job.priority], -1)
+}
+
+//------------------------------------------------------------------------------
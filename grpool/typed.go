@@ -0,0 +1,205 @@
+/*
+
+Copyright 2021-2022 This Project Authors.
+
+Author:  seanchann <seanchann@foxmail.com>
+
+See docs/ for more information about the  project.
+
+*/
+
+package grpool
+
+import (
+	"context"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+
+// TypedWorker is a Worker processing jobs of type In into results of type
+// Out. The methods other than Process have the semantics of those of Worker.
+type TypedWorker[In, Out any] interface {
+	// Process will synchronously perform a job and return the result.
+	Process(In) (Out, error)
+
+	BlockUntilReady()
+	Interrupt()
+	Terminate()
+}
+
+// typedResult carries the result of a TypedWorker through a Pool.
+type typedResult[Out any] struct {
+	out Out
+	err error
+}
+
+// typedWorker adapts a TypedWorker to the Worker interface.
+type typedWorker[In, Out any] struct {
+	TypedWorker[In, Out]
+}
+
+func (w typedWorker[In, Out]) Process(payload interface{}) interface{} {
+	in, _ := payload.(In)
+	out, err := w.TypedWorker.Process(in)
+	return typedResult[Out]{out: out, err: err}
+}
+
+// typedFuncWorker is a minimal TypedWorker implementation that simply wraps
+// a func(In) (Out, error).
+type typedFuncWorker[In, Out any] struct {
+	processor func(In) (Out, error)
+}
+
+func (w *typedFuncWorker[In, Out]) Process(in In) (Out, error) {
+	return w.processor(in)
+}
+
+func (w *typedFuncWorker[In, Out]) BlockUntilReady() {}
+func (w *typedFuncWorker[In, Out]) Interrupt()       {}
+func (w *typedFuncWorker[In, Out]) Terminate()       {}
+
+//------------------------------------------------------------------------------
+
+// TypedPool is a Pool processing jobs of type In into results of type Out.
+// Errors of the pool, such as ErrPoolNotRunning or a *JobPanicError, and
+// errors of the workers are returned alike.
+type TypedPool[In, Out any] struct {
+	pool *Pool
+}
+
+// NewTyped creates a new TypedPool of workers that starts with n workers,
+// made by ctor as New does.
+func NewTyped[In, Out any](n int, ctor func() TypedWorker[In, Out]) *TypedPool[In, Out] {
+	return &TypedPool[In, Out]{pool: New(n, typedCtor(ctor))}
+}
+
+// NewTypedWithTimeout creates a new TypedPool of workers that starts with n
+// workers, made by ctor, and removes the workers above n idle for idleTime as
+// NewWithTimeout does.
+func NewTypedWithTimeout[In, Out any](n int, ctor func() TypedWorker[In, Out], idleTime time.Duration) *TypedPool[In, Out] {
+	return &TypedPool[In, Out]{pool: NewWithTimeout(n, typedCtor(ctor), idleTime)}
+}
+
+// NewTypedFunc creates a new TypedPool of workers where each worker will
+// process using the provided func.
+func NewTypedFunc[In, Out any](n int, f func(In) (Out, error)) *TypedPool[In, Out] {
+	return NewTyped(n, func() TypedWorker[In, Out] {
+		return &typedFuncWorker[In, Out]{processor: f}
+	})
+}
+
+func typedCtor[In, Out any](ctor func() TypedWorker[In, Out]) func() Worker {
+	return func() Worker {
+		return typedWorker[In, Out]{ctor()}
+	}
+}
+
+// typedOutput extracts the result of a job from what the Pool returned.
+func typedOutput[Out any](result interface{}, err error) (Out, error) {
+	var zero Out
+	if err != nil {
+		return zero, err
+	}
+	switch r := result.(type) {
+	case typedResult[Out]:
+		return r.out, r.err
+	case *JobPanicError:
+		return zero, r
+	}
+	return zero, nil
+}
+
+// Pool returns the underlying Pool, e.g. to drive its size with an
+// Autoscaler.
+func (p *TypedPool[In, Out]) Pool() *Pool {
+	return p.pool
+}
+
+// Process will use the pool to process a job and synchronously return the
+// result. It returns ErrPoolNotRunning once the pool is closed.
+func (p *TypedPool[In, Out]) Process(in In) (Out, error) {
+	return p.ProcessCtx(context.Background(), in)
+}
+
+// ProcessTimed processes a job as Pool.ProcessTimed does.
+func (p *TypedPool[In, Out]) ProcessTimed(in In, timeout time.Duration) (Out, error) {
+	return typedOutput[Out](p.pool.ProcessTimed(in, timeout))
+}
+
+// ProcessCtx processes a job as Pool.ProcessCtx does.
+func (p *TypedPool[In, Out]) ProcessCtx(ctx context.Context, in In) (Out, error) {
+	return typedOutput[Out](p.pool.ProcessCtx(ctx, in))
+}
+
+// Submit submits a job as Pool.Submit does.
+func (p *TypedPool[In, Out]) Submit(ctx context.Context, in In) *TypedFuture[Out] {
+	return &TypedFuture[Out]{future: p.pool.Submit(ctx, in)}
+}
+
+// SubmitPriority submits a job with a priority as Pool.SubmitPriority does.
+func (p *TypedPool[In, Out]) SubmitPriority(ctx context.Context, priority Priority, in In) *TypedFuture[Out] {
+	return &TypedFuture[Out]{future: p.pool.SubmitPriority(ctx, priority, in)}
+}
+
+// OnPanic sets a function called with the error of every job that panics.
+func (p *TypedPool[In, Out]) OnPanic(handler func(err *JobPanicError)) {
+	p.pool.OnPanic(handler)
+}
+
+// QueueLength returns the current count of pending queued jobs.
+func (p *TypedPool[In, Out]) QueueLength() int64 {
+	return p.pool.QueueLength()
+}
+
+// SetSize changes the total number of workers in the pool.
+func (p *TypedPool[In, Out]) SetSize(n int) {
+	p.pool.SetSize(n)
+}
+
+// GetSize returns the current size of the pool.
+func (p *TypedPool[In, Out]) GetSize() int {
+	return p.pool.GetSize()
+}
+
+// Close will terminate all workers and close the job channel of this pool.
+func (p *TypedPool[In, Out]) Close() {
+	p.pool.Close()
+}
+
+//------------------------------------------------------------------------------
+
+// TypedFuture is the handle of a job submitted to a TypedPool.
+type TypedFuture[Out any] struct {
+	future *Future
+}
+
+// Done returns a channel that is closed once the future is done.
+func (f *TypedFuture[Out]) Done() <-chan struct{} {
+	return f.future.Done()
+}
+
+// Wait blocks until the future is done and returns its result.
+func (f *TypedFuture[Out]) Wait() (Out, error) {
+	return typedOutput[Out](f.future.Wait())
+}
+
+// WaitCtx blocks until the future is done and returns its result, or returns
+// ctx.Err() if ctx is done first.
+func (f *TypedFuture[Out]) WaitCtx(ctx context.Context) (Out, error) {
+	return typedOutput[Out](f.future.WaitCtx(ctx))
+}
+
+// Result returns the result of the future without blocking, or
+// ErrFutureNotDone if it is not done yet.
+func (f *TypedFuture[Out]) Result() (Out, error) {
+	return typedOutput[Out](f.future.Result())
+}
+
+// Future returns the untyped Future, e.g. to wait for several futures with
+// WaitAny. Their results are then read with Wait.
+func (f *TypedFuture[Out]) Future() *Future {
+	return f.future
+}
+
+//------------------------------------------------------------------------------
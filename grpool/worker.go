@@ -11,6 +11,10 @@ See docs/ for more information about the  project.
 package grpool
 
 import (
+	"context"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,8 +25,11 @@ type jobData struct {
 	payload interface{}
 	//asyncProcess asyncProcess flag
 	asyncProcess bool
-	//asyncJobComplete 异步处理完成通知回调
-	asyncJobComplete func(result interface{})
+	//asyncJobComplete 异步处理完成通知回调, err is a *JobPanicError if the job panicked,
+	//or the error of ctx if the worker was interrupted
+	asyncJobComplete func(result interface{}, err error)
+	//ctx interrupts the worker when done while processing an async job
+	ctx context.Context
 }
 
 // workRequest is a struct containing context representing a workers intention
@@ -45,7 +52,13 @@ type workRequest struct {
 // and channel arrangement. The workerWrapper is responsible for managing the
 // lifetime of both the Worker and the goroutine.
 type workerWrapper struct {
-	worker       Worker
+	// worker is replaced by one made by ctor when it panics.
+	worker     Worker
+	workerLock sync.Mutex
+	ctor       func() Worker
+	// onPanic is called with the error of every job that panicked.
+	onPanic func(err *JobPanicError)
+
 	idleTime     time.Duration
 	uuid         string
 	idleWorkChan chan<- string
@@ -64,13 +77,16 @@ type workerWrapper struct {
 
 func newWorkerWrapper(
 	reqChan chan<- workRequest,
-	worker Worker,
+	ctor func() Worker,
+	onPanic func(err *JobPanicError),
 	idleTime time.Duration,
 	uuid string,
 	idleWorkChan chan<- string,
 ) *workerWrapper {
 	w := workerWrapper{
-		worker:        worker,
+		worker:        ctor(),
+		ctor:          ctor,
+		onPanic:       onPanic,
 		idleTime:      idleTime,
 		uuid:          uuid,
 		idleWorkChan:  idleWorkChan,
@@ -89,13 +105,33 @@ func newWorkerWrapper(
 
 func (w *workerWrapper) interrupt() {
 	close(w.interruptChan)
-	w.worker.Interrupt()
+	w.currentWorker().Interrupt()
+}
+
+func (w *workerWrapper) currentWorker() Worker {
+	w.workerLock.Lock()
+	defer w.workerLock.Unlock()
+	return w.worker
+}
+
+// replace terminates a worker that panicked and replaces it with a new one.
+func (w *workerWrapper) replace(worker Worker) {
+	func() {
+		defer func() {
+			recover()
+		}()
+		worker.Terminate()
+	}()
+
+	w.workerLock.Lock()
+	defer w.workerLock.Unlock()
+	w.worker = w.ctor()
 }
 
 func (w *workerWrapper) run() {
 	jobChan, retChan := make(chan jobData), make(chan interface{})
 	defer func() {
-		w.worker.Terminate()
+		w.currentWorker().Terminate()
 		close(retChan)
 		close(w.closedChan)
 	}()
@@ -104,7 +140,7 @@ func (w *workerWrapper) run() {
 	defer idleTimeTimer.Stop()
 	for {
 		// NOTE: Blocking here will prevent the worker from closing down.
-		w.worker.BlockUntilReady()
+		w.currentWorker().BlockUntilReady()
 		// timer may be not active and may not fired
 		if !idleTimeTimer.Stop() {
 			select {
@@ -121,17 +157,26 @@ func (w *workerWrapper) run() {
 		}:
 			select {
 			case jobInData := <-jobChan:
-				result := w.worker.Process(jobInData.payload)
-				//result must not be nil. otherelse it will block select
-				if result == nil {
-					result = true
-				}
+				result, interrupted, panicErr := w.process(jobInData)
 
 				if jobInData.asyncProcess {
 					if jobInData.asyncJobComplete != nil {
-						jobInData.asyncJobComplete(result)
+						var err error
+						if panicErr != nil {
+							err = panicErr
+						} else if interrupted {
+							err = jobInData.ctx.Err()
+						}
+						jobInData.asyncJobComplete(result, err)
 					}
 				} else {
+					if panicErr != nil {
+						result = panicErr
+					}
+					//result must not be nil. otherelse it will block select
+					if result == nil {
+						result = true
+					}
 					select {
 					case retChan <- result:
 					case <-w.interruptChan:
@@ -149,6 +194,49 @@ func (w *workerWrapper) run() {
 	}
 }
 
+// process processes a job, interrupting the worker if the job's context is
+// done before it finished, in which case interrupted is true. If the worker
+// panics, the worker is replaced and the panic is returned as a
+// *JobPanicError.
+func (w *workerWrapper) process(job jobData) (result interface{}, interrupted bool, panicErr *JobPanicError) {
+	worker := w.currentWorker()
+	defer func() {
+		if r := recover(); r != nil {
+			panicErr = &JobPanicError{Payload: job.payload, Value: r, Stack: debug.Stack()}
+			w.replace(worker)
+			w.onPanic(panicErr)
+		}
+	}()
+
+	if job.ctx == nil || job.ctx.Done() == nil {
+		return worker.Process(job.payload), false, nil
+	}
+
+	// state is set once, to jobFinished or jobInterrupted, by whichever of
+	// the job and its context is done first.
+	var state int32
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-job.ctx.Done():
+			if atomic.CompareAndSwapInt32(&state, jobRunning, jobInterrupted) {
+				worker.Interrupt()
+			}
+		case <-finished:
+		}
+	}()
+	result = worker.Process(job.payload)
+	return result, !atomic.CompareAndSwapInt32(&state, jobRunning, jobFinished), nil
+}
+
+// The states of a job processed with a context.
+const (
+	jobRunning int32 = iota
+	jobFinished
+	jobInterrupted
+)
+
 //------------------------------------------------------------------------------
 
 func (w *workerWrapper) stop() {
@@ -0,0 +1,277 @@
+/*
+Copyright 2015 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package h2
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/commcos/utils/httpstream"
+	"golang.org/x/net/http2"
+)
+
+// clientConnection is the client side of a connection. It owns a dedicated
+// HTTP/2 client connection and the control stream that established it.
+type clientConnection struct {
+	// nextID is accessed atomically.
+	nextID uint32
+
+	cc       *http2.ClientConn
+	template *http.Request
+	control  io.ReadCloser
+	writer   *io.PipeWriter
+	cancel   context.CancelFunc
+
+	streamLock sync.Mutex
+	streams    map[uint32]*clientStream
+
+	closeOnce sync.Once
+	closeChan chan bool
+	idle      idleTimer
+}
+
+var _ httpstream.Connection = &clientConnection{}
+
+func newClientConnection(cc *http2.ClientConn, template *http.Request, control io.ReadCloser, writer *io.PipeWriter, cancel context.CancelFunc) *clientConnection {
+	c := &clientConnection{
+		cc:        cc,
+		template:  template,
+		control:   control,
+		writer:    writer,
+		cancel:    cancel,
+		streams:   make(map[uint32]*clientStream),
+		closeChan: make(chan bool),
+	}
+	c.idle.onIdle = func() { c.Close() }
+	go c.watchControl()
+	return c
+}
+
+// watchControl closes the connection once the server ends the control
+// stream.
+func (c *clientConnection) watchControl() {
+	io.Copy(ioutil.Discard, c.control)
+	c.Close()
+}
+
+// CreateStream opens a new stream with the specified headers and registers
+// it with the connection.
+func (c *clientConnection) CreateStream(headers http.Header) (httpstream.Stream, error) {
+	select {
+	case <-c.closeChan:
+		return nil, ErrConnectionClosed
+	default:
+	}
+
+	id := atomic.AddUint32(&c.nextID, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, writer := io.Pipe()
+	req := c.template.Clone(ctx)
+	for k, v := range headers {
+		req.Header[k] = append([]string(nil), v...)
+	}
+	req.Header.Set(HeaderStreamID, strconv.FormatUint(uint64(id), 10))
+	req.Body = reader
+
+	timer := time.AfterFunc(createStreamResponseTimeout, cancel)
+	resp, err := c.cc.RoundTrip(req)
+	timer.Stop()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer cancel()
+		defer resp.Body.Close()
+		responseError, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create stream: %s", resp.Status)
+		}
+		return nil, fmt.Errorf("unable to create stream: %s", strings.TrimSpace(string(responseError)))
+	}
+
+	s := &clientStream{
+		conn:    c,
+		id:      id,
+		headers: headers,
+		writer:  writer,
+		body:    resp.Body,
+		cancel:  cancel,
+	}
+	c.streamLock.Lock()
+	c.streams[id] = s
+	c.streamLock.Unlock()
+	c.idle.touch()
+	return s, nil
+}
+
+// Close resets all of the connection's streams, and then closes the
+// underlying HTTP/2 connection.
+func (c *clientConnection) Close() error {
+	c.closeOnce.Do(func() {
+		c.streamLock.Lock()
+		streams := c.streams
+		c.streams = make(map[uint32]*clientStream)
+		c.streamLock.Unlock()
+		for _, s := range streams {
+			s.Reset()
+		}
+
+		c.idle.stop()
+		c.writer.Close()
+		c.cancel()
+		c.cc.Close()
+		close(c.closeChan)
+	})
+	return nil
+}
+
+// CloseChan returns a channel that is closed when the connection is closed.
+func (c *clientConnection) CloseChan() <-chan bool {
+	return c.closeChan
+}
+
+// SetIdleTimeout sets the amount of time the connection may remain idle before
+// it is automatically closed.
+func (c *clientConnection) SetIdleTimeout(timeout time.Duration) {
+	c.idle.set(timeout)
+}
+
+// RemoveStreams can be used to remove a set of streams from the Connection.
+func (c *clientConnection) RemoveStreams(streams ...httpstream.Stream) {
+	c.streamLock.Lock()
+	for _, stream := range streams {
+		// It may be possible that the provided stream is nil if timed out.
+		if stream != nil {
+			delete(c.streams, stream.Identifier())
+		}
+	}
+	c.streamLock.Unlock()
+}
+
+// clientStream is the client side of a stream. Data written by the client is
+// the body of the CONNECT request, and data sent by the server is read from
+// the frames of the response body.
+type clientStream struct {
+	conn    *clientConnection
+	id      uint32
+	headers http.Header
+	writer  *io.PipeWriter
+	body    io.ReadCloser
+	cancel  context.CancelFunc
+
+	// reset is set atomically once the stream was reset locally.
+	reset int32
+
+	// readLock guards remaining and fin.
+	readLock  sync.Mutex
+	remaining uint32
+	fin       bool
+}
+
+var _ httpstream.Stream = &clientStream{}
+
+// Read reads data sent by the server, returning io.EOF once the server has
+// closed the stream or the stream has been reset locally.
+func (s *clientStream) Read(p []byte) (int, error) {
+	n, err := s.read(p)
+	if err != nil && err != io.EOF && atomic.LoadInt32(&s.reset) == 1 {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (s *clientStream) read(p []byte) (int, error) {
+	s.readLock.Lock()
+	defer s.readLock.Unlock()
+
+	for s.remaining == 0 {
+		if s.fin {
+			return 0, io.EOF
+		}
+		var header [frameHeaderLen]byte
+		if _, err := io.ReadFull(s.body, header[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = ErrStreamReset
+			}
+			return 0, err
+		}
+		s.remaining = binary.BigEndian.Uint32(header[:])
+		if s.remaining == 0 {
+			s.fin = true
+			return 0, io.EOF
+		}
+	}
+
+	if uint32(len(p)) > s.remaining {
+		p = p[:s.remaining]
+	}
+	n, err := s.body.Read(p)
+	s.remaining -= uint32(n)
+	if n > 0 {
+		s.conn.idle.touch()
+	}
+	if err == io.EOF {
+		if n == 0 {
+			return 0, ErrStreamReset
+		}
+		err = nil
+	}
+	return n, err
+}
+
+// Write sends data to the server.
+func (s *clientStream) Write(p []byte) (int, error) {
+	n, err := s.writer.Write(p)
+	if n > 0 {
+		s.conn.idle.touch()
+	}
+	return n, err
+}
+
+// Close half-closes the stream, ending the CONNECT request body.
+func (s *clientStream) Close() error {
+	return s.writer.Close()
+}
+
+// Reset closes both directions of the stream by resetting the HTTP/2
+// stream.
+func (s *clientStream) Reset() error {
+	atomic.StoreInt32(&s.reset, 1)
+	s.cancel()
+	s.writer.CloseWithError(ErrStreamReset)
+	return s.body.Close()
+}
+
+// Headers returns the headers used to create the stream.
+func (s *clientStream) Headers() http.Header {
+	return s.headers
+}
+
+// Identifier returns the stream's ID.
+func (s *clientStream) Identifier() uint32 {
+	return s.id
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2015 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package h2
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Protocol is the value of the :protocol pseudo-header sent with every
+	// extended CONNECT request of this package.
+	Protocol = "httpstream"
+	// HeaderSession identifies the connection a CONNECT request belongs to.
+	HeaderSession = "X-Stream-Session"
+	// HeaderStreamID carries the identifier of the stream opened by a CONNECT
+	// request. It is absent from the request establishing the connection.
+	HeaderStreamID = "X-Stream-Id"
+
+	// headerProtocol is the pseudo-header golang.org/x/net/http2 maps to and
+	// from the request headers of an extended CONNECT request.
+	headerProtocol = ":protocol"
+)
+
+// createStreamResponseTimeout indicates how long to wait for the other side to
+// acknowledge the new stream before timing out.
+const createStreamResponseTimeout = 30 * time.Second
+
+var (
+	// ErrStreamReset is returned when reading from a stream that the peer
+	// ended without closing it.
+	ErrStreamReset = errors.New("stream reset by peer")
+	// ErrConnectionClosed is returned when creating a stream on a closed
+	// connection.
+	ErrConnectionClosed = errors.New("connection closed")
+	// ErrServerStreamsNotSupported is returned by CreateStream on the server
+	// side. HTTP/2 only lets clients open streams.
+	ErrServerStreamsNotSupported = errors.New("creating streams from the server side is not supported over HTTP/2")
+)
+
+// isExtendedConnect returns true if req is an extended CONNECT request for
+// Protocol.
+func isExtendedConnect(req *http.Request) bool {
+	return req.Method == http.MethodConnect && req.Header.Get(headerProtocol) == Protocol
+}
+
+// streamHeaders returns the headers of a stream request without the headers
+// this package adds to it.
+func streamHeaders(req *http.Request) http.Header {
+	headers := req.Header.Clone()
+	headers.Del(headerProtocol)
+	headers.Del(HeaderSession)
+	headers.Del(HeaderStreamID)
+	return headers
+}
+
+func parseStreamID(req *http.Request) (uint32, error) {
+	id, err := strconv.ParseUint(req.Header.Get(HeaderStreamID), 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(id), nil
+}
+
+// idleTimer closes a connection that has had no stream activity for a
+// configurable amount of time.
+type idleTimer struct {
+	lock    sync.Mutex
+	timeout time.Duration
+	timer   *time.Timer
+	onIdle  func()
+}
+
+// set changes the idle timeout. A zero timeout disables the timer.
+func (t *idleTimer) set(timeout time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.timeout = timeout
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	if timeout > 0 {
+		t.timer = time.AfterFunc(timeout, t.onIdle)
+	}
+}
+
+// touch records activity, pushing back the idle timeout.
+func (t *idleTimer) touch() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.timer != nil {
+		t.timer.Reset(t.timeout)
+	}
+}
+
+func (t *idleTimer) stop() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+}
@@ -0,0 +1,31 @@
+/*
+Copyright 2015 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package h2 implements httpstream.Connection over HTTP/2 extended CONNECT
+// (RFC 8441). Every httpstream.Stream is carried by its own HTTP/2 stream, so
+// multiplexing, flow control and TLS are provided by the HTTP/2 stack.
+//
+// A connection is established by an extended CONNECT request with the
+// :protocol pseudo-header set to Protocol. Streams are opened by further
+// extended CONNECT requests on the same HTTP/2 connection that carry the
+// connection's HeaderSession and their own HeaderStreamID; the server refuses
+// them on any other connection (see ConnContext). Proxies between client and
+// server must therefore route all requests of a session to the same backend
+// connection.
+//
+// The golang.org/x/net/http2 and net/http servers only accept extended
+// CONNECT requests when the process runs with GODEBUG=http2xconnect=1.
+package h2 // import "github.com/commcos/utils/httpstream/h2"
@@ -0,0 +1,378 @@
+/*
+Copyright 2015 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package h2
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/commcos/utils/httpstream"
+	"github.com/commcos/utils/httpstream/portforward"
+	spdytransport "github.com/commcos/utils/restclient/transport/spdy"
+	"github.com/commcos/utils/wait"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const testProtocol = "test.v1"
+
+// TestMain re-runs the tests with extended CONNECT enabled, since the HTTP/2
+// servers only read the setting from the environment at startup.
+func TestMain(m *testing.M) {
+	const setting = "http2xconnect=1"
+	if strings.Contains(os.Getenv("GODEBUG"), setting) {
+		os.Exit(m.Run())
+	}
+
+	godebug := setting
+	if v := os.Getenv("GODEBUG"); v != "" {
+		godebug = v + "," + setting
+	}
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Env = append(os.Environ(), "GODEBUG="+godebug)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.ExitCode())
+		}
+		fmt.Fprintf(os.Stderr, "unable to re-run tests: %v\n", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// echoHandler is an httpstream.NewStreamHandler that echoes everything it
+// reads, and closes its side once the client closed its own.
+func echoHandler(stream httpstream.Stream, replySent <-chan struct{}) error {
+	if stream.Headers().Get("Reject") != "" {
+		return fmt.Errorf("rejected by request")
+	}
+	go func() {
+		<-replySent
+		io.Copy(stream, stream)
+		stream.Close()
+	}()
+	return nil
+}
+
+// newUpgradeHandler returns a handler that establishes a connection for
+// every request and keeps it until it is closed.
+func newUpgradeHandler(conns chan<- httpstream.Connection) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if _, err := httpstream.Handshake(req, w, []string{testProtocol}); err != nil {
+			return
+		}
+		conn := NewResponseUpgrader().UpgradeResponse(w, req, echoHandler)
+		if conn == nil {
+			return
+		}
+		defer conn.Close()
+		if conns != nil {
+			conns <- conn
+		}
+		<-conn.CloseChan()
+	})
+}
+
+func newH2CServer(handler http.Handler) *httptest.Server {
+	return httptest.NewServer(h2c.NewHandler(NewHandler(handler), &http2.Server{}))
+}
+
+func dial(t *testing.T, rt *RoundTripper, serverURL string) httpstream.Connection {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		t.Fatalf("unable to parse url: %v", err)
+	}
+	conn, protocol, err := spdytransport.NewDialer(rt, &http.Client{Transport: rt}, "POST", u).Dial(testProtocol)
+	if err != nil {
+		t.Fatalf("unable to dial: %v", err)
+	}
+	if protocol != testProtocol {
+		t.Fatalf("expected protocol %q, got %q", testProtocol, protocol)
+	}
+	return conn
+}
+
+func testEcho(t *testing.T, conn httpstream.Connection, count int) {
+	for i := 0; i < count; i++ {
+		stream, err := conn.CreateStream(http.Header{"Index": []string{strconv.Itoa(i)}})
+		if err != nil {
+			t.Fatalf("%d: unable to create stream: %v", i, err)
+		}
+		msg := bytes.Repeat([]byte(fmt.Sprintf("message %d ", i)), 1000)
+		go func() {
+			stream.Write(msg)
+			stream.Close()
+		}()
+		got, err := io.ReadAll(stream)
+		if err != nil {
+			t.Fatalf("%d: unable to read stream: %v", i, err)
+		}
+		if !bytes.Equal(msg, got) {
+			t.Fatalf("%d: expected %d echoed bytes, got %d", i, len(msg), len(got))
+		}
+		conn.RemoveStreams(stream)
+	}
+}
+
+func TestConnectionH2C(t *testing.T) {
+	server := newH2CServer(newUpgradeHandler(nil))
+	defer server.Close()
+
+	conn := dial(t, NewRoundTripper(nil), server.URL)
+	defer conn.Close()
+	testEcho(t, conn, 5)
+}
+
+func TestConnectionTLS(t *testing.T) {
+	server := httptest.NewUnstartedServer(NewHandler(newUpgradeHandler(nil)))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	conn := dial(t, NewRoundTripper(&tls.Config{RootCAs: pool}), server.URL)
+	defer conn.Close()
+	testEcho(t, conn, 2)
+}
+
+func TestStreamRejected(t *testing.T) {
+	server := newH2CServer(newUpgradeHandler(nil))
+	defer server.Close()
+
+	conn := dial(t, NewRoundTripper(nil), server.URL)
+	defer conn.Close()
+	_, err := conn.CreateStream(http.Header{"Reject": []string{"true"}})
+	if err == nil || !strings.Contains(err.Error(), "rejected by request") {
+		t.Fatalf("expected the stream to be rejected, got %v", err)
+	}
+	// The connection remains usable.
+	testEcho(t, conn, 1)
+}
+
+func TestStreamFromOtherConnection(t *testing.T) {
+	h2cServer := newH2CServer(newUpgradeHandler(nil))
+	defer h2cServer.Close()
+	tlsServer := httptest.NewUnstartedServer(NewHandler(newUpgradeHandler(nil)))
+	tlsServer.EnableHTTP2 = true
+	tlsServer.Config.ConnContext = ConnContext
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(tlsServer.Certificate())
+
+	tests := map[string]struct {
+		server    *httptest.Server
+		tlsConfig *tls.Config
+	}{
+		"addresses":   {server: h2cServer},
+		"ConnContext": {server: tlsServer, tlsConfig: &tls.Config{RootCAs: pool}},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			conn := dial(t, NewRoundTripper(test.tlsConfig), test.server.URL)
+			defer conn.Close()
+			other := dial(t, NewRoundTripper(test.tlsConfig), test.server.URL)
+			defer other.Close()
+
+			// Knowing the session of a connection is not enough to open
+			// streams of it from another connection.
+			template := other.(*clientConnection).template
+			template.Header.Set(HeaderSession, conn.(*clientConnection).template.Header.Get(HeaderSession))
+			_, err := other.CreateStream(http.Header{})
+			if err == nil || !strings.Contains(err.Error(), "unknown session") {
+				t.Fatalf("expected an unknown session, got %v", err)
+			}
+			testEcho(t, conn, 1)
+		})
+	}
+}
+
+func TestUpgradeRequiresExtendedConnect(t *testing.T) {
+	server := httptest.NewServer(newUpgradeHandler(nil))
+	defer server.Close()
+
+	req, _ := http.NewRequest("POST", server.URL, nil)
+	req.Header.Set(httpstream.HeaderProtocolVersion, testProtocol)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestCloseFromServer(t *testing.T) {
+	conns := make(chan httpstream.Connection, 1)
+	server := newH2CServer(newUpgradeHandler(conns))
+	defer server.Close()
+
+	conn := dial(t, NewRoundTripper(nil), server.URL)
+	defer conn.Close()
+	stream, err := conn.CreateStream(http.Header{})
+	if err != nil {
+		t.Fatalf("unable to create stream: %v", err)
+	}
+
+	(<-conns).Close()
+	select {
+	case <-conn.CloseChan():
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatalf("timed out waiting for the client connection to close")
+	}
+	// Closing the connection resets its streams, which unblocks readers.
+	if _, err := io.ReadAll(stream); err != nil {
+		t.Fatalf("unexpected error reading a reset stream: %v", err)
+	}
+	if _, err := conn.CreateStream(http.Header{}); err != ErrConnectionClosed {
+		t.Fatalf("expected %v, got %v", ErrConnectionClosed, err)
+	}
+}
+
+func TestCloseFromClient(t *testing.T) {
+	conns := make(chan httpstream.Connection, 1)
+	server := newH2CServer(newUpgradeHandler(conns))
+	defer server.Close()
+
+	conn := dial(t, NewRoundTripper(nil), server.URL)
+	serverConn := <-conns
+	if _, err := serverConn.CreateStream(http.Header{}); err != ErrServerStreamsNotSupported {
+		t.Fatalf("expected %v, got %v", ErrServerStreamsNotSupported, err)
+	}
+
+	conn.Close()
+	select {
+	case <-serverConn.CloseChan():
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatalf("timed out waiting for the server connection to close")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	conns := make(chan httpstream.Connection, 1)
+	server := newH2CServer(newUpgradeHandler(conns))
+	defer server.Close()
+
+	conn := dial(t, NewRoundTripper(nil), server.URL)
+	defer conn.Close()
+	(<-conns).SetIdleTimeout(50 * time.Millisecond)
+
+	select {
+	case <-conn.CloseChan():
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatalf("timed out waiting for the idle connection to close")
+	}
+}
+
+func TestPortForward(t *testing.T) {
+	backend, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	port := backend.Addr().(*net.TCPAddr).Port
+
+	server := newH2CServer(portforward.NewHandler(portforward.NewDialForwarder("127.0.0.1", nil), &portforward.ServerOptions{
+		Upgrader: NewResponseUpgrader(),
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	rt := NewRoundTripper(nil)
+	stopChan := make(chan struct{})
+	readyChan := make(chan struct{})
+	pf, err := portforward.NewOnAddresses(spdytransport.NewDialer(rt, &http.Client{Transport: rt}, "POST", u),
+		[]string{"127.0.0.1"}, []string{fmt.Sprintf(":%d", port)}, stopChan, readyChan, io.Discard, io.Discard)
+	if err != nil {
+		t.Fatalf("unable to create port forwarder: %v", err)
+	}
+	doneChan := make(chan error, 1)
+	go func() { doneChan <- pf.ForwardPorts() }()
+
+	select {
+	case <-readyChan:
+	case err := <-doneChan:
+		t.Fatalf("port forwarder exited early: %v", err)
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatalf("timed out waiting for the port forwarder")
+	}
+	ports, err := pf.GetPorts()
+	if err != nil {
+		t.Fatalf("unable to get ports: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(ports[0].Local))))
+		if err != nil {
+			t.Fatalf("unable to dial forwarded port: %v", err)
+		}
+		conn.SetDeadline(time.Now().Add(wait.ForeverTestTimeout))
+		msg := []byte(fmt.Sprintf("hello %d", i))
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatalf("unable to write: %v", err)
+		}
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatalf("unable to read: %v", err)
+		}
+		if !bytes.Equal(msg, got) {
+			t.Fatalf("expected %q, got %q", msg, got)
+		}
+		conn.Close()
+	}
+
+	close(stopChan)
+	select {
+	case err := <-doneChan:
+		if err != nil {
+			t.Fatalf("unexpected error from ForwardPorts: %v", err)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatalf("timed out waiting for ForwardPorts to return")
+	}
+}
@@ -0,0 +1,238 @@
+/*
+Copyright 2015 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package h2
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/commcos/utils/httpstream"
+	utilnet "github.com/commcos/utils/net"
+	"github.com/commcos/utils/third_party/forked/golang/netutil"
+	"github.com/google/uuid"
+	"golang.org/x/net/http2"
+)
+
+// RoundTripper knows how to establish an httpstream.Connection over HTTP/2
+// extended CONNECT. Every RoundTrip dials a dedicated HTTP/2 connection, and
+// the streams of the resulting httpstream.Connection all share it.
+// RoundTripper implements the UpgradeRoundTripper interface.
+//
+// https URLs are dialed with TLS and ALPN; http URLs use HTTP/2 with prior
+// knowledge (h2c).
+type RoundTripper struct {
+	// tlsConfig holds the TLS configuration settings to use when connecting
+	// to the remote server.
+	tlsConfig *tls.Config
+
+	// transport configures the HTTP/2 client connections.
+	transport *http2.Transport
+
+	// Dialer is the dialer used to connect.  Used if non-nil.
+	Dialer *net.Dialer
+
+	// lock guards conn, which holds the connection established by the last
+	// successful RoundTrip until NewConnection picks it up.
+	lock sync.Mutex
+	conn *clientConnection
+}
+
+var _ utilnet.TLSClientConfigHolder = &RoundTripper{}
+var _ httpstream.UpgradeRoundTripper = &RoundTripper{}
+
+// RoundTripperConfig is a set of options for a RoundTripper.
+type RoundTripperConfig struct {
+	// TLS configuration used for https URLs. NextProtos is always set to h2.
+	TLS *tls.Config
+	// Transport configures the HTTP/2 client connections, for instance
+	// ReadIdleTimeout to enable health check pings. Its TLS and dial settings
+	// are not used. Optional.
+	Transport *http2.Transport
+}
+
+// NewRoundTripper creates a new RoundTripper that will use the specified
+// tlsConfig.
+func NewRoundTripper(tlsConfig *tls.Config) *RoundTripper {
+	return NewRoundTripperWithConfig(RoundTripperConfig{
+		TLS: tlsConfig,
+	})
+}
+
+// NewRoundTripperWithConfig creates a new RoundTripper with the specified
+// configuration.
+func NewRoundTripperWithConfig(cfg RoundTripperConfig) *RoundTripper {
+	transport := cfg.Transport
+	if transport == nil {
+		transport = &http2.Transport{}
+	}
+	return &RoundTripper{
+		tlsConfig: cfg.TLS,
+		transport: transport,
+	}
+}
+
+// TLSClientConfig implements pkg/util/net.TLSClientConfigHolder for proper TLS checking during
+// proxying with an HTTP/2 round tripper.
+func (rt *RoundTripper) TLSClientConfig() *tls.Config {
+	return rt.tlsConfig
+}
+
+// RoundTrip dials the server and sends req as the extended CONNECT request
+// establishing a connection. After a successful RoundTrip, clients may call
+// NewConnection to retrieve the connection. The returned response's body is
+// empty, as the underlying HTTP/2 stream stays open for the lifetime of the
+// connection.
+func (rt *RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	netConn, err := rt.dial(req)
+	if err != nil {
+		return nil, err
+	}
+	cc, err := rt.transport.NewClientConn(netConn)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	template := utilnet.CloneRequest(req)
+	template.Method = http.MethodConnect
+	template.Body = nil
+	template.ContentLength = 0
+	template.Header[headerProtocol] = []string{Protocol}
+	template.Header.Set(HeaderSession, uuid.New().String())
+	template.Header.Del(HeaderStreamID)
+
+	// The control stream lives as long as the connection, so it must not be
+	// bound to req's context once the connection is established.
+	ctx, cancel := context.WithCancel(context.Background())
+	established := make(chan struct{})
+	go func() {
+		select {
+		case <-req.Context().Done():
+			cancel()
+		case <-established:
+		}
+	}()
+	reader, writer := io.Pipe()
+	control := template.WithContext(ctx)
+	control.Body = reader
+
+	resp, err := cc.RoundTrip(control)
+	close(established)
+	if err != nil {
+		cancel()
+		cc.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		// Buffer the error so that the connection can be released now.
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			body = []byte("unable to read error from server response")
+		}
+		resp.Body.Close()
+		writer.Close()
+		cancel()
+		cc.Close()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		return resp, nil
+	}
+
+	rt.lock.Lock()
+	rt.conn = newClientConnection(cc, template, resp.Body, writer, cancel)
+	rt.lock.Unlock()
+
+	upgraded := *resp
+	upgraded.Body = http.NoBody
+	return &upgraded, nil
+}
+
+// NewConnection validates the response to RoundTrip, creating and returning
+// a new httpstream.Connection if there were no errors.
+func (rt *RoundTripper) NewConnection(resp *http.Response) (httpstream.Connection, error) {
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		responseError := ""
+		responseErrorBytes, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			responseError = "unable to read error from server response"
+		} else {
+			responseError = strings.TrimSpace(string(responseErrorBytes))
+		}
+		return nil, fmt.Errorf("unable to upgrade connection: %s", responseError)
+	}
+
+	rt.lock.Lock()
+	conn := rt.conn
+	rt.conn = nil
+	rt.lock.Unlock()
+	if conn == nil {
+		return nil, fmt.Errorf("unable to upgrade connection: no connection was established")
+	}
+	return conn, nil
+}
+
+// dial opens the network connection for req, negotiating h2 over TLS for
+// https URLs.
+func (rt *RoundTripper) dial(req *http.Request) (net.Conn, error) {
+	dialer := rt.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	dialAddr := netutil.CanonicalAddr(req.URL)
+	conn, err := dialer.DialContext(req.Context(), "tcp", dialAddr)
+	if err != nil {
+		return nil, err
+	}
+	if req.URL.Scheme != "https" {
+		return conn, nil
+	}
+
+	var tlsConfig *tls.Config
+	if rt.tlsConfig != nil {
+		tlsConfig = rt.tlsConfig.Clone()
+	} else {
+		tlsConfig = &tls.Config{}
+	}
+	tlsConfig.NextProtos = []string{http2.NextProtoTLS}
+	if tlsConfig.ServerName == "" {
+		host, _, err := net.SplitHostPort(dialAddr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConfig.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(req.Context()); err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+	if p := tlsConn.ConnectionState().NegotiatedProtocol; p != http2.NextProtoTLS {
+		tlsConn.Close()
+		return nil, fmt.Errorf("unexpected ALPN protocol %q; want %q", p, http2.NextProtoTLS)
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,483 @@
+/*
+Copyright 2015 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package h2
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/commcos/utils/httpstream"
+	"github.com/commcos/utils/logger"
+	"github.com/commcos/utils/runtime"
+)
+
+// frameHeaderLen is the size of the length prefix of the frames the server
+// writes to a stream's response body. A zero length frame tells the client
+// that the server closed its side of the stream, which an HTTP/2 handler
+// cannot express otherwise while it keeps reading the request body.
+const frameHeaderLen = 4
+
+// sessions holds the connections established on this server, indexed by
+// HeaderSession, so that the requests opening their streams can find them.
+var sessions = struct {
+	sync.Mutex
+	m map[string]*serverConnection
+}{m: make(map[string]*serverConnection)}
+
+// connContextKey is the key of the *contextConn stored by ConnContext.
+type connContextKey struct{}
+
+// contextConn is stored by pointer, so that connections compare by identity
+// even if their net.Conn implementation is not comparable.
+type contextConn struct {
+	net.Conn
+}
+
+// ConnContext is meant to be set as the ConnContext of the http.Server
+// serving the connections. It lets the server bind every session to the
+// HTTP/2 connection that established it, so that streams are only opened
+// by requests on that connection. Without it, a connection is identified by
+// the addresses of the request, which a handler rewriting
+// http.Request.RemoteAddr, such as a middleware trusting the
+// X-Forwarded-For header, must not run before.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, &contextConn{c})
+}
+
+// connectionOf returns a value identifying the HTTP/2 connection req was
+// received on.
+func connectionOf(req *http.Request) interface{} {
+	if c := req.Context().Value(connContextKey{}); c != nil {
+		return c
+	}
+	return fmt.Sprintf("%v %s", req.Context().Value(http.LocalAddrContextKey), req.RemoteAddr)
+}
+
+// responseUpgrader knows how to establish connections from extended CONNECT
+// requests. It implements the httpstream.ResponseUpgrader interface.
+type responseUpgrader struct{}
+
+// NewResponseUpgrader returns a new httpstream.ResponseUpgrader that
+// establishes connections from HTTP/2 extended CONNECT requests.
+func NewResponseUpgrader() httpstream.ResponseUpgrader {
+	return responseUpgrader{}
+}
+
+// NewHandler returns an http.Handler that serves the requests opening the
+// streams of established connections, and passes any other request to
+// handler. Wrapping the handler that calls UpgradeResponse this way keeps
+// stream requests from running through it; without the wrapper,
+// UpgradeResponse serves stream requests itself and returns nil.
+func NewHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if isExtendedConnect(req) && req.Header.Get(HeaderStreamID) != "" {
+			serveStream(w, req)
+			return
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// UpgradeResponse establishes a connection from an extended CONNECT request.
+// newStreamHandler will be called synchronously whenever the client opens a
+// new stream. The connection lives until it is closed, the client ends it,
+// or the handler serving req returns.
+func (u responseUpgrader) UpgradeResponse(w http.ResponseWriter, req *http.Request, newStreamHandler httpstream.NewStreamHandler) httpstream.Connection {
+	if !isExtendedConnect(req) {
+		errorMsg := fmt.Sprintf("unable to upgrade: expected an HTTP/2 extended CONNECT request for %q", Protocol)
+		http.Error(w, errorMsg, http.StatusBadRequest)
+		return nil
+	}
+	if req.Header.Get(HeaderStreamID) != "" {
+		serveStream(w, req)
+		return nil
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		errorMsg := "unable to upgrade: unable to flush response"
+		http.Error(w, errorMsg, http.StatusInternalServerError)
+		return nil
+	}
+	session := req.Header.Get(HeaderSession)
+	if len(session) == 0 {
+		errorMsg := fmt.Sprintf("unable to upgrade: %s is required", HeaderSession)
+		http.Error(w, errorMsg, http.StatusBadRequest)
+		return nil
+	}
+
+	c := newServerConnection(session, connectionOf(req), newStreamHandler)
+	sessions.Lock()
+	_, exists := sessions.m[session]
+	if !exists {
+		sessions.m[session] = c
+	}
+	sessions.Unlock()
+	if exists {
+		errorMsg := fmt.Sprintf("unable to upgrade: session %q already exists", session)
+		http.Error(w, errorMsg, http.StatusConflict)
+		return nil
+	}
+
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// The client ends the control stream to close the connection. Reading it
+	// also fails once the handler serving req returns.
+	go func() {
+		io.Copy(ioutil.Discard, req.Body)
+		c.Close()
+	}()
+	return c
+}
+
+// serverConnection is the server side of a connection.
+type serverConnection struct {
+	session string
+	// conn identifies the HTTP/2 connection that established the session,
+	// see connectionOf.
+	conn             interface{}
+	newStreamHandler httpstream.NewStreamHandler
+
+	streamLock sync.Mutex
+	streams    map[uint32]*serverStream
+
+	closeOnce sync.Once
+	closeChan chan bool
+	idle      idleTimer
+}
+
+var _ httpstream.Connection = &serverConnection{}
+
+func newServerConnection(session string, conn interface{}, newStreamHandler httpstream.NewStreamHandler) *serverConnection {
+	c := &serverConnection{
+		session:          session,
+		conn:             conn,
+		newStreamHandler: newStreamHandler,
+		streams:          make(map[uint32]*serverStream),
+		closeChan:        make(chan bool),
+	}
+	c.idle.onIdle = func() { c.Close() }
+	return c
+}
+
+// CreateStream always fails, HTTP/2 does not let servers open streams.
+func (c *serverConnection) CreateStream(headers http.Header) (httpstream.Stream, error) {
+	return nil, ErrServerStreamsNotSupported
+}
+
+// Close resets all of the connection's streams and forgets the session.
+func (c *serverConnection) Close() error {
+	c.closeOnce.Do(func() {
+		sessions.Lock()
+		if sessions.m[c.session] == c {
+			delete(sessions.m, c.session)
+		}
+		sessions.Unlock()
+
+		c.idle.stop()
+		close(c.closeChan)
+	})
+	return nil
+}
+
+// CloseChan returns a channel that is closed when the connection is closed.
+func (c *serverConnection) CloseChan() <-chan bool {
+	return c.closeChan
+}
+
+// SetIdleTimeout sets the amount of time the connection may remain idle before
+// it is automatically closed.
+func (c *serverConnection) SetIdleTimeout(timeout time.Duration) {
+	c.idle.set(timeout)
+}
+
+// RemoveStreams can be used to remove a set of streams from the Connection.
+func (c *serverConnection) RemoveStreams(streams ...httpstream.Stream) {
+	c.streamLock.Lock()
+	for _, stream := range streams {
+		// It may be possible that the provided stream is nil if timed out.
+		if stream != nil {
+			delete(c.streams, stream.Identifier())
+		}
+	}
+	c.streamLock.Unlock()
+}
+
+// serveStream serves a request opening a stream of an established
+// connection. It blocks until the stream is done, since returning ends the
+// HTTP/2 stream. Requests received on another HTTP/2 connection than the
+// one that established the session are refused as if it did not exist.
+func serveStream(w http.ResponseWriter, req *http.Request) {
+	sessions.Lock()
+	c := sessions.m[req.Header.Get(HeaderSession)]
+	sessions.Unlock()
+	if c == nil || c.conn != connectionOf(req) {
+		http.Error(w, "unable to create stream: unknown session", http.StatusNotFound)
+		return
+	}
+	id, err := parseStreamID(req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to create stream: invalid %s: %v", HeaderStreamID, err), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "unable to create stream: unable to flush response", http.StatusInternalServerError)
+		return
+	}
+
+	s := newServerStream(c, id, streamHeaders(req), w, flusher)
+	replySent := make(chan struct{})
+	if err := c.newStreamHandler(s, replySent); err != nil {
+		logger.Logf(logger.WarnLevel, "Stream rejected: %v", err)
+		s.Reset()
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	c.streamLock.Lock()
+	c.streams[id] = s
+	c.streamLock.Unlock()
+	c.idle.touch()
+
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	close(s.ready)
+	close(replySent)
+
+	go s.receive(req.Body)
+
+	select {
+	case <-s.done:
+	case <-c.closeChan:
+		s.Reset()
+	}
+	c.RemoveStreams(s)
+	// Wait for a write in progress, the response writer must not be used
+	// once this returns.
+	s.writeLock.Lock()
+	s.writeLock.Unlock()
+}
+
+// serverStream is the server side of a stream. Data sent by the client is
+// read from the CONNECT request body, and data written by the server is
+// framed into the response body.
+type serverStream struct {
+	conn    *serverConnection
+	id      uint32
+	headers http.Header
+	w       http.ResponseWriter
+	flusher http.Flusher
+
+	// reader is fed from the request body by receive, so that the end of the
+	// client's side is noticed even if nothing reads the stream.
+	reader *io.PipeReader
+	writer *io.PipeWriter
+
+	// ready is closed once the response headers have been sent.
+	ready chan struct{}
+	// done is closed when both sides are closed or the stream is reset.
+	done chan struct{}
+
+	// writeLock serializes the use of w.
+	writeLock sync.Mutex
+
+	lock         sync.Mutex
+	localClosed  bool
+	remoteClosed bool
+	finished     bool
+}
+
+var _ httpstream.Stream = &serverStream{}
+
+func newServerStream(conn *serverConnection, id uint32, headers http.Header, w http.ResponseWriter, flusher http.Flusher) *serverStream {
+	reader, writer := io.Pipe()
+	return &serverStream{
+		conn:    conn,
+		id:      id,
+		headers: headers,
+		w:       w,
+		flusher: flusher,
+		reader:  reader,
+		writer:  writer,
+		ready:   make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// receive copies the request body to the stream's reader until the client
+// closes or resets its side.
+func (s *serverStream) receive(body io.Reader) {
+	if _, err := io.Copy(s.writer, body); err != nil {
+		s.writer.CloseWithError(err)
+		s.finish()
+		return
+	}
+	s.writer.Close()
+	s.closeSide(false)
+}
+
+// Read reads data sent by the client. Once the stream has been reset
+// locally, Read returns io.EOF.
+func (s *serverStream) Read(p []byte) (int, error) {
+	n, err := s.reader.Read(p)
+	if n > 0 {
+		s.conn.idle.touch()
+	}
+	if err == io.ErrClosedPipe {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Write sends data to the client.
+func (s *serverStream) Write(p []byte) (int, error) {
+	if err := s.waitReady(); err != nil {
+		return 0, err
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if s.closed() {
+		return 0, io.ErrClosedPipe
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if err := s.writeFrameHeader(uint32(len(p))); err != nil {
+		return 0, err
+	}
+	n, err := s.w.Write(p)
+	s.flusher.Flush()
+	if n > 0 {
+		s.conn.idle.touch()
+	}
+	return n, err
+}
+
+// Close half-closes the stream, telling the client that no more data will be
+// written.
+func (s *serverStream) Close() error {
+	if err := s.waitReady(); err != nil {
+		return nil
+	}
+	s.writeLock.Lock()
+	if s.closed() {
+		s.writeLock.Unlock()
+		return nil
+	}
+	err := s.writeFrameHeader(0)
+	s.flusher.Flush()
+	s.writeLock.Unlock()
+
+	s.closeSide(true)
+	return err
+}
+
+// Reset closes both directions of the stream by resetting the HTTP/2
+// stream.
+func (s *serverStream) Reset() error {
+	if !s.finish() {
+		return nil
+	}
+	s.reader.Close()
+	// A write deadline in the past makes the HTTP/2 server reset the stream
+	// right away, which also unblocks a write waiting for flow control.
+	if d, ok := s.w.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		select {
+		case <-s.ready:
+			if err := d.SetWriteDeadline(time.Unix(1, 0)); err != nil {
+				runtime.HandleError(fmt.Errorf("unable to reset stream %d: %v", s.id, err))
+			}
+		default:
+		}
+	}
+	return nil
+}
+
+// Headers returns the headers used to create the stream.
+func (s *serverStream) Headers() http.Header {
+	return s.headers
+}
+
+// Identifier returns the stream's ID.
+func (s *serverStream) Identifier() uint32 {
+	return s.id
+}
+
+func (s *serverStream) waitReady() error {
+	select {
+	case <-s.ready:
+		return nil
+	case <-s.done:
+		return io.ErrClosedPipe
+	}
+}
+
+func (s *serverStream) writeFrameHeader(length uint32) error {
+	var header [frameHeaderLen]byte
+	binary.BigEndian.PutUint32(header[:], length)
+	_, err := s.w.Write(header[:])
+	return err
+}
+
+// closed returns true if the server side of the stream can no longer be
+// written to.
+func (s *serverStream) closed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.localClosed || s.finished
+}
+
+// closeSide marks the server or client side of the stream as closed, and
+// finishes the stream when both are.
+func (s *serverStream) closeSide(local bool) {
+	s.lock.Lock()
+	if local {
+		s.localClosed = true
+	} else {
+		s.remoteClosed = true
+	}
+	closed := s.localClosed && s.remoteClosed
+	s.lock.Unlock()
+
+	if closed {
+		s.finish()
+	}
+}
+
+// finish marks the stream as done. It returns false if it already was.
+func (s *serverStream) finish() bool {
+	s.lock.Lock()
+	if s.finished {
+		s.lock.Unlock()
+		return false
+	}
+	s.finished = true
+	s.lock.Unlock()
+
+	close(s.done)
+	return true
+}
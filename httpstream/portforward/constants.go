@@ -0,0 +1,56 @@
+/*
+Copyright 2015 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package portforward
+
+import "time"
+
+const (
+	// PortForwardProtocolV1Name is the subprotocol used for port forwarding.
+	PortForwardProtocolV1Name = "portforward.v1"
+
+	// StreamType is the header that names the purpose of a stream.
+	StreamType = "streamType"
+	// StreamTypeData is the value for the StreamType header of a data stream.
+	StreamTypeData = "data"
+	// StreamTypeError is the value for the StreamType header of an error stream.
+	StreamTypeError = "error"
+
+	// PortHeader is the header that carries the remote port to forward to.
+	PortHeader = "port"
+	// ProtocolHeader is the header that carries the transport protocol of the
+	// forwarded port. A missing header means ProtocolTCP.
+	ProtocolHeader = "protocol"
+	// PortForwardRequestIDHeader is the header that pairs the data and error
+	// streams belonging to the same forwarded connection.
+	PortForwardRequestIDHeader = "requestID"
+
+	// ProtocolTCP forwards a stream oriented port.
+	ProtocolTCP = "tcp"
+	// ProtocolUDP forwards a datagram oriented port. Datagrams are carried
+	// over the data stream with a two byte big endian length prefix.
+	ProtocolUDP = "udp"
+)
+
+const (
+	// DefaultStreamCreationTimeout is how long the server waits for both
+	// streams of a request to arrive before giving up on it.
+	DefaultStreamCreationTimeout = 30 * time.Second
+
+	// DefaultUDPSessionTimeout is how long a UDP session may stay idle before
+	// its streams are torn down.
+	DefaultUDPSessionTimeout = 2 * time.Minute
+)
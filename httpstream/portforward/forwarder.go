@@ -0,0 +1,136 @@
+/*
+Copyright 2015 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package portforward
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/commcos/utils/runtime"
+)
+
+// dialForwarder implements Forwarder by dialing a port on a fixed host.
+type dialForwarder struct {
+	host   string
+	dialer *net.Dialer
+}
+
+var _ Forwarder = &dialForwarder{}
+
+// NewDialForwarder returns a Forwarder that dials the forwarded port on host
+// for every forwarded connection. If dialer is nil a default dialer is used.
+func NewDialForwarder(host string, dialer *net.Dialer) Forwarder {
+	if dialer == nil {
+		dialer = &net.Dialer{Timeout: 30 * time.Second}
+	}
+	return &dialForwarder{host: host, dialer: dialer}
+}
+
+// PortForward is part of the Forwarder interface.
+func (f *dialForwarder) PortForward(ctx context.Context, protocol string, port int32, stream io.ReadWriteCloser) error {
+	addr := net.JoinHostPort(f.host, strconv.Itoa(int(port)))
+	conn, err := f.dialer.DialContext(ctx, protocol, addr)
+	if err != nil {
+		return fmt.Errorf("failed to dial %s/%s: %v", addr, protocol, err)
+	}
+	defer conn.Close()
+
+	if protocol == ProtocolUDP {
+		return forwardDatagrams(ctx, conn, stream)
+	}
+	return forwardStream(ctx, conn, stream)
+}
+
+// forwardStream copies data between conn and stream until either side is
+// done or ctx is cancelled.
+func forwardStream(ctx context.Context, conn net.Conn, stream io.ReadWriteCloser) error {
+	errCh := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(conn, stream)
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			// let the target know the client is done sending
+			tcp.CloseWrite()
+		}
+		errCh <- err
+	}()
+	go func() {
+		_, err := io.Copy(stream, conn)
+		errCh <- err
+	}()
+
+	select {
+	case err := <-errCh:
+		if err != nil && !isClosedConnError(err) {
+			return err
+		}
+		// wait for the other direction, it finishes once the target closes
+		// or the stream is torn down
+		select {
+		case err = <-errCh:
+			if err != nil && !isClosedConnError(err) {
+				return err
+			}
+		case <-ctx.Done():
+		}
+		return nil
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// forwardDatagrams unpacks datagrams from stream and sends them to conn, and
+// packs every datagram received from conn back onto stream.
+func forwardDatagrams(ctx context.Context, conn net.Conn, stream io.ReadWriteCloser) error {
+	go func() {
+		defer runtime.HandleCrash()
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			if err := writeDatagram(stream, buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := readDatagram(stream, buf)
+		if err != nil {
+			if err == io.EOF || isClosedConnError(err) {
+				return nil
+			}
+			return err
+		}
+		if _, err := conn.Write(buf[:n]); err != nil {
+			if isClosedConnError(err) {
+				return nil
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,620 @@
+/*
+Copyright 2015 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package portforward
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/commcos/utils/httpstream"
+	"github.com/commcos/utils/runtime"
+)
+
+// ErrLostConnection is returned by ForwardPorts when the underlying
+// httpstream.Connection is closed before the forwarder is stopped.
+var ErrLostConnection = errors.New("lost connection to remote host")
+
+// PortForwarder knows how to listen for local connections and forward them to
+// a remote host via an upgraded HTTP request.
+type PortForwarder struct {
+	addresses []listenAddress
+	ports     []ForwardedPort
+	stopChan  <-chan struct{}
+
+	dialer        httpstream.Dialer
+	streamConn    httpstream.Connection
+	listenersLock sync.Mutex
+	listeners     []io.Closer
+	handlers      sync.WaitGroup
+	Ready         chan struct{}
+	requestIDLock sync.Mutex
+	requestID     int
+	out           io.Writer
+	errOut        io.Writer
+}
+
+// ForwardedPort contains a Local:Remote port pairing and the transport
+// protocol used to forward it.
+type ForwardedPort struct {
+	Local    uint16
+	Remote   uint16
+	Protocol string
+}
+
+/*
+valid port specifications:
+
+5000
+- forwards from localhost:5000 to remote:5000
+
+8888:5000
+- forwards from localhost:8888 to remote:5000
+
+0:5000
+:5000
+  - selects a random available local port,
+    forwards from localhost:<random port> to remote:5000
+
+5353:53/udp
+- forwards datagrams from localhost:5353 to remote:53
+*/
+func parsePorts(ports []string) ([]ForwardedPort, error) {
+	var forwards []ForwardedPort
+	for _, portString := range ports {
+		protocol := ProtocolTCP
+		if i := strings.LastIndex(portString, "/"); i >= 0 {
+			protocol = strings.ToLower(portString[i+1:])
+			portString = portString[:i]
+			if protocol != ProtocolTCP && protocol != ProtocolUDP {
+				return nil, fmt.Errorf("invalid protocol %q: must be %q or %q", protocol, ProtocolTCP, ProtocolUDP)
+			}
+		}
+
+		parts := strings.Split(portString, ":")
+		var localString, remoteString string
+		if len(parts) == 1 {
+			localString = parts[0]
+			remoteString = parts[0]
+		} else if len(parts) == 2 {
+			localString = parts[0]
+			if localString == "" {
+				// support :5000
+				localString = "0"
+			}
+			remoteString = parts[1]
+		} else {
+			return nil, fmt.Errorf("invalid port format '%s'", portString)
+		}
+
+		localPort, err := strconv.ParseUint(localString, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing local port '%s': %s", localString, err)
+		}
+
+		remotePort, err := strconv.ParseUint(remoteString, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing remote port '%s': %s", remoteString, err)
+		}
+		if remotePort == 0 {
+			return nil, fmt.Errorf("remote port must be > 0")
+		}
+
+		forwards = append(forwards, ForwardedPort{uint16(localPort), uint16(remotePort), protocol})
+	}
+
+	return forwards, nil
+}
+
+type listenAddress struct {
+	address     string
+	family      string
+	failureMode string
+}
+
+func parseAddresses(addressesToParse []string) ([]listenAddress, error) {
+	var addresses []listenAddress
+	parsed := make(map[string]listenAddress)
+	for _, address := range addressesToParse {
+		if address == "localhost" {
+			if _, exists := parsed["127.0.0.1"]; !exists {
+				ip := listenAddress{address: "127.0.0.1", family: "4", failureMode: "all"}
+				parsed[ip.address] = ip
+			}
+			if _, exists := parsed["::1"]; !exists {
+				ip := listenAddress{address: "::1", family: "6", failureMode: "all"}
+				parsed[ip.address] = ip
+			}
+		} else if ip := net.ParseIP(address); ip != nil && ip.To4() != nil {
+			parsed[address] = listenAddress{address: address, family: "4", failureMode: "any"}
+		} else if ip != nil {
+			parsed[address] = listenAddress{address: address, family: "6", failureMode: "any"}
+		} else {
+			return nil, fmt.Errorf("%s is not a valid IP", address)
+		}
+	}
+	addresses = make([]listenAddress, len(parsed))
+	id := 0
+	for _, v := range parsed {
+		addresses[id] = v
+		id++
+	}
+	// Sort addresses before returning to get a stable order
+	sort.Slice(addresses, func(i, j int) bool { return addresses[i].address < addresses[j].address })
+
+	return addresses, nil
+}
+
+// New creates a new PortForwarder with localhost listen addresses.
+func New(dialer httpstream.Dialer, ports []string, stopChan <-chan struct{}, readyChan chan struct{}, out, errOut io.Writer) (*PortForwarder, error) {
+	return NewOnAddresses(dialer, []string{"localhost"}, ports, stopChan, readyChan, out, errOut)
+}
+
+// NewOnAddresses creates a new PortForwarder with custom listen addresses.
+func NewOnAddresses(dialer httpstream.Dialer, addresses []string, ports []string, stopChan <-chan struct{}, readyChan chan struct{}, out, errOut io.Writer) (*PortForwarder, error) {
+	if len(addresses) == 0 {
+		return nil, errors.New("you must specify at least 1 address")
+	}
+	parsedAddresses, err := parseAddresses(addresses)
+	if err != nil {
+		return nil, err
+	}
+	if len(ports) == 0 {
+		return nil, errors.New("you must specify at least 1 port")
+	}
+	parsedPorts, err := parsePorts(ports)
+	if err != nil {
+		return nil, err
+	}
+	return &PortForwarder{
+		dialer:    dialer,
+		addresses: parsedAddresses,
+		ports:     parsedPorts,
+		stopChan:  stopChan,
+		Ready:     readyChan,
+		out:       out,
+		errOut:    errOut,
+	}, nil
+}
+
+// ForwardPorts formats and executes a port forwarding request. The connection
+// will remain open until stopChan is closed. Before returning, all listeners
+// are closed and every in-flight forwarded connection is torn down.
+func (pf *PortForwarder) ForwardPorts() error {
+	var err error
+	pf.streamConn, _, err = pf.dialer.Dial(PortForwardProtocolV1Name)
+	if err != nil {
+		return fmt.Errorf("error upgrading connection: %s", err)
+	}
+	defer func() {
+		pf.Close()
+		pf.streamConn.Close()
+		pf.handlers.Wait()
+	}()
+
+	return pf.forward()
+}
+
+// forward dials the remote host specific in req, upgrades the request, starts
+// listeners for each port specified in ports, and forwards local connections
+// to the remote host via streams.
+func (pf *PortForwarder) forward() error {
+	var err error
+
+	listenSuccess := false
+	for i := range pf.ports {
+		port := &pf.ports[i]
+		err = pf.listenOnPort(port)
+		switch {
+		case err == nil:
+			listenSuccess = true
+		default:
+			if pf.errOut != nil {
+				fmt.Fprintf(pf.errOut, "Unable to listen on port %d: %v\n", port.Local, err)
+			}
+		}
+	}
+
+	if !listenSuccess {
+		return fmt.Errorf("unable to listen on any of the requested ports: %v", pf.ports)
+	}
+
+	if pf.Ready != nil {
+		close(pf.Ready)
+	}
+
+	// wait for interrupt or conn closure
+	select {
+	case <-pf.stopChan:
+	case <-pf.streamConn.CloseChan():
+		return ErrLostConnection
+	}
+
+	return nil
+}
+
+// listenOnPort delegates listener creation and waits for connections on
+// requested bind addresses. An error is raised based on address groups
+// (default and localhost) and their failure modes.
+func (pf *PortForwarder) listenOnPort(port *ForwardedPort) error {
+	var errors []error
+	failCounters := make(map[string]int, 2)
+	successCounters := make(map[string]int, 2)
+	for _, addr := range pf.addresses {
+		err := pf.listenOnPortAndAddress(port, addr.family, addr.address)
+		if err != nil {
+			errors = append(errors, err)
+			failCounters[addr.failureMode]++
+		} else {
+			successCounters[addr.failureMode]++
+		}
+	}
+	if successCounters["all"] == 0 && failCounters["all"] > 0 {
+		return fmt.Errorf("%s: %v", "Listeners failed to create with the following errors", errors)
+	}
+	if failCounters["any"] > 0 {
+		return fmt.Errorf("%s: %v", "Listeners failed to create with the following errors", errors)
+	}
+	return nil
+}
+
+// listenOnPortAndAddress delegates listener creation and waits for new
+// connections in the background.
+func (pf *PortForwarder) listenOnPortAndAddress(port *ForwardedPort, family string, address string) error {
+	network := port.Protocol + family
+	hostPort := net.JoinHostPort(address, strconv.Itoa(int(port.Local)))
+
+	var listener io.Closer
+	var localAddr net.Addr
+	switch port.Protocol {
+	case ProtocolUDP:
+		conn, err := net.ListenPacket(network, hostPort)
+		if err != nil {
+			return fmt.Errorf("unable to create listener: Error %s", err)
+		}
+		listener, localAddr = conn, conn.LocalAddr()
+		defer pf.serve(func() { pf.waitForDatagrams(conn, *port) })
+	default:
+		l, err := net.Listen(network, hostPort)
+		if err != nil {
+			return fmt.Errorf("unable to create listener: Error %s", err)
+		}
+		listener, localAddr = l, l.Addr()
+		defer pf.serve(func() { pf.waitForConnection(l, *port) })
+	}
+
+	if err := pf.recordLocalPort(port, localAddr, address); err != nil {
+		listener.Close()
+		return err
+	}
+
+	pf.listenersLock.Lock()
+	pf.listeners = append(pf.listeners, listener)
+	pf.listenersLock.Unlock()
+	return nil
+}
+
+// serve runs loop in the background, accounting for it in pf.handlers so that
+// ForwardPorts does not return before the loop and everything it started has
+// finished.
+func (pf *PortForwarder) serve(loop func()) {
+	pf.handlers.Add(1)
+	go func() {
+		defer pf.handlers.Done()
+		loop()
+	}()
+}
+
+// recordLocalPort stores the port the listener actually bound to, so that a
+// requested local port of 0 is reported as the selected port.
+func (pf *PortForwarder) recordLocalPort(port *ForwardedPort, localAddr net.Addr, hostname string) error {
+	listenerAddress := localAddr.String()
+	host, localPort, _ := net.SplitHostPort(listenerAddress)
+	localPortUInt, err := strconv.ParseUint(localPort, 10, 16)
+	if err != nil {
+		if pf.out != nil {
+			fmt.Fprintf(pf.out, "Failed to forward from %s:%d -> %d\n", hostname, localPortUInt, port.Remote)
+		}
+		return fmt.Errorf("error parsing local port: %s from %s (%s)", err, listenerAddress, host)
+	}
+	port.Local = uint16(localPortUInt)
+	if pf.out != nil {
+		fmt.Fprintf(pf.out, "Forwarding from %s -> %d/%s\n", net.JoinHostPort(hostname, strconv.Itoa(int(localPortUInt))), port.Remote, port.Protocol)
+	}
+	return nil
+}
+
+// waitForConnection waits for new connections to listener and handles them in
+// the background.
+func (pf *PortForwarder) waitForConnection(listener net.Listener, port ForwardedPort) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			// TODO consider using something like https://github.com/hydrogen18/stoppableListener?
+			if !isClosedConnError(err) {
+				runtime.HandleError(fmt.Errorf("error accepting connection on port %d: %v", port.Local, err))
+			}
+			return
+		}
+		pf.handlers.Add(1)
+		go func() {
+			defer pf.handlers.Done()
+			pf.handleConnection(conn, port)
+		}()
+	}
+}
+
+func (pf *PortForwarder) nextRequestID() int {
+	pf.requestIDLock.Lock()
+	defer pf.requestIDLock.Unlock()
+	id := pf.requestID
+	pf.requestID++
+	return id
+}
+
+// createStreams opens the error and data streams for a single forwarded
+// connection. The returned channel yields at most one error read from the
+// error stream and is closed once the remote side closes it.
+func (pf *PortForwarder) createStreams(port ForwardedPort) (httpstream.Stream, httpstream.Stream, <-chan error, error) {
+	requestID := pf.nextRequestID()
+
+	// create error stream
+	headers := http.Header{}
+	headers.Set(StreamType, StreamTypeError)
+	headers.Set(PortHeader, fmt.Sprintf("%d", port.Remote))
+	headers.Set(ProtocolHeader, port.Protocol)
+	headers.Set(PortForwardRequestIDHeader, strconv.Itoa(requestID))
+	errorStream, err := pf.streamConn.CreateStream(headers)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error creating error stream for port %d -> %d: %v", port.Local, port.Remote, err)
+	}
+	// we're not writing to this stream
+	errorStream.Close()
+
+	errorChan := make(chan error)
+	go func() {
+		message, err := io.ReadAll(errorStream)
+		switch {
+		case err != nil:
+			errorChan <- fmt.Errorf("error reading from error stream for port %d -> %d: %v", port.Local, port.Remote, err)
+		case len(message) > 0:
+			errorChan <- fmt.Errorf("an error occurred forwarding %d -> %d: %v", port.Local, port.Remote, string(message))
+		}
+		close(errorChan)
+	}()
+
+	// create data stream
+	headers.Set(StreamType, StreamTypeData)
+	dataStream, err := pf.streamConn.CreateStream(headers)
+	if err != nil {
+		pf.streamConn.RemoveStreams(errorStream)
+		return nil, nil, nil, fmt.Errorf("error creating forwarding stream for port %d -> %d: %v", port.Local, port.Remote, err)
+	}
+
+	return errorStream, dataStream, errorChan, nil
+}
+
+// handleConnection copies data between the local connection and the stream to
+// the remote server.
+func (pf *PortForwarder) handleConnection(conn net.Conn, port ForwardedPort) {
+	defer conn.Close()
+
+	if pf.out != nil {
+		fmt.Fprintf(pf.out, "Handling connection for %d\n", port.Local)
+	}
+
+	errorStream, dataStream, errorChan, err := pf.createStreams(port)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	defer pf.streamConn.RemoveStreams(errorStream, dataStream)
+
+	localError := make(chan struct{})
+	remoteDone := make(chan struct{})
+
+	go func() {
+		// Copy from the remote side to the local port.
+		if _, err := io.Copy(conn, dataStream); err != nil && !isClosedConnError(err) {
+			runtime.HandleError(fmt.Errorf("error copying from remote stream to local connection: %v", err))
+		}
+
+		// inform the select below that the remote copy is done
+		close(remoteDone)
+	}()
+
+	go func() {
+		// inform server we're not sending any more data after copy unblocks
+		defer dataStream.Close()
+
+		// Copy from the local port to the remote side.
+		if _, err := io.Copy(dataStream, conn); err != nil && !isClosedConnError(err) {
+			runtime.HandleError(fmt.Errorf("error copying from local connection to remote stream: %v", err))
+			// break out of the select below without waiting for the other copy to finish
+			close(localError)
+		}
+	}()
+
+	// wait for either a local->remote error or for copying from remote->local to finish
+	select {
+	case <-remoteDone:
+	case <-localError:
+	}
+
+	// always expect something on errorChan (it may be nil)
+	err = <-errorChan
+	if err != nil {
+		runtime.HandleError(err)
+	}
+}
+
+// waitForDatagrams reads datagrams from conn and forwards each one over the
+// session belonging to its source address, creating the session on first use.
+func (pf *PortForwarder) waitForDatagrams(conn net.PacketConn, port ForwardedPort) {
+	var lock sync.Mutex
+	sessions := make(map[string]*udpSession)
+	defer func() {
+		lock.Lock()
+		defer lock.Unlock()
+		for _, s := range sessions {
+			s.close()
+		}
+	}()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if !isClosedConnError(err) {
+				runtime.HandleError(fmt.Errorf("error reading datagram on port %d: %v", port.Local, err))
+			}
+			return
+		}
+
+		key := addr.String()
+		lock.Lock()
+		s, ok := sessions[key]
+		if !ok {
+			if pf.out != nil {
+				fmt.Fprintf(pf.out, "Handling datagrams from %s for %d\n", key, port.Local)
+			}
+			errorStream, dataStream, errorChan, err := pf.createStreams(port)
+			if err != nil {
+				lock.Unlock()
+				runtime.HandleError(err)
+				continue
+			}
+			s = newUDPSession(errorStream, dataStream)
+			sessions[key] = s
+			pf.handlers.Add(1)
+			go func() {
+				defer pf.handlers.Done()
+				s.relay(conn, addr, errorChan)
+				pf.streamConn.RemoveStreams(errorStream, dataStream)
+				lock.Lock()
+				if sessions[key] == s {
+					delete(sessions, key)
+				}
+				lock.Unlock()
+			}()
+		}
+		lock.Unlock()
+
+		s.touch()
+		if err := writeDatagram(s.dataStream, buf[:n]); err != nil {
+			runtime.HandleError(fmt.Errorf("error forwarding datagram from %s to port %d: %v", key, port.Remote, err))
+			s.close()
+		}
+	}
+}
+
+// udpSession holds the streams carrying the datagrams exchanged with a single
+// local peer.
+type udpSession struct {
+	errorStream httpstream.Stream
+	dataStream  httpstream.Stream
+	idle        *time.Timer
+	closeOnce   sync.Once
+}
+
+func newUDPSession(errorStream, dataStream httpstream.Stream) *udpSession {
+	s := &udpSession{
+		errorStream: errorStream,
+		dataStream:  dataStream,
+	}
+	s.idle = time.AfterFunc(DefaultUDPSessionTimeout, s.close)
+	return s
+}
+
+// touch postpones the idle timeout of the session.
+func (s *udpSession) touch() {
+	s.idle.Reset(DefaultUDPSessionTimeout)
+}
+
+func (s *udpSession) close() {
+	s.closeOnce.Do(func() {
+		s.idle.Stop()
+		s.dataStream.Reset()
+	})
+}
+
+// relay writes every datagram received from the remote side back to addr
+// until the session is closed.
+func (s *udpSession) relay(conn net.PacketConn, addr net.Addr, errorChan <-chan error) {
+	defer s.close()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := readDatagram(s.dataStream, buf)
+		if err != nil {
+			break
+		}
+		s.touch()
+		if _, err := conn.WriteTo(buf[:n], addr); err != nil {
+			if !isClosedConnError(err) {
+				runtime.HandleError(fmt.Errorf("error writing datagram to %s: %v", addr, err))
+			}
+			break
+		}
+	}
+
+	if err := <-errorChan; err != nil {
+		runtime.HandleError(err)
+	}
+}
+
+// Close stops all listeners of PortForwarder.
+func (pf *PortForwarder) Close() {
+	pf.listenersLock.Lock()
+	defer pf.listenersLock.Unlock()
+
+	// stop all listeners
+	for _, l := range pf.listeners {
+		if err := l.Close(); err != nil && !isClosedConnError(err) {
+			runtime.HandleError(fmt.Errorf("error closing listener: %v", err))
+		}
+	}
+	pf.listeners = nil
+}
+
+// GetPorts will return the ports that were forwarded; this can be used to
+// retrieve the locally-bound port in cases where the input was port 0. This
+// function will signal an error if the Ready channel is nil or if the
+// listeners are not ready yet; this function will succeed after the Ready
+// channel has been closed.
+func (pf *PortForwarder) GetPorts() ([]ForwardedPort, error) {
+	if pf.Ready == nil {
+		return nil, fmt.Errorf("no Ready channel provided")
+	}
+	select {
+	case <-pf.Ready:
+		return pf.ports, nil
+	default:
+		return nil, fmt.Errorf("listeners not ready")
+	}
+}
+
+func isClosedConnError(err error) bool {
+	return errors.Is(err, net.ErrClosed) || strings.Contains(strings.ToLower(err.Error()), "use of closed network connection")
+}
@@ -0,0 +1,292 @@
+/*
+Copyright 2015 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package portforward
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/commcos/utils/httpstream"
+	"github.com/commcos/utils/httpstream/spdy"
+	spdytransport "github.com/commcos/utils/restclient/transport/spdy"
+	"github.com/commcos/utils/wait"
+)
+
+func TestParsePortsAndNew(t *testing.T) {
+	tests := []struct {
+		input                   []string
+		addresses               []string
+		expectedPorts           []ForwardedPort
+		expectedAddrs           []listenAddress
+		expectPortParseError    bool
+		expectAddressParseError bool
+	}{
+		{input: []string{"a"}, expectPortParseError: true},
+		{input: []string{":a"}, expectPortParseError: true},
+		{input: []string{"-1"}, expectPortParseError: true},
+		{input: []string{"65536"}, expectPortParseError: true},
+		{input: []string{"0"}, expectPortParseError: true},
+		{input: []string{"0:0"}, expectPortParseError: true},
+		{input: []string{"a:5000"}, expectPortParseError: true},
+		{input: []string{"5000:a"}, expectPortParseError: true},
+		{input: []string{"5000/sctp"}, expectPortParseError: true},
+		{input: []string{"5000:5000"}, addresses: []string{"127.0.0.257"}, expectAddressParseError: true},
+		{input: []string{"5000:5000"}, addresses: []string{"::g"}, expectAddressParseError: true},
+		{input: []string{"5000:5000"}, addresses: []string{"domain.invalid"}, expectAddressParseError: true},
+		{
+			input:     []string{"5000:5000"},
+			addresses: []string{"localhost"},
+			expectedPorts: []ForwardedPort{
+				{5000, 5000, ProtocolTCP},
+			},
+			expectedAddrs: []listenAddress{
+				{family: "4", address: "127.0.0.1", failureMode: "all"},
+				{family: "6", address: "::1", failureMode: "all"},
+			},
+		},
+		{
+			input:     []string{"5000", "5000:5000", "8888:5000", "5000:8888", ":5000", "0:5000", "5353:53/udp", "53/UDP"},
+			addresses: []string{"127.0.0.1", "::1"},
+			expectedPorts: []ForwardedPort{
+				{5000, 5000, ProtocolTCP},
+				{5000, 5000, ProtocolTCP},
+				{8888, 5000, ProtocolTCP},
+				{5000, 8888, ProtocolTCP},
+				{0, 5000, ProtocolTCP},
+				{0, 5000, ProtocolTCP},
+				{5353, 53, ProtocolUDP},
+				{53, 53, ProtocolUDP},
+			},
+			expectedAddrs: []listenAddress{
+				{family: "4", address: "127.0.0.1", failureMode: "any"},
+				{family: "6", address: "::1", failureMode: "any"},
+			},
+		},
+	}
+
+	for i, test := range tests {
+		var addresses []string
+		if len(test.addresses) > 0 {
+			addresses = test.addresses
+		} else {
+			addresses = []string{"localhost"}
+		}
+
+		if test.expectAddressParseError {
+			if _, err := parseAddresses(addresses); err == nil {
+				t.Fatalf("%d: expected an address parse error", i)
+			}
+			continue
+		}
+
+		parsedPorts, err := parsePorts(test.input)
+		haveError := err != nil
+		if e, a := test.expectPortParseError, haveError; e != a {
+			t.Fatalf("%d: parsePorts: error expected=%t, got %t: %s", i, e, a, err)
+		}
+		if haveError {
+			continue
+		}
+
+		pf, err := NewOnAddresses(nil, addresses, test.input, nil, nil, nil, nil)
+		if err != nil {
+			t.Fatalf("%d: unexpected error from New: %v", i, err)
+		}
+
+		if e, a := test.expectedPorts, parsedPorts; !reflect.DeepEqual(e, a) {
+			t.Fatalf("%d: ports: expected %#v, got %#v", i, e, a)
+		}
+		if e, a := test.expectedPorts, pf.ports; !reflect.DeepEqual(e, a) {
+			t.Fatalf("%d: ports: expected %#v, got %#v", i, e, a)
+		}
+		if e, a := test.expectedAddrs, pf.addresses; !reflect.DeepEqual(e, a) {
+			t.Fatalf("%d: addresses: expected %#v, got %#v", i, e, a)
+		}
+	}
+}
+
+func TestDatagramFraming(t *testing.T) {
+	var buf bytes.Buffer
+	payloads := [][]byte{[]byte("hello"), {}, bytes.Repeat([]byte{'x'}, 1500)}
+	for _, p := range payloads {
+		if err := writeDatagram(&buf, p); err != nil {
+			t.Fatalf("unexpected error writing datagram: %v", err)
+		}
+	}
+	if err := writeDatagram(&buf, make([]byte, maxDatagramSize+1)); err == nil {
+		t.Fatalf("expected an error for an oversized datagram")
+	}
+
+	out := make([]byte, maxDatagramSize)
+	for i, p := range payloads {
+		n, err := readDatagram(&buf, out)
+		if err != nil {
+			t.Fatalf("%d: unexpected error reading datagram: %v", i, err)
+		}
+		if !bytes.Equal(p, out[:n]) {
+			t.Fatalf("%d: expected %q, got %q", i, p, out[:n])
+		}
+	}
+	if _, err := readDatagram(&buf, out); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestGetPortsReturnsDynamicallyAssignedLocalPort(t *testing.T) {
+	pf, err := New(nil, []string{":5000"}, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("error while calling New: %s", err)
+	}
+	if _, err := pf.GetPorts(); err == nil {
+		t.Fatalf("expected an error without a Ready channel")
+	}
+
+	readyChan := make(chan struct{})
+	pf, err = New(nil, []string{":5000"}, nil, readyChan, nil, nil)
+	if err != nil {
+		t.Fatalf("error while calling New: %s", err)
+	}
+	if _, err := pf.GetPorts(); err == nil {
+		t.Fatalf("expected an error before the forwarder is ready")
+	}
+}
+
+func startTCPEcho(t *testing.T) (int, func()) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port, func() { l.Close() }
+}
+
+func startUDPEcho(t *testing.T) (int, func()) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr).Port, func() { conn.Close() }
+}
+
+func newTestDialer(t *testing.T, serverURL string) httpstream.Dialer {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		t.Fatalf("unable to parse url: %v", err)
+	}
+	transport := spdy.NewRoundTripper(nil)
+	return spdytransport.NewDialer(transport, &http.Client{Transport: transport}, "POST", u)
+}
+
+func TestForwardPorts(t *testing.T) {
+	tcpPort, stopTCP := startTCPEcho(t)
+	defer stopTCP()
+	udpPort, stopUDP := startUDPEcho(t)
+	defer stopUDP()
+
+	server := httptest.NewServer(NewHandler(NewDialForwarder("127.0.0.1", nil), nil))
+	defer server.Close()
+
+	stopChan := make(chan struct{})
+	readyChan := make(chan struct{})
+	pf, err := NewOnAddresses(newTestDialer(t, server.URL), []string{"127.0.0.1"},
+		[]string{fmt.Sprintf(":%d", tcpPort), fmt.Sprintf(":%d/udp", udpPort)}, stopChan, readyChan, io.Discard, io.Discard)
+	if err != nil {
+		t.Fatalf("unexpected error creating forwarder: %v", err)
+	}
+
+	doneChan := make(chan error)
+	go func() {
+		doneChan <- pf.ForwardPorts()
+	}()
+
+	select {
+	case <-readyChan:
+	case err := <-doneChan:
+		t.Fatalf("forwarder exited early: %v", err)
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatalf("timed out waiting for the forwarder to become ready")
+	}
+
+	ports, err := pf.GetPorts()
+	if err != nil {
+		t.Fatalf("unexpected error getting ports: %v", err)
+	}
+
+	for _, port := range ports {
+		addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port.Local)))
+		conn, err := net.Dial(port.Protocol, addr)
+		if err != nil {
+			t.Fatalf("unable to dial %s/%s: %v", addr, port.Protocol, err)
+		}
+		conn.SetDeadline(time.Now().Add(wait.ForeverTestTimeout))
+
+		for i := 0; i < 3; i++ {
+			msg := []byte(fmt.Sprintf("%s message %d", port.Protocol, i))
+			if _, err := conn.Write(msg); err != nil {
+				t.Fatalf("unable to write to %s: %v", addr, err)
+			}
+			got := make([]byte, len(msg))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				t.Fatalf("unable to read from %s: %v", addr, err)
+			}
+			if !bytes.Equal(msg, got) {
+				t.Fatalf("expected %q, got %q", msg, got)
+			}
+		}
+		conn.Close()
+	}
+
+	close(stopChan)
+	select {
+	case err := <-doneChan:
+		if err != nil {
+			t.Fatalf("unexpected error from ForwardPorts: %v", err)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatalf("timed out waiting for ForwardPorts to return")
+	}
+}
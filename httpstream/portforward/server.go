@@ -0,0 +1,346 @@
+/*
+Copyright 2015 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package portforward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/commcos/utils/httpstream"
+	"github.com/commcos/utils/httpstream/spdy"
+	"github.com/commcos/utils/logger"
+	"github.com/commcos/utils/runtime"
+)
+
+// Forwarder knows how to forward content from a data stream to/from a
+// port on the target host.
+type Forwarder interface {
+	// PortForward copies data between stream and the given port until either
+	// side is done. protocol is one of ProtocolTCP or ProtocolUDP.
+	PortForward(ctx context.Context, protocol string, port int32, stream io.ReadWriteCloser) error
+}
+
+// ServerOptions holds the settings of the server side port forward handler.
+type ServerOptions struct {
+	// Upgrader upgrades the incoming request. Defaults to SPDY/3.1.
+	Upgrader httpstream.ResponseUpgrader
+	// IdleTimeout is how long the upgraded connection may remain idle before
+	// it is closed. Zero disables the timeout.
+	IdleTimeout time.Duration
+	// StreamCreationTimeout is how long to wait for both streams of a request.
+	// Defaults to DefaultStreamCreationTimeout.
+	StreamCreationTimeout time.Duration
+	// SupportedProtocols lists the subprotocols accepted during the
+	// handshake. Defaults to PortForwardProtocolV1Name.
+	SupportedProtocols []string
+}
+
+// NewHandler returns an http.Handler that serves port forward requests by
+// handing every forwarded connection to forwarder. A nil opts uses the
+// defaults described on ServerOptions.
+func NewHandler(forwarder Forwarder, opts *ServerOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ServePortForward(w, req, forwarder, opts)
+	})
+}
+
+// ServePortForward handles a port forwarding request. A single request can
+// forward multiple ports, and every forwarded connection is carried by a pair
+// of data and error streams. ServePortForward blocks until the upgraded
+// connection is closed.
+func ServePortForward(w http.ResponseWriter, req *http.Request, forwarder Forwarder, opts *ServerOptions) {
+	var o ServerOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.Upgrader == nil {
+		o.Upgrader = spdy.NewResponseUpgrader()
+	}
+	if o.StreamCreationTimeout == 0 {
+		o.StreamCreationTimeout = DefaultStreamCreationTimeout
+	}
+	if len(o.SupportedProtocols) == 0 {
+		o.SupportedProtocols = []string{PortForwardProtocolV1Name}
+	}
+
+	if err := handleHTTPStreams(req, w, forwarder, o); err != nil {
+		runtime.HandleError(err)
+		return
+	}
+}
+
+func handleHTTPStreams(req *http.Request, w http.ResponseWriter, forwarder Forwarder, opts ServerOptions) error {
+	_, err := httpstream.Handshake(req, w, opts.SupportedProtocols)
+	// negotiated protocol isn't currently used server side, but could be in the future
+	if err != nil {
+		// Handshake writes the error to the client
+		return err
+	}
+	streamChan := make(chan httpstream.Stream, 1)
+
+	logger.Logf(logger.DebugLevel, "Upgrading port forward response")
+	conn := opts.Upgrader.UpgradeResponse(w, req, httpStreamReceived(streamChan))
+	if conn == nil {
+		return errors.New("unable to upgrade httpstream connection")
+	}
+	defer conn.Close()
+
+	logger.Logf(logger.DebugLevel, "(conn=%p) setting port forwarding streaming connection idle timeout to %v", conn, opts.IdleTimeout)
+	conn.SetIdleTimeout(opts.IdleTimeout)
+
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+
+	h := &httpStreamHandler{
+		conn:                  conn,
+		streamChan:            streamChan,
+		streamPairs:           make(map[string]*httpStreamPair),
+		streamCreationTimeout: opts.StreamCreationTimeout,
+		forwarder:             forwarder,
+	}
+	h.run(ctx)
+
+	return nil
+}
+
+// httpStreamReceived is the httpstream.NewStreamHandler for port
+// forward streams. It checks each stream's port, protocol and stream type
+// headers, rejecting any streams that with missing or invalid values. Each
+// valid stream is sent to the streams channel.
+func httpStreamReceived(streams chan httpstream.Stream) func(httpstream.Stream, <-chan struct{}) error {
+	return func(stream httpstream.Stream, replySent <-chan struct{}) error {
+		// make sure it has a valid port header
+		portString := stream.Headers().Get(PortHeader)
+		if len(portString) == 0 {
+			return fmt.Errorf("%q header is required", PortHeader)
+		}
+		port, err := strconv.ParseUint(portString, 10, 16)
+		if err != nil {
+			return fmt.Errorf("unable to parse %q as a port: %v", portString, err)
+		}
+		if port < 1 {
+			return fmt.Errorf("port %q must be > 0", portString)
+		}
+
+		// make sure it has a valid protocol header
+		switch protocol := stream.Headers().Get(ProtocolHeader); protocol {
+		case "", ProtocolTCP, ProtocolUDP:
+		default:
+			return fmt.Errorf("invalid protocol %q", protocol)
+		}
+
+		// make sure it has a valid stream type header
+		streamType := stream.Headers().Get(StreamType)
+		if len(streamType) == 0 {
+			return fmt.Errorf("%q header is required", StreamType)
+		}
+		if streamType != StreamTypeError && streamType != StreamTypeData {
+			return fmt.Errorf("invalid stream type %q", streamType)
+		}
+
+		streams <- stream
+		return nil
+	}
+}
+
+// httpStreamHandler is capable of processing multiple port forward
+// requests over a single httpstream.Connection.
+type httpStreamHandler struct {
+	conn                  httpstream.Connection
+	streamChan            chan httpstream.Stream
+	streamPairsLock       sync.RWMutex
+	streamPairs           map[string]*httpStreamPair
+	streamCreationTimeout time.Duration
+	forwarder             Forwarder
+}
+
+// getStreamPair returns a httpStreamPair for requestID. This creates a
+// new pair if one does not yet exist for the requestID. The returned bool is
+// true if the pair was created.
+func (h *httpStreamHandler) getStreamPair(requestID string) (*httpStreamPair, bool) {
+	h.streamPairsLock.Lock()
+	defer h.streamPairsLock.Unlock()
+
+	if p, ok := h.streamPairs[requestID]; ok {
+		logger.Logf(logger.TraceLevel, "(conn=%p, request=%s) found existing stream pair", h.conn, requestID)
+		return p, false
+	}
+
+	logger.Logf(logger.TraceLevel, "(conn=%p, request=%s) creating new stream pair", h.conn, requestID)
+
+	p := newPortForwardPair(requestID)
+	h.streamPairs[requestID] = p
+
+	return p, true
+}
+
+// monitorStreamPair waits for the pair to receive both its error and data
+// streams, or for the timeout to expire (whichever happens first), and then
+// removes the pair.
+func (h *httpStreamHandler) monitorStreamPair(p *httpStreamPair, timeout <-chan time.Time) {
+	select {
+	case <-timeout:
+		err := fmt.Errorf("(conn=%p, request=%s) timed out waiting for streams", h.conn, p.requestID)
+		runtime.HandleError(err)
+		p.printError(err.Error())
+	case <-p.complete:
+		logger.Logf(logger.TraceLevel, "(conn=%p, request=%s) successfully received error and data streams", h.conn, p.requestID)
+	}
+	h.removeStreamPair(p.requestID)
+}
+
+// removeStreamPair removes the stream pair identified by requestID from streamPairs.
+func (h *httpStreamHandler) removeStreamPair(requestID string) {
+	h.streamPairsLock.Lock()
+	defer h.streamPairsLock.Unlock()
+
+	if h.conn != nil {
+		pair := h.streamPairs[requestID]
+		h.conn.RemoveStreams(pair.dataStream, pair.errorStream)
+	}
+	delete(h.streamPairs, requestID)
+}
+
+// requestID returns the request id for stream.
+func (h *httpStreamHandler) requestID(stream httpstream.Stream) (string, error) {
+	requestID := stream.Headers().Get(PortForwardRequestIDHeader)
+	if len(requestID) == 0 {
+		return "", fmt.Errorf("%q header is required", PortForwardRequestIDHeader)
+	}
+	return requestID, nil
+}
+
+// run is the main loop for the httpStreamHandler. It processes new
+// streams, invoking portForward for each complete stream pair. The loop exits
+// when the httpstream.Connection is closed.
+func (h *httpStreamHandler) run(ctx context.Context) {
+	logger.Logf(logger.TraceLevel, "(conn=%p) waiting for port forward streams", h.conn)
+Loop:
+	for {
+		select {
+		case <-h.conn.CloseChan():
+			logger.Logf(logger.TraceLevel, "(conn=%p) upgraded connection closed", h.conn)
+			break Loop
+		case stream := <-h.streamChan:
+			requestID, err := h.requestID(stream)
+			if err != nil {
+				logger.Logf(logger.WarnLevel, "(conn=%p) failed to parse request id: %v", h.conn, err)
+				stream.Reset()
+				continue
+			}
+			streamType := stream.Headers().Get(StreamType)
+			logger.Logf(logger.TraceLevel, "(conn=%p, request=%s) received new stream of type %s", h.conn, requestID, streamType)
+
+			p, created := h.getStreamPair(requestID)
+			if created {
+				go h.monitorStreamPair(p, time.After(h.streamCreationTimeout))
+			}
+			if complete, err := p.add(stream); err != nil {
+				msg := fmt.Sprintf("error processing stream for request %s: %v", requestID, err)
+				runtime.HandleError(errors.New(msg))
+				p.printError(msg)
+			} else if complete {
+				go h.portForward(ctx, p)
+			}
+		}
+	}
+}
+
+// portForward invokes the httpStreamHandler's forwarder.PortForward
+// function for the given stream pair.
+func (h *httpStreamHandler) portForward(ctx context.Context, p *httpStreamPair) {
+	defer p.dataStream.Close()
+	defer p.errorStream.Close()
+
+	portString := p.dataStream.Headers().Get(PortHeader)
+	port, _ := strconv.ParseInt(portString, 10, 32)
+	protocol := p.dataStream.Headers().Get(ProtocolHeader)
+	if protocol == "" {
+		protocol = ProtocolTCP
+	}
+
+	logger.Logf(logger.TraceLevel, "(conn=%p, request=%s) invoking forwarder.PortForward for port %s/%s", h.conn, p.requestID, portString, protocol)
+	err := h.forwarder.PortForward(ctx, protocol, int32(port), p.dataStream)
+	logger.Logf(logger.TraceLevel, "(conn=%p, request=%s) done invoking forwarder.PortForward for port %s/%s", h.conn, p.requestID, portString, protocol)
+
+	if err != nil {
+		msg := fmt.Errorf("error forwarding port %d/%s: %v", port, protocol, err)
+		runtime.HandleError(msg)
+		fmt.Fprint(p.errorStream, msg.Error())
+	}
+}
+
+// httpStreamPair represents the error and data streams for a port
+// forwarding request.
+type httpStreamPair struct {
+	lock        sync.RWMutex
+	requestID   string
+	dataStream  httpstream.Stream
+	errorStream httpstream.Stream
+	complete    chan struct{}
+}
+
+// newPortForwardPair creates a new httpStreamPair.
+func newPortForwardPair(requestID string) *httpStreamPair {
+	return &httpStreamPair{
+		requestID: requestID,
+		complete:  make(chan struct{}),
+	}
+}
+
+// add adds the stream to the httpStreamPair. If the pair already
+// contains a stream for the new stream's type, an error is returned. add
+// returns true if both the data and error streams for this pair have been
+// received.
+func (p *httpStreamPair) add(stream httpstream.Stream) (bool, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	switch stream.Headers().Get(StreamType) {
+	case StreamTypeError:
+		if p.errorStream != nil {
+			return false, errors.New("error stream already assigned")
+		}
+		p.errorStream = stream
+	case StreamTypeData:
+		if p.dataStream != nil {
+			return false, errors.New("data stream already assigned")
+		}
+		p.dataStream = stream
+	}
+
+	complete := p.errorStream != nil && p.dataStream != nil
+	if complete {
+		close(p.complete)
+	}
+	return complete, nil
+}
+
+// printError writes s to p.errorStream if p.errorStream has been set.
+func (p *httpStreamPair) printError(s string) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.errorStream != nil {
+		fmt.Fprint(p.errorStream, s)
+	}
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package remotecommand
+
+import (
+	"time"
+)
+
+const (
+	// StreamProtocolV1Name is the first version of the remote command
+	// subprotocol. It supports stdin, stdout, stderr, terminal resizing and
+	// reports the command result as a JSON encoded Status on the error
+	// stream.
+	StreamProtocolV1Name = "remotecommand.v1"
+
+	// DefaultStreamCreationTimeout is how long the server waits for the
+	// client to create all expected streams.
+	DefaultStreamCreationTimeout = 30 * time.Second
+)
+
+// SupportedStreamingProtocols lists the subprotocols understood by this
+// package, most preferred first.
+var SupportedStreamingProtocols = []string{StreamProtocolV1Name}
+
+const (
+	// StreamType is the header that names the purpose of a stream.
+	StreamType = "streamType"
+
+	// Values for the StreamType header.
+	StreamTypeStdin  = "stdin"
+	StreamTypeStdout = "stdout"
+	StreamTypeStderr = "stderr"
+	StreamTypeError  = "error"
+	StreamTypeResize = "resize"
+)
+
+const (
+	// Query parameters of the upgrade request.
+	ExecCommandParam = "command"
+	ExecStdinParam   = "stdin"
+	ExecStdoutParam  = "stdout"
+	ExecStderrParam  = "stderr"
+	ExecTTYParam     = "tty"
+)
+
+const (
+	// StatusSuccess is the Status.Status of a command that exited with 0.
+	StatusSuccess = "Success"
+	// StatusFailure is the Status.Status of a command that failed.
+	StatusFailure = "Failure"
+
+	// NonZeroExitCodeReason is the Status.Reason of a command that ran to
+	// completion with a non-zero exit code.
+	NonZeroExitCodeReason = "NonZeroExitCode"
+)
+
+// Status is written by the server to the error stream once the command has
+// finished.
+type Status struct {
+	// Status is one of StatusSuccess or StatusFailure.
+	Status string `json:"status"`
+	// Reason is a machine readable description of a failure.
+	Reason string `json:"reason,omitempty"`
+	// Message is a human readable description of a failure.
+	Message string `json:"message,omitempty"`
+	// ExitCode is the exit code of the command when Reason is
+	// NonZeroExitCodeReason.
+	ExitCode int `json:"exitCode,omitempty"`
+}
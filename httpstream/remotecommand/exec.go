@@ -0,0 +1,206 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package remotecommand
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/commcos/utils/exec"
+	"github.com/commcos/utils/runtime"
+)
+
+// NewExecHandler returns an http.Handler that runs the command described by
+// the query parameters of each request on the local host through executor.
+// A nil opts uses the defaults described on ServerOptions.
+func NewExecHandler(executor exec.Interface, opts *ServerOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ServeExec(w, req, executor, opts)
+	})
+}
+
+// ServeExec handles requests to execute a command on the local host. The
+// command and the requested streams are read from the query parameters of req
+// (see NewOptions). The command is started through executor and, when a TTY
+// is requested, attached to a newly allocated pseudo terminal. The result is
+// written as a Status on the error stream.
+func ServeExec(w http.ResponseWriter, req *http.Request, executor exec.Interface, opts *ServerOptions) {
+	execOpts, err := NewOptions(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, ok := createStreams(req, w, execOpts, opts.complete())
+	if !ok {
+		// error is handled by createStreams
+		return
+	}
+	defer ctx.conn.Close()
+
+	var stdin io.Reader
+	if ctx.stdinStream != nil {
+		stdin = ctx.stdinStream
+	}
+	var stdout, stderr io.Writer
+	if ctx.stdoutStream != nil {
+		stdout = ctx.stdoutStream
+	}
+	if ctx.stderrStream != nil {
+		stderr = ctx.stderrStream
+	}
+
+	err = runCommand(req.Context(), executor, execOpts.Command, stdin, stdout, stderr, ctx.tty, ctx.resizeChan)
+	if err != nil {
+		if exitErr, ok := err.(exec.ExitError); ok && exitErr.Exited() {
+			rc := exitErr.ExitStatus()
+			ctx.writeStatus(&Status{
+				Status:   StatusFailure,
+				Reason:   NonZeroExitCodeReason,
+				Message:  fmt.Sprintf("command terminated with non-zero exit code: %v", exitErr),
+				ExitCode: rc,
+			})
+		} else {
+			err = fmt.Errorf("error executing command: %v", err)
+			runtime.HandleError(err)
+			ctx.writeStatus(&Status{
+				Status:  StatusFailure,
+				Message: err.Error(),
+			})
+		}
+	} else {
+		ctx.writeStatus(&Status{
+			Status: StatusSuccess,
+		})
+	}
+	ctx.closeStreams()
+}
+
+// runCommand starts command through executor with the given streams and waits
+// for it to finish.
+func runCommand(ctx context.Context, executor exec.Interface, command []string, stdin io.Reader, stdout, stderr io.Writer, tty bool, resize <-chan TerminalSize) error {
+	cmd := executor.CommandContext(ctx, command[0], command[1:]...)
+	if tty {
+		return runCommandInTerminal(cmd, stdin, stdout, resize)
+	}
+
+	if stdin != nil {
+		// hand the process a real pipe, so that Wait does not block on a
+		// client that keeps its stdin open after the process exited
+		r, w, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+		cmd.SetStdin(r)
+		go func() {
+			defer runtime.HandleCrash()
+			io.Copy(w, stdin)
+			w.Close()
+		}()
+		defer r.Close()
+	}
+	if stdout != nil {
+		cmd.SetStdout(stdout)
+	}
+	if stderr != nil {
+		cmd.SetStderr(stderr)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return cmd.Wait()
+}
+
+// runCommandInTerminal attaches cmd to a new pseudo terminal, copies stdin to
+// and stdout from it and applies every size received from resize.
+func runCommandInTerminal(cmd exec.Cmd, stdin io.Reader, stdout io.Writer, resize <-chan TerminalSize) error {
+	ptmx, tty, err := openPty()
+	if err != nil {
+		return fmt.Errorf("unable to allocate a terminal: %v", err)
+	}
+	defer ptmx.Close()
+
+	cmd.SetStdin(tty)
+	cmd.SetStdout(tty)
+	cmd.SetStderr(tty)
+	err = cmd.Start()
+	// the process owns the terminal now, keeping our end open would prevent
+	// reads from ptmx to finish once it exits
+	tty.Close()
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	var resizing sync.WaitGroup
+	defer func() {
+		close(done)
+		resizing.Wait()
+	}()
+
+	if resize != nil {
+		resizing.Add(1)
+		go func() {
+			defer runtime.HandleCrash()
+			defer resizing.Done()
+			for {
+				select {
+				case size, ok := <-resize:
+					if !ok {
+						return
+					}
+					if size.Height < 1 || size.Width < 1 {
+						continue
+					}
+					if err := setTerminalSize(ptmx, size); err != nil {
+						runtime.HandleError(fmt.Errorf("unable to resize terminal: %v", err))
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	if stdin != nil {
+		go func() {
+			defer runtime.HandleCrash()
+			io.Copy(ptmx, stdin)
+		}()
+	}
+
+	if stdout == nil {
+		stdout = io.Discard
+	}
+	copyDone := make(chan struct{})
+	go func() {
+		defer runtime.HandleCrash()
+		defer close(copyDone)
+		// reading from ptmx fails with EIO once the terminal is released
+		io.Copy(stdout, ptmx)
+	}()
+
+	err = cmd.Wait()
+	<-copyDone
+	return err
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package remotecommand
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Options contains details about which streams are required for a remote
+// command and which command to run.
+type Options struct {
+	Command []string
+	Stdin   bool
+	Stdout  bool
+	Stderr  bool
+	TTY     bool
+}
+
+// NewOptions creates a new Options from the query parameters of the upgrade
+// request.
+func NewOptions(req *http.Request) (*Options, error) {
+	query := req.URL.Query()
+	command := query[ExecCommandParam]
+	if len(command) == 0 {
+		return nil, fmt.Errorf("%q parameter is required", ExecCommandParam)
+	}
+	tty := query.Get(ExecTTYParam) == "1"
+	stdin := query.Get(ExecStdinParam) == "1"
+	stdout := query.Get(ExecStdoutParam) == "1"
+	stderr := query.Get(ExecStderrParam) == "1"
+	if tty && stderr {
+		// a tty merges stderr into stdout
+		stderr = false
+	}
+
+	if !stdin && !stdout && !stderr {
+		return nil, fmt.Errorf("you must specify at least 1 of stdin, stdout, stderr")
+	}
+
+	return &Options{
+		Command: command,
+		Stdin:   stdin,
+		Stdout:  stdout,
+		Stderr:  stderr,
+		TTY:     tty,
+	}, nil
+}
+
+// encode returns a copy of u whose query carries the options.
+func (o *Options) encode(u *url.URL) *url.URL {
+	encoded := *u
+	query := encoded.Query()
+	query.Del(ExecCommandParam)
+	for _, c := range o.Command {
+		query.Add(ExecCommandParam, c)
+	}
+	setFlag := func(key string, value bool) {
+		if value {
+			query.Set(key, "1")
+		} else {
+			query.Del(key)
+		}
+	}
+	setFlag(ExecStdinParam, o.Stdin)
+	setFlag(ExecStdoutParam, o.Stdout)
+	setFlag(ExecStderrParam, o.Stderr)
+	setFlag(ExecTTYParam, o.TTY)
+	encoded.RawQuery = query.Encode()
+	return &encoded
+}
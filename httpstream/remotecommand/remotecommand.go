@@ -0,0 +1,207 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package remotecommand
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/commcos/utils/httpstream"
+	"github.com/commcos/utils/runtime"
+)
+
+// StreamOptions holds information pertaining to the current streaming session:
+// the command to run, input/output streams, whether a TTY is requested, and a
+// terminal size queue to support terminal resizing.
+type StreamOptions struct {
+	Command           []string
+	Stdin             io.Reader
+	Stdout            io.Writer
+	Stderr            io.Writer
+	Tty               bool
+	TerminalSizeQueue TerminalSizeQueue
+}
+
+// Executor is an interface for transporting shell-style streams.
+type Executor interface {
+	// Stream initiates the transport of the standard shell streams. It will
+	// transport any non-nil stream to a remote system, and return an error if
+	// a problem occurs. If tty is set, the stderr stream is not used (raw TTY
+	// manages stdout and stderr over the stdout stream). A command that exits
+	// with a non-zero code is reported as an exec.CodeExitError.
+	Stream(options StreamOptions) error
+	// StreamWithContext is the same as Stream, but the connection is closed
+	// and the call returns ctx.Err() when ctx is done.
+	StreamWithContext(ctx context.Context, options StreamOptions) error
+}
+
+type streamCreator interface {
+	CreateStream(headers http.Header) (httpstream.Stream, error)
+}
+
+type streamProtocolHandler interface {
+	stream(conn streamCreator) error
+}
+
+// streamExecutor handles transporting standard shell streams over an httpstream connection.
+type streamExecutor struct {
+	transport httpstream.UpgradeRoundTripper
+	method    string
+	url       *url.URL
+	protocols []string
+}
+
+// NewExecutor connects to the provided server and upgrades the connection to
+// multiplexed bidirectional streams using transport.
+func NewExecutor(transport httpstream.UpgradeRoundTripper, method string, url *url.URL) Executor {
+	return NewExecutorForProtocols(transport, method, url, SupportedStreamingProtocols...)
+}
+
+// NewExecutorForProtocols connects to the provided server and upgrades the
+// connection to multiplexed bidirectional streams using the given protocols.
+func NewExecutorForProtocols(transport httpstream.UpgradeRoundTripper, method string, url *url.URL, protocols ...string) Executor {
+	return &streamExecutor{
+		transport: transport,
+		method:    method,
+		url:       url,
+		protocols: protocols,
+	}
+}
+
+// Stream opens a protocol streamer to the server and streams until a client closes
+// the connection or the server disconnects.
+func (e *streamExecutor) Stream(options StreamOptions) error {
+	return e.StreamWithContext(context.Background(), options)
+}
+
+// newConnectionAndStream creates a new connection and negotiates the
+// protocol handler for it.
+func (e *streamExecutor) newConnectionAndStream(ctx context.Context, options StreamOptions) (httpstream.Connection, streamProtocolHandler, error) {
+	if len(options.Command) == 0 {
+		return nil, nil, fmt.Errorf("a command is required")
+	}
+	opts := &Options{
+		Command: options.Command,
+		Stdin:   options.Stdin != nil,
+		Stdout:  options.Stdout != nil,
+		Stderr:  options.Stderr != nil && !options.Tty,
+		TTY:     options.Tty,
+	}
+
+	req, err := http.NewRequestWithContext(ctx, e.method, opts.encode(e.url).String(), nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating request: %v", err)
+	}
+	for i := range e.protocols {
+		req.Header.Add(httpstream.HeaderProtocolVersion, e.protocols[i])
+	}
+
+	client := &http.Client{Transport: e.transport}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error sending request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	conn, err := e.transport.NewConnection(resp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var streamer streamProtocolHandler
+	switch protocol := resp.Header.Get(httpstream.HeaderProtocolVersion); protocol {
+	case StreamProtocolV1Name:
+		streamer = newStreamProtocolV1(options)
+	default:
+		conn.Close()
+		return nil, nil, fmt.Errorf("unsupported remote command protocol %q", protocol)
+	}
+
+	return conn, streamer, nil
+}
+
+// StreamWithContext opens a protocol streamer to the server and streams until
+// a client closes the connection, the server disconnects or ctx is done.
+func (e *streamExecutor) StreamWithContext(ctx context.Context, options StreamOptions) error {
+	conn, streamer, err := e.newConnectionAndStream(ctx, options)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	panicChan := make(chan interface{}, 1)
+	errorChan := make(chan error, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				panicChan <- p
+			}
+		}()
+		errorChan <- streamer.stream(conn)
+	}()
+
+	select {
+	case p := <-panicChan:
+		panic(p)
+	case err := <-errorChan:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// readerWrapper hides any io.WriterTo of the wrapped reader so that io.Copy
+// always reads in small chunks and notices a closed stream early.
+type readerWrapper struct {
+	reader io.Reader
+}
+
+func (r readerWrapper) Read(p []byte) (int, error) {
+	return r.reader.Read(p)
+}
+
+// watchErrorStream watches the errorStream for remote command error data,
+// decodes it with d and sends the result on the returned channel. The
+// channel yields nil when the error stream is closed without data.
+func watchErrorStream(errorStream io.Reader, d errorStreamDecoder) chan error {
+	errorChan := make(chan error)
+
+	go func() {
+		defer runtime.HandleCrash()
+
+		message, err := io.ReadAll(errorStream)
+		switch {
+		case err != nil && err != io.EOF:
+			errorChan <- fmt.Errorf("error reading from error stream: %s", err)
+		case len(message) > 0:
+			errorChan <- d.decode(message)
+		default:
+			errorChan <- nil
+		}
+		close(errorChan)
+	}()
+
+	return errorChan
+}
+
+// errorStreamDecoder interprets the data on the error channel and creates a go error object from it.
+type errorStreamDecoder interface {
+	decode(message []byte) error
+}
@@ -0,0 +1,202 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package remotecommand
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/commcos/utils/exec"
+	"github.com/commcos/utils/httpstream/spdy"
+	"github.com/commcos/utils/wait"
+)
+
+func newTestExecutor(t *testing.T) (Executor, func()) {
+	server := httptest.NewServer(NewExecHandler(exec.New(), nil))
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("unable to parse url: %v", err)
+	}
+	return NewExecutor(spdy.NewRoundTripper(nil), "POST", u), server.Close
+}
+
+func TestStream(t *testing.T) {
+	testCases := map[string]struct {
+		command        []string
+		stdin          string
+		expectStdout   string
+		expectStderr   string
+		expectExitCode int
+	}{
+		"stdout": {
+			command:      []string{"sh", "-c", "echo hello"},
+			expectStdout: "hello\n",
+		},
+		"stdout and stderr": {
+			command:      []string{"sh", "-c", "echo out; echo err >&2"},
+			expectStdout: "out\n",
+			expectStderr: "err\n",
+		},
+		"stdin": {
+			command:      []string{"cat"},
+			stdin:        "some input\nmore input\n",
+			expectStdout: "some input\nmore input\n",
+		},
+		"exit code": {
+			command:        []string{"sh", "-c", "echo failing >&2; exit 3"},
+			expectStderr:   "failing\n",
+			expectExitCode: 3,
+		},
+		"exit without reading stdin": {
+			command:        []string{"sh", "-c", "exit 4"},
+			stdin:          "ignored",
+			expectExitCode: 4,
+		},
+	}
+
+	executor, stop := newTestExecutor(t)
+	defer stop()
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			options := StreamOptions{
+				Command: tc.command,
+				Stdout:  &stdout,
+				Stderr:  &stderr,
+			}
+			if len(tc.stdin) > 0 {
+				options.Stdin = strings.NewReader(tc.stdin)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), wait.ForeverTestTimeout)
+			defer cancel()
+			err := executor.StreamWithContext(ctx, options)
+
+			if tc.expectExitCode == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			} else {
+				exitErr, ok := err.(exec.ExitError)
+				if !ok {
+					t.Fatalf("expected an exec.ExitError, got %#v", err)
+				}
+				if e, a := tc.expectExitCode, exitErr.ExitStatus(); e != a {
+					t.Fatalf("expected exit code %d, got %d", e, a)
+				}
+			}
+			if e, a := tc.expectStdout, stdout.String(); e != a {
+				t.Errorf("stdout: expected %q, got %q", e, a)
+			}
+			if e, a := tc.expectStderr, stderr.String(); e != a {
+				t.Errorf("stderr: expected %q, got %q", e, a)
+			}
+		})
+	}
+}
+
+type fixedSizeQueue struct {
+	sizes chan *TerminalSize
+}
+
+func (q *fixedSizeQueue) Next() *TerminalSize {
+	return <-q.sizes
+}
+
+func TestStreamWithTerminal(t *testing.T) {
+	executor, stop := newTestExecutor(t)
+	defer stop()
+
+	queue := &fixedSizeQueue{sizes: make(chan *TerminalSize, 1)}
+	queue.sizes <- &TerminalSize{Width: 132, Height: 43}
+
+	// wait for the resize to be applied before reading the size back
+	stdin := strings.NewReader("")
+	var stdout bytes.Buffer
+	ctx, cancel := context.WithTimeout(context.Background(), wait.ForeverTestTimeout)
+	defer cancel()
+	err := executor.StreamWithContext(ctx, StreamOptions{
+		Command:           []string{"sh", "-c", "test -t 1 && echo tty; sleep 0.5; stty size"},
+		Stdin:             stdin,
+		Stdout:            &stdout,
+		Tty:               true,
+		TerminalSizeQueue: queue,
+	})
+	close(queue.sizes)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if e, a := "tty\r\n43 132\r\n", stdout.String(); e != a {
+		t.Errorf("expected %q, got %q", e, a)
+	}
+}
+
+func TestStreamWithContextCancel(t *testing.T) {
+	executor, stop := newTestExecutor(t)
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	var stdout bytes.Buffer
+	err := executor.StreamWithContext(ctx, StreamOptions{
+		Command: []string{"sleep", "10"},
+		Stdout:  &stdout,
+	})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestServeExecRejectsInvalidOptions(t *testing.T) {
+	server := httptest.NewServer(NewExecHandler(exec.New(), nil))
+	defer server.Close()
+
+	for _, query := range []string{"", "command=ls", "stdout=1"} {
+		resp, err := http.Post(server.URL+"?"+query, "", nil)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", query, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%q: expected status %d, got %d", query, http.StatusBadRequest, resp.StatusCode)
+		}
+	}
+}
+
+func TestOptionsEncode(t *testing.T) {
+	base, _ := url.Parse("http://example.com/exec?command=stale&other=1")
+	opts := &Options{Command: []string{"ls", "-l"}, Stdout: true, TTY: true}
+	req, _ := http.NewRequest("POST", opts.encode(base).String(), nil)
+
+	parsed, err := NewOptions(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if e, a := opts, parsed; e.TTY != a.TTY || e.Stdout != a.Stdout || e.Stdin != a.Stdin || e.Stderr != a.Stderr || strings.Join(e.Command, " ") != strings.Join(a.Command, " ") {
+		t.Errorf("expected %#v, got %#v", e, a)
+	}
+	if req.URL.Query().Get("other") != "1" {
+		t.Errorf("expected unrelated query parameters to be kept, got %q", req.URL.RawQuery)
+	}
+}
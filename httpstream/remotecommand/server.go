@@ -0,0 +1,259 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package remotecommand
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/commcos/utils/httpstream"
+	"github.com/commcos/utils/httpstream/spdy"
+	"github.com/commcos/utils/runtime"
+)
+
+// ServerOptions holds the settings of the server side remote command handler.
+type ServerOptions struct {
+	// Upgrader upgrades the incoming request. Defaults to SPDY/3.1.
+	Upgrader httpstream.ResponseUpgrader
+	// IdleTimeout is how long the upgraded connection may remain idle before
+	// it is closed. Zero disables the timeout.
+	IdleTimeout time.Duration
+	// StreamCreationTimeout is how long to wait for the client to create all
+	// expected streams. Defaults to DefaultStreamCreationTimeout.
+	StreamCreationTimeout time.Duration
+	// SupportedProtocols lists the subprotocols accepted during the
+	// handshake. Defaults to SupportedStreamingProtocols.
+	SupportedProtocols []string
+}
+
+func (o *ServerOptions) complete() ServerOptions {
+	var c ServerOptions
+	if o != nil {
+		c = *o
+	}
+	if c.Upgrader == nil {
+		c.Upgrader = spdy.NewResponseUpgrader()
+	}
+	if c.StreamCreationTimeout == 0 {
+		c.StreamCreationTimeout = DefaultStreamCreationTimeout
+	}
+	if len(c.SupportedProtocols) == 0 {
+		c.SupportedProtocols = SupportedStreamingProtocols
+	}
+	return c
+}
+
+// connectionContext contains the connection and streams used when
+// forwarding an attach or execute session into a process.
+type connectionContext struct {
+	conn         io.Closer
+	stdinStream  io.ReadCloser
+	stdoutStream io.WriteCloser
+	stderrStream io.WriteCloser
+	errorStream  io.WriteCloser
+	resizeStream io.ReadCloser
+	resizeChan   chan TerminalSize
+	tty          bool
+}
+
+// writeStatus encodes status onto the error stream.
+func (c *connectionContext) writeStatus(status *Status) error {
+	bs, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	_, err = c.errorStream.Write(bs)
+	return err
+}
+
+// closeStreams half-closes every stream the server writes to, so that the
+// client observes EOF once the data already sent has been read.
+func (c *connectionContext) closeStreams() {
+	for _, s := range []io.Closer{c.stdoutStream, c.stderrStream, c.errorStream} {
+		if s != nil {
+			s.Close()
+		}
+	}
+}
+
+// streamAndReply holds both a Stream that was received by the server
+// and a replySent channel that is closed when the reply for the stream
+// has been sent to the client.
+type streamAndReply struct {
+	httpstream.Stream
+	replySent <-chan struct{}
+}
+
+func createStreams(req *http.Request, w http.ResponseWriter, opts *Options, serverOpts ServerOptions) (*connectionContext, bool) {
+	protocol, err := httpstream.Handshake(req, w, serverOpts.SupportedProtocols)
+	if err != nil {
+		// Handshake writes the error to the client
+		runtime.HandleError(err)
+		return nil, false
+	}
+
+	streamCh := make(chan streamAndReply)
+
+	conn := serverOpts.Upgrader.UpgradeResponse(w, req, func(stream httpstream.Stream, replySent <-chan struct{}) error {
+		streamCh <- streamAndReply{Stream: stream, replySent: replySent}
+		return nil
+	})
+	// from this point on, we can no longer call methods on response
+	if conn == nil {
+		// The upgrader is responsible for notifying the client of any errors that
+		// occurred during upgrading. All we can do is return here at this point
+		// if we weren't successful in upgrading.
+		return nil, false
+	}
+
+	conn.SetIdleTimeout(serverOpts.IdleTimeout)
+
+	var handler protocolHandler
+	switch protocol {
+	case StreamProtocolV1Name:
+		handler = &v1ProtocolHandler{}
+	default:
+		runtime.HandleError(fmt.Errorf("unsupported remote command protocol %q", protocol))
+		conn.Close()
+		return nil, false
+	}
+
+	// count the streams client asked for, starting with 1
+	expectedStreams := 1
+	if opts.Stdin {
+		expectedStreams++
+	}
+	if opts.Stdout {
+		expectedStreams++
+	}
+	if opts.Stderr {
+		expectedStreams++
+	}
+	if opts.TTY && handler.supportsTerminalResizing() {
+		expectedStreams++
+	}
+
+	expired := time.NewTimer(serverOpts.StreamCreationTimeout)
+	defer expired.Stop()
+
+	ctx, err := handler.waitForStreams(streamCh, expectedStreams, expired.C)
+	if err != nil {
+		runtime.HandleError(err)
+		conn.Close()
+		return nil, false
+	}
+
+	ctx.conn = conn
+	ctx.tty = opts.TTY
+
+	if ctx.resizeStream != nil {
+		ctx.resizeChan = make(chan TerminalSize)
+		go handleResizeEvents(ctx.resizeStream, ctx.resizeChan)
+	}
+
+	return ctx, true
+}
+
+type protocolHandler interface {
+	// waitForStreams waits for the expected streams or a timeout, returning a
+	// connectionContext on success.
+	waitForStreams(streams <-chan streamAndReply, expectedStreams int, expired <-chan time.Time) (*connectionContext, error)
+	// supportsTerminalResizing returns true if the protocol handler supports terminal resizing
+	supportsTerminalResizing() bool
+}
+
+// v1ProtocolHandler implements the V1 protocol version for streaming command execution.
+type v1ProtocolHandler struct{}
+
+func (*v1ProtocolHandler) waitForStreams(streams <-chan streamAndReply, expectedStreams int, expired <-chan time.Time) (*connectionContext, error) {
+	ctx := &connectionContext{}
+	receivedStreams := 0
+	replyChan := make(chan struct{})
+	stop := make(chan struct{})
+	defer close(stop)
+WaitForStreams:
+	for {
+		select {
+		case stream := <-streams:
+			streamType := stream.Headers().Get(StreamType)
+			switch streamType {
+			case StreamTypeError:
+				ctx.errorStream = stream
+				go waitStreamReply(stream.replySent, replyChan, stop)
+			case StreamTypeStdin:
+				ctx.stdinStream = stream
+				go waitStreamReply(stream.replySent, replyChan, stop)
+			case StreamTypeStdout:
+				ctx.stdoutStream = stream
+				go waitStreamReply(stream.replySent, replyChan, stop)
+			case StreamTypeStderr:
+				ctx.stderrStream = stream
+				go waitStreamReply(stream.replySent, replyChan, stop)
+			case StreamTypeResize:
+				ctx.resizeStream = stream
+				go waitStreamReply(stream.replySent, replyChan, stop)
+			default:
+				runtime.HandleError(fmt.Errorf("unexpected stream type: %q", streamType))
+			}
+		case <-replyChan:
+			receivedStreams++
+			if receivedStreams == expectedStreams {
+				break WaitForStreams
+			}
+		case <-expired:
+			// TODO find a way to return the error to the user. Maybe use a separate
+			// stream to report errors?
+			return nil, errors.New("timed out waiting for client to create streams")
+		}
+	}
+
+	if ctx.errorStream == nil {
+		return nil, errors.New("client did not create an error stream")
+	}
+	return ctx, nil
+}
+
+// supportsTerminalResizing returns true because v1ProtocolHandler supports it
+func (*v1ProtocolHandler) supportsTerminalResizing() bool { return true }
+
+// waitStreamReply waits until either replySent or stop is closed. If replySent is closed, it sends
+// an empty struct to the notify channel.
+func waitStreamReply(replySent <-chan struct{}, notify chan<- struct{}, stop <-chan struct{}) {
+	select {
+	case <-replySent:
+		notify <- struct{}{}
+	case <-stop:
+	}
+}
+
+func handleResizeEvents(stream io.Reader, channel chan<- TerminalSize) {
+	defer runtime.HandleCrash()
+	defer close(channel)
+
+	decoder := json.NewDecoder(stream)
+	for {
+		size := TerminalSize{}
+		if err := decoder.Decode(&size); err != nil {
+			break
+		}
+		channel <- size
+	}
+}
@@ -19,7 +19,9 @@ package spdy
 import (
 	"net"
 	"net/http"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/commcos/utils/httpstream"
@@ -30,11 +32,46 @@ import (
 // connection maintains state about a spdystream.Connection and its associated
 // streams.
 type connection struct {
+	// accessed atomically, kept first for alignment on 32 bit platforms.
+	bytesRead       int64
+	bytesWritten    int64
+	totalStreams    int64
+	rejectedStreams int64
+
 	conn             *spdystream.Connection
 	streams          map[uint32]httpstream.Stream
 	streamLock       sync.Mutex
 	newStreamHandler httpstream.NewStreamHandler
 	ping             func() (time.Duration, error)
+	opts             ConnectionOptions
+
+	// tracked holds the streams that are still open, and inboundStreams the
+	// number of those opened by the remote peer. Both are guarded by
+	// streamLock.
+	tracked        map[*trackedStream]struct{}
+	inboundStreams int
+}
+
+// ConnectionOptions configures stream admission and accounting for a SPDY
+// connection. The zero value imposes no limits.
+type ConnectionOptions struct {
+	// PingPeriod, if non-zero, makes a background goroutine send periodic
+	// Ping frames to the peer.
+	PingPeriod time.Duration
+	// MaxConcurrentStreams caps the number of streams opened by the remote
+	// peer that may be open at the same time. Streams above the cap are reset
+	// without invoking the NewStreamHandler. Zero means no limit.
+	MaxConcurrentStreams int
+	// StreamIdleTimeout resets a stream on which no data has been read or
+	// written for this long. Zero disables the timeout.
+	StreamIdleTimeout time.Duration
+	// StreamTimeout resets a stream this long after it was opened, whether or
+	// not it is active. Zero disables the timeout.
+	StreamTimeout time.Duration
+	// OnStreamDone, if non-nil, is called once for every accepted or created
+	// stream when it is closed by both sides, reset, timed out, or torn down
+	// together with the connection. It must not block.
+	OnStreamDone func(StreamStats)
 }
 
 // NewClientConnection creates a new SPDY client connection.
@@ -72,28 +109,47 @@ func NewServerConnection(conn net.Conn, newStreamHandler httpstream.NewStreamHan
 // frames to the server. Use this to keep idle connections through certain load
 // balancers alive longer.
 func NewServerConnectionWithPings(conn net.Conn, newStreamHandler httpstream.NewStreamHandler, pingPeriod time.Duration) (httpstream.Connection, error) {
+	return NewServerConnectionWithOptions(conn, newStreamHandler, ConnectionOptions{PingPeriod: pingPeriod})
+}
+
+// NewServerConnectionWithOptions creates a new SPDY server connection that
+// admits, times out and accounts its streams according to opts.
+// newStreamHandler will be invoked when the server receives a newly created
+// stream from the client and the stream is within the concurrency limit.
+//
+// The returned connection implements StatsProvider.
+func NewServerConnectionWithOptions(conn net.Conn, newStreamHandler httpstream.NewStreamHandler, opts ConnectionOptions) (httpstream.Connection, error) {
 	spdyConn, err := spdystream.NewConnection(conn, true)
 	if err != nil {
 		defer conn.Close()
 		return nil, err
 	}
 
-	return newConnection(spdyConn, newStreamHandler, pingPeriod, spdyConn.Ping), nil
+	return newConnectionWithOptions(spdyConn, newStreamHandler, opts, spdyConn.Ping), nil
 }
 
 // newConnection returns a new connection wrapping conn. newStreamHandler
 // will be invoked when the server receives a newly created stream from the
 // client.
 func newConnection(conn *spdystream.Connection, newStreamHandler httpstream.NewStreamHandler, pingPeriod time.Duration, pingFn func() (time.Duration, error)) httpstream.Connection {
+	return newConnectionWithOptions(conn, newStreamHandler, ConnectionOptions{PingPeriod: pingPeriod}, pingFn)
+}
+
+// newConnectionWithOptions returns a new connection wrapping conn, configured
+// by opts.
+func newConnectionWithOptions(conn *spdystream.Connection, newStreamHandler httpstream.NewStreamHandler, opts ConnectionOptions, pingFn func() (time.Duration, error)) httpstream.Connection {
 	c := &connection{
 		conn:             conn,
 		newStreamHandler: newStreamHandler,
 		ping:             pingFn,
+		opts:             opts,
 		streams:          make(map[uint32]httpstream.Stream),
+		tracked:          make(map[*trackedStream]struct{}),
 	}
 	go conn.Serve(c.newSpdyStream)
-	if pingPeriod > 0 && pingFn != nil {
-		go c.sendPings(pingPeriod)
+	go c.finishStreamsOnClose()
+	if opts.PingPeriod > 0 && pingFn != nil {
+		go c.sendPings(opts.PingPeriod)
 	}
 	return c
 }
@@ -105,6 +161,8 @@ const createStreamResponseTimeout = 30 * time.Second
 // Close first sends a reset for all of the connection's streams, and then
 // closes the underlying spdystream.Connection.
 func (c *connection) Close() error {
+	c.finishStreams(StreamConnectionClosed)
+
 	c.streamLock.Lock()
 	for _, s := range c.streams {
 		// calling Reset instead of Close ensures that all streams are fully torn down
@@ -120,6 +178,8 @@ func (c *connection) Close() error {
 }
 
 // RemoveStreams can be used to removes a set of streams from the Connection.
+// The streams still open are done, releasing their MaxConcurrentStreams
+// slots.
 func (c *connection) RemoveStreams(streams ...httpstream.Stream) {
 	c.streamLock.Lock()
 	for _, stream := range streams {
@@ -129,6 +189,12 @@ func (c *connection) RemoveStreams(streams ...httpstream.Stream) {
 		}
 	}
 	c.streamLock.Unlock()
+
+	for _, stream := range streams {
+		if s, ok := stream.(*trackedStream); ok {
+			s.finish(StreamRemoved)
+		}
+	}
 }
 
 // CreateStream creates a new stream with the specified headers and registers
@@ -142,8 +208,10 @@ func (c *connection) CreateStream(headers http.Header) (httpstream.Stream, error
 		return nil, err
 	}
 
-	c.registerStream(stream)
-	return stream, nil
+	s := newTrackedStream(c, stream, false)
+	c.trackStream(s)
+	c.registerStream(s)
+	return s, nil
 }
 
 // registerStream adds the stream s to the connection's list of streams that
@@ -164,21 +232,121 @@ func (c *connection) CloseChan() <-chan bool {
 // It calls connection's newStreamHandler, giving it the opportunity to accept or reject
 // the stream. If newStreamHandler returns an error, the stream is rejected. If not, the
 // stream is accepted and registered with the connection.
+//
+// Streams above ConnectionOptions.MaxConcurrentStreams are rejected before
+// newStreamHandler is consulted.
 func (c *connection) newSpdyStream(stream *spdystream.Stream) {
+	if !c.admitStream() {
+		logger.Logf(logger.WarnLevel, "Stream rejected: connection already has %d concurrent streams", c.opts.MaxConcurrentStreams)
+		atomic.AddInt64(&c.rejectedStreams, 1)
+		stream.Reset()
+		return
+	}
+
+	s := newTrackedStream(c, stream, true)
+	c.trackStream(s)
+
 	replySent := make(chan struct{})
-	err := c.newStreamHandler(stream, replySent)
+	err := c.newStreamHandler(s, replySent)
 	rejectStream := (err != nil)
 	if rejectStream {
 		logger.Logf(logger.WarnLevel, "Stream rejected: %v", err)
+		s.reject()
 		stream.Reset()
 		return
 	}
 
-	c.registerStream(stream)
+	atomic.AddInt64(&c.totalStreams, 1)
+	c.registerStream(s)
 	stream.SendReply(http.Header{}, rejectStream)
 	close(replySent)
 }
 
+// admitStream reserves a slot for a stream opened by the remote peer. It
+// returns false if the connection is at ConnectionOptions.MaxConcurrentStreams.
+func (c *connection) admitStream() bool {
+	c.streamLock.Lock()
+	defer c.streamLock.Unlock()
+	if c.opts.MaxConcurrentStreams > 0 && c.inboundStreams >= c.opts.MaxConcurrentStreams {
+		return false
+	}
+	c.inboundStreams++
+	return true
+}
+
+// trackStream adds s to the set of open streams. The admission slot of an
+// inbound stream has already been taken by admitStream.
+func (c *connection) trackStream(s *trackedStream) {
+	c.streamLock.Lock()
+	c.tracked[s] = struct{}{}
+	c.streamLock.Unlock()
+	if !s.inbound {
+		atomic.AddInt64(&c.totalStreams, 1)
+	}
+}
+
+// streamDone removes s from the set of open streams, releasing its admission
+// slot, and reports it to ConnectionOptions.OnStreamDone if notify is set.
+func (c *connection) streamDone(s *trackedStream, notify bool) {
+	c.streamLock.Lock()
+	if _, ok := c.tracked[s]; ok {
+		delete(c.tracked, s)
+		if s.inbound {
+			c.inboundStreams--
+		}
+	}
+	c.streamLock.Unlock()
+
+	if !notify {
+		atomic.AddInt64(&c.rejectedStreams, 1)
+		return
+	}
+	if c.opts.OnStreamDone != nil {
+		c.opts.OnStreamDone(s.stats())
+	}
+}
+
+// finishStreams marks every open stream as done with the given reason.
+func (c *connection) finishStreams(reason StreamCloseReason) {
+	c.streamLock.Lock()
+	streams := make([]*trackedStream, 0, len(c.tracked))
+	for s := range c.tracked {
+		streams = append(streams, s)
+	}
+	c.streamLock.Unlock()
+
+	for _, s := range streams {
+		s.finish(reason)
+	}
+}
+
+// finishStreamsOnClose waits for the underlying connection to close and then
+// marks the streams that are still open as done.
+func (c *connection) finishStreamsOnClose() {
+	<-c.conn.CloseChan()
+	c.finishStreams(StreamConnectionClosed)
+}
+
+// Stats returns a snapshot of the connection's stream accounting.
+func (c *connection) Stats() ConnectionStats {
+	c.streamLock.Lock()
+	streams := make([]StreamStats, 0, len(c.tracked))
+	for s := range c.tracked {
+		streams = append(streams, s.stats())
+	}
+	c.streamLock.Unlock()
+
+	sort.Slice(streams, func(i, j int) bool { return streams[i].Identifier < streams[j].Identifier })
+	return ConnectionStats{
+		ActiveStreams:   len(streams),
+		TotalStreams:    atomic.LoadInt64(&c.totalStreams),
+		RejectedStreams: atomic.LoadInt64(&c.rejectedStreams),
+		BytesRead:       atomic.LoadInt64(&c.bytesRead),
+		BytesWritten:    atomic.LoadInt64(&c.bytesWritten),
+		Streams:         streams,
+	}
+}
+
 // SetIdleTimeout sets the amount of time the connection may remain idle before
 // it is automatically closed.
 func (c *connection) SetIdleTimeout(timeout time.Duration) {
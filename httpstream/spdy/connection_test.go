@@ -27,6 +27,7 @@ import (
 	"time"
 
 	"github.com/commcos/utils/httpstream"
+	"github.com/commcos/utils/wait"
 	"github.com/moby/spdystream"
 )
 
@@ -331,3 +332,252 @@ func TestConnectionRemoveStreams(t *testing.T) {
 	}
 
 }
+
+// newTestConnectionPair returns a client connection talking to a server
+// connection created with opts.
+func newTestConnectionPair(t *testing.T, opts ConnectionOptions, handler httpstream.NewStreamHandler) (httpstream.Connection, httpstream.Connection) {
+	listener, err := net.Listen("tcp4", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	srvConnChan := make(chan httpstream.Connection, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Errorf("server: error accepting connection: %v", err)
+			close(srvConnChan)
+			return
+		}
+		srvConn, err := NewServerConnectionWithOptions(conn, handler, opts)
+		if err != nil {
+			t.Errorf("server: error creating spdy connection: %v", err)
+		}
+		srvConnChan <- srvConn
+	}()
+
+	conn, err := net.Dial("tcp4", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("client: error connecting: %v", err)
+	}
+	clConn, err := NewClientConnection(conn)
+	if err != nil {
+		t.Fatalf("client: error creating spdy connection: %v", err)
+	}
+	srvConn := <-srvConnChan
+	if srvConn == nil {
+		t.FailNow()
+	}
+	return clConn, srvConn
+}
+
+func echoStreamHandler(stream httpstream.Stream, replySent <-chan struct{}) error {
+	go func() {
+		io.Copy(stream, stream)
+		stream.Close()
+	}()
+	return nil
+}
+
+func TestConnectionMaxConcurrentStreams(t *testing.T) {
+	done := make(chan StreamStats, 10)
+	clConn, srvConn := newTestConnectionPair(t, ConnectionOptions{
+		MaxConcurrentStreams: 1,
+		OnStreamDone:         func(s StreamStats) { done <- s },
+	}, echoStreamHandler)
+	defer clConn.Close()
+	defer srvConn.Close()
+
+	first, err := clConn.CreateStream(http.Header{})
+	if err != nil {
+		t.Fatalf("unexpected error creating first stream: %v", err)
+	}
+	if _, err := clConn.CreateStream(http.Header{}); err == nil {
+		t.Fatalf("expected the second stream to be rejected")
+	}
+
+	stats := srvConn.(StatsProvider).Stats()
+	if stats.ActiveStreams != 1 || stats.TotalStreams != 1 || stats.RejectedStreams != 1 {
+		t.Fatalf("unexpected stats: %#v", stats)
+	}
+
+	// Closing the first stream from both sides frees its slot.
+	first.Close()
+	if _, err := io.Copy(io.Discard, first); err != nil {
+		t.Fatalf("unexpected error draining first stream: %v", err)
+	}
+	select {
+	case s := <-done:
+		if s.Reason != StreamClosed {
+			t.Fatalf("expected reason %q, got %q", StreamClosed, s.Reason)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatalf("timed out waiting for the first stream to finish")
+	}
+
+	if _, err := clConn.CreateStream(http.Header{}); err != nil {
+		t.Fatalf("unexpected error creating stream after freeing a slot: %v", err)
+	}
+}
+
+func TestConnectionReleasesUnreadStreams(t *testing.T) {
+	done := make(chan StreamStats, 10)
+	streams := make(chan httpstream.Stream, 10)
+	clConn, srvConn := newTestConnectionPair(t, ConnectionOptions{
+		MaxConcurrentStreams: 1,
+		OnStreamDone:         func(s StreamStats) { done <- s },
+	}, func(stream httpstream.Stream, replySent <-chan struct{}) error {
+		streams <- stream
+		return nil
+	})
+	defer clConn.Close()
+	defer srvConn.Close()
+
+	expectDone := func(reason StreamCloseReason) {
+		t.Helper()
+		select {
+		case s := <-done:
+			if s.Reason != reason {
+				t.Fatalf("expected reason %q, got %q", reason, s.Reason)
+			}
+		case <-time.After(wait.ForeverTestTimeout):
+			t.Fatalf("timed out waiting for the stream to finish")
+		}
+	}
+
+	// A stream closed by both sides frees its slot though neither read it.
+	first, err := clConn.CreateStream(http.Header{})
+	if err != nil {
+		t.Fatalf("unexpected error creating first stream: %v", err)
+	}
+	first.Close()
+	(<-streams).Close()
+	expectDone(StreamClosed)
+
+	// So does a stream removed from the connection.
+	if _, err := clConn.CreateStream(http.Header{}); err != nil {
+		t.Fatalf("unexpected error creating second stream: %v", err)
+	}
+	srvConn.RemoveStreams(<-streams)
+	expectDone(StreamRemoved)
+
+	if _, err := clConn.CreateStream(http.Header{}); err != nil {
+		t.Fatalf("unexpected error creating stream after freeing the slots: %v", err)
+	}
+}
+
+func TestConnectionStreamAccounting(t *testing.T) {
+	done := make(chan StreamStats, 10)
+	clConn, srvConn := newTestConnectionPair(t, ConnectionOptions{
+		OnStreamDone: func(s StreamStats) { done <- s },
+	}, echoStreamHandler)
+	defer clConn.Close()
+	defer srvConn.Close()
+
+	stream, err := clConn.CreateStream(http.Header{"Name": []string{"echo"}})
+	if err != nil {
+		t.Fatalf("unexpected error creating stream: %v", err)
+	}
+	msg := []byte("hello world")
+	if _, err := stream.Write(msg); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	stream.Close()
+	got, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatalf("unexpected error reading: %v", err)
+	}
+	if string(got) != string(msg) {
+		t.Fatalf("expected %q, got %q", msg, got)
+	}
+
+	select {
+	case s := <-done:
+		if s.BytesRead != int64(len(msg)) || s.BytesWritten != int64(len(msg)) {
+			t.Fatalf("unexpected stream byte counts: %#v", s)
+		}
+		if s.Headers.Get("Name") != "echo" || s.Reason != StreamClosed {
+			t.Fatalf("unexpected stream stats: %#v", s)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatalf("timed out waiting for the stream to finish")
+	}
+
+	stats := srvConn.(StatsProvider).Stats()
+	if stats.ActiveStreams != 0 || stats.TotalStreams != 1 {
+		t.Fatalf("unexpected stream counts: %#v", stats)
+	}
+	if stats.BytesRead != int64(len(msg)) || stats.BytesWritten != int64(len(msg)) {
+		t.Fatalf("unexpected connection byte counts: %#v", stats)
+	}
+
+	clStats := clConn.(StatsProvider).Stats()
+	if clStats.BytesRead != int64(len(msg)) || clStats.BytesWritten != int64(len(msg)) {
+		t.Fatalf("unexpected client byte counts: %#v", clStats)
+	}
+}
+
+func TestConnectionStreamTimeouts(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   ConnectionOptions
+		reason StreamCloseReason
+	}{
+		{name: "idle", opts: ConnectionOptions{StreamIdleTimeout: 50 * time.Millisecond}, reason: StreamIdleTimeout},
+		{name: "absolute", opts: ConnectionOptions{StreamTimeout: 50 * time.Millisecond}, reason: StreamTimeout},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			done := make(chan StreamStats, 1)
+			test.opts.OnStreamDone = func(s StreamStats) { done <- s }
+			clConn, srvConn := newTestConnectionPair(t, test.opts, httpstream.NoOpNewStreamHandler)
+			defer clConn.Close()
+			defer srvConn.Close()
+
+			stream, err := clConn.CreateStream(http.Header{})
+			if err != nil {
+				t.Fatalf("unexpected error creating stream: %v", err)
+			}
+
+			select {
+			case s := <-done:
+				if s.Reason != test.reason {
+					t.Fatalf("expected reason %q, got %q", test.reason, s.Reason)
+				}
+			case <-time.After(wait.ForeverTestTimeout):
+				t.Fatalf("timed out waiting for the stream to time out")
+			}
+
+			// The reset reaches the client, unblocking reads.
+			if _, err := io.Copy(io.Discard, stream); err != nil {
+				t.Fatalf("unexpected error reading reset stream: %v", err)
+			}
+			if stats := srvConn.(StatsProvider).Stats(); stats.ActiveStreams != 0 {
+				t.Fatalf("expected no active streams, got %d", stats.ActiveStreams)
+			}
+		})
+	}
+}
+
+func TestConnectionCloseFinishesStreams(t *testing.T) {
+	done := make(chan StreamStats, 1)
+	clConn, srvConn := newTestConnectionPair(t, ConnectionOptions{
+		OnStreamDone: func(s StreamStats) { done <- s },
+	}, httpstream.NoOpNewStreamHandler)
+	defer clConn.Close()
+
+	if _, err := clConn.CreateStream(http.Header{}); err != nil {
+		t.Fatalf("unexpected error creating stream: %v", err)
+	}
+	srvConn.Close()
+
+	select {
+	case s := <-done:
+		if s.Reason != StreamConnectionClosed {
+			t.Fatalf("expected reason %q, got %q", StreamConnectionClosed, s.Reason)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatalf("timed out waiting for the stream to finish")
+	}
+}
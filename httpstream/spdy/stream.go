@@ -0,0 +1,297 @@
+/*
+Copyright 2015 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdy
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/commcos/utils/logger"
+	"github.com/moby/spdystream"
+)
+
+// StreamCloseReason describes why a connection stopped tracking a stream.
+type StreamCloseReason string
+
+const (
+	// StreamClosed means both sides closed the stream. The remote side is
+	// closed once the peer has sent its FIN or reset the stream, whether or
+	// not the stream was read.
+	StreamClosed StreamCloseReason = "Closed"
+	// StreamReset means the stream was reset locally.
+	StreamReset StreamCloseReason = "Reset"
+	// StreamRemoved means the stream was removed from its connection with
+	// RemoveStreams before both sides closed it.
+	StreamRemoved StreamCloseReason = "Removed"
+	// StreamIdleTimeout means the stream was reset because no data was read
+	// or written for ConnectionOptions.StreamIdleTimeout.
+	StreamIdleTimeout StreamCloseReason = "IdleTimeout"
+	// StreamTimeout means the stream was reset because it was open for longer
+	// than ConnectionOptions.StreamTimeout.
+	StreamTimeout StreamCloseReason = "Timeout"
+	// StreamConnectionClosed means the stream was torn down together with its
+	// connection.
+	StreamConnectionClosed StreamCloseReason = "ConnectionClosed"
+)
+
+// StreamStats is a snapshot of the accounting kept for a single stream.
+type StreamStats struct {
+	// Identifier is the stream's ID.
+	Identifier uint32
+	// Headers are the headers used to create the stream.
+	Headers http.Header
+	// BytesRead is the number of bytes read from the stream.
+	BytesRead int64
+	// BytesWritten is the number of bytes written to the stream.
+	BytesWritten int64
+	// Created is the time the stream was opened.
+	Created time.Time
+	// LastActivity is the last time data was read from or written to the
+	// stream, or Created if no data has been transferred yet.
+	LastActivity time.Time
+	// Reason is empty while the stream is open, and otherwise records why
+	// the stream was closed.
+	Reason StreamCloseReason
+}
+
+// ConnectionStats is a snapshot of the accounting kept for a connection.
+type ConnectionStats struct {
+	// ActiveStreams is the number of streams currently open.
+	ActiveStreams int
+	// TotalStreams is the number of streams opened over the lifetime of the
+	// connection, including ones that are still active.
+	TotalStreams int64
+	// RejectedStreams is the number of streams opened by the remote peer that
+	// were refused, either because MaxConcurrentStreams was reached or
+	// because the NewStreamHandler returned an error.
+	RejectedStreams int64
+	// BytesRead is the number of bytes read from all streams of the
+	// connection, including closed ones.
+	BytesRead int64
+	// BytesWritten is the number of bytes written to all streams of the
+	// connection, including closed ones.
+	BytesWritten int64
+	// Streams holds the stats of the active streams, ordered by identifier.
+	Streams []StreamStats
+}
+
+// StatsProvider is implemented by connections that account their streams.
+// Every httpstream.Connection created by this package implements it.
+type StatsProvider interface {
+	Stats() ConnectionStats
+}
+
+// trackedStream wraps a spdystream.Stream, counting the bytes that flow
+// through it and enforcing the per-stream timeouts of its connection. It
+// implements the httpstream.Stream interface.
+type trackedStream struct {
+	// accessed atomically, kept first for alignment on 32 bit platforms.
+	bytesRead    int64
+	bytesWritten int64
+	lastActivity int64
+
+	stream  *spdystream.Stream
+	conn    *connection
+	inbound bool
+	created time.Time
+
+	idleTimeout time.Duration
+	idleTimer   *time.Timer
+	timer       *time.Timer
+
+	lock         sync.Mutex
+	localClosed  bool
+	remoteClosed bool
+	done         bool
+	reason       StreamCloseReason
+}
+
+func newTrackedStream(conn *connection, stream *spdystream.Stream, inbound bool) *trackedStream {
+	now := time.Now()
+	s := &trackedStream{
+		stream:       stream,
+		conn:         conn,
+		inbound:      inbound,
+		created:      now,
+		lastActivity: now.UnixNano(),
+		idleTimeout:  conn.opts.StreamIdleTimeout,
+	}
+
+	// The timers are assigned under the lock that their callbacks take, so a
+	// timer firing early cannot observe the fields half set.
+	s.lock.Lock()
+	if s.idleTimeout > 0 {
+		s.idleTimer = time.AfterFunc(s.idleTimeout, func() { s.expire(StreamIdleTimeout) })
+	}
+	if conn.opts.StreamTimeout > 0 {
+		s.timer = time.AfterFunc(conn.opts.StreamTimeout, func() { s.expire(StreamTimeout) })
+	}
+	s.lock.Unlock()
+	go s.watchRemote()
+	return s
+}
+
+// watchRemote marks the remote side of the stream as closed once the peer
+// has sent its FIN or reset the stream. spdystream only exposes this through
+// ReceiveHeader, which returns an error once the stream is closed; the
+// headers sent on the stream meanwhile are discarded, as nothing else
+// receives them.
+func (s *trackedStream) watchRemote() {
+	for {
+		if _, err := s.stream.ReceiveHeader(); err != nil {
+			break
+		}
+	}
+	s.closeSide(false)
+}
+
+// Read reads from the underlying stream.
+func (s *trackedStream) Read(p []byte) (int, error) {
+	n, err := s.stream.Read(p)
+	if n > 0 {
+		atomic.AddInt64(&s.bytesRead, int64(n))
+		atomic.AddInt64(&s.conn.bytesRead, int64(n))
+		s.touch()
+	}
+	return n, err
+}
+
+// Write writes to the underlying stream.
+func (s *trackedStream) Write(p []byte) (int, error) {
+	n, err := s.stream.Write(p)
+	if n > 0 {
+		atomic.AddInt64(&s.bytesWritten, int64(n))
+		atomic.AddInt64(&s.conn.bytesWritten, int64(n))
+		s.touch()
+	}
+	return n, err
+}
+
+// Close half-closes the stream. The stream is done once the remote side has
+// been observed closed as well.
+func (s *trackedStream) Close() error {
+	err := s.stream.Close()
+	s.closeSide(true)
+	return err
+}
+
+// Reset closes both directions of the stream.
+func (s *trackedStream) Reset() error {
+	s.finish(StreamReset)
+	return s.stream.Reset()
+}
+
+// Headers returns the headers used to create the stream.
+func (s *trackedStream) Headers() http.Header {
+	return s.stream.Headers()
+}
+
+// Identifier returns the stream's ID.
+func (s *trackedStream) Identifier() uint32 {
+	return s.stream.Identifier()
+}
+
+// touch records activity on the stream and pushes back its idle timeout.
+func (s *trackedStream) touch() {
+	atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
+	if s.idleTimer != nil {
+		s.lock.Lock()
+		if !s.done {
+			s.idleTimer.Reset(s.idleTimeout)
+		}
+		s.lock.Unlock()
+	}
+}
+
+// closeSide marks the local or remote side of the stream as closed, and
+// finishes the stream when both are.
+func (s *trackedStream) closeSide(local bool) {
+	s.lock.Lock()
+	if local {
+		s.localClosed = true
+	} else {
+		s.remoteClosed = true
+	}
+	closed := s.localClosed && s.remoteClosed
+	s.lock.Unlock()
+
+	if closed {
+		s.finish(StreamClosed)
+	}
+}
+
+// expire resets the stream because one of its timeouts fired.
+func (s *trackedStream) expire(reason StreamCloseReason) {
+	if !s.finish(reason) {
+		return
+	}
+	logger.Logf(logger.DebugLevel, "Resetting stream %d: %s", s.Identifier(), reason)
+	s.stream.Reset()
+}
+
+// finish marks the stream as done, stops its timers and reports it to the
+// connection. It returns false if the stream was already done.
+func (s *trackedStream) finish(reason StreamCloseReason) bool {
+	if !s.markDone(reason) {
+		return false
+	}
+	s.conn.streamDone(s, true)
+	return true
+}
+
+// reject marks a stream refused by the NewStreamHandler as done without
+// reporting it as a completed stream.
+func (s *trackedStream) reject() {
+	if s.markDone(StreamReset) {
+		s.conn.streamDone(s, false)
+	}
+}
+
+func (s *trackedStream) markDone(reason StreamCloseReason) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.done {
+		return false
+	}
+	s.done = true
+	s.reason = reason
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+	}
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	return true
+}
+
+// stats returns a snapshot of the stream's accounting.
+func (s *trackedStream) stats() StreamStats {
+	s.lock.Lock()
+	reason := s.reason
+	s.lock.Unlock()
+	return StreamStats{
+		Identifier:   s.Identifier(),
+		Headers:      s.Headers(),
+		BytesRead:    atomic.LoadInt64(&s.bytesRead),
+		BytesWritten: atomic.LoadInt64(&s.bytesWritten),
+		Created:      s.created,
+		LastActivity: time.Unix(0, atomic.LoadInt64(&s.lastActivity)),
+		Reason:       reason,
+	}
+}
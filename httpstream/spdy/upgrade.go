@@ -35,7 +35,7 @@ const HeaderSpdy31 = "SPDY/3.1"
 // responseUpgrader knows how to upgrade HTTP responses. It
 // implements the httpstream.ResponseUpgrader interface.
 type responseUpgrader struct {
-	pingPeriod time.Duration
+	opts ConnectionOptions
 }
 
 // connWrapper is used to wrap a hijacked connection and its bufio.Reader. All
@@ -77,7 +77,14 @@ func NewResponseUpgrader() httpstream.ResponseUpgrader {
 // goroutine will send periodic Ping frames to the server. Use this to keep
 // idle connections through certain load balancers alive longer.
 func NewResponseUpgraderWithPings(pingPeriod time.Duration) httpstream.ResponseUpgrader {
-	return responseUpgrader{pingPeriod: pingPeriod}
+	return NewResponseUpgraderWithOptions(ConnectionOptions{PingPeriod: pingPeriod})
+}
+
+// NewResponseUpgraderWithOptions returns a new httpstream.ResponseUpgrader
+// whose upgraded connections admit, time out and account their streams
+// according to opts. See NewServerConnectionWithOptions.
+func NewResponseUpgraderWithOptions(opts ConnectionOptions) httpstream.ResponseUpgrader {
+	return responseUpgrader{opts: opts}
 }
 
 // UpgradeResponse upgrades an HTTP response to one that supports multiplexed
@@ -110,7 +117,7 @@ func (u responseUpgrader) UpgradeResponse(w http.ResponseWriter, req *http.Reque
 	}
 
 	connWithBuf := &connWrapper{Conn: conn, bufReader: bufrw.Reader}
-	spdyConn, err := NewServerConnectionWithPings(connWithBuf, newStreamHandler, u.pingPeriod)
+	spdyConn, err := NewServerConnectionWithOptions(connWithBuf, newStreamHandler, u.opts)
 	if err != nil {
 		runtime.HandleError(fmt.Errorf("unable to upgrade: error creating SPDY server connection: %v", err))
 		return nil
@@ -0,0 +1,23 @@
+/*
+
+Copyright 2021-2022 This Project Authors.
+
+Author:  seanchann <seanchann@foxmail.com>
+
+See docs/ for more information about the  project.
+
+*/
+
+// Package metrics provides an in-process metrics registry that serves the
+// Prometheus text exposition format, without depending on the Prometheus
+// client libraries.
+//
+// A Registry holds counters, gauges and histograms, and implements the
+// metrics provider interfaces of the workqueue, controller, eventbus and
+// restclient/metrics packages. Install makes a Registry the provider of all
+// of them, and the Registry itself is the http.Handler exposing them:
+//
+//	registry := metrics.NewRegistry()
+//	metrics.Install(registry)
+//	http.Handle("/metrics", registry)
+package metrics // import "github.com/commcos/utils/metrics"
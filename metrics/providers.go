@@ -0,0 +1,189 @@
+/*
+
+Copyright 2021-2022 This Project Authors.
+
+Author:  seanchann <seanchann@foxmail.com>
+
+See docs/ for more information about the  project.
+
+*/
+
+package metrics
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/commcos/utils/controller"
+	"github.com/commcos/utils/eventbus"
+	restclientmetrics "github.com/commcos/utils/restclient/metrics"
+	"github.com/commcos/utils/workqueue"
+)
+
+var (
+	_ workqueue.MetricsProvider       = &Registry{}
+	_ workqueue.BatchMetricsProvider  = &Registry{}
+	_ workqueue.FlowMetricsProvider   = &Registry{}
+	_ controller.MetricsProvider      = &Registry{}
+	_ eventbus.MetricsProvider        = &Registry{}
+	_ restclientmetrics.LatencyMetric = &Registry{}
+	_ restclientmetrics.ResultMetric  = &Registry{}
+)
+
+// workqueueDurationBuckets cover durations from 10ns to 10s.
+var workqueueDurationBuckets = ExponentialBuckets(10e-9, 10, 10)
+
+// batchSizeBuckets cover batches of 1 to 1024 items.
+var batchSizeBuckets = ExponentialBuckets(1, 2, 11)
+
+// Install makes r the metrics provider of the workqueue, controller, eventbus
+// and restclient/metrics packages. As with the packages' own registration
+// functions, only the first provider installed is used.
+func Install(r *Registry) {
+	workqueue.SetProvider(r)
+	controller.SetProvider(r)
+	eventbus.SetProvider(r)
+	restclientmetrics.Register(r, r)
+}
+
+// NewDepthMetric implements workqueue.MetricsProvider.
+func (r *Registry) NewDepthMetric(name string) workqueue.GaugeMetric {
+	return r.Gauge("workqueue_depth", "Current depth of workqueue.", Labels{"name": name})
+}
+
+// NewAddsMetric implements workqueue.MetricsProvider.
+func (r *Registry) NewAddsMetric(name string) workqueue.CounterMetric {
+	return r.Counter("workqueue_adds_total", "Total number of adds handled by workqueue.", Labels{"name": name})
+}
+
+// NewLatencyMetric implements workqueue.MetricsProvider.
+func (r *Registry) NewLatencyMetric(name string) workqueue.HistogramMetric {
+	return r.Histogram("workqueue_queue_duration_seconds", "How long in seconds an item stays in workqueue before being requested.",
+		workqueueDurationBuckets, Labels{"name": name})
+}
+
+// NewWorkDurationMetric implements workqueue.MetricsProvider.
+func (r *Registry) NewWorkDurationMetric(name string) workqueue.HistogramMetric {
+	return r.Histogram("workqueue_work_duration_seconds", "How long in seconds processing an item from workqueue takes.",
+		workqueueDurationBuckets, Labels{"name": name})
+}
+
+// NewUnfinishedWorkSecondsMetric implements workqueue.MetricsProvider.
+func (r *Registry) NewUnfinishedWorkSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return r.Gauge("workqueue_unfinished_work_seconds", "How many seconds of work has been done that is in progress and hasn't been observed by work_duration.",
+		Labels{"name": name})
+}
+
+// NewLongestRunningProcessorSecondsMetric implements workqueue.MetricsProvider.
+func (r *Registry) NewLongestRunningProcessorSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return r.Gauge("workqueue_longest_running_processor_seconds", "How many seconds has the longest running processor for workqueue been running.",
+		Labels{"name": name})
+}
+
+// NewRetriesMetric implements workqueue.MetricsProvider.
+func (r *Registry) NewRetriesMetric(name string) workqueue.CounterMetric {
+	return r.Counter("workqueue_retries_total", "Total number of retries handled by workqueue.", Labels{"name": name})
+}
+
+// NewBatchSizeMetric implements workqueue.BatchMetricsProvider.
+func (r *Registry) NewBatchSizeMetric(name string) workqueue.HistogramMetric {
+	return r.Histogram("workqueue_batch_size", "Number of items handed out by workqueue per batch.", batchSizeBuckets, Labels{"name": name})
+}
+
+// NewFlowDepthMetric implements workqueue.FlowMetricsProvider.
+func (r *Registry) NewFlowDepthMetric(name, flow string) workqueue.GaugeMetric {
+	return r.Gauge("workqueue_flow_depth", "Current depth of a flow of workqueue.", Labels{"name": name, "flow": flow})
+}
+
+// The deprecated workqueue metrics are not exported.
+
+// NewDeprecatedDepthMetric implements workqueue.MetricsProvider.
+func (r *Registry) NewDeprecatedDepthMetric(name string) workqueue.GaugeMetric {
+	return noopMetric{}
+}
+
+// NewDeprecatedAddsMetric implements workqueue.MetricsProvider.
+func (r *Registry) NewDeprecatedAddsMetric(name string) workqueue.CounterMetric {
+	return noopMetric{}
+}
+
+// NewDeprecatedLatencyMetric implements workqueue.MetricsProvider.
+func (r *Registry) NewDeprecatedLatencyMetric(name string) workqueue.SummaryMetric {
+	return noopMetric{}
+}
+
+// NewDeprecatedWorkDurationMetric implements workqueue.MetricsProvider.
+func (r *Registry) NewDeprecatedWorkDurationMetric(name string) workqueue.SummaryMetric {
+	return noopMetric{}
+}
+
+// NewDeprecatedUnfinishedWorkSecondsMetric implements workqueue.MetricsProvider.
+func (r *Registry) NewDeprecatedUnfinishedWorkSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return noopMetric{}
+}
+
+// NewDeprecatedLongestRunningProcessorMicrosecondsMetric implements workqueue.MetricsProvider.
+func (r *Registry) NewDeprecatedLongestRunningProcessorMicrosecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return noopMetric{}
+}
+
+// NewDeprecatedRetriesMetric implements workqueue.MetricsProvider.
+func (r *Registry) NewDeprecatedRetriesMetric(name string) workqueue.CounterMetric {
+	return noopMetric{}
+}
+
+// NewReconcileTotalMetric implements controller.MetricsProvider.
+func (r *Registry) NewReconcileTotalMetric(name string) workqueue.CounterMetric {
+	return r.Counter("controller_reconcile_total", "Total number of reconciles per controller.", Labels{"controller": name})
+}
+
+// NewReconcileErrorsMetric implements controller.MetricsProvider.
+func (r *Registry) NewReconcileErrorsMetric(name string) workqueue.CounterMetric {
+	return r.Counter("controller_reconcile_errors_total", "Total number of reconcile errors per controller.", Labels{"controller": name})
+}
+
+// NewReconcileTimeMetric implements controller.MetricsProvider.
+func (r *Registry) NewReconcileTimeMetric(name string) workqueue.HistogramMetric {
+	return r.Histogram("controller_reconcile_time_seconds", "Length of time per reconcile per controller.", DefBuckets,
+		Labels{"controller": name})
+}
+
+// NewActiveWorkersMetric implements controller.MetricsProvider.
+func (r *Registry) NewActiveWorkersMetric(name string) workqueue.GaugeMetric {
+	return r.Gauge("controller_active_workers", "Number of reconciles currently in flight per controller.", Labels{"controller": name})
+}
+
+// NewMailboxDepthMetric implements eventbus.MetricsProvider.
+func (r *Registry) NewMailboxDepthMetric(topic string) eventbus.GaugeMetric {
+	return r.Gauge("eventbus_mailbox_depth", "Current number of events waiting in the mailboxes of asynchronous subscribers.",
+		Labels{"topic": topic})
+}
+
+// NewMailboxDroppedMetric implements eventbus.MetricsProvider.
+func (r *Registry) NewMailboxDroppedMetric(topic string) eventbus.CounterMetric {
+	return r.Counter("eventbus_mailbox_dropped_total", "Total number of events dropped by the full mailboxes of asynchronous subscribers.",
+		Labels{"topic": topic})
+}
+
+// Observe implements restclientmetrics.LatencyMetric. The query of u is
+// dropped to bound the number of series.
+func (r *Registry) Observe(verb string, u url.URL, latency time.Duration) {
+	u.RawQuery = ""
+	u.Fragment = ""
+	u.User = nil
+	r.Histogram("rest_client_request_duration_seconds", "Request latency in seconds. Broken down by verb and URL.", DefBuckets,
+		Labels{"verb": verb, "url": u.String()}).Observe(latency.Seconds())
+}
+
+// Increment implements restclientmetrics.ResultMetric.
+func (r *Registry) Increment(code, method, host string) {
+	r.Counter("rest_client_requests_total", "Number of HTTP requests, partitioned by status code, method, and host.",
+		Labels{"code": code, "method": method, "host": host}).Inc()
+}
+
+type noopMetric struct{}
+
+func (noopMetric) Inc()            {}
+func (noopMetric) Dec()            {}
+func (noopMetric) Set(float64)     {}
+func (noopMetric) Observe(float64) {}
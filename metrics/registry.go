@@ -0,0 +1,321 @@
+/*
+
+Copyright 2021-2022 This Project Authors.
+
+Author:  seanchann <seanchann@foxmail.com>
+
+See docs/ for more information about the  project.
+
+*/
+
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNameRE  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// DefBuckets are the default histogram buckets, suited to durations in
+// seconds of network requests.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// ExponentialBuckets returns count buckets, the first one being start and
+// each following one factor times the previous one.
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	if count < 1 || start <= 0 || factor <= 1 {
+		panic(fmt.Sprintf("invalid exponential buckets: start %v, factor %v, count %d", start, factor, count))
+	}
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
+
+// Labels are the label names and values identifying a series of a metric.
+type Labels map[string]string
+
+type metricType string
+
+const (
+	counterType   metricType = "counter"
+	gaugeType     metricType = "gauge"
+	histogramType metricType = "histogram"
+)
+
+// Registry holds metrics and serves them in the Prometheus text exposition
+// format. Metrics are created on first use and live as long as the Registry.
+// It is safe for concurrent use.
+type Registry struct {
+	lock     sync.Mutex
+	families map[string]*family
+}
+
+// family holds the series of a metric.
+type family struct {
+	name       string
+	help       string
+	typ        metricType
+	labelNames []string
+	buckets    []float64
+	series     map[string]*series
+}
+
+// series is a metric with a set of label values.
+type series struct {
+	labelValues []string
+	metric      collector
+}
+
+// collector is implemented by Counter, Gauge and Histogram.
+type collector interface {
+	write(w *strings.Builder, name, labels string)
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{families: map[string]*family{}}
+}
+
+// Counter returns the counter name with labels, creating it if needed. It
+// panics if name was registered with another type or other label names.
+func (r *Registry) Counter(name, help string, labels Labels) *Counter {
+	return r.get(name, help, counterType, nil, labels, func() collector {
+		return &Counter{}
+	}).(*Counter)
+}
+
+// Gauge returns the gauge name with labels, creating it if needed. It panics
+// if name was registered with another type or other label names.
+func (r *Registry) Gauge(name, help string, labels Labels) *Gauge {
+	return r.get(name, help, gaugeType, nil, labels, func() collector {
+		return &Gauge{}
+	}).(*Gauge)
+}
+
+// Histogram returns the histogram name with labels, creating it if needed.
+// The buckets are the upper bounds of the histogram's buckets, DefBuckets if
+// nil; they are fixed by the first call for name. It panics if name was
+// registered with another type or other label names.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels Labels) *Histogram {
+	return r.get(name, help, histogramType, buckets, labels, nil).(*Histogram)
+}
+
+func (r *Registry) get(name, help string, typ metricType, buckets []float64, labels Labels, newCollector func() collector) collector {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	f, exists := r.families[name]
+	if !exists {
+		f = newFamily(name, help, typ, buckets, labels)
+		r.families[name] = f
+	} else if f.typ != typ {
+		panic(fmt.Sprintf("metric %q registered as a %s, not a %s", name, f.typ, typ))
+	}
+
+	values := make([]string, 0, len(f.labelNames))
+	for _, label := range f.labelNames {
+		value, ok := labels[label]
+		if !ok {
+			panic(fmt.Sprintf("metric %q requires labels %v, got %v", name, f.labelNames, labels))
+		}
+		values = append(values, value)
+	}
+	if len(labels) != len(f.labelNames) {
+		panic(fmt.Sprintf("metric %q requires labels %v, got %v", name, f.labelNames, labels))
+	}
+
+	key := strings.Join(values, "\xff")
+	s, exists := f.series[key]
+	if !exists {
+		var c collector
+		if typ == histogramType {
+			c = newHistogram(f.buckets)
+		} else {
+			c = newCollector()
+		}
+		s = &series{labelValues: values, metric: c}
+		f.series[key] = s
+	}
+	return s.metric
+}
+
+func newFamily(name, help string, typ metricType, buckets []float64, labels Labels) *family {
+	if !metricNameRE.MatchString(name) {
+		panic(fmt.Sprintf("invalid metric name %q", name))
+	}
+	labelNames := make([]string, 0, len(labels))
+	for label := range labels {
+		if !labelNameRE.MatchString(label) || strings.HasPrefix(label, "__") || (typ == histogramType && label == "le") {
+			panic(fmt.Sprintf("invalid label name %q for metric %q", label, name))
+		}
+		labelNames = append(labelNames, label)
+	}
+	sort.Strings(labelNames)
+
+	if typ == histogramType {
+		if buckets == nil {
+			buckets = DefBuckets
+		}
+		buckets = append([]float64(nil), buckets...)
+		sort.Float64s(buckets)
+		if n := len(buckets); n > 0 && math.IsInf(buckets[n-1], +1) {
+			// The +Inf bucket is always exposed.
+			buckets = buckets[:n-1]
+		}
+	}
+
+	return &family{
+		name:       name,
+		help:       help,
+		typ:        typ,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     map[string]*series{},
+	}
+}
+
+// Counter is a metric that only goes up.
+type Counter struct {
+	lock  sync.Mutex
+	value float64
+}
+
+// Inc increments the counter by 1.
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add increments the counter by v. It panics if v is negative.
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		panic("counter cannot decrease")
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.value += v
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() float64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.value
+}
+
+func (c *Counter) write(w *strings.Builder, name, labels string) {
+	writeSample(w, name, labels, c.Value())
+}
+
+// Gauge is a metric that can go up and down.
+type Gauge struct {
+	lock  sync.Mutex
+	value float64
+}
+
+// Set sets the gauge to v.
+func (g *Gauge) Set(v float64) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.value = v
+}
+
+// Inc increments the gauge by 1.
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+// Dec decrements the gauge by 1.
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+// Add adds v, which may be negative, to the gauge.
+func (g *Gauge) Add(v float64) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.value += v
+}
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value() float64 {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.value
+}
+
+func (g *Gauge) write(w *strings.Builder, name, labels string) {
+	writeSample(w, name, labels, g.Value())
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	lock    sync.Mutex
+	buckets []float64
+	// counts holds the observations per bucket, the last element counting
+	// the ones above the highest bucket.
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)+1),
+	}
+}
+
+// Observe adds an observation to the histogram.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.counts[i]++
+	h.count++
+	h.sum += v
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count() uint64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.count
+}
+
+// Sum returns the sum of the observations.
+func (h *Histogram) Sum() float64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.sum
+}
+
+func (h *Histogram) write(w *strings.Builder, name, labels string) {
+	h.lock.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	count, sum := h.count, h.sum
+	h.lock.Unlock()
+
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += counts[i]
+		writeSample(w, name+"_bucket", labels+sep+`le="`+formatFloat(bound)+`"`, float64(cumulative))
+	}
+	writeSample(w, name+"_bucket", labels+sep+`le="+Inf"`, float64(count))
+	writeSample(w, name+"_sum", labels, sum)
+	writeSample(w, name+"_count", labels, float64(count))
+}
@@ -0,0 +1,213 @@
+/*
+
+Copyright 2021-2022 This Project Authors.
+
+Author:  seanchann <seanchann@foxmail.com>
+
+See docs/ for more information about the  project.
+
+*/
+
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/commcos/utils/eventbus"
+	"github.com/commcos/utils/workqueue"
+)
+
+func TestTextExposition(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("requests_total", "Total requests.", Labels{"code": "200", "path": "/a"}).Add(3)
+	r.Counter("requests_total", "Total requests.", Labels{"code": "500", "path": "/a"}).Inc()
+	r.Counter("requests_total", "Total requests.", Labels{"code": "200", "path": `q"\`}).Inc()
+	g := r.Gauge("depth", "Current\ndepth.", nil)
+	g.Inc()
+	g.Inc()
+	g.Dec()
+	h := r.Histogram("latency_seconds", "", []float64{1, 0.5}, Labels{"op": "get"})
+	h.Observe(0.2)
+	h.Observe(0.5)
+	h.Observe(0.7)
+	h.Observe(3)
+
+	expected := `# HELP depth Current\ndepth.
+# TYPE depth gauge
+depth 1
+# TYPE latency_seconds histogram
+latency_seconds_bucket{op="get",le="0.5"} 2
+latency_seconds_bucket{op="get",le="1"} 3
+latency_seconds_bucket{op="get",le="+Inf"} 4
+latency_seconds_sum{op="get"} 4.4
+latency_seconds_count{op="get"} 4
+# HELP requests_total Total requests.
+# TYPE requests_total counter
+requests_total{code="200",path="/a"} 3
+requests_total{code="200",path="q\"\\"} 1
+requests_total{code="500",path="/a"} 1
+`
+	var b strings.Builder
+	if _, err := r.WriteTo(&b); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if b.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, b.String())
+	}
+}
+
+func TestRegistryReusesMetrics(t *testing.T) {
+	r := NewRegistry()
+	a := r.Counter("c", "", Labels{"l": "x"})
+	if b := r.Counter("c", "", Labels{"l": "x"}); a != b {
+		t.Errorf("expected the same counter for the same labels")
+	}
+	if b := r.Counter("c", "", Labels{"l": "y"}); a == b {
+		t.Errorf("expected different counters for different labels")
+	}
+
+	for _, test := range []struct {
+		name string
+		f    func()
+	}{
+		{"type", func() { r.Gauge("c", "", Labels{"l": "x"}) }},
+		{"missing label", func() { r.Counter("c", "", nil) }},
+		{"extra label", func() { r.Counter("c", "", Labels{"l": "x", "m": "y"}) }},
+		{"metric name", func() { r.Counter("1c", "", nil) }},
+		{"label name", func() { r.Counter("d", "", Labels{"a-b": "x"}) }},
+		{"le label", func() { r.Histogram("h", "", nil, Labels{"le": "x"}) }},
+		{"negative counter", func() { a.Add(-1) }},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: expected a panic", test.name)
+				}
+			}()
+			test.f()
+		}()
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("hits_total", "Hits.", nil).Inc()
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+	if e, a := ContentType, resp.Header.Get("Content-Type"); e != a {
+		t.Errorf("expected content type %q, got %q", e, a)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if e, a := "# HELP hits_total Hits.\n# TYPE hits_total counter\nhits_total 1\n", string(body); e != a {
+		t.Errorf("expected %q, got %q", e, a)
+	}
+
+	resp, err = http.Post(server.URL, "text/plain", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405, got %d", resp.StatusCode)
+	}
+}
+
+var (
+	installOnce       sync.Once
+	installedRegistry *Registry
+	queueID           int
+)
+
+// installed returns the Registry installed as the global metrics provider.
+// Providers can only be installed once per process.
+func installed() *Registry {
+	installOnce.Do(func() {
+		installedRegistry = NewRegistry()
+		Install(installedRegistry)
+	})
+	return installedRegistry
+}
+
+func TestWorkqueueProvider(t *testing.T) {
+	r := installed()
+
+	queueID++
+	name := "test" + strconv.Itoa(queueID)
+	q := workqueue.NewNamed(name)
+	defer q.ShutDown()
+	q.Add("a")
+	q.Add("b")
+	item, _ := q.Get()
+	q.Done(item)
+
+	var b strings.Builder
+	r.WriteTo(&b)
+	for _, line := range []string{
+		`workqueue_adds_total{name="` + name + `"} 2`,
+		`workqueue_depth{name="` + name + `"} 1`,
+		`workqueue_work_duration_seconds_count{name="` + name + `"} 1`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("expected %q in:\n%s", line, b.String())
+		}
+	}
+}
+
+func TestEventbusProvider(t *testing.T) {
+	r := installed()
+
+	bus := eventbus.New(1)
+	release := make(chan struct{})
+	bus.SubscribeAsyncPool("metrics.test", func(n int) { <-release }, true,
+		eventbus.WithMailbox(eventbus.MailboxConfig{Size: 1, Policy: eventbus.MailboxDropNewest}))
+	for n := 0; n < 5; n++ {
+		bus.Publish("metrics.test", n)
+	}
+	close(release)
+	bus.WaitAsync()
+
+	var b strings.Builder
+	r.WriteTo(&b)
+	for _, line := range []string{
+		`eventbus_mailbox_depth{topic="metrics.test"} 0`,
+		`eventbus_mailbox_dropped_total{topic="metrics.test"}`,
+	} {
+		if !strings.Contains(b.String(), line) {
+			t.Errorf("expected %q in:\n%s", line, b.String())
+		}
+	}
+}
+
+func TestRestClientProvider(t *testing.T) {
+	r := NewRegistry()
+	r.Observe("GET", url.URL{Scheme: "https", Host: "example.com", Path: "/api", RawQuery: "token=secret"}, time.Second)
+	r.Increment("200", "GET", "example.com")
+
+	var b strings.Builder
+	r.WriteTo(&b)
+	for _, line := range []string{
+		`rest_client_request_duration_seconds_count{url="https://example.com/api",verb="GET"} 1`,
+		`rest_client_requests_total{code="200",host="example.com",method="GET"} 1`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("expected %q in:\n%s", line, b.String())
+		}
+	}
+}
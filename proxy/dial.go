@@ -0,0 +1,93 @@
+/*
+Copyright 2014 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/commcos/utils/logger"
+	utilnet "github.com/commcos/utils/net"
+	"github.com/commcos/utils/third_party/forked/golang/netutil"
+)
+
+// dialURL will dial the specified URL using the underlying dialer held by the
+// passed RoundTripper. The primary use of this method is to support proxying
+// upgradable connections. For this reason this method will prefer to negotiate
+// http/1.1 if the URL scheme is https. If you wish to ensure ALPN negotiates
+// http2 then set NextProto=[]string{"http2"} in the passed RoundTripper.
+func dialURL(ctx context.Context, url *url.URL, transport http.RoundTripper) (net.Conn, error) {
+	dialAddr := netutil.CanonicalAddr(url)
+
+	dialer, err := utilnet.DialerFor(transport)
+	if err != nil {
+		logger.Logf(logger.DebugLevel, "Unable to unwrap transport %T to get dialer: %v", transport, err)
+	}
+
+	switch url.Scheme {
+	case "http":
+		if dialer != nil {
+			return dialer(ctx, "tcp", dialAddr)
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", dialAddr)
+	case "https":
+		// Get the tls config from the transport if we recognize it
+		tlsConfig, err := utilnet.TLSClientConfig(transport)
+		if err != nil {
+			logger.Logf(logger.DebugLevel, "Unable to unwrap transport %T to get at TLS config: %v", transport, err)
+		}
+
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		} else {
+			tlsConfig = tlsConfig.Clone()
+		}
+		if len(tlsConfig.ServerName) == 0 {
+			// the handshake below verifies the certificate against this name
+			tlsConfig.ServerName, _, _ = net.SplitHostPort(dialAddr)
+		}
+		// prefer http/1.1 since only it supports connection upgrades
+		if len(tlsConfig.NextProtos) == 0 {
+			tlsConfig.NextProtos = []string{"http/1.1"}
+		}
+
+		var netConn net.Conn
+		if dialer != nil {
+			netConn, err = dialer(ctx, "tcp", dialAddr)
+		} else {
+			var d net.Dialer
+			netConn, err = d.DialContext(ctx, "tcp", dialAddr)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConn := tls.Client(netConn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	default:
+		return nil, fmt.Errorf("unknown scheme: %s", url.Scheme)
+	}
+}
@@ -0,0 +1,433 @@
+/*
+Copyright 2014 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/commcos/utils/httpstream"
+	"github.com/commcos/utils/logger"
+	utilnet "github.com/commcos/utils/net"
+	"github.com/commcos/utils/runtime"
+)
+
+// UpgradeAwareHandler is a handler for proxy requests that may require an upgrade
+type UpgradeAwareHandler struct {
+	// UpgradeRequired will reject non-upgrade connections if true.
+	UpgradeRequired bool
+	// Location is the location of the upstream proxy. It is used as the location to Dial on the upstream server
+	// for upgrade requests unless UseRequestLocation is true.
+	Location *url.URL
+	// UseRequestLocation will use the incoming request URL when talking to the backend server.
+	UseRequestLocation bool
+	// UseLocationHost overrides the HTTP host header in requests to the backend server to use the Host from Location.
+	// This will override the req.Host field of a request, while UseRequestLocation will override the req.URL field
+	// of a request. The req.URL.Host specifies the server to connect to, while the req.Host field
+	// specifies the Host header value to send in the HTTP request. If this is false, the incoming req.Host header will
+	// just be forwarded to the backend server.
+	UseLocationHost bool
+	// PathPrepend is prepended to the path of Location headers returned by
+	// the backend, so that redirects keep going through the proxy. The scheme
+	// and host of such headers are always rewritten to the ones of the
+	// incoming request.
+	PathPrepend string
+	// Transport provides an optional round tripper to use to proxy. If nil, the default proxy transport is used
+	Transport http.RoundTripper
+	// UpgradeTransport, if specified, will be used to dial the backend for
+	// upgrade requests. If it implements net.Dialer of this module (as
+	// spdy.SpdyRoundTripper does) its Dial method is used, otherwise the
+	// connection is dialed with its dialer and TLS settings, see
+	// net.DialerFor and net.TLSClientConfig. Upgrade requests fail if it
+	// provides neither. Transport is only used to dial when it is nil.
+	UpgradeTransport httpstream.UpgradeRoundTripper
+	// FlushInterval controls how often the standard HTTP proxy will flush content from the upstream.
+	FlushInterval time.Duration
+	// IdleTimeout closes an upgraded connection once no data has been
+	// exchanged in either direction for the given duration. Zero disables the
+	// timeout.
+	IdleTimeout time.Duration
+	// Responder is passed errors that occur while setting up proxying. If
+	// nil, errors are answered with 502 Bad Gateway.
+	Responder ErrorResponder
+}
+
+const defaultFlushInterval = 200 * time.Millisecond
+
+// ErrorResponder abstracts error reporting to the proxy handler to remove the need to hardcode a particular
+// error format.
+type ErrorResponder interface {
+	Error(w http.ResponseWriter, req *http.Request, err error)
+}
+
+// NewUpgradeAwareHandler creates a new proxy handler with a default flush interval. Responder is required for returning
+// errors to the caller. A nil responder answers every error with 502 Bad Gateway.
+func NewUpgradeAwareHandler(location *url.URL, transport http.RoundTripper, upgradeRequired bool, responder ErrorResponder) *UpgradeAwareHandler {
+	return &UpgradeAwareHandler{
+		Location:        location,
+		Transport:       transport,
+		UpgradeRequired: upgradeRequired,
+		FlushInterval:   defaultFlushInterval,
+		Responder:       responder,
+	}
+}
+
+// badGatewayResponder is the ErrorResponder used when none is configured.
+type badGatewayResponder struct{}
+
+func (badGatewayResponder) Error(w http.ResponseWriter, req *http.Request, err error) {
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
+
+func (h *UpgradeAwareHandler) responder() ErrorResponder {
+	if h.Responder == nil {
+		return badGatewayResponder{}
+	}
+	return h.Responder
+}
+
+// ServeHTTP handles the proxy request
+func (h *UpgradeAwareHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if h.tryUpgrade(w, req) {
+		return
+	}
+	if h.UpgradeRequired {
+		http.Error(w, "Upgrade request required", http.StatusBadRequest)
+		return
+	}
+
+	loc := *h.Location
+	loc.RawQuery = req.URL.RawQuery
+
+	// If original request URL ended in '/', append a '/' at the end of the
+	// of the proxy URL
+	if !strings.HasSuffix(loc.Path, "/") && strings.HasSuffix(req.URL.Path, "/") {
+		loc.Path += "/"
+	}
+
+	newReq := req.WithContext(req.Context())
+	newReq.Header = utilnet.CloneHeader(req.Header)
+	if !h.UseRequestLocation {
+		newReq.URL = &loc
+	}
+	setForwardedHeaders(newReq, req)
+	if h.UseLocationHost {
+		// exchanging req.Host with the backend location is necessary for backends that act on the HTTP host header (e.g. API gateways),
+		// because req.Host has preference over req.URL.Host in filling this header field
+		newReq.Host = h.Location.Host
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: h.Location.Scheme, Host: h.Location.Host})
+	proxy.Transport = h.Transport
+	proxy.FlushInterval = h.FlushInterval
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		h.rewriteLocationHeader(resp.Header, req)
+		return nil
+	}
+	// the responder might be used for providing a unified error reporting
+	// or supporting retry mechanisms by not sending non-fatal errors to the clients
+	proxy.ErrorHandler = h.responder().Error
+	proxy.ServeHTTP(w, newReq)
+}
+
+// tryUpgrade returns true if the request was handled.
+func (h *UpgradeAwareHandler) tryUpgrade(w http.ResponseWriter, req *http.Request) bool {
+	if !httpstream.IsUpgradeRequest(req) {
+		logger.Logf(logger.TraceLevel, "Request was not an upgrade")
+		return false
+	}
+
+	location := *h.Location
+	if h.UseRequestLocation {
+		location = *req.URL
+		location.Scheme = h.Location.Scheme
+		location.Host = h.Location.Host
+	}
+
+	clone := utilnet.CloneRequest(req)
+	// Only append X-Forwarded-For in the upgrade path, since httputil.NewSingleHostReverseProxy
+	// handles this in the non-upgrade path.
+	utilnet.AppendForwardedForHeader(clone)
+	setForwardedHeaders(clone, req)
+	logger.Logf(logger.TraceLevel, "Connecting to backend proxy %s\n  Headers: %v", &location, clone.Header)
+	if h.UseLocationHost {
+		clone.Host = h.Location.Host
+	}
+	clone.URL = &location
+	backendConn, err := h.DialForUpgrade(clone)
+	if err != nil {
+		logger.Logf(logger.DebugLevel, "Proxy connection error: %v", err)
+		h.responder().Error(w, req, err)
+		return true
+	}
+	defer backendConn.Close()
+
+	// determine the http response code from the backend, keeping the raw
+	// bytes read in the process so they can be forwarded verbatim
+	backendHTTPResponse, rawResponse, err := getResponse(backendConn)
+	if err != nil {
+		logger.Logf(logger.DebugLevel, "Proxy connection error: %v", err)
+		h.responder().Error(w, req, err)
+		return true
+	}
+
+	// If the backend did not upgrade the request, return an error to the client. If the response was
+	// an error, the error is forwarded directly after the connection is hijacked. Otherwise, just
+	// return a generic error here.
+	if backendHTTPResponse.StatusCode != http.StatusSwitchingProtocols && backendHTTPResponse.StatusCode < 400 {
+		err := fmt.Errorf("invalid upgrade response: status code %d", backendHTTPResponse.StatusCode)
+		logger.Logf(logger.ErrorLevel, "Proxy upgrade error: %v", err)
+		h.responder().Error(w, req, err)
+		return true
+	}
+
+	// Once the connection is hijacked, the ErrorResponder will no longer work, so
+	// hijacking should be the last step in the upgrade.
+	requestHijacker, ok := w.(http.Hijacker)
+	if !ok {
+		logger.Logf(logger.DebugLevel, "Unable to hijack response writer: %T", w)
+		h.responder().Error(w, req, fmt.Errorf("request connection cannot be hijacked: %T", w))
+		return true
+	}
+	requestHijackedConn, _, err := requestHijacker.Hijack()
+	if err != nil {
+		logger.Logf(logger.DebugLevel, "Unable to hijack response: %v", err)
+		h.responder().Error(w, req, fmt.Errorf("error hijacking connection: %v", err))
+		return true
+	}
+	defer requestHijackedConn.Close()
+
+	if backendHTTPResponse.StatusCode != http.StatusSwitchingProtocols {
+		// If the backend did not upgrade the request, echo the response from the backend to the client and return, closing the connection.
+		logger.Logf(logger.DebugLevel, "Proxy upgrade error, status code %d", backendHTTPResponse.StatusCode)
+		// set read/write deadlines
+		deadline := time.Now().Add(10 * time.Second)
+		backendConn.SetReadDeadline(deadline)
+		requestHijackedConn.SetWriteDeadline(deadline)
+		// write the response to the client
+		h.rewriteLocationHeader(backendHTTPResponse.Header, req)
+		err := backendHTTPResponse.Write(requestHijackedConn)
+		if err != nil && !isClosedConnError(err) {
+			logger.Logf(logger.ErrorLevel, "Error proxying data from backend to client: %v", err)
+		}
+		// Indicate we handled the request
+		return true
+	}
+
+	// Forward raw response bytes back to client.
+	if len(rawResponse) > 0 {
+		logger.Logf(logger.TraceLevel, "Writing %d bytes to hijacked connection", len(rawResponse))
+		if _, err = requestHijackedConn.Write(rawResponse); err != nil {
+			runtime.HandleError(fmt.Errorf("error proxying response from backend to client: %v", err))
+		}
+	}
+
+	splice(requestHijackedConn, backendConn, h.IdleTimeout)
+	logger.Logf(logger.TraceLevel, "Disconnecting from backend proxy %s\n  Headers: %v", &location, clone.Header)
+
+	return true
+}
+
+// splice copies data in both directions between the client and the backend
+// connection. Once one side of the connection exits, or no data has been
+// exchanged for idleTimeout, both connections are closed.
+func splice(client, backend net.Conn, idleTimeout time.Duration) {
+	var closeOnce sync.Once
+	closeBoth := func() {
+		closeOnce.Do(func() {
+			client.Close()
+			backend.Close()
+		})
+	}
+	defer closeBoth()
+
+	var idle *time.Timer
+	touch := func() {}
+	if idleTimeout > 0 {
+		idle = time.AfterFunc(idleTimeout, func() {
+			logger.Logf(logger.DebugLevel, "Closing upgraded connection after being idle for %v", idleTimeout)
+			closeBoth()
+		})
+		defer idle.Stop()
+		touch = func() { idle.Reset(idleTimeout) }
+	}
+
+	// Proxy the connection. This is bidirectional, so we need a goroutine
+	// to copy in each direction. Once one side of the connection exits, we
+	// exit the function which performs cleanup and in the process closes
+	// the other half of the connection in the defer.
+	writerComplete := make(chan struct{})
+	readerComplete := make(chan struct{})
+
+	go func() {
+		_, err := io.Copy(backend, activityReader{client, touch})
+		if err != nil && !isClosedConnError(err) {
+			logger.Logf(logger.ErrorLevel, "Error proxying data from client to backend: %v", err)
+		}
+		close(writerComplete)
+	}()
+
+	go func() {
+		_, err := io.Copy(client, activityReader{backend, touch})
+		if err != nil && !isClosedConnError(err) {
+			logger.Logf(logger.ErrorLevel, "Error proxying data from backend to client: %v", err)
+		}
+		close(readerComplete)
+	}()
+
+	// Wait for one half the connection to exit. Once it does the defer will
+	// clean up the other half of the connection.
+	select {
+	case <-writerComplete:
+	case <-readerComplete:
+	}
+}
+
+// activityReader calls touch after every read that returned data.
+type activityReader struct {
+	r     io.Reader
+	touch func()
+}
+
+func (a activityReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if n > 0 {
+		a.touch()
+	}
+	return n, err
+}
+
+// DialForUpgrade dials the backend at req.URL and writes req to it, using
+// UpgradeTransport if specified, and Transport otherwise.
+func (h *UpgradeAwareHandler) DialForUpgrade(req *http.Request) (net.Conn, error) {
+	if h.UpgradeTransport == nil {
+		return dial(req, h.Transport)
+	}
+	if dialer, ok := h.UpgradeTransport.(utilnet.Dialer); ok {
+		return dialer.Dial(req)
+	}
+	_, dialerErr := utilnet.DialerFor(h.UpgradeTransport)
+	_, tlsErr := utilnet.TLSClientConfig(h.UpgradeTransport)
+	if dialerErr != nil && tlsErr != nil {
+		return nil, fmt.Errorf("unable to dial the backend with upgrade transport %T: %v", h.UpgradeTransport, dialerErr)
+	}
+	return dial(req, h.UpgradeTransport)
+}
+
+// getResponse reads a http response from the given reader, returns response,
+// the raw response bytes and error
+func getResponse(r io.Reader) (*http.Response, []byte, error) {
+	rawResponse := bytes.NewBuffer(make([]byte, 0, 256))
+	// Save the bytes read while reading the response headers into the rawResponse buffer
+	resp, err := http.ReadResponse(bufio.NewReader(io.TeeReader(r, rawResponse)), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	// return the http response and the raw bytes consumed from the reader in the process
+	return resp, rawResponse.Bytes(), nil
+}
+
+// dial dials the backend at req.URL and writes req to it.
+func dial(req *http.Request, transport http.RoundTripper) (net.Conn, error) {
+	conn, err := dialURL(req.Context(), req.URL, transport)
+	if err != nil {
+		return nil, fmt.Errorf("error dialing backend: %v", err)
+	}
+
+	if err = req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error sending request: %v", err)
+	}
+
+	return conn, err
+}
+
+// setForwardedHeaders records the host and scheme the client used to reach
+// the proxy on the outgoing request.
+func setForwardedHeaders(out, in *http.Request) {
+	if len(in.Host) > 0 && len(out.Header.Get("X-Forwarded-Host")) == 0 {
+		out.Header.Set("X-Forwarded-Host", in.Host)
+	}
+	if len(out.Header.Get("X-Forwarded-Proto")) == 0 {
+		out.Header.Set("X-Forwarded-Proto", requestScheme(in))
+	}
+}
+
+func requestScheme(req *http.Request) string {
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// rewriteLocationHeader rewrites a Location header that points at the
+// backend, so that it points at the proxy the client talked to instead.
+func (h *UpgradeAwareHandler) rewriteLocationHeader(header http.Header, req *http.Request) {
+	location := header.Get("Location")
+	if len(location) == 0 {
+		return
+	}
+	header.Set("Location", h.rewriteURL(location, req))
+}
+
+// rewriteURL rewrites a single URL to go through the proxy, if the URL refers
+// to the same host as the backend.
+func (h *UpgradeAwareHandler) rewriteURL(targetURL string, req *http.Request) string {
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return targetURL
+	}
+
+	// Example: when proxying to http://bar/... with host header "foo", a target URL of http://bar/baz should become "http://foo/baz".
+	isDifferentHost := u.Host != "" && u.Host != h.Location.Host && u.Host != req.Host
+	isRelative := !strings.HasPrefix(u.Path, "/")
+	if isDifferentHost || isRelative {
+		return targetURL
+	}
+
+	if u.Host != "" {
+		u.Scheme = requestScheme(req)
+		u.Host = req.Host
+	}
+
+	// Do not rewrite URL if it already contains the necessary prefix.
+	if len(h.PathPrepend) == 0 || strings.HasPrefix(u.Path, h.PathPrepend) {
+		return u.String()
+	}
+	origPath := u.Path
+	u.Path = path.Join(h.PathPrepend, u.Path)
+	if strings.HasSuffix(origPath, "/") {
+		// Add back the trailing slash, which was stripped by path.Join().
+		u.Path += "/"
+	}
+	return u.String()
+}
+
+func isClosedConnError(err error) bool {
+	return errors.Is(err, net.ErrClosed) || strings.Contains(err.Error(), "use of closed network connection")
+}
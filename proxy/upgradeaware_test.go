@@ -0,0 +1,306 @@
+/*
+Copyright 2014 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/commcos/utils/httpstream"
+	"github.com/commcos/utils/httpstream/spdy"
+	"github.com/commcos/utils/wait"
+)
+
+// newEchoBackend returns a server that upgrades every request to SPDY and
+// echoes the data written to each stream.
+func newEchoBackend(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/forbidden" {
+			w.Header().Set("Location", "http://"+req.Host+"/login")
+			http.Error(w, "go away", http.StatusForbidden)
+			return
+		}
+		streamCh := make(chan httpstream.Stream, 1)
+		conn := spdy.NewResponseUpgrader().UpgradeResponse(w, req, func(s httpstream.Stream, replySent <-chan struct{}) error {
+			streamCh <- s
+			return nil
+		})
+		if conn == nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			select {
+			case s := <-streamCh:
+				go func() {
+					io.Copy(s, s)
+					s.Close()
+				}()
+			case <-conn.CloseChan():
+				return
+			}
+		}
+	}))
+}
+
+func dialThroughProxy(t *testing.T, proxyURL string) (httpstream.Connection, *http.Response, error) {
+	req, err := http.NewRequest("GET", proxyURL, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating request: %v", err)
+	}
+	rt := spdy.NewRoundTripper(nil)
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := rt.NewConnection(resp)
+	return conn, resp, err
+}
+
+func TestUpgradeAwareHandlerSplicesUpgradedConnection(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	handler := NewUpgradeAwareHandler(backendURL, nil, true, nil)
+	handler.UpgradeTransport = spdy.NewRoundTripper(nil)
+	proxy := httptest.NewServer(handler)
+	defer proxy.Close()
+
+	conn, _, err := dialThroughProxy(t, proxy.URL)
+	if err != nil {
+		t.Fatalf("unexpected error upgrading through proxy: %v", err)
+	}
+	defer conn.Close()
+
+	stream, err := conn.CreateStream(http.Header{})
+	if err != nil {
+		t.Fatalf("unexpected error creating stream: %v", err)
+	}
+	if _, err := stream.Write([]byte("ping")); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	stream.Close()
+	data, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatalf("unexpected error reading: %v", err)
+	}
+	if e, a := "ping", string(data); e != a {
+		t.Errorf("expected %q, got %q", e, a)
+	}
+}
+
+// wrappingUpgradeTransport is an UpgradeRoundTripper that can not dial by
+// itself, but wraps a transport that can.
+type wrappingUpgradeTransport struct {
+	httpstream.UpgradeRoundTripper
+	wrapped http.RoundTripper
+}
+
+func (t wrappingUpgradeTransport) WrappedRoundTripper() http.RoundTripper {
+	return t.wrapped
+}
+
+// opaqueUpgradeTransport is an UpgradeRoundTripper that gives no way to dial.
+type opaqueUpgradeTransport struct {
+	httpstream.UpgradeRoundTripper
+}
+
+func TestUpgradeAwareHandlerDialsWithUpgradeTransport(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	var transportDials, upgradeDials int32
+	countingTransport := func(dials *int32) *http.Transport {
+		return &http.Transport{DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(dials, 1)
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		}}
+	}
+	handler := NewUpgradeAwareHandler(backendURL, countingTransport(&transportDials), true, nil)
+	proxy := httptest.NewServer(handler)
+	defer proxy.Close()
+
+	handler.UpgradeTransport = wrappingUpgradeTransport{
+		UpgradeRoundTripper: spdy.NewRoundTripper(nil),
+		wrapped:             countingTransport(&upgradeDials),
+	}
+	conn, _, err := dialThroughProxy(t, proxy.URL)
+	if err != nil {
+		t.Fatalf("unexpected error upgrading through proxy: %v", err)
+	}
+	conn.Close()
+	if dials := atomic.LoadInt32(&upgradeDials); dials != 1 {
+		t.Errorf("expected 1 dial with the upgrade transport, got %d", dials)
+	}
+
+	// Transport is not used in place of an upgrade transport unable to dial.
+	handler.UpgradeTransport = opaqueUpgradeTransport{spdy.NewRoundTripper(nil)}
+	if _, _, err := dialThroughProxy(t, proxy.URL); err == nil {
+		t.Errorf("expected an error upgrading with an opaque upgrade transport")
+	}
+	if dials := atomic.LoadInt32(&transportDials); dials != 0 {
+		t.Errorf("expected no dial with Transport, got %d", dials)
+	}
+}
+
+func TestUpgradeAwareHandlerForwardsErrorResponse(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL + "/forbidden")
+
+	handler := NewUpgradeAwareHandler(backendURL, nil, true, nil)
+	handler.PathPrepend = "/backend"
+	proxy := httptest.NewServer(handler)
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	_, resp, err := dialThroughProxy(t, proxy.URL)
+	if err == nil {
+		t.Fatalf("expected an error upgrading a forbidden request")
+	}
+	if resp == nil {
+		t.Fatalf("expected a response, got error %v", err)
+	}
+	if e, a := http.StatusForbidden, resp.StatusCode; e != a {
+		t.Errorf("expected status %d, got %d", e, a)
+	}
+	if !strings.Contains(err.Error(), "go away") {
+		t.Errorf("expected the backend message in the error, got %v", err)
+	}
+	if e, a := "http://"+proxyURL.Host+"/backend/login", resp.Header.Get("Location"); e != a {
+		t.Errorf("expected Location %q, got %q", e, a)
+	}
+}
+
+func TestUpgradeAwareHandlerRejectsPlainRequestWhenUpgradeRequired(t *testing.T) {
+	backendURL, _ := url.Parse("http://127.0.0.1:1")
+	proxy := httptest.NewServer(NewUpgradeAwareHandler(backendURL, nil, true, nil))
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if e, a := http.StatusBadRequest, resp.StatusCode; e != a {
+		t.Errorf("expected status %d, got %d", e, a)
+	}
+}
+
+func TestUpgradeAwareHandlerProxiesPlainRequest(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/redirect") {
+			http.Redirect(w, req, "/target/", http.StatusFound)
+			return
+		}
+		w.Header().Set("X-Seen-Host", req.Host)
+		w.Header().Set("X-Seen-Forwarded-Host", req.Header.Get("X-Forwarded-Host"))
+		io.WriteString(w, "hello "+req.URL.RawQuery)
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	handler := NewUpgradeAwareHandler(backendURL, nil, false, nil)
+	handler.UseLocationHost = true
+	handler.PathPrepend = "/prefix"
+	proxy := httptest.NewServer(handler)
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	resp, err := client.Get(proxy.URL + "?a=b")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if e, a := "hello a=b", string(body); e != a {
+		t.Errorf("expected body %q, got %q", e, a)
+	}
+	if e, a := backendURL.Host, resp.Header.Get("X-Seen-Host"); e != a {
+		t.Errorf("expected backend to see host %q, got %q", e, a)
+	}
+	if e, a := proxyURL.Host, resp.Header.Get("X-Seen-Forwarded-Host"); e != a {
+		t.Errorf("expected backend to see forwarded host %q, got %q", e, a)
+	}
+
+	handler.Location, _ = url.Parse(backend.URL + "/redirect")
+	resp, err = client.Get(proxy.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if e, a := "/prefix/target/", resp.Header.Get("Location"); e != a {
+		t.Errorf("expected Location %q, got %q", e, a)
+	}
+}
+
+func TestUpgradeAwareHandlerIdleTimeout(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	handler := NewUpgradeAwareHandler(backendURL, nil, true, nil)
+	handler.IdleTimeout = 200 * time.Millisecond
+	proxy := httptest.NewServer(handler)
+	defer proxy.Close()
+
+	conn, _, err := dialThroughProxy(t, proxy.URL)
+	if err != nil {
+		t.Fatalf("unexpected error upgrading through proxy: %v", err)
+	}
+	defer conn.Close()
+
+	select {
+	case <-conn.CloseChan():
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatalf("expected the idle connection to be closed by the proxy")
+	}
+}
+
+func TestRewriteURL(t *testing.T) {
+	backendURL, _ := url.Parse("http://backend:8080/api")
+	h := &UpgradeAwareHandler{Location: backendURL, PathPrepend: "/proxy/backend"}
+	req := httptest.NewRequest("GET", "http://frontend/proxy/backend/api", nil)
+
+	testCases := map[string]string{
+		"http://backend:8080/foo":       "http://frontend/proxy/backend/foo",
+		"http://frontend/foo/":          "http://frontend/proxy/backend/foo/",
+		"/foo":                          "/proxy/backend/foo",
+		"/proxy/backend/foo":            "/proxy/backend/foo",
+		"http://elsewhere/foo":          "http://elsewhere/foo",
+		"relative/path":                 "relative/path",
+		"http://backend:8080/?q=1#frag": "http://frontend/proxy/backend/?q=1#frag",
+	}
+	for in, expected := range testCases {
+		if actual := h.rewriteURL(in, req); actual != expected {
+			t.Errorf("%s: expected %q, got %q", in, expected, actual)
+		}
+	}
+}
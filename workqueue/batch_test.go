@@ -0,0 +1,151 @@
+/*
+Copyright 2015 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package workqueue
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/commcos/utils/clock"
+	"github.com/commcos/utils/wait"
+)
+
+func TestGetBatch(t *testing.T) {
+	q := newQueue(clock.NewFakeClock(time.Now()), noMetrics[interface{}]{}, time.Millisecond)
+	defer q.ShutDown()
+
+	for _, item := range []string{"a", "b", "a", "c", "d"} {
+		q.Add(item)
+	}
+	items, shutdown := q.GetBatch(3, 0)
+	if shutdown {
+		t.Fatalf("unexpected shutdown")
+	}
+	if e, a := []interface{}{"a", "b", "c"}, items; !reflect.DeepEqual(e, a) {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+
+	// items in a batch keep the processing semantics of Get
+	q.Add("a")
+	if e, a := 1, q.Len(); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+	q.DoneBatch(items)
+	if e, a := 2, q.Len(); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+
+	items, _ = q.GetBatch(10, 0)
+	if e, a := []interface{}{"d", "a"}, items; !reflect.DeepEqual(e, a) {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+	q.DoneBatch(items)
+	if e, a := 0, q.Len(); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+}
+
+func TestGetBatchWaitsToFill(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	q := newQueue(fakeClock, noMetrics[interface{}]{}, time.Hour)
+	defer q.ShutDown()
+
+	type batch struct {
+		items    []interface{}
+		shutdown bool
+	}
+	batches := make(chan batch)
+	getBatch := func() {
+		items, shutdown := q.GetBatch(3, time.Second)
+		batches <- batch{items, shutdown}
+	}
+
+	// a full batch is returned as soon as it is filled
+	go getBatch()
+	q.Add("a")
+	q.Add("b")
+	q.Add("c")
+	if b := <-batches; !reflect.DeepEqual([]interface{}{"a", "b", "c"}, b.items) {
+		t.Errorf("expected a full batch, got %v", b.items)
+	}
+
+	// a partial batch is returned once maxWait has passed
+	go getBatch()
+	q.Add("d")
+	if err := wait.Poll(time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return q.Len() == 0 && fakeClock.HasWaiters(), nil
+	}); err != nil {
+		t.Fatalf("timed out waiting for the batch to be started")
+	}
+	q.Add("e")
+	select {
+	case b := <-batches:
+		t.Fatalf("unexpected batch before maxWait: %v", b.items)
+	case <-time.After(10 * time.Millisecond):
+	}
+	fakeClock.Step(time.Second)
+	if b := <-batches; !reflect.DeepEqual([]interface{}{"d", "e"}, b.items) || b.shutdown {
+		t.Errorf("expected a partial batch, got %v, %v", b.items, b.shutdown)
+	}
+
+	// shutting down returns the partial batch, then reports the shutdown
+	go getBatch()
+	q.Add("f")
+	if err := wait.Poll(time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return q.Len() == 0 && fakeClock.HasWaiters(), nil
+	}); err != nil {
+		t.Fatalf("timed out waiting for the batch to be started")
+	}
+	q.ShutDown()
+	if b := <-batches; !reflect.DeepEqual([]interface{}{"f"}, b.items) || b.shutdown {
+		t.Errorf("expected a partial batch, got %v, %v", b.items, b.shutdown)
+	}
+	if items, shutdown := q.GetBatch(3, time.Second); items != nil || !shutdown {
+		t.Errorf("expected shutdown, got %v, %v", items, shutdown)
+	}
+}
+
+func TestGetBatchPassesOnWakeups(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	q := newQueue(fakeClock, noMetrics[interface{}]{}, time.Hour)
+	defer q.ShutDown()
+
+	q.Add("a")
+	q.Add("b")
+	q.Add("c")
+	items, _ := q.GetBatch(1, time.Second)
+	if e, a := []interface{}{"a"}, items; !reflect.DeepEqual(e, a) {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+
+	// concurrent consumers drain what is left
+	got := make(chan interface{}, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			item, _ := q.Get()
+			got <- item
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-got:
+		case <-time.After(wait.ForeverTestTimeout):
+			t.Fatalf("timed out waiting for Get")
+		}
+	}
+}
@@ -24,14 +24,17 @@ import (
 	utilruntime "github.com/commcos/utils/runtime"
 )
 
-// DelayingInterface is an Interface that can Add an item at a later time. This makes it easier to
+// TypedDelayingInterface is a TypedInterface that can Add an item at a later time. This makes it easier to
 // requeue items after failures without ending up in a hot-loop.
-type DelayingInterface interface {
-	Interface
+type TypedDelayingInterface[T comparable] interface {
+	TypedInterface[T]
 	// AddAfter adds an item to the workqueue after the indicated duration has passed
-	AddAfter(item interface{}, duration time.Duration)
+	AddAfter(item T, duration time.Duration)
 }
 
+// DelayingInterface is the untyped form of TypedDelayingInterface.
+type DelayingInterface TypedDelayingInterface[interface{}]
+
 // NewDelayingQueue constructs a new workqueue with delayed queuing ability
 func NewDelayingQueue() DelayingInterface {
 	return newDelayingQueue(clock.RealClock{}, "")
@@ -41,13 +44,36 @@ func NewNamedDelayingQueue(name string) DelayingInterface {
 	return newDelayingQueue(clock.RealClock{}, name)
 }
 
+// NewTypedDelayingQueue constructs a new workqueue of items of type T with
+// delayed queuing ability
+func NewTypedDelayingQueue[T comparable]() TypedDelayingInterface[T] {
+	return newTypedDelayingQueue[T](clock.RealClock{}, "")
+}
+
+func NewTypedNamedDelayingQueue[T comparable](name string) TypedDelayingInterface[T] {
+	return newTypedDelayingQueue[T](clock.RealClock{}, name)
+}
+
 func newDelayingQueue(clock clock.Clock, name string) DelayingInterface {
-	ret := &delayingType{
-		Interface:         NewNamed(name),
+	return newTypedDelayingQueue[t](clock, name)
+}
+
+func newTypedDelayingQueue[T comparable](clock clock.Clock, name string) *typedDelayingType[T] {
+	return newTypedDelayingQueueWithQueue[T](clock, name, NewTypedNamed[T](name), nil)
+}
+
+// newTypedDelayingQueueWithQueue constructs a delaying queue on top of queue.
+// If queue is a TypedPriorityInterface, items added after a delay keep the
+// priority they were added with. If journal is not nil, delayed items are
+// recorded in it until they are added to queue.
+func newTypedDelayingQueueWithQueue[T comparable](clock clock.Clock, name string, queue TypedInterface[T], journal typedJournal[T]) *typedDelayingType[T] {
+	ret := &typedDelayingType[T]{
+		TypedInterface:    queue,
+		journal:           journal,
 		clock:             clock,
 		heartbeat:         clock.NewTicker(maxWait),
 		stopCh:            make(chan struct{}),
-		waitingForAddCh:   make(chan *waitFor, 1000),
+		waitingForAddCh:   make(chan *typedWaitFor[T], 1000),
 		metrics:           newRetryMetrics(name),
 		deprecatedMetrics: newDeprecatedRetryMetrics(name),
 	}
@@ -57,9 +83,12 @@ func newDelayingQueue(clock clock.Clock, name string) DelayingInterface {
 	return ret
 }
 
-// delayingType wraps an Interface and provides delayed re-enquing
-type delayingType struct {
-	Interface
+// delayingType is the untyped form of typedDelayingType.
+type delayingType = typedDelayingType[t]
+
+// typedDelayingType wraps a TypedInterface and provides delayed re-enquing
+type typedDelayingType[T comparable] struct {
+	TypedInterface[T]
 
 	// clock tracks time for delayed firing
 	clock clock.Clock
@@ -71,17 +100,24 @@ type delayingType struct {
 	heartbeat clock.Ticker
 
 	// waitingForAddCh is a buffered channel that feeds waitingForAdd
-	waitingForAddCh chan *waitFor
+	waitingForAddCh chan *typedWaitFor[T]
 
 	// metrics counts the number of retries
 	metrics           retryMetrics
 	deprecatedMetrics retryMetrics
+
+	// journal, if set, persists the items waiting for their delay to pass.
+	journal typedJournal[T]
 }
 
-// waitFor holds the data to add and the time it should be added
-type waitFor struct {
-	data    t
-	readyAt time.Time
+// waitFor is the untyped form of typedWaitFor.
+type waitFor = typedWaitFor[t]
+
+// typedWaitFor holds the data to add and the time it should be added
+type typedWaitFor[T comparable] struct {
+	data     T
+	priority int
+	readyAt  time.Time
 	// index in the priority queue (heap)
 	index int
 }
@@ -94,15 +130,15 @@ type waitFor struct {
 // it has been removed from the queue and placed at index Len()-1 by
 // container/heap. Push adds an item at index Len(), and container/heap
 // percolates it into the correct location.
-type waitForPriorityQueue []*waitFor
+type waitForPriorityQueue[T comparable] []*typedWaitFor[T]
 
-func (pq waitForPriorityQueue) Len() int {
+func (pq waitForPriorityQueue[T]) Len() int {
 	return len(pq)
 }
-func (pq waitForPriorityQueue) Less(i, j int) bool {
+func (pq waitForPriorityQueue[T]) Less(i, j int) bool {
 	return pq[i].readyAt.Before(pq[j].readyAt)
 }
-func (pq waitForPriorityQueue) Swap(i, j int) {
+func (pq waitForPriorityQueue[T]) Swap(i, j int) {
 	pq[i], pq[j] = pq[j], pq[i]
 	pq[i].index = i
 	pq[j].index = j
@@ -110,16 +146,16 @@ func (pq waitForPriorityQueue) Swap(i, j int) {
 
 // Push adds an item to the queue. Push should not be called directly; instead,
 // use `heap.Push`.
-func (pq *waitForPriorityQueue) Push(x interface{}) {
+func (pq *waitForPriorityQueue[T]) Push(x interface{}) {
 	n := len(*pq)
-	item := x.(*waitFor)
+	item := x.(*typedWaitFor[T])
 	item.index = n
 	*pq = append(*pq, item)
 }
 
 // Pop removes an item from the queue. Pop should not be called directly;
 // instead, use `heap.Pop`.
-func (pq *waitForPriorityQueue) Pop() interface{} {
+func (pq *waitForPriorityQueue[T]) Pop() interface{} {
 	n := len(*pq)
 	item := (*pq)[n-1]
 	item.index = -1
@@ -129,19 +165,37 @@ func (pq *waitForPriorityQueue) Pop() interface{} {
 
 // Peek returns the item at the beginning of the queue, without removing the
 // item or otherwise mutating the queue. It is safe to call directly.
-func (pq waitForPriorityQueue) Peek() interface{} {
+func (pq waitForPriorityQueue[T]) Peek() interface{} {
 	return pq[0]
 }
 
 // ShutDown gives a way to shut off this queue
-func (q *delayingType) ShutDown() {
-	q.Interface.ShutDown()
+func (q *typedDelayingType[T]) ShutDown() {
+	q.TypedInterface.ShutDown()
 	close(q.stopCh)
 	q.heartbeat.Stop()
 }
 
 // AddAfter adds the given item to the work queue after the given delay
-func (q *delayingType) AddAfter(item interface{}, duration time.Duration) {
+func (q *typedDelayingType[T]) AddAfter(item T, duration time.Duration) {
+	q.AddAfterWithPriority(item, DefaultPriority, duration)
+}
+
+// AddWithPriority adds the given item to the work queue with the given
+// priority. The priority is ignored unless the underlying queue is a
+// TypedPriorityInterface.
+func (q *typedDelayingType[T]) AddWithPriority(item T, priority int) {
+	if pq, ok := q.TypedInterface.(TypedPriorityInterface[T]); ok {
+		pq.AddWithPriority(item, priority)
+		return
+	}
+	q.Add(item)
+}
+
+// AddAfterWithPriority adds the given item to the work queue with the given
+// priority after the given delay. If the item is already waiting, it keeps
+// the earliest of the delays and the highest of the priorities.
+func (q *typedDelayingType[T]) AddAfterWithPriority(item T, priority int, duration time.Duration) {
 	// don't add if we're already shutting down
 	if q.ShuttingDown() {
 		return
@@ -152,14 +206,27 @@ func (q *delayingType) AddAfter(item interface{}, duration time.Duration) {
 
 	// immediately add things with no delay
 	if duration <= 0 {
-		q.Add(item)
+		q.AddWithPriority(item, priority)
 		return
 	}
 
+	readyAt := q.clock.Now().Add(duration)
+	if q.journal != nil {
+		q.journal.delay(item, readyAt)
+	}
+
 	select {
 	case <-q.stopCh:
 		// unblock if ShutDown() is called
-	case q.waitingForAddCh <- &waitFor{data: item, readyAt: q.clock.Now().Add(duration)}:
+	case q.waitingForAddCh <- &typedWaitFor[T]{data: item, priority: priority, readyAt: readyAt}:
+	}
+}
+
+// addReady adds an item whose delay has passed to the work queue.
+func (q *typedDelayingType[T]) addReady(entry *typedWaitFor[T]) {
+	q.AddWithPriority(entry.data, entry.priority)
+	if q.journal != nil {
+		q.journal.fire(entry.data)
 	}
 }
 
@@ -169,19 +236,19 @@ func (q *delayingType) AddAfter(item interface{}, duration time.Duration) {
 const maxWait = 10 * time.Second
 
 // waitingLoop runs until the workqueue is shutdown and keeps a check on the list of items to be added.
-func (q *delayingType) waitingLoop() {
+func (q *typedDelayingType[T]) waitingLoop() {
 	defer utilruntime.HandleCrash()
 
 	// Make a placeholder channel to use when there are no items in our list
 	never := make(<-chan time.Time)
 
-	waitingForQueue := &waitForPriorityQueue{}
+	waitingForQueue := &waitForPriorityQueue[T]{}
 	heap.Init(waitingForQueue)
 
-	waitingEntryByData := map[t]*waitFor{}
+	waitingEntryByData := map[T]*typedWaitFor[T]{}
 
 	for {
-		if q.Interface.ShuttingDown() {
+		if q.TypedInterface.ShuttingDown() {
 			return
 		}
 
@@ -189,20 +256,20 @@ func (q *delayingType) waitingLoop() {
 
 		// Add ready entries
 		for waitingForQueue.Len() > 0 {
-			entry := waitingForQueue.Peek().(*waitFor)
+			entry := waitingForQueue.Peek().(*typedWaitFor[T])
 			if entry.readyAt.After(now) {
 				break
 			}
 
-			entry = heap.Pop(waitingForQueue).(*waitFor)
-			q.Add(entry.data)
+			entry = heap.Pop(waitingForQueue).(*typedWaitFor[T])
+			q.addReady(entry)
 			delete(waitingEntryByData, entry.data)
 		}
 
 		// Set up a wait for the first item's readyAt (if one exists)
 		nextReadyAt := never
 		if waitingForQueue.Len() > 0 {
-			entry := waitingForQueue.Peek().(*waitFor)
+			entry := waitingForQueue.Peek().(*typedWaitFor[T])
 			nextReadyAt = q.clock.After(entry.readyAt.Sub(now))
 		}
 
@@ -220,7 +287,7 @@ func (q *delayingType) waitingLoop() {
 			if waitEntry.readyAt.After(q.clock.Now()) {
 				insert(waitingForQueue, waitingEntryByData, waitEntry)
 			} else {
-				q.Add(waitEntry.data)
+				q.addReady(waitEntry)
 			}
 
 			drained := false
@@ -230,7 +297,7 @@ func (q *delayingType) waitingLoop() {
 					if waitEntry.readyAt.After(q.clock.Now()) {
 						insert(waitingForQueue, waitingEntryByData, waitEntry)
 					} else {
-						q.Add(waitEntry.data)
+						q.addReady(waitEntry)
 					}
 				default:
 					drained = true
@@ -241,10 +308,13 @@ func (q *delayingType) waitingLoop() {
 }
 
 // insert adds the entry to the priority queue, or updates the readyAt if it already exists in the queue
-func insert(q *waitForPriorityQueue, knownEntries map[t]*waitFor, entry *waitFor) {
+func insert[T comparable](q *waitForPriorityQueue[T], knownEntries map[T]*typedWaitFor[T], entry *typedWaitFor[T]) {
 	// if the entry already exists, update the time only if it would cause the item to be queued sooner
 	existing, exists := knownEntries[entry.data]
 	if exists {
+		if entry.priority > existing.priority {
+			existing.priority = entry.priority
+		}
 		if existing.readyAt.After(entry.readyAt) {
 			existing.readyAt = entry.readyAt
 			heap.Fix(q, existing.index)
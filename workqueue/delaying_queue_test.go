@@ -253,3 +253,43 @@ func waitForWaitingQueueToFill(q DelayingInterface) error {
 		return false, nil
 	})
 }
+
+func TestTypedDeduping(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	q := newTypedDelayingQueue[int](fakeClock, "")
+
+	q.AddAfter(1, 50*time.Millisecond)
+	q.AddAfter(1, 70*time.Millisecond)
+	q.AddAfter(2, 20*time.Millisecond)
+	if err := wait.Poll(1*time.Millisecond, 10*time.Second, func() (bool, error) {
+		return len(q.waitingForAddCh) == 0, nil
+	}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if q.Len() != 0 {
+		t.Errorf("should not have added")
+	}
+
+	// step past the earliest time the first item was added for
+	fakeClock.Step(60 * time.Millisecond)
+	if err := wait.Poll(1*time.Millisecond, 10*time.Second, func() (bool, error) {
+		return q.Len() == 2, nil
+	}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	for _, expected := range []int{2, 1} {
+		item, _ := q.Get()
+		if item != expected {
+			t.Errorf("expected %v, got %v", expected, item)
+		}
+		q.Done(item)
+	}
+
+	// the later AddAfter of the first item must not fire again
+	fakeClock.Step(20 * time.Millisecond)
+	if q.Len() != 0 {
+		t.Errorf("should not have added")
+	}
+	q.ShutDown()
+}
@@ -0,0 +1,490 @@
+/*
+Copyright 2015 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package workqueue
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/commcos/utils/clock"
+	utilruntime "github.com/commcos/utils/runtime"
+)
+
+// DefaultCompactionInterval is the compaction interval used when
+// DurableQueueConfig.CompactionInterval is zero.
+const DefaultCompactionInterval = time.Minute
+
+const (
+	walFileName = "queue.wal"
+	walTmpName  = walFileName + ".tmp"
+)
+
+// DurableQueueConfig configures a durable work queue.
+type DurableQueueConfig struct {
+	// Name is used to register the queue's metrics. Unnamed queues are not
+	// instrumented.
+	Name string
+
+	// CompactionInterval is how often the log is rewritten to hold only
+	// the items that still need processing. Zero selects
+	// DefaultCompactionInterval.
+	CompactionInterval time.Duration
+
+	// SyncWrites makes every log record be flushed to stable storage before
+	// the call that produced it returns. Without it records are handed to
+	// the operating system, which survives a crash of the process but not
+	// of the machine.
+	SyncWrites bool
+}
+
+// TypedDurableInterface is a TypedDelayingInterface whose pending and delayed
+// items are recorded in a write-ahead log, so that they survive a restart of
+// the process.
+//
+// An item is recorded from the moment it is added until Done is called for
+// it without it having been added again in the meantime. Items that were
+// being processed when the process stopped are therefore handed out again
+// after a restart: processing is at-least-once.
+type TypedDurableInterface[T comparable] interface {
+	TypedDelayingInterface[T]
+	// Close compacts and closes the log. Call it after ShutDown, once the
+	// workers have called Done for the items they were processing. Changes
+	// made to the queue after Close are not recorded.
+	Close() error
+}
+
+// TypedDurableRateLimitingInterface is a TypedRateLimitingInterface whose
+// pending and delayed items survive a restart of the process (see
+// TypedDurableInterface). The state of the rate limiter is not persisted.
+type TypedDurableRateLimitingInterface[T comparable] interface {
+	TypedRateLimitingInterface[T]
+	Close() error
+}
+
+// NewTypedDurableQueue constructs a work queue of items of type T that logs
+// its items to dir, replaying the items left in dir by a previous queue.
+// Items are encoded with encoding/json and must decode back to a value equal
+// to the one that was encoded. Only one queue may use dir at a time.
+func NewTypedDurableQueue[T comparable](dir string, config DurableQueueConfig) (TypedDurableInterface[T], error) {
+	return newTypedDurableQueue[T](clock.RealClock{}, dir, config)
+}
+
+// NewTypedDurableRateLimitingQueue constructs a durable work queue of items of
+// type T (see NewTypedDurableQueue) with rateLimited queuing ability.
+// Remember to call Forget!  If you don't, you may end up tracking failures forever.
+func NewTypedDurableRateLimitingQueue[T comparable](rateLimiter TypedRateLimiter[T], dir string, config DurableQueueConfig) (TypedDurableRateLimitingInterface[T], error) {
+	q, err := NewTypedDurableQueue[T](dir, config)
+	if err != nil {
+		return nil, err
+	}
+	return &typedDurableRateLimitingType[T]{
+		typedRateLimitingType: typedRateLimitingType[T]{
+			TypedDelayingInterface: q,
+			rateLimiter:            rateLimiter,
+		},
+		closer: q,
+	}, nil
+}
+
+func newTypedDurableQueue[T comparable](c clock.Clock, dir string, config DurableQueueConfig) (*typedDurableType[T], error) {
+	journal, err := openFileJournal[T](dir, config.SyncWrites)
+	if err != nil {
+		return nil, err
+	}
+	pending, delayed := journal.snapshot()
+
+	queue := newTypedQueue(c, newTypedQueueMetrics[T](&globalMetricsFactory, config.Name, c), defaultUnfinishedWorkUpdatePeriod)
+	queue.journal = journal
+
+	interval := config.CompactionInterval
+	if interval <= 0 {
+		interval = DefaultCompactionInterval
+	}
+	q := &typedDurableType[T]{
+		typedDelayingType: newTypedDelayingQueueWithQueue[T](c, config.Name, queue, journal),
+		journal:           journal,
+		compactionTicker:  c.NewTicker(interval),
+		stopCompaction:    make(chan struct{}),
+	}
+
+	now := c.Now()
+	for _, item := range pending {
+		q.Add(item)
+	}
+	for item, readyAt := range delayed {
+		if readyAt.After(now) {
+			q.AddAfter(item, readyAt.Sub(now))
+			continue
+		}
+		q.Add(item)
+		journal.fire(item)
+	}
+
+	go q.compactionLoop()
+
+	return q, nil
+}
+
+// typedDurableType is a delaying queue backed by a fileJournal.
+type typedDurableType[T comparable] struct {
+	*typedDelayingType[T]
+
+	journal *fileJournal[T]
+
+	compactionTicker clock.Ticker
+	stopCompaction   chan struct{}
+	closeOnce        sync.Once
+}
+
+// Close compacts and closes the log.
+func (q *typedDurableType[T]) Close() error {
+	var err error
+	q.closeOnce.Do(func() {
+		close(q.stopCompaction)
+		q.compactionTicker.Stop()
+		err = q.journal.close()
+	})
+	return err
+}
+
+func (q *typedDurableType[T]) compactionLoop() {
+	defer utilruntime.HandleCrash()
+
+	for {
+		select {
+		case <-q.stopCompaction:
+			return
+		case <-q.compactionTicker.C():
+			if err := q.journal.compact(); err != nil {
+				utilruntime.HandleError(err)
+			}
+		}
+	}
+}
+
+// typedDurableRateLimitingType is a rate limiting queue over a durable queue.
+type typedDurableRateLimitingType[T comparable] struct {
+	typedRateLimitingType[T]
+
+	closer io.Closer
+}
+
+func (q *typedDurableRateLimitingType[T]) Close() error {
+	return q.closer.Close()
+}
+
+// typedJournal records the items of a queue that still need processing.
+// Its methods are called while the queue holds its own locks, in the order
+// in which the queue changes.
+type typedJournal[T comparable] interface {
+	// add records that item needs processing.
+	add(item T)
+	// done records that item has been processed and was not added again.
+	done(item T)
+	// delay records that item is to be added at readyAt.
+	delay(item T, readyAt time.Time)
+	// fire records that the delay of item has passed and it was added.
+	fire(item T)
+}
+
+const (
+	walOpAdd   = "add"
+	walOpDone  = "done"
+	walOpDelay = "delay"
+	walOpFire  = "fire"
+)
+
+// walRecord is a single line of the log.
+type walRecord[T comparable] struct {
+	Op      string     `json:"op"`
+	Item    T          `json:"item"`
+	ReadyAt *time.Time `json:"readyAt,omitempty"`
+}
+
+// fileJournal is a typedJournal writing newline delimited JSON records to a
+// file. It keeps the state the log describes in memory, so that compaction
+// can rewrite the log without reading it back.
+type fileJournal[T comparable] struct {
+	lock sync.Mutex
+
+	dir        string
+	syncWrites bool
+	file       *os.File
+	writer     *bufio.Writer
+	closed     bool
+
+	// pending holds the items that need processing.
+	pending map[T]empty
+	// delayed holds the items waiting to be added, with the earliest time
+	// they are due.
+	delayed map[T]time.Time
+	// records counts the records written since the last compaction.
+	records int
+}
+
+// openFileJournal replays the log in dir, creating dir if needed, and
+// rewrites it to hold only the replayed state.
+func openFileJournal[T comparable](dir string, syncWrites bool) (*fileJournal[T], error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	j := &fileJournal[T]{
+		dir:        dir,
+		syncWrites: syncWrites,
+		pending:    map[T]empty{},
+		delayed:    map[T]time.Time{},
+	}
+	if err := j.replay(); err != nil {
+		return nil, err
+	}
+	if err := j.rewrite(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *fileJournal[T]) replay() error {
+	path := filepath.Join(j.dir, walFileName)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// A record without its trailing newline was torn by a crash
+			// while it was written, and never acknowledged.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var record walRecord[T]
+		if err := json.Unmarshal(data, &record); err != nil {
+			return fmt.Errorf("unable to decode record %d of %s: %v", line, path, err)
+		}
+		if err := j.apply(&record); err != nil {
+			return fmt.Errorf("invalid record %d of %s: %v", line, path, err)
+		}
+	}
+}
+
+// apply updates the in-memory state with record.
+func (j *fileJournal[T]) apply(record *walRecord[T]) error {
+	switch record.Op {
+	case walOpAdd:
+		j.pending[record.Item] = empty{}
+	case walOpDone:
+		delete(j.pending, record.Item)
+	case walOpDelay:
+		if record.ReadyAt == nil {
+			return fmt.Errorf("delay record without a ready time")
+		}
+		if existing, exists := j.delayed[record.Item]; !exists || record.ReadyAt.Before(existing) {
+			j.delayed[record.Item] = *record.ReadyAt
+		}
+	case walOpFire:
+		delete(j.delayed, record.Item)
+	default:
+		return fmt.Errorf("unknown operation %q", record.Op)
+	}
+	return nil
+}
+
+// snapshot returns the items the log describes.
+func (j *fileJournal[T]) snapshot() ([]T, map[T]time.Time) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	pending := make([]T, 0, len(j.pending))
+	for item := range j.pending {
+		pending = append(pending, item)
+	}
+	delayed := make(map[T]time.Time, len(j.delayed))
+	for item, readyAt := range j.delayed {
+		delayed[item] = readyAt
+	}
+	return pending, delayed
+}
+
+func (j *fileJournal[T]) add(item T) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if _, exists := j.pending[item]; exists {
+		return
+	}
+	j.pending[item] = empty{}
+	j.write(&walRecord[T]{Op: walOpAdd, Item: item})
+}
+
+func (j *fileJournal[T]) done(item T) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if _, exists := j.pending[item]; !exists {
+		return
+	}
+	delete(j.pending, item)
+	j.write(&walRecord[T]{Op: walOpDone, Item: item})
+}
+
+func (j *fileJournal[T]) delay(item T, readyAt time.Time) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if existing, exists := j.delayed[item]; exists && !readyAt.Before(existing) {
+		return
+	}
+	j.delayed[item] = readyAt
+	j.write(&walRecord[T]{Op: walOpDelay, Item: item, ReadyAt: &readyAt})
+}
+
+func (j *fileJournal[T]) fire(item T) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if _, exists := j.delayed[item]; !exists {
+		return
+	}
+	delete(j.delayed, item)
+	j.write(&walRecord[T]{Op: walOpFire, Item: item})
+}
+
+// write appends record to the log. Failures are reported through
+// HandleError: the queue keeps working in memory.
+func (j *fileJournal[T]) write(record *walRecord[T]) {
+	if j.closed {
+		return
+	}
+	if err := j.writeRecord(j.writer, record); err != nil {
+		utilruntime.HandleError(fmt.Errorf("unable to write %s record to the log in %s: %v", record.Op, j.dir, err))
+		return
+	}
+	if err := j.writer.Flush(); err != nil {
+		utilruntime.HandleError(fmt.Errorf("unable to write %s record to the log in %s: %v", record.Op, j.dir, err))
+		return
+	}
+	if j.syncWrites {
+		if err := j.file.Sync(); err != nil {
+			utilruntime.HandleError(fmt.Errorf("unable to sync the log in %s: %v", j.dir, err))
+		}
+	}
+	j.records++
+}
+
+func (j *fileJournal[T]) writeRecord(w io.Writer, record *walRecord[T]) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	_, err = w.Write(data)
+	return err
+}
+
+// compact rewrites the log if records were written since it was last
+// rewritten.
+func (j *fileJournal[T]) compact() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.closed || j.records == 0 {
+		return nil
+	}
+	return j.rewrite()
+}
+
+// close compacts and closes the log.
+func (j *fileJournal[T]) close() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.closed {
+		return nil
+	}
+	err := j.rewrite()
+	j.closed = true
+	if j.file != nil {
+		if closeErr := j.file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// rewrite replaces the log with one holding only the current state, and
+// reopens it for appending. It must be called with the lock held.
+func (j *fileJournal[T]) rewrite() error {
+	tmpPath := filepath.Join(j.dir, walTmpName)
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	err = func() error {
+		for item := range j.pending {
+			if err := j.writeRecord(w, &walRecord[T]{Op: walOpAdd, Item: item}); err != nil {
+				return err
+			}
+		}
+		for item, readyAt := range j.delayed {
+			readyAt := readyAt
+			if err := j.writeRecord(w, &walRecord[T]{Op: walOpDelay, Item: item, ReadyAt: &readyAt}); err != nil {
+				return err
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		return tmp.Sync()
+	}()
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("unable to compact the log in %s: %v", j.dir, err)
+	}
+
+	path := filepath.Join(j.dir, walFileName)
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("unable to compact the log in %s: %v", j.dir, err)
+	}
+	if d, err := os.Open(j.dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file = f
+	j.writer = bufio.NewWriter(f)
+	j.records = 0
+	return nil
+}
@@ -0,0 +1,232 @@
+/*
+Copyright 2015 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package workqueue
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/commcos/utils/clock"
+	"github.com/commcos/utils/wait"
+)
+
+type durableTestItem struct {
+	Namespace string
+	Name      string
+}
+
+func drainDurableQueue(t *testing.T, q TypedInterface[durableTestItem], n int) []string {
+	t.Helper()
+	var names []string
+	for i := 0; i < n; i++ {
+		item, shutdown := q.Get()
+		if shutdown {
+			t.Fatalf("unexpected shutdown")
+		}
+		names = append(names, item.Name)
+		q.Done(item)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestDurableQueueReplay(t *testing.T) {
+	dir := t.TempDir()
+	fakeClock := clock.NewFakeClock(time.Now())
+
+	q, err := newTypedDurableQueue[durableTestItem](fakeClock, dir, DurableQueueConfig{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, name := range []string{"done", "processing", "readded", "pending"} {
+		q.Add(durableTestItem{Namespace: "ns", Name: name})
+	}
+	q.AddAfter(durableTestItem{Namespace: "ns", Name: "delayed"}, time.Minute)
+	if err := wait.Poll(time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return len(q.waitingForAddCh) == 0, nil
+	}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	for _, name := range []string{"done", "processing", "readded"} {
+		item, _ := q.Get()
+		if item.Name != name {
+			t.Fatalf("expected %v, got %v", name, item.Name)
+		}
+	}
+	q.Done(durableTestItem{Namespace: "ns", Name: "done"})
+	// added again while processing, so it is still pending after Done
+	q.Add(durableTestItem{Namespace: "ns", Name: "readded"})
+	q.Done(durableTestItem{Namespace: "ns", Name: "readded"})
+
+	// simulate a crash: the log is neither compacted nor closed cleanly
+	q.ShutDown()
+	crashDurableQueue(q)
+
+	q, err = newTypedDurableQueue[durableTestItem](fakeClock, dir, DurableQueueConfig{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer q.Close()
+	defer q.ShutDown()
+
+	if e, a := []string{"pending", "processing", "readded"}, drainDurableQueue(t, q, 3); !reflect.DeepEqual(e, a) {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+	if q.Len() != 0 {
+		t.Errorf("expected the delayed item to still be waiting")
+	}
+
+	fakeClock.Step(2 * time.Minute)
+	if err := wait.Poll(time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return q.Len() == 1, nil
+	}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if e, a := []string{"delayed"}, drainDurableQueue(t, q, 1); !reflect.DeepEqual(e, a) {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+
+	pending, delayed := q.journal.snapshot()
+	if len(pending) != 0 || len(delayed) != 0 {
+		t.Errorf("expected an empty log, got %v pending and %v delayed items", pending, delayed)
+	}
+}
+
+func TestDurableQueueReplaysDueItems(t *testing.T) {
+	dir := t.TempDir()
+	fakeClock := clock.NewFakeClock(time.Now())
+
+	q, err := newTypedDurableQueue[durableTestItem](fakeClock, dir, DurableQueueConfig{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	q.AddAfter(durableTestItem{Name: "due"}, time.Second)
+	q.ShutDown()
+	if err := q.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	fakeClock.Step(time.Hour)
+	q, err = newTypedDurableQueue[durableTestItem](fakeClock, dir, DurableQueueConfig{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer q.Close()
+	defer q.ShutDown()
+
+	if e, a := 1, q.Len(); e != a {
+		t.Fatalf("expected %v, got %v", e, a)
+	}
+	pending, delayed := q.journal.snapshot()
+	if len(pending) != 1 || len(delayed) != 0 {
+		t.Errorf("expected the due item to be pending, got %v pending and %v delayed items", pending, delayed)
+	}
+}
+
+func TestDurableQueueCompaction(t *testing.T) {
+	dir := t.TempDir()
+	fakeClock := clock.NewFakeClock(time.Now())
+
+	q, err := newTypedDurableQueue[durableTestItem](fakeClock, dir, DurableQueueConfig{CompactionInterval: time.Second})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer q.ShutDown()
+
+	for i := 0; i < 100; i++ {
+		q.Add(durableTestItem{Name: "churn"})
+		item, _ := q.Get()
+		q.Done(item)
+	}
+	q.Add(durableTestItem{Name: "pending"})
+
+	path := filepath.Join(dir, walFileName)
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if e, a := 201, bytes.Count(before, []byte("\n")); e != a {
+		t.Errorf("expected %v records, got %v", e, a)
+	}
+
+	fakeClock.Step(time.Second)
+	if err := wait.Poll(time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		after, err := os.ReadFile(path)
+		return err == nil && bytes.Count(after, []byte("\n")) == 1, nil
+	}); err != nil {
+		t.Fatalf("log was not compacted: %v", err)
+	}
+
+	// records keep being appended to the compacted log
+	q.Add(durableTestItem{Name: "another"})
+	if err := q.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if e, a := 2, bytes.Count(after, []byte("\n")); e != a {
+		t.Errorf("expected %v records, got %v", e, a)
+	}
+}
+
+func TestDurableQueueTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, walFileName)
+	log := `{"op":"add","item":{"Namespace":"ns","Name":"foo"}}` + "\n" + `{"op":"done","item":{"Names`
+	if err := os.WriteFile(path, []byte(log), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	q, err := NewTypedDurableQueue[durableTestItem](dir, DurableQueueConfig{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer q.Close()
+	defer q.ShutDown()
+	if e, a := []string{"foo"}, drainDurableQueue(t, q, 1); !reflect.DeepEqual(e, a) {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+}
+
+func TestDurableQueueCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, walFileName), []byte("garbage\n"), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := NewTypedDurableQueue[durableTestItem](dir, DurableQueueConfig{}); err == nil {
+		t.Errorf("expected an error for a corrupt log")
+	}
+}
+
+// crashDurableQueue stops q from touching its log any further, without
+// compacting it.
+func crashDurableQueue(q *typedDurableType[durableTestItem]) {
+	close(q.stopCompaction)
+	q.compactionTicker.Stop()
+	q.journal.lock.Lock()
+	defer q.journal.lock.Unlock()
+	q.journal.closed = true
+	q.journal.file.Close()
+}
@@ -0,0 +1,335 @@
+/*
+Copyright 2015 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package workqueue
+
+import (
+	"sync"
+	"time"
+
+	"github.com/commcos/utils/clock"
+)
+
+// TypedFairQueueConfig configures a fair work queue of items of type T.
+type TypedFairQueueConfig[T comparable] struct {
+	// Name is used to register the queue's metrics. Unnamed queues are not
+	// instrumented.
+	Name string
+
+	// Flow classifies an item into the flow, e.g. the tenant, it belongs
+	// to. The same item must always be classified into the same flow. If
+	// nil, all items belong to a single flow.
+	Flow func(item T) string
+
+	// Weight returns how many items of flow may be dispatched per round,
+	// relative to the other flows. If nil, or for weights lower than 1,
+	// flows are weighted 1.
+	Weight func(flow string) int
+}
+
+// FairQueueConfig is the untyped form of TypedFairQueueConfig.
+type FairQueueConfig = TypedFairQueueConfig[t]
+
+// NewFairQueue constructs a new fair work queue.
+func NewFairQueue(config FairQueueConfig) *FairType {
+	return NewTypedFairQueue[t](config)
+}
+
+// NewTypedFairQueue constructs a new fair work queue of items of type T.
+func NewTypedFairQueue[T comparable](config TypedFairQueueConfig[T]) *TypedFair[T] {
+	rc := clock.RealClock{}
+	return newTypedFairQueue(
+		rc,
+		newTypedQueueMetrics[T](&globalMetricsFactory, config.Name, rc),
+		globalMetricsFactory.newFlowDepthMetrics(config.Name),
+		defaultUnfinishedWorkUpdatePeriod,
+		config,
+	)
+}
+
+// NewFairRateLimitingQueue constructs a new fair work queue with rateLimited
+// queuing ability.
+// Remember to call Forget!  If you don't, you may end up tracking failures forever.
+func NewFairRateLimitingQueue(rateLimiter RateLimiter, config FairQueueConfig) RateLimitingInterface {
+	return NewTypedFairRateLimitingQueue[t](rateLimiter, config)
+}
+
+// NewTypedFairRateLimitingQueue constructs a new fair work queue of items of
+// type T with rateLimited queuing ability.
+// Remember to call Forget!  If you don't, you may end up tracking failures forever.
+func NewTypedFairRateLimitingQueue[T comparable](rateLimiter TypedRateLimiter[T], config TypedFairQueueConfig[T]) TypedRateLimitingInterface[T] {
+	return &typedRateLimitingType[T]{
+		TypedDelayingInterface: newTypedDelayingQueueWithQueue[T](clock.RealClock{}, config.Name, NewTypedFairQueue[T](config), nil),
+		rateLimiter:            rateLimiter,
+	}
+}
+
+func newTypedFairQueue[T comparable](c clock.Clock, metrics typedQueueMetrics[T], flowDepth func(flow string) GaugeMetric, updatePeriod time.Duration, config TypedFairQueueConfig[T]) *TypedFair[T] {
+	q := &TypedFair[T]{
+		clock:                      c,
+		classify:                   config.Flow,
+		weight:                     config.Weight,
+		flows:                      map[string]*flow[T]{},
+		flowDepth:                  flowDepth,
+		flowDepthMetrics:           map[string]GaugeMetric{},
+		dirty:                      set[T]{},
+		processing:                 set[T]{},
+		cond:                       sync.NewCond(&sync.Mutex{}),
+		metrics:                    metrics,
+		unfinishedWorkUpdatePeriod: updatePeriod,
+	}
+	go q.updateUnfinishedWorkLoop()
+	return q
+}
+
+// FairType is the untyped form of TypedFair.
+type FairType = TypedFair[t]
+
+// TypedFair is a work queue that shares dispatch fairly between flows of items,
+// so that a flow holding many items cannot hold back the items of the other
+// flows. It has the same dedup and processing semantics as Typed, and keeps
+// items of the same flow in FIFO order.
+//
+// Flows are served with deficit round robin: every round, each flow with
+// waiting items may dispatch as many items as its weight before the next
+// flow is served.
+type TypedFair[T comparable] struct {
+	classify func(item T) string
+	weight   func(flow string) int
+
+	// flows holds the flows with waiting items.
+	flows map[string]*flow[T]
+	// active lists the flows with waiting items in round robin order. The
+	// flow being served is at the head.
+	active []*flow[T]
+	// length is the number of waiting items across all flows.
+	length int
+
+	flowDepth        func(flow string) GaugeMetric
+	flowDepthMetrics map[string]GaugeMetric
+
+	// dirty defines all of the items that need to be processed.
+	dirty set[T]
+
+	// Things that are currently being processed are in the processing set.
+	// These things may be simultaneously in the dirty set. When we finish
+	// processing something and remove it from this set, we'll check if
+	// it's in the dirty set, and if so, add it to its flow.
+	processing set[T]
+
+	cond *sync.Cond
+
+	shuttingDown bool
+
+	metrics typedQueueMetrics[T]
+
+	unfinishedWorkUpdatePeriod time.Duration
+	clock                      clock.Clock
+}
+
+// flow holds the waiting items of a flow.
+type flow[T comparable] struct {
+	name  string
+	queue []T
+	// deficit is the number of items the flow may still dispatch in the
+	// current round.
+	deficit int
+	depth   GaugeMetric
+}
+
+// Add marks item as needing processing.
+func (q *TypedFair[T]) Add(item T) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	if q.shuttingDown {
+		return
+	}
+	if q.dirty.has(item) {
+		return
+	}
+
+	q.metrics.add(item)
+
+	q.dirty.insert(item)
+	if q.processing.has(item) {
+		return
+	}
+
+	q.enqueue(item)
+	q.cond.Signal()
+}
+
+// Len returns the current queue length, for informational purposes only. You
+// shouldn't e.g. gate a call to Add() or Get() on Len() being a particular
+// value, that can't be synchronized properly.
+func (q *TypedFair[T]) Len() int {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return q.length
+}
+
+// FlowLen returns the number of items of flow waiting to be processed, for
+// informational purposes only.
+func (q *TypedFair[T]) FlowLen(flow string) int {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	if f, exists := q.flows[flow]; exists {
+		return len(f.queue)
+	}
+	return 0
+}
+
+// Get blocks until it can return an item to be processed, taking it from the
+// flow whose turn it is. If shutdown = true, the caller should end their
+// goroutine. You must call Done with item when you have finished processing
+// it.
+func (q *TypedFair[T]) Get() (item T, shutdown bool) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	for q.length == 0 && !q.shuttingDown {
+		q.cond.Wait()
+	}
+	if q.length == 0 {
+		// We must be shutting down.
+		return item, true
+	}
+
+	item = q.dequeue()
+
+	q.metrics.get(item)
+
+	q.processing.insert(item)
+	q.dirty.delete(item)
+
+	return item, false
+}
+
+// Done marks item as done processing, and if it has been marked as dirty again
+// while it was being processed, it will be re-added to its flow for
+// re-processing.
+func (q *TypedFair[T]) Done(item T) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	q.metrics.done(item)
+
+	q.processing.delete(item)
+	if q.dirty.has(item) {
+		q.enqueue(item)
+		q.cond.Signal()
+	}
+}
+
+// ShutDown will cause q to ignore all new items added to it. As soon as the
+// worker goroutines have drained the existing items in the queue, they will be
+// instructed to exit.
+func (q *TypedFair[T]) ShutDown() {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.shuttingDown = true
+	q.cond.Broadcast()
+}
+
+func (q *TypedFair[T]) ShuttingDown() bool {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	return q.shuttingDown
+}
+
+// enqueue appends item to its flow, activating the flow if it had no waiting
+// items. It must be called with the lock held.
+func (q *TypedFair[T]) enqueue(item T) {
+	name := ""
+	if q.classify != nil {
+		name = q.classify(item)
+	}
+	f, exists := q.flows[name]
+	if !exists {
+		f = &flow[T]{name: name, depth: q.flowDepthMetric(name)}
+		q.flows[name] = f
+		q.active = append(q.active, f)
+	}
+	f.queue = append(f.queue, item)
+	f.depth.Inc()
+	q.length++
+}
+
+// dequeue takes the next item from the flow at the head of the round robin.
+// It must be called with the lock held and at least one item waiting.
+func (q *TypedFair[T]) dequeue() T {
+	f := q.active[0]
+	if f.deficit == 0 {
+		// The flow's turn starts.
+		f.deficit = q.flowWeight(f.name)
+	}
+
+	var item T
+	item, f.queue = f.queue[0], f.queue[1:]
+	f.deficit--
+	f.depth.Dec()
+	q.length--
+
+	switch {
+	case len(f.queue) == 0:
+		// An idle flow does not keep its deficit, and is forgotten until
+		// it has items again.
+		q.active[0] = nil
+		q.active = q.active[1:]
+		delete(q.flows, f.name)
+	case f.deficit == 0:
+		// The flow's turn is over, move it to the back of the round.
+		q.active = append(q.active[1:], f)
+	}
+	return item
+}
+
+func (q *TypedFair[T]) flowWeight(flow string) int {
+	if q.weight == nil {
+		return 1
+	}
+	if w := q.weight(flow); w > 1 {
+		return w
+	}
+	return 1
+}
+
+func (q *TypedFair[T]) flowDepthMetric(flow string) GaugeMetric {
+	if m, exists := q.flowDepthMetrics[flow]; exists {
+		return m
+	}
+	m := q.flowDepth(flow)
+	q.flowDepthMetrics[flow] = m
+	return m
+}
+
+func (q *TypedFair[T]) updateUnfinishedWorkLoop() {
+	t := q.clock.NewTicker(q.unfinishedWorkUpdatePeriod)
+	defer t.Stop()
+	for range t.C() {
+		if !func() bool {
+			q.cond.L.Lock()
+			defer q.cond.L.Unlock()
+			if !q.shuttingDown {
+				q.metrics.updateUnfinishedWork()
+				return true
+			}
+			return false
+		}() {
+			return
+		}
+	}
+}
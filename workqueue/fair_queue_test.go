@@ -0,0 +1,177 @@
+/*
+Copyright 2015 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package workqueue
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/commcos/utils/clock"
+)
+
+func tenantOf(item string) string {
+	return strings.SplitN(item, "/", 2)[0]
+}
+
+func newTestFairQueue(config TypedFairQueueConfig[string]) *TypedFair[string] {
+	return newTypedFairQueue[string](clock.NewFakeClock(time.Now()), noMetrics[string]{}, globalMetricsFactory.newFlowDepthMetrics(""), time.Hour, config)
+}
+
+func drainFairQueue(q *TypedFair[string], n int) []string {
+	var items []string
+	for i := 0; i < n; i++ {
+		item, _ := q.Get()
+		items = append(items, item)
+		q.Done(item)
+	}
+	return items
+}
+
+func TestFairQueueRoundRobin(t *testing.T) {
+	q := newTestFairQueue(TypedFairQueueConfig[string]{Flow: tenantOf})
+	defer q.ShutDown()
+
+	for i := 0; i < 100; i++ {
+		q.Add(fmt.Sprintf("noisy/%d", i))
+	}
+	q.Add("quiet/0")
+	q.Add("quiet/1")
+	q.Add("other/0")
+
+	if e, a := 103, q.Len(); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+	if e, a := 100, q.FlowLen("noisy"); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+
+	expected := []string{"noisy/0", "quiet/0", "other/0", "noisy/1", "quiet/1", "noisy/2", "noisy/3"}
+	if a := drainFairQueue(q, len(expected)); !reflect.DeepEqual(expected, a) {
+		t.Errorf("expected %v, got %v", expected, a)
+	}
+	if e, a := 0, q.FlowLen("quiet"); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+}
+
+func TestFairQueueWeights(t *testing.T) {
+	q := newTestFairQueue(TypedFairQueueConfig[string]{
+		Flow: tenantOf,
+		Weight: func(flow string) int {
+			if flow == "gold" {
+				return 3
+			}
+			return 0
+		},
+	})
+	defer q.ShutDown()
+
+	for i := 0; i < 6; i++ {
+		q.Add(fmt.Sprintf("gold/%d", i))
+		q.Add(fmt.Sprintf("bronze/%d", i))
+	}
+
+	expected := []string{
+		"gold/0", "gold/1", "gold/2", "bronze/0",
+		"gold/3", "gold/4", "gold/5", "bronze/1",
+		"bronze/2", "bronze/3",
+	}
+	if a := drainFairQueue(q, len(expected)); !reflect.DeepEqual(expected, a) {
+		t.Errorf("expected %v, got %v", expected, a)
+	}
+}
+
+func TestFairQueueDeduping(t *testing.T) {
+	q := newTestFairQueue(TypedFairQueueConfig[string]{Flow: tenantOf})
+	defer q.ShutDown()
+
+	q.Add("a/foo")
+	q.Add("a/foo")
+	q.Add("b/bar")
+	if e, a := 2, q.Len(); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+
+	item, _ := q.Get()
+	if item != "a/foo" {
+		t.Errorf("expected %v, got %v", "a/foo", item)
+	}
+	// Add it back while processing
+	q.Add(item)
+	if e, a := 1, q.Len(); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+	q.Done(item)
+
+	if a := drainFairQueue(q, 2); !reflect.DeepEqual([]string{"b/bar", "a/foo"}, a) {
+		t.Errorf("expected %v, got %v", []string{"b/bar", "a/foo"}, a)
+	}
+
+	q.ShutDown()
+	if _, shutdown := q.Get(); !shutdown {
+		t.Errorf("expected shutdown")
+	}
+}
+
+type testFlowMetricsProvider struct {
+	testMetricsProvider
+
+	lock  sync.Mutex
+	flows map[string]*testMetric
+}
+
+func (m *testFlowMetricsProvider) NewFlowDepthMetric(name, flow string) GaugeMetric {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	metric := &testMetric{}
+	m.flows[name+"/"+flow] = metric
+	return metric
+}
+
+func TestFairQueueFlowMetrics(t *testing.T) {
+	mp := &testFlowMetricsProvider{flows: map[string]*testMetric{}}
+	mf := queueMetricsFactory{metricsProvider: mp}
+	c := clock.NewFakeClock(time.Now())
+	q := newTypedFairQueue[string](c, newTypedQueueMetrics[string](&mf, "test", c), mf.newFlowDepthMetrics("test"), time.Hour, TypedFairQueueConfig[string]{Flow: tenantOf})
+	defer q.ShutDown()
+
+	q.Add("a/0")
+	q.Add("a/1")
+	q.Add("b/0")
+	if e, a := 3.0, mp.depth.gaugeValue(); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+	if e, a := 2.0, mp.flows["test/a"].gaugeValue(); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+
+	drainFairQueue(q, 3)
+	q.Add("a/2")
+	if e, a := 1.0, mp.flows["test/a"].gaugeValue(); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+	if e, a := 0.0, mp.flows["test/b"].gaugeValue(); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+	if e, a := 2, len(mp.flows); e != a {
+		t.Errorf("expected flow metrics to be created once per flow, got %v", a)
+	}
+}
@@ -26,13 +26,16 @@ import (
 // This file provides abstractions for setting the provider (e.g., prometheus)
 // of metrics.
 
-type queueMetrics interface {
-	add(item t)
-	get(item t)
-	done(item t)
+type typedQueueMetrics[T comparable] interface {
+	add(item T)
+	get(item T)
+	done(item T)
+	batch(size int)
 	updateUnfinishedWork()
 }
 
+type queueMetrics = typedQueueMetrics[t]
+
 // GaugeMetric represents a single numerical value that can arbitrarily go up
 // and down.
 type GaugeMetric interface {
@@ -69,8 +72,11 @@ func (noopMetric) Dec()            {}
 func (noopMetric) Set(float64)     {}
 func (noopMetric) Observe(float64) {}
 
-// defaultQueueMetrics expects the caller to lock before setting any metrics.
-type defaultQueueMetrics struct {
+// defaultQueueMetrics is the untyped form of defaultTypedQueueMetrics.
+type defaultQueueMetrics = defaultTypedQueueMetrics[t]
+
+// defaultTypedQueueMetrics expects the caller to lock before setting any metrics.
+type defaultTypedQueueMetrics[T comparable] struct {
 	clock clock.Clock
 
 	// current depth of a workqueue
@@ -81,8 +87,11 @@ type defaultQueueMetrics struct {
 	latency HistogramMetric
 	// how long processing an item from a workqueue takes
 	workDuration         HistogramMetric
-	addTimes             map[t]time.Time
-	processingStartTimes map[t]time.Time
+	addTimes             map[T]time.Time
+	processingStartTimes map[T]time.Time
+
+	// how many items a GetBatch call hands out
+	batchSize HistogramMetric
 
 	// how long have current threads been working?
 	unfinishedWorkSeconds   SettableGaugeMetric
@@ -97,7 +106,7 @@ type defaultQueueMetrics struct {
 	deprecatedLongestRunningProcessor SettableGaugeMetric
 }
 
-func (m *defaultQueueMetrics) add(item t) {
+func (m *defaultTypedQueueMetrics[T]) add(item T) {
 	if m == nil {
 		return
 	}
@@ -111,7 +120,7 @@ func (m *defaultQueueMetrics) add(item t) {
 	}
 }
 
-func (m *defaultQueueMetrics) get(item t) {
+func (m *defaultTypedQueueMetrics[T]) get(item T) {
 	if m == nil {
 		return
 	}
@@ -126,7 +135,7 @@ func (m *defaultQueueMetrics) get(item t) {
 	}
 }
 
-func (m *defaultQueueMetrics) done(item t) {
+func (m *defaultTypedQueueMetrics[T]) done(item T) {
 	if m == nil {
 		return
 	}
@@ -138,7 +147,15 @@ func (m *defaultQueueMetrics) done(item t) {
 	}
 }
 
-func (m *defaultQueueMetrics) updateUnfinishedWork() {
+func (m *defaultTypedQueueMetrics[T]) batch(size int) {
+	if m == nil {
+		return
+	}
+
+	m.batchSize.Observe(float64(size))
+}
+
+func (m *defaultTypedQueueMetrics[T]) updateUnfinishedWork() {
 	// Note that a summary metric would be better for this, but prometheus
 	// doesn't seem to have non-hacky ways to reset the summary metrics.
 	var total float64
@@ -158,20 +175,21 @@ func (m *defaultQueueMetrics) updateUnfinishedWork() {
 	m.deprecatedLongestRunningProcessor.Set(oldest) // in microseconds.
 }
 
-type noMetrics struct{}
+type noMetrics[T comparable] struct{}
 
-func (noMetrics) add(item t)            {}
-func (noMetrics) get(item t)            {}
-func (noMetrics) done(item t)           {}
-func (noMetrics) updateUnfinishedWork() {}
+func (noMetrics[T]) add(item T)            {}
+func (noMetrics[T]) get(item T)            {}
+func (noMetrics[T]) done(item T)           {}
+func (noMetrics[T]) batch(size int)        {}
+func (noMetrics[T]) updateUnfinishedWork() {}
 
 // Gets the time since the specified start in microseconds.
-func (m *defaultQueueMetrics) sinceInMicroseconds(start time.Time) float64 {
+func (m *defaultTypedQueueMetrics[T]) sinceInMicroseconds(start time.Time) float64 {
 	return float64(m.clock.Since(start).Nanoseconds() / time.Microsecond.Nanoseconds())
 }
 
 // Gets the time since the specified start in seconds.
-func (m *defaultQueueMetrics) sinceInSeconds(start time.Time) float64 {
+func (m *defaultTypedQueueMetrics[T]) sinceInSeconds(start time.Time) float64 {
 	return m.clock.Since(start).Seconds()
 }
 
@@ -209,6 +227,22 @@ type MetricsProvider interface {
 	NewDeprecatedRetriesMetric(name string) CounterMetric
 }
 
+// BatchMetricsProvider is implemented by MetricsProviders that also generate
+// the metrics of batch dequeues (see Type.GetBatch). Queues created while the
+// provider does not implement it do not record batch sizes.
+type BatchMetricsProvider interface {
+	NewBatchSizeMetric(name string) HistogramMetric
+}
+
+// FlowMetricsProvider is implemented by MetricsProviders that also generate
+// the per-flow metrics of fair queues (see TypedFair). Queues created while
+// the provider does not implement it do not record per-flow depth.
+type FlowMetricsProvider interface {
+	// NewFlowDepthMetric returns the depth metric of flow in the queue
+	// name. It is called once per flow and queue.
+	NewFlowDepthMetric(name, flow string) GaugeMetric
+}
+
 type noopMetricsProvider struct{}
 
 func (_ noopMetricsProvider) NewDepthMetric(name string) GaugeMetric {
@@ -284,11 +318,21 @@ func (f *queueMetricsFactory) setProvider(mp MetricsProvider) {
 }
 
 func (f *queueMetricsFactory) newQueueMetrics(name string, clock clock.Clock) queueMetrics {
+	return newTypedQueueMetrics[t](f, name, clock)
+}
+
+// newTypedQueueMetrics is the generic form of queueMetricsFactory.newQueueMetrics.
+func newTypedQueueMetrics[T comparable](f *queueMetricsFactory, name string, clock clock.Clock) typedQueueMetrics[T] {
 	mp := f.metricsProvider
 	if len(name) == 0 || mp == (noopMetricsProvider{}) {
-		return noMetrics{}
+		return noMetrics[T]{}
 	}
-	return &defaultQueueMetrics{
+	var batchSize HistogramMetric = noopMetric{}
+	if bmp, ok := mp.(BatchMetricsProvider); ok {
+		batchSize = bmp.NewBatchSizeMetric(name)
+	}
+	return &defaultTypedQueueMetrics[T]{
+		batchSize:                         batchSize,
 		clock:                             clock,
 		depth:                             mp.NewDepthMetric(name),
 		adds:                              mp.NewAddsMetric(name),
@@ -302,8 +346,20 @@ func (f *queueMetricsFactory) newQueueMetrics(name string, clock clock.Clock) qu
 		deprecatedWorkDuration:            mp.NewDeprecatedWorkDurationMetric(name),
 		deprecatedUnfinishedWorkSeconds:   mp.NewDeprecatedUnfinishedWorkSecondsMetric(name),
 		deprecatedLongestRunningProcessor: mp.NewDeprecatedLongestRunningProcessorMicrosecondsMetric(name),
-		addTimes:                          map[t]time.Time{},
-		processingStartTimes:              map[t]time.Time{},
+		addTimes:                          map[T]time.Time{},
+		processingStartTimes:              map[T]time.Time{},
+	}
+}
+
+// newFlowDepthMetrics returns the function generating the per-flow depth
+// metrics of the queue name.
+func (f *queueMetricsFactory) newFlowDepthMetrics(name string) func(flow string) GaugeMetric {
+	fmp, ok := f.metricsProvider.(FlowMetricsProvider)
+	if len(name) == 0 || !ok {
+		return func(string) GaugeMetric { return noopMetric{} }
+	}
+	return func(flow string) GaugeMetric {
+		return fmp.NewFlowDepthMetric(name, flow)
 	}
 }
 
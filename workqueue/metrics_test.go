@@ -33,6 +33,7 @@ type testMetrics struct {
 func (m *testMetrics) add(item t)            { m.added++ }
 func (m *testMetrics) get(item t)            { m.gotten++ }
 func (m *testMetrics) done(item t)           { m.finished++ }
+func (m *testMetrics) batch(size int)        {}
 func (m *testMetrics) updateUnfinishedWork() { m.updateCalled <- struct{}{} }
 
 func TestMetricShutdown(t *testing.T) {
@@ -137,6 +138,7 @@ type testMetricsProvider struct {
 	unfinished testMetric
 	longest    testMetric
 	retries    testMetric
+	batchSize  testMetric
 	// deprecated metrics
 	deprecatedDepth      testMetric
 	deprecatedAdds       testMetric
@@ -147,6 +149,10 @@ type testMetricsProvider struct {
 	deprecatedRetries    testMetric
 }
 
+func (m *testMetricsProvider) NewBatchSizeMetric(name string) HistogramMetric {
+	return &m.batchSize
+}
+
 func (m *testMetricsProvider) NewDepthMetric(name string) GaugeMetric {
 	return &m.depth
 }
@@ -380,3 +386,36 @@ func TestMetrics(t *testing.T) {
 		t.Errorf("expected %v, got %v", e, a)
 	}
 }
+
+func TestBatchMetrics(t *testing.T) {
+	mp := testMetricsProvider{}
+	c := clock.NewFakeClock(time.Unix(0, 0))
+	mf := queueMetricsFactory{metricsProvider: &mp}
+	q := newQueue(c, mf.newQueueMetrics("test", c), time.Millisecond)
+	defer q.ShutDown()
+
+	q.Add("foo")
+	q.Add("bar")
+	q.Add("baz")
+	items, _ := q.GetBatch(2, 0)
+	if e, a := 2.0, mp.batchSize.observationValue(); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+	if e, a := 1.0, mp.depth.gaugeValue(); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+
+	c.Step(50 * time.Microsecond)
+	q.DoneBatch(items)
+	if e, a := 2, mp.duration.observationCount(); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+
+	q.GetBatch(2, 0)
+	if e, a := 1.0, mp.batchSize.observationValue(); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+	if e, a := 2, mp.batchSize.observationCount(); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+}
@@ -18,6 +18,10 @@ package workqueue
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sort"
 	"sync"
 
 	utilruntime "github.com/commcos/utils/runtime"
@@ -35,6 +39,9 @@ func Parallelize(workers, pieces int, doWorkPiece DoWorkPieceFunc) {
 
 // ParallelizeUntil is a framework that allows for parallelizing N
 // independent pieces of work until done or the context is canceled.
+//
+// Deprecated: Use ParallelizeErr instead, which reports the errors and panics
+// of the pieces.
 func ParallelizeUntil(ctx context.Context, workers, pieces int, doWorkPiece DoWorkPieceFunc) {
 	var stop <-chan struct{}
 	if ctx != nil {
@@ -69,3 +76,173 @@ func ParallelizeUntil(ctx context.Context, workers, pieces int, doWorkPiece DoWo
 	}
 	wg.Wait()
 }
+
+// DoWorkPieceErrFunc processes a piece of work. The context is canceled when
+// the remaining pieces will not be processed.
+type DoWorkPieceErrFunc func(ctx context.Context, piece int) error
+
+// PanicError is the error reported for a piece of work that panicked.
+type PanicError struct {
+	// Piece is the index of the piece that panicked.
+	Piece int
+	// Value is the value passed to panic.
+	Value interface{}
+	// Stack is the stack trace of the panicking goroutine.
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("piece %d panicked: %v", e.Piece, e.Value)
+}
+
+// ParallelizeOption configures ParallelizeErr and ParallelizeSlice.
+type ParallelizeOption func(*parallelizeOptions)
+
+type parallelizeOptions struct {
+	chunkSize  int
+	collectAll bool
+}
+
+// WithChunkSize makes workers take chunkSize consecutive pieces at a time,
+// amortizing the cost of dispatching pieces when they are cheap. Values
+// below 1 are treated as 1, the default.
+func WithChunkSize(chunkSize int) ParallelizeOption {
+	return func(o *parallelizeOptions) {
+		o.chunkSize = chunkSize
+	}
+}
+
+// WithCollectAllErrors keeps processing the remaining pieces when a piece
+// fails, and returns the errors of all the failed pieces. By default, the
+// first error stops the processing of further pieces and is returned alone.
+func WithCollectAllErrors() ParallelizeOption {
+	return func(o *parallelizeOptions) {
+		o.collectAll = true
+	}
+}
+
+// ParallelizeErr processes pieces independent pieces of work with up to
+// workers goroutines, until done or ctx is canceled. A piece that panics fails
+// with a *PanicError.
+//
+// By default, the first piece to fail cancels the context passed to the
+// pieces still running, no further piece is started, and its error is
+// returned. With WithCollectAllErrors, every piece is processed and the
+// errors are returned joined, ordered by piece. If ctx is canceled before
+// every piece was started, ctx.Err() is returned along with those errors.
+func ParallelizeErr(ctx context.Context, workers, pieces int, doWorkPiece DoWorkPieceErrFunc, opts ...ParallelizeOption) error {
+	if pieces <= 0 {
+		return nil
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	o := parallelizeOptions{chunkSize: 1}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.chunkSize < 1 {
+		o.chunkSize = 1
+	}
+
+	chunks := (pieces + o.chunkSize - 1) / o.chunkSize
+	toProcess := make(chan int, chunks)
+	for i := 0; i < chunks; i++ {
+		toProcess <- i * o.chunkSize
+	}
+	close(toProcess)
+
+	if chunks < workers {
+		workers = chunks
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	pieceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		lock    sync.Mutex
+		errs    []*pieceError
+		skipped bool
+	)
+	fail := func(piece int, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		errs = append(errs, &pieceError{piece: piece, err: err})
+		if !o.collectAll {
+			cancel()
+		}
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for start := range toProcess {
+				end := start + o.chunkSize
+				if end > pieces {
+					end = pieces
+				}
+				for piece := start; piece < end; piece++ {
+					if pieceCtx.Err() != nil {
+						lock.Lock()
+						skipped = true
+						lock.Unlock()
+						return
+					}
+					if err := doPiece(pieceCtx, piece, doWorkPiece); err != nil {
+						fail(piece, err)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(errs) == 0 {
+		if skipped {
+			return ctx.Err()
+		}
+		return nil
+	}
+	if !o.collectAll {
+		return errs[0].err
+	}
+
+	sort.Slice(errs, func(i, j int) bool { return errs[i].piece < errs[j].piece })
+	all := make([]error, 0, len(errs)+1)
+	for _, e := range errs {
+		all = append(all, e.err)
+	}
+	if skipped {
+		all = append(all, ctx.Err())
+	}
+	return errors.Join(all...)
+}
+
+// ParallelizeSlice calls doWorkItem for every item of items, in parallel as
+// ParallelizeErr does, with the index of the item in items.
+func ParallelizeSlice[T any](ctx context.Context, workers int, items []T, doWorkItem func(ctx context.Context, i int, item T) error, opts ...ParallelizeOption) error {
+	return ParallelizeErr(ctx, workers, len(items), func(ctx context.Context, piece int) error {
+		return doWorkItem(ctx, piece, items[piece])
+	}, opts...)
+}
+
+type pieceError struct {
+	piece int
+	err   error
+}
+
+// doPiece processes a piece, turning a panic into a *PanicError.
+func doPiece(ctx context.Context, piece int, doWorkPiece DoWorkPieceErrFunc) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Piece: piece, Value: r, Stack: debug.Stack()}
+			utilruntime.HandleError(err)
+		}
+	}()
+	return doWorkPiece(ctx, piece)
+}
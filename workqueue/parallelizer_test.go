@@ -0,0 +1,124 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package workqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParallelizeErr(t *testing.T) {
+	for _, chunkSize := range []int{0, 1, 3, 100} {
+		var done [50]int32
+		err := ParallelizeErr(context.Background(), 4, len(done), func(ctx context.Context, piece int) error {
+			atomic.AddInt32(&done[piece], 1)
+			return nil
+		}, WithChunkSize(chunkSize))
+		if err != nil {
+			t.Fatalf("chunk size %d: unexpected error: %v", chunkSize, err)
+		}
+		for i := range done {
+			if done[i] != 1 {
+				t.Errorf("chunk size %d: piece %d processed %d times", chunkSize, i, done[i])
+			}
+		}
+	}
+}
+
+func TestParallelizeErrFailFast(t *testing.T) {
+	failure := errors.New("failure")
+	var processed int32
+	err := ParallelizeErr(context.Background(), 1, 10, func(ctx context.Context, piece int) error {
+		atomic.AddInt32(&processed, 1)
+		if piece == 3 {
+			return failure
+		}
+		return nil
+	})
+	if err != failure {
+		t.Errorf("expected %v, got %v", failure, err)
+	}
+	if processed != 4 {
+		t.Errorf("expected processing to stop after the failing piece, processed %d", processed)
+	}
+}
+
+func TestParallelizeErrCollectAll(t *testing.T) {
+	var processed int32
+	err := ParallelizeErr(context.Background(), 3, 10, func(ctx context.Context, piece int) error {
+		atomic.AddInt32(&processed, 1)
+		if piece%3 == 0 {
+			return fmt.Errorf("piece %d", piece)
+		}
+		if piece == 5 {
+			panic("boom")
+		}
+		return nil
+	}, WithCollectAllErrors(), WithChunkSize(2))
+	if processed != 10 {
+		t.Errorf("expected every piece to be processed, processed %d", processed)
+	}
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	expected := "piece 0\npiece 3\npiece 5 panicked: boom\npiece 6\npiece 9"
+	if err.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, err.Error())
+	}
+	var panicErr *PanicError
+	if !errors.As(err, &panicErr) || panicErr.Piece != 5 || panicErr.Value != "boom" || len(panicErr.Stack) == 0 {
+		t.Errorf("expected a PanicError for piece 5, got %#v", panicErr)
+	}
+}
+
+func TestParallelizeErrCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var processed int32
+	err := ParallelizeErr(ctx, 1, 10, func(ctx context.Context, piece int) error {
+		atomic.AddInt32(&processed, 1)
+		if piece == 1 {
+			cancel()
+		}
+		return nil
+	})
+	if err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+	if processed != 2 {
+		t.Errorf("expected 2 pieces to be processed, got %d", processed)
+	}
+}
+
+func TestParallelizeSlice(t *testing.T) {
+	items := []string{"a", "b", "c", "d"}
+	out := make([]string, len(items))
+	err := ParallelizeSlice(context.Background(), 2, items, func(ctx context.Context, i int, item string) error {
+		out[i] = item + item
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, item := range items {
+		if out[i] != item+item {
+			t.Errorf("%d: expected %q, got %q", i, item+item, out[i])
+		}
+	}
+}
@@ -0,0 +1,443 @@
+/*
+Copyright 2015 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package workqueue
+
+import (
+	"container/heap"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/commcos/utils/clock"
+)
+
+// DefaultPriority is the priority of items added without one, e.g. through Add
+// or AddAfter.
+const DefaultPriority = 0
+
+// DefaultPriorityAgingInterval is the aging interval used when
+// PriorityQueueConfig.AgingInterval is zero.
+const DefaultPriorityAgingInterval = 10 * time.Second
+
+// PriorityQueueConfig configures a priority work queue.
+type PriorityQueueConfig struct {
+	// Name is used to register the queue's metrics. Unnamed queues are not
+	// instrumented.
+	Name string
+
+	// AgingInterval is how long an item has to wait to gain one priority
+	// level, so that low priority items cannot be starved forever by a
+	// steady stream of higher priority ones. Zero selects
+	// DefaultPriorityAgingInterval, a negative value disables aging.
+	AgingInterval time.Duration
+}
+
+// TypedPriorityInterface is a TypedInterface whose items are handed out by
+// priority instead of in FIFO order. Get returns the waiting item with the
+// highest priority, where an item's priority grows by one for every
+// AgingInterval it has been waiting. Items of the same effective priority are
+// returned in the order in which they were added.
+type TypedPriorityInterface[T comparable] interface {
+	TypedInterface[T]
+	// AddWithPriority marks item as needing processing with the given
+	// priority. Add is equivalent to AddWithPriority(item, DefaultPriority).
+	// If item is already waiting, its priority is raised to priority if that
+	// is higher, but never lowered.
+	AddWithPriority(item T, priority int)
+}
+
+// PriorityInterface is the untyped form of TypedPriorityInterface.
+type PriorityInterface TypedPriorityInterface[interface{}]
+
+// TypedPriorityDelayingInterface is a TypedPriorityInterface that can add an
+// item with a priority at a later time.
+type TypedPriorityDelayingInterface[T comparable] interface {
+	TypedDelayingInterface[T]
+	AddWithPriority(item T, priority int)
+	// AddAfterWithPriority adds an item with the given priority after the
+	// indicated duration has passed. AddAfter is equivalent to
+	// AddAfterWithPriority(item, DefaultPriority, duration).
+	AddAfterWithPriority(item T, priority int, duration time.Duration)
+}
+
+// PriorityDelayingInterface is the untyped form of TypedPriorityDelayingInterface.
+type PriorityDelayingInterface TypedPriorityDelayingInterface[interface{}]
+
+// TypedPriorityRateLimitingInterface is a TypedPriorityDelayingInterface that
+// rate limits items being added to the queue.
+type TypedPriorityRateLimitingInterface[T comparable] interface {
+	TypedRateLimitingInterface[T]
+	AddWithPriority(item T, priority int)
+	AddAfterWithPriority(item T, priority int, duration time.Duration)
+	// AddRateLimitedWithPriority adds an item with the given priority after
+	// the rate limiter says it's ok. AddRateLimited is equivalent to
+	// AddRateLimitedWithPriority(item, DefaultPriority).
+	AddRateLimitedWithPriority(item T, priority int)
+}
+
+// PriorityRateLimitingInterface is the untyped form of TypedPriorityRateLimitingInterface.
+type PriorityRateLimitingInterface TypedPriorityRateLimitingInterface[interface{}]
+
+// NewPriorityQueue constructs a new priority work queue.
+func NewPriorityQueue(config PriorityQueueConfig) *PriorityType {
+	return NewTypedPriorityQueue[t](config)
+}
+
+// NewTypedPriorityQueue constructs a new priority work queue of items of type T.
+func NewTypedPriorityQueue[T comparable](config PriorityQueueConfig) *TypedPriority[T] {
+	rc := clock.RealClock{}
+	return newTypedPriorityQueue(
+		rc,
+		newTypedQueueMetrics[T](&globalMetricsFactory, config.Name, rc),
+		defaultUnfinishedWorkUpdatePeriod,
+		config.AgingInterval,
+	)
+}
+
+// NewPriorityDelayingQueue constructs a new priority work queue with delayed
+// queuing ability.
+func NewPriorityDelayingQueue(config PriorityQueueConfig) PriorityDelayingInterface {
+	return NewTypedPriorityDelayingQueue[t](config)
+}
+
+// NewTypedPriorityDelayingQueue constructs a new priority work queue of items
+// of type T with delayed queuing ability.
+func NewTypedPriorityDelayingQueue[T comparable](config PriorityQueueConfig) TypedPriorityDelayingInterface[T] {
+	return newTypedDelayingQueueWithQueue[T](clock.RealClock{}, config.Name, NewTypedPriorityQueue[T](config), nil)
+}
+
+// NewPriorityRateLimitingQueue constructs a new priority work queue with
+// rateLimited queuing ability.
+// Remember to call Forget!  If you don't, you may end up tracking failures forever.
+func NewPriorityRateLimitingQueue(rateLimiter RateLimiter, config PriorityQueueConfig) PriorityRateLimitingInterface {
+	return NewTypedPriorityRateLimitingQueue[t](rateLimiter, config)
+}
+
+// NewTypedPriorityRateLimitingQueue constructs a new priority work queue of
+// items of type T with rateLimited queuing ability.
+// Remember to call Forget!  If you don't, you may end up tracking failures forever.
+func NewTypedPriorityRateLimitingQueue[T comparable](rateLimiter TypedRateLimiter[T], config PriorityQueueConfig) TypedPriorityRateLimitingInterface[T] {
+	return &typedPriorityRateLimitingType[T]{
+		TypedPriorityDelayingInterface: NewTypedPriorityDelayingQueue[T](config),
+		rateLimiter:                    rateLimiter,
+	}
+}
+
+func newTypedPriorityQueue[T comparable](c clock.Clock, metrics typedQueueMetrics[T], updatePeriod, agingInterval time.Duration) *TypedPriority[T] {
+	if agingInterval == 0 {
+		agingInterval = DefaultPriorityAgingInterval
+	}
+	if agingInterval < 0 {
+		agingInterval = 0
+	}
+	q := &TypedPriority[T]{
+		clock:                      c,
+		agingInterval:              agingInterval,
+		dirty:                      map[T]*priorityItem[T]{},
+		processing:                 set[T]{},
+		cond:                       sync.NewCond(&sync.Mutex{}),
+		metrics:                    metrics,
+		unfinishedWorkUpdatePeriod: updatePeriod,
+	}
+	q.queue.agingInterval = agingInterval
+	go q.updateUnfinishedWorkLoop()
+	return q
+}
+
+// PriorityType is the untyped form of TypedPriority.
+type PriorityType = TypedPriority[t]
+
+// TypedPriority is a work queue that hands out items by priority (see
+// TypedPriorityInterface). It has the same dedup and processing semantics as
+// Typed.
+type TypedPriority[T comparable] struct {
+	// queue orders the items waiting to be worked on. Every element of
+	// queue is in the dirty set and not in the processing set.
+	queue priorityHeap[T]
+
+	// dirty holds all of the items that need to be processed, together with
+	// their priority. Dirty items that are also being processed are not in
+	// queue until they are Done.
+	dirty map[T]*priorityItem[T]
+
+	// Things that are currently being processed are in the processing set.
+	processing set[T]
+
+	// seq orders items of the same effective priority by insertion.
+	seq uint64
+
+	cond *sync.Cond
+
+	shuttingDown bool
+
+	metrics typedQueueMetrics[T]
+
+	agingInterval              time.Duration
+	unfinishedWorkUpdatePeriod time.Duration
+	clock                      clock.Clock
+}
+
+// priorityItem is a dirty item of a priority queue.
+type priorityItem[T comparable] struct {
+	data     T
+	priority int
+	addedAt  time.Time
+	seq      uint64
+	// index in the heap, or -1 while the item waits for Done.
+	index int
+}
+
+// Add marks item as needing processing with DefaultPriority.
+func (q *TypedPriority[T]) Add(item T) {
+	q.AddWithPriority(item, DefaultPriority)
+}
+
+// AddWithPriority marks item as needing processing with the given priority.
+func (q *TypedPriority[T]) AddWithPriority(item T, priority int) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	if q.shuttingDown {
+		return
+	}
+	if existing, exists := q.dirty[item]; exists {
+		if priority > existing.priority {
+			existing.priority = priority
+			if existing.index >= 0 {
+				heap.Fix(&q.queue, existing.index)
+			}
+		}
+		return
+	}
+
+	q.metrics.add(item)
+
+	q.seq++
+	entry := &priorityItem[T]{
+		data:     item,
+		priority: priority,
+		addedAt:  q.clock.Now(),
+		seq:      q.seq,
+		index:    -1,
+	}
+	q.dirty[item] = entry
+	if q.processing.has(item) {
+		return
+	}
+
+	heap.Push(&q.queue, entry)
+	q.cond.Signal()
+}
+
+// Len returns the current queue length, for informational purposes only. You
+// shouldn't e.g. gate a call to Add() or Get() on Len() being a particular
+// value, that can't be synchronized properly.
+func (q *TypedPriority[T]) Len() int {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return q.queue.Len()
+}
+
+// Get blocks until it can return an item to be processed, picking the item
+// with the highest effective priority. If shutdown = true, the caller should
+// end their goroutine. You must call Done with item when you have finished
+// processing it.
+func (q *TypedPriority[T]) Get() (item T, shutdown bool) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	for q.queue.Len() == 0 && !q.shuttingDown {
+		q.cond.Wait()
+	}
+	if q.queue.Len() == 0 {
+		// We must be shutting down.
+		return item, true
+	}
+
+	item = heap.Pop(&q.queue).(*priorityItem[T]).data
+
+	q.metrics.get(item)
+
+	q.processing.insert(item)
+	delete(q.dirty, item)
+
+	return item, false
+}
+
+// Done marks item as done processing, and if it has been marked as dirty again
+// while it was being processed, it will be re-added to the queue for
+// re-processing with the priority it was re-added with.
+func (q *TypedPriority[T]) Done(item T) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	q.metrics.done(item)
+
+	q.processing.delete(item)
+	if entry, exists := q.dirty[item]; exists {
+		heap.Push(&q.queue, entry)
+		q.cond.Signal()
+	}
+}
+
+// ShutDown will cause q to ignore all new items added to it. As soon as the
+// worker goroutines have drained the existing items in the queue, they will be
+// instructed to exit.
+func (q *TypedPriority[T]) ShutDown() {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.shuttingDown = true
+	q.cond.Broadcast()
+}
+
+func (q *TypedPriority[T]) ShuttingDown() bool {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	return q.shuttingDown
+}
+
+func (q *TypedPriority[T]) updateUnfinishedWorkLoop() {
+	t := q.clock.NewTicker(q.unfinishedWorkUpdatePeriod)
+	defer t.Stop()
+	for range t.C() {
+		if !func() bool {
+			q.cond.L.Lock()
+			defer q.cond.L.Unlock()
+			if !q.shuttingDown {
+				q.metrics.updateUnfinishedWork()
+				return true
+			}
+			return false
+		}() {
+			return
+		}
+	}
+}
+
+// priorityHeap implements heap.Interface, keeping the item with the highest
+// effective priority at the root.
+//
+// An item's effective priority is priority + waited/agingInterval. Since all
+// waiting items age at the same rate, comparing two items does not depend on
+// the current time: a has precedence over b when
+// a.priority*agingInterval - a.addedAt > b.priority*agingInterval - b.addedAt.
+// The order of the heap therefore never goes stale while items wait. The
+// products are not computed when they would overflow: the priorities then
+// decide alone.
+type priorityHeap[T comparable] struct {
+	items         []*priorityItem[T]
+	agingInterval time.Duration
+}
+
+func (h *priorityHeap[T]) Len() int {
+	return len(h.items)
+}
+
+func (h *priorityHeap[T]) Less(i, j int) bool {
+	a, b := h.items[i], h.items[j]
+	if h.agingInterval > 0 {
+		if c := h.compare(a, b); c != 0 {
+			return c > 0
+		}
+	} else if a.priority != b.priority {
+		return a.priority > b.priority
+	}
+	return a.seq < b.seq
+}
+
+// compare returns the sign of the difference between the effective
+// priorities of a and b.
+func (h *priorityHeap[T]) compare(a, b *priorityItem[T]) int {
+	if a.priority < b.priority {
+		return -h.compare(b, a)
+	}
+	// a has the higher priority, and b can only catch up by having waited
+	// longer than the priority gap.
+	lead := b.addedAt.Sub(a.addedAt)
+	if a.priority == b.priority || lead > 0 {
+		switch {
+		case lead > 0:
+			return 1
+		case lead < 0:
+			return -1
+		}
+		return 0
+	}
+	behind := a.addedAt.Sub(b.addedAt)
+	gap := uint64(a.priority) - uint64(b.priority)
+	if gap > uint64(math.MaxInt64/h.agingInterval) {
+		return 1
+	}
+	switch head := time.Duration(gap) * h.agingInterval; {
+	case head > behind:
+		return 1
+	case head < behind:
+		return -1
+	}
+	return 0
+}
+
+func (h *priorityHeap[T]) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.items[i].index = i
+	h.items[j].index = j
+}
+
+// Push adds an item to the heap. Push should not be called directly; instead,
+// use `heap.Push`.
+func (h *priorityHeap[T]) Push(x interface{}) {
+	item := x.(*priorityItem[T])
+	item.index = len(h.items)
+	h.items = append(h.items, item)
+}
+
+// Pop removes an item from the heap. Pop should not be called directly;
+// instead, use `heap.Pop`.
+func (h *priorityHeap[T]) Pop() interface{} {
+	n := len(h.items)
+	item := h.items[n-1]
+	item.index = -1
+	h.items[n-1] = nil
+	h.items = h.items[:n-1]
+	return item
+}
+
+// typedPriorityRateLimitingType wraps a TypedPriorityDelayingInterface and
+// provides rateLimited re-enquing
+type typedPriorityRateLimitingType[T comparable] struct {
+	TypedPriorityDelayingInterface[T]
+
+	rateLimiter TypedRateLimiter[T]
+}
+
+// AddRateLimited AddAfter's the item based on the time when the rate limiter says it's ok
+func (q *typedPriorityRateLimitingType[T]) AddRateLimited(item T) {
+	q.AddRateLimitedWithPriority(item, DefaultPriority)
+}
+
+// AddRateLimitedWithPriority AddAfterWithPriority's the item based on the time
+// when the rate limiter says it's ok
+func (q *typedPriorityRateLimitingType[T]) AddRateLimitedWithPriority(item T, priority int) {
+	q.TypedPriorityDelayingInterface.AddAfterWithPriority(item, priority, q.rateLimiter.When(item))
+}
+
+func (q *typedPriorityRateLimitingType[T]) NumRequeues(item T) int {
+	return q.rateLimiter.NumRequeues(item)
+}
+
+func (q *typedPriorityRateLimitingType[T]) Forget(item T) {
+	q.rateLimiter.Forget(item)
+}
@@ -0,0 +1,209 @@
+/*
+Copyright 2015 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package workqueue
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/commcos/utils/clock"
+	"github.com/commcos/utils/wait"
+)
+
+func newTestPriorityQueue(c clock.Clock, agingInterval time.Duration) *TypedPriority[string] {
+	return newTypedPriorityQueue[string](c, noMetrics[string]{}, time.Millisecond, agingInterval)
+}
+
+func expectGet(t *testing.T, q TypedInterface[string], expected ...string) {
+	t.Helper()
+	for _, e := range expected {
+		item, shutdown := q.Get()
+		if shutdown {
+			t.Fatalf("unexpected shutdown, expected %v", e)
+		}
+		if item != e {
+			t.Errorf("expected %v, got %v", e, item)
+		}
+		q.Done(item)
+	}
+}
+
+func TestPriorityQueueOrder(t *testing.T) {
+	q := newTestPriorityQueue(clock.NewFakeClock(time.Now()), -1)
+	defer q.ShutDown()
+
+	q.Add("resync-1")
+	q.AddWithPriority("user", 10)
+	q.Add("resync-2")
+	q.AddWithPriority("low", -1)
+	q.AddWithPriority("urgent", 100)
+
+	if e, a := 5, q.Len(); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+	expectGet(t, q, "urgent", "user", "resync-1", "resync-2", "low")
+}
+
+func TestPriorityQueueDeduping(t *testing.T) {
+	q := newTestPriorityQueue(clock.NewFakeClock(time.Now()), -1)
+	defer q.ShutDown()
+
+	q.Add("foo")
+	q.Add("bar")
+	// re-adding raises the priority of a waiting item, but never lowers it
+	q.AddWithPriority("bar", 5)
+	q.AddWithPriority("bar", 1)
+	if e, a := 2, q.Len(); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+	expectGet(t, q, "bar", "foo")
+}
+
+func TestPriorityQueueAddWhileProcessing(t *testing.T) {
+	q := newTestPriorityQueue(clock.NewFakeClock(time.Now()), -1)
+	defer q.ShutDown()
+
+	q.Add("foo")
+	item, _ := q.Get()
+
+	// Add it back with a high priority while it is processing
+	q.AddWithPriority("foo", 10)
+	q.Add("bar")
+	if e, a := 1, q.Len(); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+
+	// It is queued again with the priority it was re-added with
+	q.Done(item)
+	if e, a := 2, q.Len(); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+	expectGet(t, q, "foo", "bar")
+}
+
+func TestPriorityQueueAging(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	q := newTestPriorityQueue(fakeClock, time.Second)
+	defer q.ShutDown()
+
+	q.Add("old")
+	fakeClock.Step(3 * time.Second)
+	// "old" has aged to an effective priority of 3 by now
+	q.AddWithPriority("two", 2)
+	q.AddWithPriority("five", 5)
+	q.AddWithPriority("three", 3)
+
+	expectGet(t, q, "five", "old", "three", "two")
+}
+
+func TestPriorityQueueLargePriorities(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	q := newTestPriorityQueue(fakeClock, 0)
+	defer q.ShutDown()
+
+	q.Add("default")
+	q.AddWithPriority("min", math.MinInt)
+	fakeClock.Step(time.Hour)
+	// priority*agingInterval overflows int64 for all but "high"
+	q.AddWithPriority("max", math.MaxInt)
+	q.AddWithPriority("int32", math.MaxInt32)
+	q.AddWithPriority("high", 1000)
+
+	expectGet(t, q, "max", "int32", "high", "default", "min")
+}
+
+func TestPriorityQueueShutDown(t *testing.T) {
+	q := newTestPriorityQueue(clock.NewFakeClock(time.Now()), 0)
+	q.AddWithPriority("foo", 1)
+	q.ShutDown()
+	q.Add("bar")
+
+	expectGet(t, q, "foo")
+	if _, shutdown := q.Get(); !shutdown {
+		t.Errorf("expected shutdown")
+	}
+}
+
+func TestPriorityDelayingQueue(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	q := newTypedDelayingQueueWithQueue[string](fakeClock, "", newTestPriorityQueue(fakeClock, -1), nil)
+	defer q.ShutDown()
+
+	q.AddAfterWithPriority("user", 10, 50*time.Millisecond)
+	q.AddAfter("resync", 10*time.Millisecond)
+	q.AddAfterWithPriority("user", 20, 70*time.Millisecond)
+	if err := wait.Poll(time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return len(q.waitingForAddCh) == 0, nil
+	}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if q.Len() != 0 {
+		t.Errorf("should not have added")
+	}
+
+	fakeClock.Step(60 * time.Millisecond)
+	if err := wait.Poll(time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return q.Len() == 2, nil
+	}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// "user" fired at the earliest delay with the highest priority
+	q.AddWithPriority("resync", 15)
+	expectGet(t, q, "user", "resync")
+}
+
+func TestPriorityRateLimitingQueue(t *testing.T) {
+	limiter := NewTypedItemExponentialFailureRateLimiter[string](time.Millisecond, time.Second)
+	queue := NewTypedPriorityRateLimitingQueue(limiter, PriorityQueueConfig{}).(*typedPriorityRateLimitingType[string])
+	fakeClock := clock.NewFakeClock(time.Now())
+	delayingQueue := &typedDelayingType[string]{
+		TypedInterface:    newTestPriorityQueue(fakeClock, -1),
+		clock:             fakeClock,
+		heartbeat:         fakeClock.NewTicker(maxWait),
+		stopCh:            make(chan struct{}),
+		waitingForAddCh:   make(chan *typedWaitFor[string], 1000),
+		metrics:           newRetryMetrics(""),
+		deprecatedMetrics: newDeprecatedRetryMetrics(""),
+	}
+	queue.TypedPriorityDelayingInterface = delayingQueue
+
+	queue.AddRateLimitedWithPriority("one", 7)
+	waitEntry := <-delayingQueue.waitingForAddCh
+	if e, a := time.Millisecond, waitEntry.readyAt.Sub(fakeClock.Now()); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+	if e, a := 7, waitEntry.priority; e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+	queue.AddRateLimited("one")
+	waitEntry = <-delayingQueue.waitingForAddCh
+	if e, a := 2*time.Millisecond, waitEntry.readyAt.Sub(fakeClock.Now()); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+	if e, a := DefaultPriority, waitEntry.priority; e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+	if e, a := 2, queue.NumRequeues("one"); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+	queue.Forget("one")
+	if e, a := 0, queue.NumRequeues("one"); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+}
@@ -23,34 +23,54 @@ import (
 	"github.com/commcos/utils/clock"
 )
 
-type Interface interface {
-	Add(item interface{})
+// TypedInterface is a work queue of items of type T (see the package
+// comment). Items must be comparable, as they are deduplicated by value.
+type TypedInterface[T comparable] interface {
+	Add(item T)
 	Len() int
-	Get() (item interface{}, shutdown bool)
-	Done(item interface{})
+	Get() (item T, shutdown bool)
+	Done(item T)
 	ShutDown()
 	ShuttingDown() bool
 }
 
+// Interface is the untyped form of TypedInterface.
+type Interface TypedInterface[interface{}]
+
 // New constructs a new work queue (see the package comment).
 func New() *Type {
 	return NewNamed("")
 }
 
 func NewNamed(name string) *Type {
+	return NewTypedNamed[interface{}](name)
+}
+
+// NewTyped constructs a new work queue of items of type T.
+func NewTyped[T comparable]() *Typed[T] {
+	return NewTypedNamed[T]("")
+}
+
+// NewTypedNamed constructs a new named work queue of items of type T. The
+// name is used to register the queue's metrics.
+func NewTypedNamed[T comparable](name string) *Typed[T] {
 	rc := clock.RealClock{}
-	return newQueue(
+	return newTypedQueue(
 		rc,
-		globalMetricsFactory.newQueueMetrics(name, rc),
+		newTypedQueueMetrics[T](&globalMetricsFactory, name, rc),
 		defaultUnfinishedWorkUpdatePeriod,
 	)
 }
 
 func newQueue(c clock.Clock, metrics queueMetrics, updatePeriod time.Duration) *Type {
-	t := &Type{
+	return newTypedQueue[t](c, metrics, updatePeriod)
+}
+
+func newTypedQueue[T comparable](c clock.Clock, metrics typedQueueMetrics[T], updatePeriod time.Duration) *Typed[T] {
+	t := &Typed[T]{
 		clock:                      c,
-		dirty:                      set{},
-		processing:                 set{},
+		dirty:                      set[T]{},
+		processing:                 set[T]{},
 		cond:                       sync.NewCond(&sync.Mutex{}),
 		metrics:                    metrics,
 		unfinishedWorkUpdatePeriod: updatePeriod,
@@ -62,50 +82,56 @@ func newQueue(c clock.Clock, metrics queueMetrics, updatePeriod time.Duration) *
 const defaultUnfinishedWorkUpdatePeriod = 500 * time.Millisecond
 
 // Type is a work queue (see the package comment).
-type Type struct {
+type Type = Typed[t]
+
+// Typed is a work queue of items of type T (see the package comment).
+type Typed[T comparable] struct {
 	// queue defines the order in which we will work on items. Every
 	// element of queue should be in the dirty set and not in the
 	// processing set.
-	queue []t
+	queue []T
 
 	// dirty defines all of the items that need to be processed.
-	dirty set
+	dirty set[T]
 
 	// Things that are currently being processed are in the processing set.
 	// These things may be simultaneously in the dirty set. When we finish
 	// processing something and remove it from this set, we'll check if
 	// it's in the dirty set, and if so, add it to the queue.
-	processing set
+	processing set[T]
 
 	cond *sync.Cond
 
 	shuttingDown bool
 
-	metrics queueMetrics
+	metrics typedQueueMetrics[T]
+
+	// journal, if set, persists the items that still need processing.
+	journal typedJournal[T]
 
 	unfinishedWorkUpdatePeriod time.Duration
 	clock                      clock.Clock
 }
 
 type empty struct{}
-type t interface{}
-type set map[t]empty
+type t = interface{}
+type set[T comparable] map[T]empty
 
-func (s set) has(item t) bool {
+func (s set[T]) has(item T) bool {
 	_, exists := s[item]
 	return exists
 }
 
-func (s set) insert(item t) {
+func (s set[T]) insert(item T) {
 	s[item] = empty{}
 }
 
-func (s set) delete(item t) {
+func (s set[T]) delete(item T) {
 	delete(s, item)
 }
 
 // Add marks item as needing processing.
-func (q *Type) Add(item interface{}) {
+func (q *Typed[T]) Add(item T) {
 	q.cond.L.Lock()
 	defer q.cond.L.Unlock()
 	if q.shuttingDown {
@@ -122,6 +148,10 @@ func (q *Type) Add(item interface{}) {
 		return
 	}
 
+	if q.journal != nil {
+		q.journal.add(item)
+	}
+
 	q.queue = append(q.queue, item)
 	q.cond.Signal()
 }
@@ -129,7 +159,7 @@ func (q *Type) Add(item interface{}) {
 // Len returns the current queue length, for informational purposes only. You
 // shouldn't e.g. gate a call to Add() or Get() on Len() being a particular
 // value, that can't be synchronized properly.
-func (q *Type) Len() int {
+func (q *Typed[T]) Len() int {
 	q.cond.L.Lock()
 	defer q.cond.L.Unlock()
 	return len(q.queue)
@@ -138,7 +168,7 @@ func (q *Type) Len() int {
 // Get blocks until it can return an item to be processed. If shutdown = true,
 // the caller should end their goroutine. You must call Done with item when you
 // have finished processing it.
-func (q *Type) Get() (item interface{}, shutdown bool) {
+func (q *Typed[T]) Get() (item T, shutdown bool) {
 	q.cond.L.Lock()
 	defer q.cond.L.Unlock()
 	for len(q.queue) == 0 && !q.shuttingDown {
@@ -146,7 +176,7 @@ func (q *Type) Get() (item interface{}, shutdown bool) {
 	}
 	if len(q.queue) == 0 {
 		// We must be shutting down.
-		return nil, true
+		return item, true
 	}
 
 	item, q.queue = q.queue[0], q.queue[1:]
@@ -162,37 +192,121 @@ func (q *Type) Get() (item interface{}, shutdown bool) {
 // Done marks item as done processing, and if it has been marked as dirty again
 // while it was being processed, it will be re-added to the queue for
 // re-processing.
-func (q *Type) Done(item interface{}) {
+func (q *Typed[T]) Done(item T) {
 	q.cond.L.Lock()
 	defer q.cond.L.Unlock()
 
+	q.done(item)
+}
+
+// GetBatch blocks until it can return at least one item to be processed, then
+// waits at most maxWait for more items to fill a batch of up to max distinct
+// items. If shutdown = true, the caller should end their goroutine. Items are
+// handed out with the same guarantees as Get: you must call DoneBatch (or
+// Done for every item) when you have finished processing them.
+func (q *Typed[T]) GetBatch(max int, maxWait time.Duration) (items []T, shutdown bool) {
+	if max < 1 {
+		max = 1
+	}
+
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	for len(q.queue) == 0 && !q.shuttingDown {
+		q.cond.Wait()
+	}
+	if len(q.queue) == 0 {
+		// We must be shutting down.
+		return nil, true
+	}
+
+	items = q.take(items, max)
+	if len(items) < max && maxWait > 0 {
+		expired := false
+		timer := q.clock.AfterFunc(maxWait, func() {
+			q.cond.L.Lock()
+			defer q.cond.L.Unlock()
+			expired = true
+			q.cond.Broadcast()
+		})
+		for len(items) < max && !expired && !q.shuttingDown {
+			if len(q.queue) == 0 {
+				q.cond.Wait()
+				continue
+			}
+			items = q.take(items, max)
+		}
+		timer.Stop()
+	}
+	if len(q.queue) > 0 {
+		// We may have consumed the wakeup meant for another waiter.
+		q.cond.Signal()
+	}
+
+	q.metrics.batch(len(items))
+
+	return items, false
+}
+
+// take moves items from the head of the queue to the processing set, and
+// appends them to items until it holds max of them. It must be called with
+// the lock held.
+func (q *Typed[T]) take(items []T, max int) []T {
+	for len(q.queue) > 0 && len(items) < max {
+		var item T
+		item, q.queue = q.queue[0], q.queue[1:]
+
+		q.metrics.get(item)
+
+		q.processing.insert(item)
+		q.dirty.delete(item)
+
+		items = append(items, item)
+	}
+	return items
+}
+
+// DoneBatch marks every item returned by GetBatch as done processing (see
+// Done).
+func (q *Typed[T]) DoneBatch(items []T) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	for _, item := range items {
+		q.done(item)
+	}
+}
+
+// done implements Done. It must be called with the lock held.
+func (q *Typed[T]) done(item T) {
 	q.metrics.done(item)
 
 	q.processing.delete(item)
 	if q.dirty.has(item) {
 		q.queue = append(q.queue, item)
 		q.cond.Signal()
+	} else if q.journal != nil {
+		q.journal.done(item)
 	}
 }
 
 // ShutDown will cause q to ignore all new items added to it. As soon as the
 // worker goroutines have drained the existing items in the queue, they will be
 // instructed to exit.
-func (q *Type) ShutDown() {
+func (q *Typed[T]) ShutDown() {
 	q.cond.L.Lock()
 	defer q.cond.L.Unlock()
 	q.shuttingDown = true
 	q.cond.Broadcast()
 }
 
-func (q *Type) ShuttingDown() bool {
+func (q *Typed[T]) ShuttingDown() bool {
 	q.cond.L.Lock()
 	defer q.cond.L.Unlock()
 
 	return q.shuttingDown
 }
 
-func (q *Type) updateUnfinishedWorkLoop() {
+func (q *Typed[T]) updateUnfinishedWorkLoop() {
 	t := q.clock.NewTicker(q.unfinishedWorkUpdatePeriod)
 	defer t.Stop()
 	for range t.C() {
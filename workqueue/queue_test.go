@@ -159,3 +159,43 @@ func TestReinsert(t *testing.T) {
 		t.Errorf("Expected queue to be empty. Has %v items", a)
 	}
 }
+
+func TestTypedQueue(t *testing.T) {
+	type key struct {
+		namespace, name string
+	}
+	q := workqueue.NewTyped[key]()
+	foo := key{namespace: "ns", name: "foo"}
+	bar := key{namespace: "ns", name: "bar"}
+
+	q.Add(foo)
+	q.Add(foo)
+	q.Add(bar)
+	if a := q.Len(); a != 2 {
+		t.Errorf("Expected duplicate adds to be collapsed, got %v items", a)
+	}
+
+	// Start processing, then add the item back while it is processing
+	i, _ := q.Get()
+	if i != foo {
+		t.Errorf("Expected %v, got %v", foo, i)
+	}
+	q.Add(foo)
+	if a := q.Len(); a != 1 {
+		t.Errorf("Expected an item being processed not to be queued, got %v items", a)
+	}
+	q.Done(i)
+
+	for _, expected := range []key{bar, foo} {
+		i, _ := q.Get()
+		if i != expected {
+			t.Errorf("Expected %v, got %v", expected, i)
+		}
+		q.Done(i)
+	}
+
+	q.ShutDown()
+	if i, shutdown := q.Get(); !shutdown || i != (key{}) {
+		t.Errorf("Expected the zero value and shutdown, got %v, %v", i, shutdown)
+	}
+}
@@ -16,54 +16,70 @@ limitations under the License.
 
 package workqueue
 
-// RateLimitingInterface is an interface that rate limits items being added to the queue.
-type RateLimitingInterface interface {
-	DelayingInterface
+// TypedRateLimitingInterface is an interface that rate limits items being added to the queue.
+type TypedRateLimitingInterface[T comparable] interface {
+	TypedDelayingInterface[T]
 
 	// AddRateLimited adds an item to the workqueue after the rate limiter says it's ok
-	AddRateLimited(item interface{})
+	AddRateLimited(item T)
 
 	// Forget indicates that an item is finished being retried.  Doesn't matter whether it's for perm failing
 	// or for success, we'll stop the rate limiter from tracking it.  This only clears the `rateLimiter`, you
 	// still have to call `Done` on the queue.
-	Forget(item interface{})
+	Forget(item T)
 
 	// NumRequeues returns back how many times the item was requeued
-	NumRequeues(item interface{}) int
+	NumRequeues(item T) int
 }
 
+// RateLimitingInterface is the untyped form of TypedRateLimitingInterface.
+type RateLimitingInterface TypedRateLimitingInterface[interface{}]
+
 // NewRateLimitingQueue constructs a new workqueue with rateLimited queuing ability
 // Remember to call Forget!  If you don't, you may end up tracking failures forever.
 func NewRateLimitingQueue(rateLimiter RateLimiter) RateLimitingInterface {
-	return &rateLimitingType{
-		DelayingInterface: NewDelayingQueue(),
-		rateLimiter:       rateLimiter,
-	}
+	return NewTypedRateLimitingQueue[t](rateLimiter)
 }
 
 func NewNamedRateLimitingQueue(rateLimiter RateLimiter, name string) RateLimitingInterface {
-	return &rateLimitingType{
-		DelayingInterface: NewNamedDelayingQueue(name),
-		rateLimiter:       rateLimiter,
+	return NewTypedNamedRateLimitingQueue[t](rateLimiter, name)
+}
+
+// NewTypedRateLimitingQueue constructs a new workqueue of items of type T with rateLimited queuing ability
+// Remember to call Forget!  If you don't, you may end up tracking failures forever.
+func NewTypedRateLimitingQueue[T comparable](rateLimiter TypedRateLimiter[T]) TypedRateLimitingInterface[T] {
+	return &typedRateLimitingType[T]{
+		TypedDelayingInterface: NewTypedDelayingQueue[T](),
+		rateLimiter:            rateLimiter,
 	}
 }
 
-// rateLimitingType wraps an Interface and provides rateLimited re-enquing
-type rateLimitingType struct {
-	DelayingInterface
+func NewTypedNamedRateLimitingQueue[T comparable](rateLimiter TypedRateLimiter[T], name string) TypedRateLimitingInterface[T] {
+	return &typedRateLimitingType[T]{
+		TypedDelayingInterface: NewTypedNamedDelayingQueue[T](name),
+		rateLimiter:            rateLimiter,
+	}
+}
+
+// rateLimitingType is the untyped form of typedRateLimitingType.
+type rateLimitingType = typedRateLimitingType[t]
+
+// typedRateLimitingType wraps a TypedDelayingInterface and provides rateLimited re-enquing
+type typedRateLimitingType[T comparable] struct {
+	TypedDelayingInterface[T]
 
-	rateLimiter RateLimiter
+	rateLimiter TypedRateLimiter[T]
 }
 
 // AddRateLimited AddAfter's the item based on the time when the rate limiter says it's ok
-func (q *rateLimitingType) AddRateLimited(item interface{}) {
-	q.DelayingInterface.AddAfter(item, q.rateLimiter.When(item))
+func (q *typedRateLimitingType[T]) AddRateLimited(item T) {
+	q.TypedDelayingInterface.AddAfter(item, q.rateLimiter.When(item))
 }
 
-func (q *rateLimitingType) NumRequeues(item interface{}) int {
+func (q *typedRateLimitingType[T]) NumRequeues(item T) int {
 	return q.rateLimiter.NumRequeues(item)
 }
 
-func (q *rateLimitingType) Forget(item interface{}) {
+func (q *typedRateLimitingType[T]) Forget(item T) {
 	q.rateLimiter.Forget(item)
 }
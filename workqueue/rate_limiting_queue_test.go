@@ -28,7 +28,7 @@ func TestRateLimitingQueue(t *testing.T) {
 	queue := NewRateLimitingQueue(limiter).(*rateLimitingType)
 	fakeClock := clock.NewFakeClock(time.Now())
 	delayingQueue := &delayingType{
-		Interface:         New(),
+		TypedInterface:    New(),
 		clock:             fakeClock,
 		heartbeat:         fakeClock.NewTicker(maxWait),
 		stopCh:            make(chan struct{}),
@@ -36,7 +36,7 @@ func TestRateLimitingQueue(t *testing.T) {
 		metrics:           newRetryMetrics(""),
 		deprecatedMetrics: newDeprecatedRetryMetrics(""),
 	}
-	queue.DelayingInterface = delayingQueue
+	queue.TypedDelayingInterface = delayingQueue
 
 	queue.AddRateLimited("one")
 	waitEntry := <-delayingQueue.waitingForAddCh
@@ -74,3 +74,46 @@ func TestRateLimitingQueue(t *testing.T) {
 	}
 
 }
+
+func TestTypedRateLimitingQueue(t *testing.T) {
+	type key struct{ name string }
+	limiter := NewTypedMaxOfRateLimiter(
+		NewTypedItemFastSlowRateLimiter[key](5*time.Millisecond, 3*time.Second, 1),
+		NewTypedItemExponentialFailureRateLimiter[key](1*time.Millisecond, 1*time.Second),
+	)
+	queue := NewTypedRateLimitingQueue(limiter).(*typedRateLimitingType[key])
+	fakeClock := clock.NewFakeClock(time.Now())
+	delayingQueue := &typedDelayingType[key]{
+		TypedInterface:    NewTyped[key](),
+		clock:             fakeClock,
+		heartbeat:         fakeClock.NewTicker(maxWait),
+		stopCh:            make(chan struct{}),
+		waitingForAddCh:   make(chan *typedWaitFor[key], 1000),
+		metrics:           newRetryMetrics(""),
+		deprecatedMetrics: newDeprecatedRetryMetrics(""),
+	}
+	queue.TypedDelayingInterface = delayingQueue
+
+	one := key{name: "one"}
+	queue.AddRateLimited(one)
+	waitEntry := <-delayingQueue.waitingForAddCh
+	if e, a := 5*time.Millisecond, waitEntry.readyAt.Sub(fakeClock.Now()); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+	if e, a := one, waitEntry.data; e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+	queue.AddRateLimited(one)
+	waitEntry = <-delayingQueue.waitingForAddCh
+	if e, a := 3*time.Second, waitEntry.readyAt.Sub(fakeClock.Now()); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+	if e, a := 2, queue.NumRequeues(one); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+
+	queue.Forget(one)
+	if e, a := 0, queue.NumRequeues(one); e != a {
+		t.Errorf("expected %v, got %v", e, a)
+	}
+}